@@ -27,9 +27,9 @@ import (
 // https://github.com/grpc/grpc/blob/master/doc/connection-backoff.md.
 var DefaultBackoffConfig = BackoffConfig{
 	MaxDelay:  120 * time.Second,
-	baseDelay: 1.0 * time.Second,
-	factor:    1.6,
-	jitter:    0.2,
+	BaseDelay: 1.0 * time.Second,
+	Factor:    1.6,
+	Jitter:    0.2,
 }
 
 // backoffStrategy defines the methodology for backing off after a grpc
@@ -45,42 +45,46 @@ type backoffStrategy interface {
 }
 
 // BackoffConfig defines the parameters for the default gRPC backoff strategy.
+// Fields left at their zero value fall back to the corresponding value in
+// DefaultBackoffConfig.
 type BackoffConfig struct {
 	// MaxDelay is the upper bound of backoff delay.
 	MaxDelay time.Duration
 
-	// TODO(stevvooe): The following fields are not exported, as allowing
-	// changes would violate the current gRPC specification for backoff. If
-	// gRPC decides to allow more interesting backoff strategies, these fields
-	// may be opened up in the future.
-
-	// baseDelay is the amount of time to wait before retrying after the first
+	// BaseDelay is the amount of time to wait before retrying after the first
 	// failure.
-	baseDelay time.Duration
+	BaseDelay time.Duration
 
-	// factor is applied to the backoff after each retry.
-	factor float64
+	// Factor is the multiplier applied to the backoff after each retry.
+	Factor float64
 
-	// jitter provides a range to randomize backoff delays.
-	jitter float64
+	// Jitter provides a range to randomize backoff delays. A delay is
+	// multiplied by a random number in [1-Jitter, 1+Jitter].
+	Jitter float64
 }
 
 func setDefaults(bc *BackoffConfig) {
-	md := bc.MaxDelay
-	*bc = DefaultBackoffConfig
-
-	if md > 0 {
-		bc.MaxDelay = md
+	if bc.MaxDelay <= 0 {
+		bc.MaxDelay = DefaultBackoffConfig.MaxDelay
+	}
+	if bc.BaseDelay <= 0 {
+		bc.BaseDelay = DefaultBackoffConfig.BaseDelay
+	}
+	if bc.Factor <= 0 {
+		bc.Factor = DefaultBackoffConfig.Factor
+	}
+	if bc.Jitter <= 0 {
+		bc.Jitter = DefaultBackoffConfig.Jitter
 	}
 }
 
 func (bc BackoffConfig) backoff(retries int) time.Duration {
 	if retries == 0 {
-		return bc.baseDelay
+		return bc.BaseDelay
 	}
-	backoff, max := float64(bc.baseDelay), float64(bc.MaxDelay)
+	backoff, max := float64(bc.BaseDelay), float64(bc.MaxDelay)
 	for backoff < max && retries > 0 {
-		backoff *= bc.factor
+		backoff *= bc.Factor
 		retries--
 	}
 	if backoff > max {
@@ -88,7 +92,7 @@ func (bc BackoffConfig) backoff(retries int) time.Duration {
 	}
 	// Randomize backoff delays so that if a cluster of requests start at
 	// the same time, they won't operate in lockstep.
-	backoff *= 1 + bc.jitter*(rand.Float64()*2-1)
+	backoff *= 1 + bc.Jitter*(rand.Float64()*2-1)
 	if backoff < 0 {
 		return 0
 	}
@@ -18,7 +18,10 @@
 
 package grpc
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestBackoffConfigDefaults(t *testing.T) {
 	b := BackoffConfig{}
@@ -27,3 +30,45 @@ func TestBackoffConfigDefaults(t *testing.T) {
 		t.Fatalf("expected BackoffConfig to pickup default parameters: %v != %v", b, DefaultBackoffConfig)
 	}
 }
+
+func TestBackoffConfigPartialDefaults(t *testing.T) {
+	b := BackoffConfig{BaseDelay: 10 * time.Millisecond, Factor: 2.0}
+	setDefaults(&b)
+	want := BackoffConfig{
+		MaxDelay:  DefaultBackoffConfig.MaxDelay,
+		BaseDelay: 10 * time.Millisecond,
+		Factor:    2.0,
+		Jitter:    DefaultBackoffConfig.Jitter,
+	}
+	if b != want {
+		t.Fatalf("expected unset BackoffConfig fields to pickup default parameters: %v != %v", b, want)
+	}
+}
+
+// TestBackoffIncreasingDelays verifies that consecutive retries back off
+// exponentially up to MaxDelay and that every delay stays within the
+// configured jitter bounds.
+func TestBackoffIncreasingDelays(t *testing.T) {
+	b := BackoffConfig{
+		MaxDelay:  3 * time.Second,
+		BaseDelay: 100 * time.Millisecond,
+		Factor:    2.0,
+		Jitter:    0.2,
+	}
+	if got := b.backoff(0); got != b.BaseDelay {
+		t.Fatalf("backoff(0) = %v, want %v", got, b.BaseDelay)
+	}
+	expected := float64(b.BaseDelay)
+	for retries := 1; retries <= 8; retries++ {
+		expected *= b.Factor
+		if expected > float64(b.MaxDelay) {
+			expected = float64(b.MaxDelay)
+		}
+		got := float64(b.backoff(retries))
+		min := expected * (1 - b.Jitter)
+		max := expected * (1 + b.Jitter)
+		if got < min || got > max {
+			t.Fatalf("backoff(%d) = %v, want a value in [%v, %v]", retries, time.Duration(got), time.Duration(min), time.Duration(max))
+		}
+	}
+}
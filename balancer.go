@@ -22,10 +22,12 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/publica-project/grpc/codes"
 	"github.com/publica-project/grpc/credentials"
 	"github.com/publica-project/grpc/grpclog"
+	"github.com/publica-project/grpc/metadata"
 	"github.com/publica-project/grpc/naming"
 	"github.com/publica-project/grpc/status"
 	"golang.org/x/net/context"
@@ -51,6 +53,66 @@ type BalancerConfig struct {
 	// to a remote load balancer server. The Balancer implementations
 	// can ignore this if it doesn't need to talk to remote balancer.
 	Dialer func(context.Context, string) (net.Conn, error)
+	// HealthCheckInterval, when non-zero, makes gRPC periodically send an
+	// HTTP/2 PING frame on every Ready connection managed through this
+	// balancer. A connection whose ping is not acknowledged in time is torn
+	// down so that picking skips it and the usual reconnect logic takes over.
+	// This operates independently of transport keepalive; when keepalive is
+	// configured it already detects dead connections and enabling this as
+	// well only adds redundant pings.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout bounds the wait for each health-check ping ack. It
+	// defaults to HealthCheckInterval when zero.
+	HealthCheckTimeout time.Duration
+	// OutlierEjectionThreshold, when positive, temporarily ejects an address
+	// from picking once that many consecutive RPCs on it have failed. Ejected
+	// addresses are skipped for OutlierEjectionCooldown and then probed
+	// again; a successful RPC fully re-admits them. At least one address
+	// always remains pickable, so ejection never makes the channel
+	// connectionless.
+	OutlierEjectionThreshold int
+	// OutlierEjectionCooldown is how long an ejected address is skipped
+	// before it is probed again. It defaults to 10 seconds when zero.
+	OutlierEjectionCooldown time.Duration
+	// StartupFailFast, when set, makes RPCs issued before the balancer has
+	// delivered its first address fail immediately with codes.Unavailable
+	// instead of blocking until an address shows up. It only affects the
+	// startup window; once an address has been received, wait-for-ready
+	// RPCs block as usual. The zero value preserves the blocking behavior.
+	StartupFailFast bool
+}
+
+// HealthCheckConfigurer is implemented by Balancers that want connection
+// health checking. The returned BalancerConfig is consulted once, when the
+// balancer is installed with WithBalancer; only its health-check fields are
+// read.
+type HealthCheckConfigurer interface {
+	HealthCheckConfig() BalancerConfig
+}
+
+// OutlierEjectionConfigurer is implemented by Balancers that want addresses
+// with persistently failing RPCs temporarily ejected from picking. The
+// returned BalancerConfig is consulted once, when the balancer is installed
+// with WithBalancer; only its outlier-ejection fields are read.
+type OutlierEjectionConfigurer interface {
+	OutlierEjectionConfig() BalancerConfig
+}
+
+// StartupFailFastConfigurer is implemented by Balancers that want RPCs
+// issued before their first address update to fail immediately instead of
+// blocking. The returned BalancerConfig is consulted once, when the balancer
+// is installed with WithBalancer; only its StartupFailFast field is read.
+type StartupFailFastConfigurer interface {
+	StartupFailFastConfig() BalancerConfig
+}
+
+// DoneReporter is implemented by Balancers that want to observe the outcome of
+// the RPCs issued on the addresses they return from Get. Done is called once
+// per RPC, after the put callback returned by Get, with the address the RPC
+// was sent to, the error it finished with (nil on success) and the trailer
+// metadata received from the server, if any.
+type DoneReporter interface {
+	Done(addr Address, err error, trailer metadata.MD)
 }
 
 // BalancerGetOptions configures a Get call.
@@ -27,6 +27,7 @@ import (
 
 	"github.com/publica-project/grpc/connectivity"
 	"github.com/publica-project/grpc/credentials"
+	"github.com/publica-project/grpc/metadata"
 	"github.com/publica-project/grpc/resolver"
 	"golang.org/x/net/context"
 )
@@ -148,6 +149,8 @@ type DoneInfo struct {
 	BytesSent bool
 	// BytesReceived indicates if any byte has been received from the server.
 	BytesReceived bool
+	// Trailer is the trailer metadata the server sent, if any.
+	Trailer metadata.MD
 }
 
 var (
@@ -20,18 +20,26 @@ package grpc
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/publica-project/grpc/balancer"
 	"github.com/publica-project/grpc/codes"
+	"github.com/publica-project/grpc/connectivity"
 	_ "github.com/publica-project/grpc/grpclog/glogger"
+	"github.com/publica-project/grpc/metadata"
 	"github.com/publica-project/grpc/naming"
+	"github.com/publica-project/grpc/resolver"
 	"github.com/publica-project/grpc/status"
 	"github.com/publica-project/grpc/test/leakcheck"
 	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
 
 	// V1 balancer tests use passthrough resolver instead of dns.
 	// TODO(bar) remove this when removing v1 balaner entirely.
@@ -802,3 +810,344 @@ func TestPickFirstOneAddressRemoval(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// healthCheckBalancer wraps a v1 balancer and opts in to connection health
+// checking with the given interval and timeout.
+type healthCheckBalancer struct {
+	Balancer
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (b *healthCheckBalancer) HealthCheckConfig() BalancerConfig {
+	return BalancerConfig{
+		HealthCheckInterval: b.interval,
+		HealthCheckTimeout:  b.timeout,
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	defer leakcheck.Check(t)
+	// A backend that completes the HTTP/2 handshake but then goes silent,
+	// emulating a dead server whose transport still reports Ready.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		framer := http2.NewFramer(conn, conn)
+		if err := framer.WriteSettings(); err != nil {
+			t.Errorf("Error writing settings: %v", err)
+			return
+		}
+		// Swallow everything the client sends, including its pings, without
+		// ever responding.
+		io.Copy(ioutil.Discard, conn)
+	}()
+	b := &healthCheckBalancer{
+		Balancer: RoundRobin(nil),
+		interval: 50 * time.Millisecond,
+		timeout:  50 * time.Millisecond,
+	}
+	cc, err := Dial("passthrough:///"+lis.Addr().String(), WithBalancer(b), WithBlock(), WithInsecure(), WithCodec(testCodec{}))
+	if err != nil {
+		t.Fatalf("Failed to create ClientConn: %v", err)
+	}
+	defer cc.Close()
+	// The health checker must notice the unanswered pings, tear the
+	// connection down and kick off a reconnect, taking the ClientConn out of
+	// Ready.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !cc.WaitForStateChange(ctx, connectivity.Ready) {
+		t.Fatalf("ClientConn stayed in state %v; health checking did not tear down the dead connection", connectivity.Ready)
+	}
+}
+
+// doneRecordingBalancer wraps a v1 balancer and records the outcome of every
+// RPC issued on the addresses it returns.
+type doneRecordingBalancer struct {
+	Balancer
+	mu   sync.Mutex
+	errs []error
+}
+
+func (b *doneRecordingBalancer) Done(addr Address, err error, trailer metadata.MD) {
+	b.mu.Lock()
+	b.errs = append(b.errs, err)
+	b.mu.Unlock()
+}
+
+func TestBalancerDoneReporter(t *testing.T) {
+	defer leakcheck.Check(t)
+	servers, r, cleanup := startServers(t, 1, math.MaxUint32)
+	defer cleanup()
+	b := &doneRecordingBalancer{Balancer: RoundRobin(r)}
+	cc, err := Dial("passthrough:///foo.bar.com", WithBalancer(b), WithBlock(), WithInsecure(), WithCodec(testCodec{}))
+	if err != nil {
+		t.Fatalf("Failed to create ClientConn: %v", err)
+	}
+	defer cc.Close()
+	var reply string
+	if err := Invoke(context.Background(), "/foo/bar", &expectedRequest, &reply, cc); err != nil || reply != expectedResponse {
+		t.Fatalf("grpc.Invoke(_, _, _, _, _) = %v, reply = %q, want %q, <nil>", err, reply, expectedResponse)
+	}
+	req := "port"
+	if err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc); err == nil || errorDesc(err) != servers[0].port {
+		t.Fatalf("grpc.Invoke(_, _, _, _, _) = %v, want %s", err, servers[0].port)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.errs) != 2 {
+		t.Fatalf("balancer observed %d RPC outcomes, want 2", len(b.errs))
+	}
+	if b.errs[0] != nil {
+		t.Errorf("first RPC outcome = %v, want <nil>", b.errs[0])
+	}
+	if got := b.errs[1]; got == nil || errorDesc(got) != servers[0].port {
+		t.Errorf("second RPC outcome = %v, want error with desc %q", got, servers[0].port)
+	}
+}
+
+// outlierEjectionBalancer makes a v1 balancer opt in to outlier ejection.
+type outlierEjectionBalancer struct {
+	Balancer
+	threshold int
+	cooldown  time.Duration
+}
+
+func (b *outlierEjectionBalancer) OutlierEjectionConfig() BalancerConfig {
+	return BalancerConfig{
+		OutlierEjectionThreshold: b.threshold,
+		OutlierEjectionCooldown:  b.cooldown,
+	}
+}
+
+func TestBalancerOutlierEjection(t *testing.T) {
+	defer leakcheck.Check(t)
+	servers, r, cleanup := startServers(t, 2, math.MaxUint32)
+	defer cleanup()
+	// servers[0] fails every "respond-with-port" RPC with its port as the
+	// desc; servers[1] succeeds with its port as the reply. Either way the
+	// serving backend is identifiable.
+	servers[0].mu.Lock()
+	servers[0].failRPCs = true
+	servers[0].mu.Unlock()
+	b := &outlierEjectionBalancer{Balancer: RoundRobin(r), threshold: 2, cooldown: time.Second}
+	cc, err := Dial("passthrough:///foo.bar.com", WithBalancer(b), WithBlock(), WithInsecure(), WithCodec(testCodec{}))
+	if err != nil {
+		t.Fatalf("Failed to create ClientConn: %v", err)
+	}
+	defer cc.Close()
+	r.w.inject([]*naming.Update{{
+		Op:   naming.Add,
+		Addr: "localhost:" + servers[1].port,
+	}})
+	req := "respond-with-port"
+	var reply string
+	// Drive RPCs until servers[0] accumulated enough failures to be ejected
+	// and servers[1] answered at least once.
+	var failures, successes int
+	for i := 0; failures < 2 || successes == 0; i++ {
+		if i >= 50 {
+			t.Fatalf("%d failures from servers[0] and %d successes from servers[1] after %d RPCs, want at least 2 and 1", failures, successes, i)
+		}
+		err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc)
+		switch {
+		case err == nil && reply == servers[1].port:
+			successes++
+		case err != nil && errorDesc(err) == servers[0].port:
+			failures++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// servers[0] is now ejected: every RPC within the cooldown must be
+	// served by servers[1].
+	for i := 0; i < 6; i++ {
+		if err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc); err != nil || reply != servers[1].port {
+			t.Fatalf("Invoke during ejection = %v, reply = %q, want %q, <nil>", err, reply, servers[1].port)
+		}
+	}
+	// After the cooldown servers[0] must be probed again, observable as an
+	// RPC failing with its port.
+	time.Sleep(b.cooldown + 500*time.Millisecond)
+	for i := 0; ; i++ {
+		if i >= 50 {
+			t.Fatalf("servers[0] was not picked again after the ejection cooldown")
+		}
+		if err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc); err != nil && errorDesc(err) == servers[0].port {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancerOutlierEjectionSingleBackend(t *testing.T) {
+	defer leakcheck.Check(t)
+	servers, r, cleanup := startServers(t, 1, math.MaxUint32)
+	defer cleanup()
+	servers[0].mu.Lock()
+	servers[0].failRPCs = true
+	servers[0].mu.Unlock()
+	b := &outlierEjectionBalancer{Balancer: RoundRobin(r), threshold: 1, cooldown: time.Minute}
+	cc, err := Dial("passthrough:///foo.bar.com", WithBalancer(b), WithBlock(), WithInsecure(), WithCodec(testCodec{}))
+	if err != nil {
+		t.Fatalf("Failed to create ClientConn: %v", err)
+	}
+	defer cc.Close()
+	req := "respond-with-port"
+	var reply string
+	// With its only backend ejected the wrapper must keep picking it rather
+	// than failing RPCs with "no connection available".
+	for i := 0; i < 5; i++ {
+		if err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc); err == nil || errorDesc(err) != servers[0].port {
+			t.Fatalf("Invoke with the only backend ejected = %v, want error with desc %q", err, servers[0].port)
+		}
+	}
+}
+
+// emptyNameResolver returns a watcher that delivers no updates until the
+// test injects some.
+type emptyNameResolver struct {
+	w *testWatcher
+}
+
+func (r *emptyNameResolver) Resolve(target string) (naming.Watcher, error) {
+	r.w = &testWatcher{
+		update:   make(chan *naming.Update, 1),
+		side:     make(chan int, 1),
+		readDone: make(chan int),
+	}
+	return r.w, nil
+}
+
+// startupFailFastBalancer makes a v1 balancer opt in to failing picks
+// immediately while no address has been received yet.
+type startupFailFastBalancer struct {
+	Balancer
+}
+
+func (b *startupFailFastBalancer) StartupFailFastConfig() BalancerConfig {
+	return BalancerConfig{StartupFailFast: true}
+}
+
+func TestBalancerStartupFailFast(t *testing.T) {
+	defer leakcheck.Check(t)
+	s := newTestServer()
+	go s.start(t, 0, math.MaxUint32)
+	s.wait(t, 2*time.Second)
+	defer s.stop()
+	r := &emptyNameResolver{}
+	b := &startupFailFastBalancer{Balancer: RoundRobin(r)}
+	cc, err := Dial("passthrough:///foo.bar.com", WithBalancer(b), WithInsecure(), WithCodec(testCodec{}))
+	if err != nil {
+		t.Fatalf("Failed to create ClientConn: %v", err)
+	}
+	defer cc.Close()
+	// Before the first address update even a wait-for-ready RPC must fail
+	// immediately with Unavailable instead of blocking until the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var reply string
+	err = Invoke(ctx, "/foo/bar", &expectedRequest, &reply, cc, FailFast(false))
+	cancel()
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Invoke before any address update = %v, want code %v", err, codes.Unavailable)
+	}
+	// Once an address shows up the channel must behave as usual.
+	r.w.inject([]*naming.Update{{
+		Op:   naming.Add,
+		Addr: "localhost:" + s.port,
+	}})
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Invoke(ctx, "/foo/bar", &expectedRequest, &reply, cc, FailFast(false)); err != nil || reply != expectedResponse {
+		t.Fatalf("grpc.Invoke(_, _, _, _, _) = %v, reply = %q, want %q, <nil>", err, reply, expectedResponse)
+	}
+}
+
+func TestBalancerDrainSubConn(t *testing.T) {
+	defer leakcheck.Check(t)
+	servers, r, cleanup := startServers(t, 2, math.MaxUint32)
+	defer cleanup()
+	cc, err := Dial("passthrough:///foo.bar.com", WithBalancer(RoundRobin(r)), WithBlock(), WithInsecure(), WithCodec(testCodec{}))
+	if err != nil {
+		t.Fatalf("Failed to create ClientConn: %v", err)
+	}
+	defer cc.Close()
+	r.w.inject([]*naming.Update{{
+		Op:   naming.Add,
+		Addr: "localhost:" + servers[1].port,
+	}})
+	req := "port"
+	var reply string
+	// Loop until servers[1] is up.
+	for {
+		if err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc); err != nil && errorDesc(err) == servers[1].port {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bw := cc.balancerWrapper.balancer.(*balancerWrapper)
+	// Hold a pick on servers[0] to emulate an RPC still in flight there,
+	// finishing the picks that landed elsewhere right away.
+	var (
+		sc0   balancer.SubConn
+		done0 func(balancer.DoneInfo)
+	)
+	for i := 0; sc0 == nil; i++ {
+		if i >= 50 {
+			t.Fatalf("servers[0] was not picked after %d picks", i)
+		}
+		sc, done, err := bw.Pick(context.Background(), balancer.PickOptions{})
+		if err != nil {
+			t.Fatalf("Pick failed: %v", err)
+		}
+		bw.mu.Lock()
+		st := bw.connSt[sc]
+		onTarget := st != nil && st.addr.Addr == "localhost:"+servers[0].port
+		bw.mu.Unlock()
+		if onTarget {
+			sc0, done0 = sc, done
+		} else if done != nil {
+			done(balancer.DoneInfo{})
+		}
+	}
+	bw.DrainSubConn(resolver.Address{
+		Addr: "localhost:" + servers[0].port,
+		Type: resolver.Backend,
+	})
+	// New RPCs must all land on servers[1] while the drained SubConn's RPC
+	// is still in flight.
+	for i := 0; i < 10; i++ {
+		if err := Invoke(context.Background(), "/foo/bar", &req, &reply, cc); err == nil || errorDesc(err) != servers[1].port {
+			t.Fatalf("Invoke during drain = %v, want error with desc %q", err, servers[1].port)
+		}
+	}
+	// The SubConn must survive until its in-flight RPC completes.
+	bw.mu.Lock()
+	_, present := bw.connSt[sc0]
+	bw.mu.Unlock()
+	if !present {
+		t.Fatalf("draining SubConn was removed while an RPC was still in flight")
+	}
+	done0(balancer.DoneInfo{})
+	// With the last RPC finished the SubConn must now be torn down.
+	for i := 0; ; i++ {
+		bw.mu.Lock()
+		_, present := bw.connSt[sc0]
+		bw.mu.Unlock()
+		if !present {
+			break
+		}
+		if i >= 100 {
+			t.Fatalf("drained SubConn was not removed after its last RPC completed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -21,6 +21,7 @@ package grpc
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/publica-project/grpc/balancer"
 	"github.com/publica-project/grpc/codes"
@@ -35,6 +36,10 @@ type balancerWrapperBuilder struct {
 	b Balancer // The v1 balancer.
 }
 
+// defaultOutlierEjectionCooldown is how long an ejected SubConn is skipped
+// when the balancer enables outlier ejection without setting a cooldown.
+const defaultOutlierEjectionCooldown = 10 * time.Second
+
 func (bwb *balancerWrapperBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
 	targetAddr := cc.Target()
 	targetSplitted := strings.Split(targetAddr, ":///")
@@ -42,24 +47,53 @@ func (bwb *balancerWrapperBuilder) Build(cc balancer.ClientConn, opts balancer.B
 		targetAddr = targetSplitted[1]
 	}
 
-	bwb.b.Start(targetAddr, BalancerConfig{
+	config := BalancerConfig{
 		DialCreds: opts.DialCreds,
 		Dialer:    opts.Dialer,
-	})
+	}
+	if hc, ok := bwb.b.(HealthCheckConfigurer); ok {
+		hcConfig := hc.HealthCheckConfig()
+		config.HealthCheckInterval = hcConfig.HealthCheckInterval
+		config.HealthCheckTimeout = hcConfig.HealthCheckTimeout
+		if config.HealthCheckInterval > 0 && config.HealthCheckTimeout <= 0 {
+			config.HealthCheckTimeout = config.HealthCheckInterval
+		}
+	}
+	if oe, ok := bwb.b.(OutlierEjectionConfigurer); ok {
+		oeConfig := oe.OutlierEjectionConfig()
+		config.OutlierEjectionThreshold = oeConfig.OutlierEjectionThreshold
+		config.OutlierEjectionCooldown = oeConfig.OutlierEjectionCooldown
+		if config.OutlierEjectionThreshold > 0 && config.OutlierEjectionCooldown <= 0 {
+			config.OutlierEjectionCooldown = defaultOutlierEjectionCooldown
+		}
+	}
+	if sff, ok := bwb.b.(StartupFailFastConfigurer); ok {
+		config.StartupFailFast = sff.StartupFailFastConfig().StartupFailFast
+	}
+	bwb.b.Start(targetAddr, config)
 	_, pickfirst := bwb.b.(*pickFirst)
 	bw := &balancerWrapper{
-		balancer:   bwb.b,
-		pickfirst:  pickfirst,
-		cc:         cc,
-		targetAddr: targetAddr,
-		startCh:    make(chan struct{}),
-		conns:      make(map[resolver.Address]balancer.SubConn),
-		connSt:     make(map[balancer.SubConn]*scState),
-		csEvltr:    &connectivityStateEvaluator{},
-		state:      connectivity.Idle,
+		balancer:        bwb.b,
+		pickfirst:       pickfirst,
+		cc:              cc,
+		targetAddr:      targetAddr,
+		hcInterval:      config.HealthCheckInterval,
+		hcTimeout:       config.HealthCheckTimeout,
+		ejectThreshold:  config.OutlierEjectionThreshold,
+		ejectCooldown:   config.OutlierEjectionCooldown,
+		startupFailFast: config.StartupFailFast,
+		startCh:         make(chan struct{}),
+		conns:           make(map[resolver.Address]balancer.SubConn),
+		connSt:          make(map[balancer.SubConn]*scState),
+		csEvltr:         &connectivityStateEvaluator{},
+		state:           connectivity.Idle,
 	}
 	cc.UpdateBalancerState(connectivity.Idle, bw)
 	go bw.lbWatcher()
+	if bw.hcInterval > 0 {
+		bw.hcDone = make(chan struct{})
+		go bw.healthChecker()
+	}
 	return bw
 }
 
@@ -71,6 +105,20 @@ type scState struct {
 	addr Address // The v1 address type.
 	s    connectivity.State
 	down func(error)
+	// lastUse is the last time this SubConn was picked for an RPC. Guarded
+	// by balancerWrapper.mu.
+	lastUse time.Time
+	// consecFailures counts the RPCs that failed on this SubConn since its
+	// last success. ejectedUntil, when in the future, excludes the SubConn
+	// from picking. Both guarded by balancerWrapper.mu.
+	consecFailures int
+	ejectedUntil   time.Time
+	// activeRPCs counts the RPCs currently in flight on this SubConn.
+	// draining is set by DrainSubConn; a draining SubConn is no longer
+	// picked and is removed once activeRPCs reaches zero. Both guarded by
+	// balancerWrapper.mu.
+	activeRPCs int
+	draining   bool
 }
 
 type balancerWrapper struct {
@@ -80,6 +128,22 @@ type balancerWrapper struct {
 	cc         balancer.ClientConn
 	targetAddr string // Target without the scheme.
 
+	// hcInterval and hcTimeout configure connection health checking; see
+	// BalancerConfig. hcDone, non-nil iff health checking is enabled, is
+	// closed by Close to stop the checker.
+	hcInterval time.Duration
+	hcTimeout  time.Duration
+	hcDone     chan struct{}
+
+	// ejectThreshold and ejectCooldown configure outlier ejection; see
+	// BalancerConfig. Outlier ejection is enabled iff ejectThreshold > 0.
+	ejectThreshold int
+	ejectCooldown  time.Duration
+
+	// startupFailFast, when set, makes Pick fail with codes.Unavailable
+	// instead of blocking while gotAddrs is still false; see BalancerConfig.
+	startupFailFast bool
+
 	// To aggregate the connectivity state.
 	csEvltr *connectivityStateEvaluator
 	state   connectivity.State
@@ -92,6 +156,9 @@ type balancerWrapper struct {
 	// - NewSubConn is created, cc wants to notify balancer of state changes;
 	// - Build hasn't return, cc doesn't have access to balancer.
 	startCh chan struct{}
+	// gotAddrs becomes true once the balancer has delivered at least one
+	// address, and never goes back to false.
+	gotAddrs bool
 }
 
 // lbWatcher watches the Notify channel of the balancer and manages
@@ -107,14 +174,18 @@ func (bw *balancerWrapper) lbWatcher() {
 		}
 		sc, err := bw.cc.NewSubConn([]resolver.Address{a}, balancer.NewSubConnOptions{})
 		if err != nil {
-			grpclog.Warningf("Error creating connection to %v. Err: %v", a, err)
+			if grpclog.V(2) {
+				grpclog.Warningf("Error creating connection to %v. Err: %v", a, err)
+			}
 		} else {
 			bw.mu.Lock()
 			bw.conns[a] = sc
 			bw.connSt[sc] = &scState{
-				addr: Address{Addr: bw.targetAddr},
-				s:    connectivity.Idle,
+				addr:    Address{Addr: bw.targetAddr},
+				s:       connectivity.Idle,
+				lastUse: time.Now(),
 			}
+			bw.gotAddrs = true
 			bw.mu.Unlock()
 			sc.Connect()
 		}
@@ -122,7 +193,14 @@ func (bw *balancerWrapper) lbWatcher() {
 	}
 
 	for addrs := range notifyCh {
-		grpclog.Infof("balancerWrapper: got update addr from Notify: %v\n", addrs)
+		if len(addrs) > 0 {
+			bw.mu.Lock()
+			bw.gotAddrs = true
+			bw.mu.Unlock()
+		}
+		if grpclog.V(2) {
+			grpclog.Infof("balancerWrapper: got update addr from Notify: %v\n", addrs)
+		}
 		if bw.pickfirst {
 			var (
 				oldA  resolver.Address
@@ -159,7 +237,9 @@ func (bw *balancerWrapper) lbWatcher() {
 				// Create new sc.
 				sc, err := bw.cc.NewSubConn(newAddrs, balancer.NewSubConnOptions{})
 				if err != nil {
-					grpclog.Warningf("Error creating connection to %v. Err: %v", newAddrs, err)
+					if grpclog.V(2) {
+						grpclog.Warningf("Error creating connection to %v. Err: %v", newAddrs, err)
+					}
 				} else {
 					bw.mu.Lock()
 					// For pickfirst, there should be only one SubConn, so the
@@ -167,8 +247,9 @@ func (bw *balancerWrapper) lbWatcher() {
 					// and picking should all happen on that only SubConn.
 					bw.conns[resolver.Address{}] = sc
 					bw.connSt[sc] = &scState{
-						addr: addrs[0], // Use the first address.
-						s:    connectivity.Idle,
+						addr:    addrs[0], // Use the first address.
+						s:       connectivity.Idle,
+						lastUse: time.Now(),
 					}
 					bw.mu.Unlock()
 					sc.Connect()
@@ -210,13 +291,16 @@ func (bw *balancerWrapper) lbWatcher() {
 			for _, a := range add {
 				sc, err := bw.cc.NewSubConn([]resolver.Address{a}, balancer.NewSubConnOptions{})
 				if err != nil {
-					grpclog.Warningf("Error creating connection to %v. Err: %v", a, err)
+					if grpclog.V(2) {
+						grpclog.Warningf("Error creating connection to %v. Err: %v", a, err)
+					}
 				} else {
 					bw.mu.Lock()
 					bw.conns[a] = sc
 					bw.connSt[sc] = &scState{
-						addr: resAddrs[a],
-						s:    connectivity.Idle,
+						addr:    resAddrs[a],
+						s:       connectivity.Idle,
+						lastUse: time.Now(),
 					}
 					bw.mu.Unlock()
 					sc.Connect()
@@ -273,9 +357,157 @@ func (bw *balancerWrapper) HandleResolvedAddrs([]resolver.Address, error) {
 	return
 }
 
+// CloseIdleSubConns removes SubConns that have not been picked for an RPC
+// within the last d, calling RemoveSubConn on the ClientConn for each of
+// them. The most recently used SubConn always survives, so the wrapper never
+// goes connectionless even when every SubConn is idle.
+func (bw *balancerWrapper) CloseIdleSubConns(d time.Duration) {
+	now := time.Now()
+	var del []balancer.SubConn
+	bw.mu.Lock()
+	// Find the most recently used SubConn; it is kept unconditionally.
+	var (
+		newest    balancer.SubConn
+		newestUse time.Time
+	)
+	for _, sc := range bw.conns {
+		st, ok := bw.connSt[sc]
+		if !ok {
+			continue
+		}
+		if newest == nil || st.lastUse.After(newestUse) {
+			newest, newestUse = sc, st.lastUse
+		}
+	}
+	for a, sc := range bw.conns {
+		if sc == newest {
+			continue
+		}
+		st, ok := bw.connSt[sc]
+		if !ok {
+			continue
+		}
+		if now.Sub(st.lastUse) > d {
+			del = append(del, sc)
+			delete(bw.conns, a)
+			// Keep the state of this sc in bw.connSt until its state becomes Shutdown.
+		}
+	}
+	bw.mu.Unlock()
+	for _, sc := range del {
+		bw.cc.RemoveSubConn(sc)
+	}
+}
+
+// DrainSubConn stops sending new RPCs to the SubConn for addr while letting
+// the ones already in flight finish. The SubConn is removed once its last
+// active RPC completes (immediately when it is idle), so the drain itself
+// never resets streams. Draining an unknown or already draining address is a
+// no-op.
+func (bw *balancerWrapper) DrainSubConn(addr resolver.Address) {
+	bw.mu.Lock()
+	sc, ok := bw.conns[addr]
+	if !ok {
+		bw.mu.Unlock()
+		return
+	}
+	st, ok := bw.connSt[sc]
+	if !ok || st.draining {
+		bw.mu.Unlock()
+		return
+	}
+	st.draining = true
+	// Take the address out of the pickable set; the scState stays in
+	// bw.connSt until the SubConn reaches Shutdown.
+	delete(bw.conns, addr)
+	if st.s == connectivity.Ready {
+		// Tell the v1 balancer the address is gone so Get stops handing it
+		// out.
+		if st.down != nil {
+			st.down(errConnDrain)
+			st.down = nil
+		}
+		// The SubConn still reports Ready but can no longer be picked;
+		// account for it as a failure so the aggregate state reflects that.
+		// Updating st.s keeps the books straight when the final Shutdown
+		// transition is recorded against it.
+		sa := bw.csEvltr.recordTransition(connectivity.Ready, connectivity.TransientFailure)
+		st.s = connectivity.TransientFailure
+		if bw.state != sa {
+			bw.state = sa
+		}
+		bw.cc.UpdateBalancerState(bw.state, bw)
+	}
+	remove := st.activeRPCs == 0
+	bw.mu.Unlock()
+	if remove {
+		bw.cc.RemoveSubConn(sc)
+	}
+}
+
+// rpcDone marks one in-flight RPC on sc as finished and completes a pending
+// drain once the last one is gone.
+func (bw *balancerWrapper) rpcDone(sc balancer.SubConn) {
+	bw.mu.Lock()
+	st, ok := bw.connSt[sc]
+	if !ok {
+		bw.mu.Unlock()
+		return
+	}
+	if st.activeRPCs > 0 {
+		st.activeRPCs--
+	}
+	remove := st.draining && st.activeRPCs == 0
+	bw.mu.Unlock()
+	if remove {
+		bw.cc.RemoveSubConn(sc)
+	}
+}
+
+// healthChecker periodically pings every Ready SubConn and tears down those
+// whose ping ack does not arrive within hcTimeout, so that the regular
+// reconnect logic takes over. It runs until hcDone is closed.
+func (bw *balancerWrapper) healthChecker() {
+	ticker := time.NewTicker(bw.hcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bw.hcDone:
+			return
+		case <-ticker.C:
+		}
+		bw.mu.Lock()
+		var scs []balancer.SubConn
+		for sc, st := range bw.connSt {
+			if st.s == connectivity.Ready {
+				scs = append(scs, sc)
+			}
+		}
+		bw.mu.Unlock()
+		for _, sc := range scs {
+			acbw, ok := sc.(*acBalancerWrapper)
+			if !ok {
+				continue
+			}
+			go func(ac *addrConn) {
+				ctx, cancel := context.WithTimeout(context.Background(), bw.hcTimeout)
+				defer cancel()
+				ac.healthCheck(ctx)
+			}(acbw.getAddrConn())
+		}
+	}
+}
+
 func (bw *balancerWrapper) Close() {
 	bw.mu.Lock()
 	defer bw.mu.Unlock()
+	if bw.hcDone != nil {
+		select {
+		case <-bw.hcDone:
+		default:
+			close(bw.hcDone)
+		}
+	}
 	select {
 	case <-bw.startCh:
 	default:
@@ -285,6 +517,26 @@ func (bw *balancerWrapper) Close() {
 	return
 }
 
+// recordOutcome feeds an RPC outcome into outlier detection. A failure moves
+// the SubConn towards ejection; a success re-admits it entirely.
+func (bw *balancerWrapper) recordOutcome(sc balancer.SubConn, err error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	st, ok := bw.connSt[sc]
+	if !ok {
+		return
+	}
+	if err == nil {
+		st.consecFailures = 0
+		st.ejectedUntil = time.Time{}
+		return
+	}
+	st.consecFailures++
+	if st.consecFailures >= bw.ejectThreshold {
+		st.ejectedUntil = time.Now().Add(bw.ejectCooldown)
+	}
+}
+
 // The picker is the balancerWrapper itself.
 // Pick should never return ErrNoSubConnAvailable.
 // It either blocks or returns error, consistent with v1 balancer Get().
@@ -293,15 +545,34 @@ func (bw *balancerWrapper) Pick(ctx context.Context, opts balancer.PickOptions)
 	if ss, ok := rpcInfoFromContext(ctx); ok {
 		failfast = ss.failfast
 	}
+	if bw.startupFailFast {
+		bw.mu.Lock()
+		got := bw.gotAddrs
+		bw.mu.Unlock()
+		if !got {
+			// The balancer has not produced a single address yet; fail the
+			// pick instead of blocking in the v1 Get below.
+			return nil, nil, status.Errorf(codes.Unavailable, "there is no address available")
+		}
+	}
 	a, p, err := bw.balancer.Get(ctx, BalancerGetOptions{BlockingWait: !failfast})
 	if err != nil {
 		return nil, nil, err
 	}
-	var done func(balancer.DoneInfo)
-	if p != nil {
-		done = func(i balancer.DoneInfo) { p() }
-	}
 	var sc balancer.SubConn
+	dr, isDR := bw.balancer.(DoneReporter)
+	done := func(i balancer.DoneInfo) {
+		if p != nil {
+			p()
+		}
+		if isDR {
+			dr.Done(a, i.Err, i.Trailer)
+		}
+		if bw.ejectThreshold > 0 {
+			bw.recordOutcome(sc, i.Err)
+		}
+		bw.rpcDone(sc)
+	}
 	bw.mu.Lock()
 	defer bw.mu.Unlock()
 	if bw.pickfirst {
@@ -326,6 +597,35 @@ func (bw *balancerWrapper) Pick(ctx context.Context, opts balancer.PickOptions)
 			return nil, nil, status.Errorf(codes.Unavailable, "there is no connection available")
 		}
 	}
+	if bw.ejectThreshold > 0 && !bw.pickfirst {
+		if st, ok := bw.connSt[sc]; ok && time.Now().Before(st.ejectedUntil) {
+			// The picked SubConn is ejected; fall back to a Ready,
+			// non-ejected SubConn if there is one. If there is none, keep
+			// the original pick so that at least one SubConn always remains
+			// pickable.
+			now := time.Now()
+			for ca, c := range bw.conns {
+				if cst, ok := bw.connSt[c]; ok && cst.s == connectivity.Ready && !now.Before(cst.ejectedUntil) {
+					sc = c
+					// The RPC is not carried by the address the balancer
+					// picked: release the balancer's checkout of it right
+					// away and attribute the RPC to the substitute so
+					// put/Done accounting follows the backend that actually
+					// serves it.
+					if p != nil {
+						p()
+						p = nil
+					}
+					a = Address{Addr: ca.Addr, Metadata: ca.Metadata}
+					break
+				}
+			}
+		}
+	}
+	if st, ok := bw.connSt[sc]; ok {
+		st.lastUse = time.Now()
+		st.activeRPCs++
+	}
 
 	return sc, done, nil
 }
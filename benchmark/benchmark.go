@@ -27,6 +27,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -36,9 +38,14 @@ import (
 	"github.com/publica-project/grpc/benchmark/latency"
 	"github.com/publica-project/grpc/benchmark/stats"
 	"github.com/publica-project/grpc/grpclog"
+	"github.com/publica-project/grpc/metadata"
 	"golang.org/x/net/context"
 )
 
+// ServerElapsedKey is the trailer key under which the benchmark server reports
+// its per-RPC processing time, in nanoseconds, when started with ReportServerTime.
+const ServerElapsedKey = "benchmark-server-elapsed-ns"
+
 // AddOne add 1 to the features slice
 func AddOne(features []int, featuresMaxPosition []int) {
 	for i := len(features) - 1; i >= 0; i-- {
@@ -75,12 +82,23 @@ func newPayload(t testpb.PayloadType, size int) *testpb.Payload {
 }
 
 type testServer struct {
+	// reportElapsed makes UnaryCall attach its processing time to the
+	// response trailer under ServerElapsedKey.
+	reportElapsed bool
 }
 
 func (s *testServer) UnaryCall(ctx context.Context, in *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
-	return &testpb.SimpleResponse{
+	if !s.reportElapsed {
+		return &testpb.SimpleResponse{
+			Payload: newPayload(in.ResponseType, int(in.ResponseSize)),
+		}, nil
+	}
+	start := time.Now()
+	resp := &testpb.SimpleResponse{
 		Payload: newPayload(in.ResponseType, int(in.ResponseSize)),
-	}, nil
+	}
+	grpc.SetTrailer(ctx, metadata.Pairs(ServerElapsedKey, strconv.FormatInt(time.Since(start).Nanoseconds(), 10)))
+	return resp, nil
 }
 
 func (s *testServer) StreamingCall(stream testpb.BenchmarkService_StreamingCallServer) error {
@@ -150,12 +168,26 @@ type ServerInfo struct {
 
 	// Network can simulate latency
 	Network *latency.Network
+
+	// ReportServerTime makes the "protobuf" server attach its per-RPC
+	// processing time to the response trailer under ServerElapsedKey.
+	// Only unary calls report it; a streaming call carries a single
+	// trailer for the whole stream.
+	ReportServerTime bool
 }
 
 // StartServer starts a gRPC server serving a benchmark service according to info.
 // It returns its listen address and a function to stop the server.
 func StartServer(info ServerInfo, opts ...grpc.ServerOption) (string, func()) {
-	lis, err := net.Listen("tcp", info.Addr)
+	network := "tcp"
+	address := info.Addr
+	// Addresses like unix:///tmp/bench.sock select a unix domain socket.
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+		address = strings.TrimPrefix(address, "//")
+	}
+	lis, err := net.Listen(network, address)
 	if err != nil {
 		grpclog.Fatalf("Failed to listen: %v", err)
 	}
@@ -168,7 +200,7 @@ func StartServer(info ServerInfo, opts ...grpc.ServerOption) (string, func()) {
 	s := grpc.NewServer(opts...)
 	switch info.Type {
 	case "protobuf":
-		testpb.RegisterBenchmarkServiceServer(s, &testServer{})
+		testpb.RegisterBenchmarkServiceServer(s, &testServer{reportElapsed: info.ReportServerTime})
 	case "bytebuf":
 		respSize, ok := info.Metadata.(int32)
 		if !ok {
@@ -179,25 +211,55 @@ func StartServer(info ServerInfo, opts ...grpc.ServerOption) (string, func()) {
 		grpclog.Fatalf("failed to StartServer, unknown Type: %v", info.Type)
 	}
 	go s.Serve(lis)
-	return lis.Addr().String(), func() {
+	addr := lis.Addr().String()
+	if lis.Addr().Network() == "unix" {
+		// Hand back a target the client dial path understands.
+		addr = "unix://" + addr
+	}
+	return addr, func() {
 		s.Stop()
 	}
 }
 
 // DoUnaryCall performs an unary RPC with given stub and request and response sizes.
-func DoUnaryCall(tc testpb.BenchmarkServiceClient, reqSize, respSize int) error {
+func DoUnaryCall(tc testpb.BenchmarkServiceClient, reqSize, respSize int, opts ...grpc.CallOption) error {
 	pl := newPayload(testpb.PayloadType_COMPRESSABLE, reqSize)
 	req := &testpb.SimpleRequest{
 		ResponseType: pl.Type,
 		ResponseSize: int32(respSize),
 		Payload:      pl,
 	}
-	if _, err := tc.UnaryCall(context.Background(), req); err != nil {
+	if _, err := tc.UnaryCall(context.Background(), req, opts...); err != nil {
 		return fmt.Errorf("/BenchmarkService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
 	}
 	return nil
 }
 
+// DoUnaryCallServerTime performs an unary RPC like DoUnaryCall and additionally
+// returns the server-reported processing time read from the response trailer.
+// It returns 0 if the server did not attach the trailer.
+func DoUnaryCallServerTime(tc testpb.BenchmarkServiceClient, reqSize, respSize int) (time.Duration, error) {
+	pl := newPayload(testpb.PayloadType_COMPRESSABLE, reqSize)
+	req := &testpb.SimpleRequest{
+		ResponseType: pl.Type,
+		ResponseSize: int32(respSize),
+		Payload:      pl,
+	}
+	var trailer metadata.MD
+	if _, err := tc.UnaryCall(context.Background(), req, grpc.Trailer(&trailer)); err != nil {
+		return 0, fmt.Errorf("/BenchmarkService/UnaryCall(_, _) = _, %v, want _, <nil>", err)
+	}
+	vals := trailer[ServerElapsedKey]
+	if len(vals) == 0 {
+		return 0, nil
+	}
+	ns, err := strconv.ParseInt(vals[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s trailer %q: %v", ServerElapsedKey, vals[0], err)
+	}
+	return time.Duration(ns), nil
+}
+
 // DoStreamingRoundTrip performs a round trip for a single streaming rpc.
 func DoStreamingRoundTrip(stream testpb.BenchmarkService_StreamingCallClient, reqSize, respSize int) error {
 	pl := newPayload(testpb.PayloadType_COMPRESSABLE, reqSize)
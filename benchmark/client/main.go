@@ -19,11 +19,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,11 +37,14 @@ import (
 	testpb "github.com/publica-project/grpc/benchmark/grpc_testing"
 	"github.com/publica-project/grpc/benchmark/stats"
 	"github.com/publica-project/grpc/grpclog"
+	"github.com/publica-project/grpc/naming"
+	"github.com/publica-project/grpc/peer"
 	"golang.org/x/net/context"
 )
 
 var (
 	server            = flag.String("server", "", "The server address")
+	servers           = flag.String("servers", "", "Comma-separated list of server addresses; load is spread over them with the round-robin balancer and per-target RPC counts are reported for unary calls. Overrides -server when set")
 	maxConcurrentRPCs = flag.Int("max_concurrent_rpcs", 1, "The max number of concurrent RPCs")
 	duration          = flag.Int("duration", math.MaxInt32, "The duration in seconds to run the benchmark client")
 	trace             = flag.Bool("trace", true, "Whether tracing is on")
@@ -44,53 +52,173 @@ var (
 		`Configure different client rpc type. Valid options are:
 		   0 : unary call;
 		   1 : streaming call.`)
+	ramp              = flag.Bool("ramp", false, "Whether to ramp the number of concurrent RPCs from 1 up to max_concurrent_rpcs, recording stats per concurrency level")
+	rampStepDuration  = flag.Int("ramp_step_duration", 10, "The duration in seconds spent on each concurrency level when -ramp is on")
+	measureServerTime = flag.Bool("measure_server_time", false, "Whether to read the server-reported processing time from response trailers and record it in a separate histogram; requires the server to run with -measure_server_time and only works with unary calls")
 )
 
-func unaryCaller(client testpb.BenchmarkServiceClient) {
-	benchmark.DoUnaryCall(client, 1, 1)
+// targets returns the addresses to benchmark: the -servers list when given,
+// otherwise the single -server address.
+func targets() []string {
+	if *servers == "" {
+		return []string{*server}
+	}
+	return strings.Split(*servers, ",")
+}
+
+// staticResolver resolves any target to a fixed list of addresses, so the
+// round-robin balancer spreads load over them.
+type staticResolver struct {
+	addrs []string
+}
+
+func (r *staticResolver) Resolve(target string) (naming.Watcher, error) {
+	w := &staticWatcher{
+		updates: make(chan []*naming.Update, 1),
+		done:    make(chan struct{}),
+	}
+	us := make([]*naming.Update, 0, len(r.addrs))
+	for _, a := range r.addrs {
+		us = append(us, &naming.Update{Op: naming.Add, Addr: a})
+	}
+	w.updates <- us
+	return w, nil
+}
+
+// staticWatcher delivers the resolver's addresses once and then blocks until
+// it is closed.
+type staticWatcher struct {
+	updates chan []*naming.Update
+	done    chan struct{}
+}
+
+func (w *staticWatcher) Next() ([]*naming.Update, error) {
+	select {
+	case us := <-w.updates:
+		return us, nil
+	case <-w.done:
+		return nil, errors.New("watcher closed")
+	}
+}
+
+func (w *staticWatcher) Close() {
+	close(w.done)
+}
+
+// targetCounts tallies how many RPCs each target served, learned through the
+// Peer call option.
+type targetCounts struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func (c *targetCounts) record(addr string) {
+	c.mu.Lock()
+	c.m[addr]++
+	c.mu.Unlock()
+}
+
+func (c *targetCounts) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := make([]string, 0, len(c.m))
+	for a := range c.m {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	var buf bytes.Buffer
+	for _, a := range addrs {
+		fmt.Fprintf(&buf, "%s: %d\n", a, c.m[a])
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+func unaryCaller(client testpb.BenchmarkServiceClient, counts *targetCounts) {
+	if counts == nil {
+		benchmark.DoUnaryCall(client, 1, 1)
+		return
+	}
+	var p peer.Peer
+	benchmark.DoUnaryCall(client, 1, 1, grpc.Peer(&p))
+	if p.Addr != nil {
+		counts.record(p.Addr.String())
+	}
+}
+
+func unaryCallerServerTime(client testpb.BenchmarkServiceClient) time.Duration {
+	d, err := benchmark.DoUnaryCallServerTime(client, 1, 1)
+	if err != nil {
+		grpclog.Fatalf("DoUnaryCallServerTime failed: %v", err)
+	}
+	return d
 }
 
 func streamCaller(stream testpb.BenchmarkService_StreamingCallClient) {
 	benchmark.DoStreamingRoundTrip(stream, 1, 1)
 }
 
-func buildConnection() (s *stats.Stats, conn *grpc.ClientConn, tc testpb.BenchmarkServiceClient) {
+// buildConnection dials the given targets. A single target is dialed
+// directly; multiple targets are dialed through the round-robin balancer so
+// load is distributed over all of them.
+func buildConnection(targets []string) (s *stats.Stats, conn *grpc.ClientConn, tc testpb.BenchmarkServiceClient) {
 	s = stats.NewStats(256)
-	conn = benchmark.NewClientConn(*server)
+	if len(targets) == 1 {
+		conn = benchmark.NewClientConn(targets[0])
+	} else {
+		b := grpc.RoundRobin(&staticResolver{addrs: targets})
+		conn = benchmark.NewClientConn(targets[0], grpc.WithBalancer(b))
+	}
 	tc = testpb.NewBenchmarkServiceClient(conn)
 	return s, conn, tc
 }
 
-func closeLoopUnary() {
-	s, conn, tc := buildConnection()
-
-	for i := 0; i < 100; i++ {
-		unaryCaller(tc)
+// rampLevels returns the concurrency schedule used by -ramp: starting at 1
+// and doubling until max_concurrent_rpcs is reached.
+func rampLevels() []int {
+	var levels []int
+	for c := 1; c < *maxConcurrentRPCs; c *= 2 {
+		levels = append(levels, c)
 	}
-	ch := make(chan int, *maxConcurrentRPCs*4)
+	return append(levels, *maxConcurrentRPCs)
+}
+
+// runUnary records client-observed latency in s. If sSrv is non-nil, it also
+// reads the server-reported processing time from each RPC's trailer and
+// records it in sSrv. If counts is non-nil, it tallies the backend that
+// served each RPC.
+func runUnary(s, sSrv *stats.Stats, counts *targetCounts, tc testpb.BenchmarkServiceClient, concurrency int, d time.Duration) {
+	ch := make(chan int, concurrency*4)
 	var (
 		mu sync.Mutex
 		wg sync.WaitGroup
 	)
-	wg.Add(*maxConcurrentRPCs)
+	wg.Add(concurrency)
 
-	for i := 0; i < *maxConcurrentRPCs; i++ {
+	for i := 0; i < concurrency; i++ {
 		go func() {
 			for range ch {
 				start := time.Now()
-				unaryCaller(tc)
+				var srv time.Duration
+				if sSrv != nil {
+					srv = unaryCallerServerTime(tc)
+				} else {
+					unaryCaller(tc, counts)
+				}
 				elapse := time.Since(start)
 				mu.Lock()
 				s.Add(elapse)
+				if sSrv != nil {
+					sSrv.Add(srv)
+				}
 				mu.Unlock()
 			}
 			wg.Done()
 		}()
 	}
-	// Stop the client when time is up.
+	// Stop the workers when time is up.
 	done := make(chan struct{})
 	go func() {
-		<-time.After(time.Duration(*duration) * time.Second)
+		<-time.After(d)
 		close(done)
 	}()
 	ok := true
@@ -103,21 +231,69 @@ func closeLoopUnary() {
 	}
 	close(ch)
 	wg.Wait()
-	conn.Close()
-	grpclog.Println(s.String())
+}
 
+// printUnaryStats prints the client-observed histogram and, when
+// -measure_server_time is on, the server-reported one next to it. The
+// difference between the two is the time spent on the network and in the
+// transports.
+func printUnaryStats(s, sSrv *stats.Stats) {
+	if sSrv == nil {
+		grpclog.Println(s.String())
+		return
+	}
+	grpclog.Printf("Client-observed latency:\n%s", s.String())
+	grpclog.Printf("Server-reported latency:\n%s", sSrv.String())
 }
 
-func closeLoopStream() {
-	s, conn, tc := buildConnection()
-	ch := make(chan int, *maxConcurrentRPCs*4)
+func closeLoopUnary() {
+	tgts := targets()
+	s, conn, tc := buildConnection(tgts)
+	defer conn.Close()
+	var counts *targetCounts
+	if len(tgts) > 1 {
+		counts = &targetCounts{m: make(map[string]int64)}
+	}
+
+	for i := 0; i < 100; i++ {
+		unaryCaller(tc, nil)
+	}
+	if !*ramp {
+		var sSrv *stats.Stats
+		if *measureServerTime {
+			sSrv = stats.NewStats(256)
+		}
+		runUnary(s, sSrv, counts, tc, *maxConcurrentRPCs, time.Duration(*duration)*time.Second)
+		printUnaryStats(s, sSrv)
+		if counts != nil {
+			grpclog.Printf("Per-target RPC counts:\n%s", counts)
+		}
+		return
+	}
+	for _, c := range rampLevels() {
+		s := stats.NewStats(256)
+		var sSrv *stats.Stats
+		if *measureServerTime {
+			sSrv = stats.NewStats(256)
+		}
+		runUnary(s, sSrv, counts, tc, c, time.Duration(*rampStepDuration)*time.Second)
+		grpclog.Printf("== %d concurrent RPCs ==", c)
+		printUnaryStats(s, sSrv)
+	}
+	if counts != nil {
+		grpclog.Printf("Per-target RPC counts:\n%s", counts)
+	}
+}
+
+func runStream(s *stats.Stats, tc testpb.BenchmarkServiceClient, concurrency int, d time.Duration) {
+	ch := make(chan int, concurrency*4)
 	var (
 		mu sync.Mutex
 		wg sync.WaitGroup
 	)
-	wg.Add(*maxConcurrentRPCs)
-	// Distribute RPCs over maxConcurrentCalls workers.
-	for i := 0; i < *maxConcurrentRPCs; i++ {
+	wg.Add(concurrency)
+	// Distribute RPCs over concurrency workers.
+	for i := 0; i < concurrency; i++ {
 		go func() {
 			stream, err := tc.StreamingCall(context.Background())
 			if err != nil {
@@ -138,10 +314,10 @@ func closeLoopStream() {
 			wg.Done()
 		}()
 	}
-	// Stop the client when time is up.
+	// Stop the workers when time is up.
 	done := make(chan struct{})
 	go func() {
-		<-time.After(time.Duration(*duration) * time.Second)
+		<-time.After(d)
 		close(done)
 	}()
 	ok := true
@@ -154,8 +330,21 @@ func closeLoopStream() {
 	}
 	close(ch)
 	wg.Wait()
-	conn.Close()
-	grpclog.Println(s.String())
+}
+
+func closeLoopStream() {
+	s, conn, tc := buildConnection(targets())
+	defer conn.Close()
+	if !*ramp {
+		runStream(s, tc, *maxConcurrentRPCs, time.Duration(*duration)*time.Second)
+		grpclog.Println(s.String())
+		return
+	}
+	for _, c := range rampLevels() {
+		s := stats.NewStats(256)
+		runStream(s, tc, c, time.Duration(*rampStepDuration)*time.Second)
+		grpclog.Printf("== %d concurrent RPCs ==\n%s", c, s.String())
+	}
 }
 
 func main() {
@@ -175,6 +364,11 @@ func main() {
 	case 0:
 		closeLoopUnary()
 	case 1:
+		if *measureServerTime {
+			// A streaming call carries a single trailer for the whole
+			// stream, so there is no per-RPC server time to read.
+			grpclog.Fatalf("-measure_server_time only works with unary calls")
+		}
 		closeLoopStream()
 	}
 }
@@ -30,7 +30,10 @@ import (
 	"github.com/publica-project/grpc/grpclog"
 )
 
-var duration = flag.Int("duration", math.MaxInt32, "The duration in seconds to run the benchmark server")
+var (
+	duration          = flag.Int("duration", math.MaxInt32, "The duration in seconds to run the benchmark server")
+	measureServerTime = flag.Bool("measure_server_time", false, "Whether to attach the per-RPC processing time to response trailers")
+)
 
 func main() {
 	flag.Parse()
@@ -44,7 +47,7 @@ func main() {
 			grpclog.Fatalf("Failed to serve: %v", err)
 		}
 	}()
-	addr, stopper := benchmark.StartServer(benchmark.ServerInfo{Addr: ":0", Type: "protobuf"}) // listen on all interfaces
+	addr, stopper := benchmark.StartServer(benchmark.ServerInfo{Addr: ":0", Type: "protobuf", ReportServerTime: *measureServerTime}) // listen on all interfaces
 	grpclog.Println("Server Address: ", addr)
 	<-time.After(time.Duration(*duration) * time.Second)
 	stopper()
@@ -63,6 +63,9 @@ func (testCodec) String() string {
 type testStreamHandler struct {
 	port string
 	t    transport.ServerTransport
+	// failRPCs makes "respond-with-port" requests fail with the server's
+	// port as the error desc, so tests can simulate one bad backend.
+	failRPCs bool
 }
 
 func (h *testStreamHandler) handleStream(t *testing.T, s *transport.Stream) {
@@ -98,6 +101,22 @@ func (h *testStreamHandler) handleStream(t *testing.T, s *transport.Stream) {
 			h.t.WriteStatus(s, status.New(codes.Internal, h.port))
 			return
 		}
+		if v == "respond-with-port" {
+			// Identify the serving backend either way: fail with the port as
+			// the error desc, or reply with the port as the response.
+			if h.failRPCs {
+				h.t.WriteStatus(s, status.New(codes.Internal, h.port))
+				return
+			}
+			hdr, data, err := encode(testCodec{}, &h.port, nil, nil, nil)
+			if err != nil {
+				t.Errorf("Failed to encode the response: %v", err)
+				return
+			}
+			h.t.Write(s, hdr, data, &transport.Options{})
+			h.t.WriteStatus(s, status.New(codes.OK, ""))
+			return
+		}
 
 		if v != expectedRequest {
 			h.t.WriteStatus(s, status.New(codes.Internal, strings.Repeat("A", sizeLargeErr)))
@@ -121,6 +140,7 @@ type server struct {
 	startedErr chan error // sent nil or an error after server starts
 	mu         sync.Mutex
 	conns      map[transport.ServerTransport]bool
+	failRPCs   bool // see testStreamHandler.failRPCs; guarded by mu
 }
 
 func newTestServer() *server {
@@ -167,11 +187,12 @@ func (s *server) start(t *testing.T, port int, maxStreams uint32) {
 			return
 		}
 		s.conns[st] = true
-		s.mu.Unlock()
 		h := &testStreamHandler{
-			port: s.port,
-			t:    st,
+			port:     s.port,
+			t:        st,
+			failRPCs: s.failRPCs,
 		}
+		s.mu.Unlock()
 		go st.HandleStreams(func(s *transport.Stream) {
 			go h.handleStream(t, s)
 		}, func(ctx context.Context, method string) context.Context {
@@ -250,13 +250,11 @@ func WithBackoffMaxDelay(md time.Duration) DialOption {
 }
 
 // WithBackoffConfig configures the dialer to use the provided backoff
-// parameters after connection failures.
-//
-// Use WithBackoffMaxDelay until more parameters on BackoffConfig are opened up
-// for use.
+// parameters after connection failures. Fields left at their zero value fall
+// back to the values in DefaultBackoffConfig.
 func WithBackoffConfig(b BackoffConfig) DialOption {
-	// Set defaults to ensure that provided BackoffConfig is valid and
-	// unexported fields get default values.
+	// Set defaults to ensure that the provided BackoffConfig is valid and
+	// omitted fields get default values.
 	setDefaults(&b)
 	return withBackoff(b)
 }
@@ -503,6 +501,10 @@ func DialContext(ctx context.Context, target string, opts ...DialOption) (conn *
 		cc.authority = creds.Info().ServerName
 	} else if cc.dopts.insecure && cc.dopts.copts.Authority != "" {
 		cc.authority = cc.dopts.copts.Authority
+	} else if strings.HasPrefix(target, "unix:") {
+		// A unix domain socket path is not a valid :authority value; use a
+		// placeholder instead.
+		cc.authority = "localhost"
 	} else {
 		// Use endpoint from "scheme://authority/endpoint" as the default
 		// authority for ClientConn.
@@ -850,9 +852,9 @@ func (ac *addrConn) connect() error {
 // tryUpdateAddrs tries to update ac.addrs with the new addresses list.
 //
 // It checks whether current connected address of ac is in the new addrs list.
-//  - If true, it updates ac.addrs and returns true. The ac will keep using
-//    the existing connection.
-//  - If false, it does nothing and returns false.
+//   - If true, it updates ac.addrs and returns true. The ac will keep using
+//     the existing connection.
+//   - If false, it does nothing and returns false.
 func (ac *addrConn) tryUpdateAddrs(addrs []resolver.Address) bool {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
@@ -1003,6 +1005,11 @@ type addrConn struct {
 	// connectDeadline is the time by which all connection
 	// negotiations must complete.
 	connectDeadline time.Time
+	// skipBackoff, when set, makes the next resetTransport attempt connect
+	// without the usual backoff delay. It is set when the previous
+	// transport was closed by a clean GOAWAY, where a replacement server is
+	// expected to be up already.
+	skipBackoff bool
 }
 
 // adjustParams updates parameters used to create transports upon
@@ -1072,6 +1079,12 @@ func (ac *addrConn) resetTransport() error {
 			// or this is the first time this addrConn is trying to establish a
 			// connection.
 			backoffFor := ac.dopts.bs.backoff(connectRetryNum) // time.Duration.
+			if ac.skipBackoff {
+				// The previous transport went away through a clean GOAWAY;
+				// reconnect right away instead of backing off.
+				backoffFor = 0
+				ac.skipBackoff = false
+			}
 			// This will be the duration that dial gets to finish.
 			dialDuration := minConnectTimeout
 			if backoffFor > dialDuration {
@@ -1263,7 +1276,15 @@ func (ac *addrConn) transportMonitor() {
 		// parameters as appropriate.
 		select {
 		case <-t.GoAway():
-			ac.adjustParams(t.GetGoAwayReason())
+			r := t.GetGoAwayReason()
+			ac.adjustParams(r)
+			if r == transport.GoAwayGraceful {
+				// A clean GOAWAY means the server shut down on purpose;
+				// don't back off before connecting to its replacement.
+				ac.mu.Lock()
+				ac.skipBackoff = true
+				ac.mu.Unlock()
+			}
 		default:
 		}
 		ac.mu.Lock()
@@ -1354,6 +1375,24 @@ func (ac *addrConn) getReadyTransport() (transport.ClientTransport, bool) {
 	return nil, false
 }
 
+// healthCheck sends an HTTP/2 ping on ac's ready transport and closes the
+// transport if the ack does not arrive before ctx expires, so that
+// transportMonitor notices the failure and reconnects. It is a no-op when ac
+// is not ready.
+func (ac *addrConn) healthCheck(ctx context.Context) {
+	ac.mu.Lock()
+	if ac.state != connectivity.Ready {
+		ac.mu.Unlock()
+		return
+	}
+	t := ac.transport
+	ac.mu.Unlock()
+	if err := t.Ping(ctx); err != nil {
+		ac.errorf("health check ping failed, closing transport: %v", err)
+		t.Close()
+	}
+}
+
 // tearDown starts to tear down the addrConn.
 // TODO(zhaoq): Make this synchronous to avoid unbounded memory consumption in
 // some edge cases (e.g., the caller opens and closes many addrConn's in a
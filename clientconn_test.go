@@ -19,9 +19,11 @@
 package grpc
 
 import (
+	"errors"
 	"io"
 	"math"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -662,3 +664,78 @@ func TestClientUpdatesParamsAfterGoAway(t *testing.T) {
 		t.Fatalf("cc.dopts.copts.Keepalive.Time = %v , want 100ms", v)
 	}
 }
+
+func TestImmediateReconnectAfterGracefulGoAway(t *testing.T) {
+	defer leakcheck.Check(t)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error while listening. Err: %v", err)
+	}
+	defer lis.Close()
+	// Fail the first reconnect dial so that, without the clean-GOAWAY
+	// exemption, the client would sleep for the base backoff delay (1s)
+	// before trying again.
+	var dials uint32
+	dialer := func(addr string, timeout time.Duration) (net.Conn, error) {
+		if atomic.AddUint32(&dials, 1) == 2 {
+			return nil, errors.New("test dialer: failing first reconnect attempt")
+		}
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	sendGoAway := make(chan struct{})
+	goAwaySent := make(chan time.Time, 1)
+	reconnected := make(chan time.Time, 1)
+	done := make(chan struct{})
+	go func() { // Launch the server.
+		defer close(done)
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Errorf("Error while accepting. Err: %v", err)
+			return
+		}
+		defer conn.Close()
+		framer := http2.NewFramer(conn, conn)
+		if err := framer.WriteSettings(http2.Setting{}); err != nil {
+			t.Errorf("Error while writing settings. Err: %v", err)
+			return
+		}
+		<-sendGoAway
+		if err := framer.WriteGoAway(0, http2.ErrCodeNo, nil); err != nil {
+			t.Errorf("Error while writing GOAWAY. Err: %v", err)
+			return
+		}
+		goAwaySent <- time.Now()
+		conn2, err := lis.Accept()
+		if err != nil {
+			t.Errorf("Error while accepting. Err: %v", err)
+			return
+		}
+		reconnected <- time.Now()
+		defer conn2.Close()
+		framer2 := http2.NewFramer(conn2, conn2)
+		if err := framer2.WriteSettings(http2.Setting{}); err != nil {
+			t.Errorf("Error while writing settings. Err: %v", err)
+			return
+		}
+		// Drain the connection until the client goes away.
+		for {
+			if _, err := conn2.Read(make([]byte, 1024)); err != nil {
+				return
+			}
+		}
+	}()
+	cc, err := Dial(lis.Addr().String(), WithInsecure(), WithWaitForHandshake(), WithBlock(), WithDialer(dialer))
+	if err != nil {
+		t.Fatalf("Error while dialing. Err: %v", err)
+	}
+	defer func() {
+		cc.Close()
+		<-done
+	}()
+	close(sendGoAway)
+	start := <-goAwaySent
+	end := <-reconnected
+	if got := end.Sub(start); got > 500*time.Millisecond {
+		t.Fatalf("Reconnect after a clean GOAWAY took %v, want no backoff delay", got)
+	}
+}
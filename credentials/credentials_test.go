@@ -21,6 +21,7 @@ package credentials
 import (
 	"crypto/tls"
 	"net"
+	"reflect"
 	"testing"
 
 	"github.com/publica-project/grpc/testdata"
@@ -204,3 +205,32 @@ func tlsClientHandshake(conn net.Conn, _ string) (AuthInfo, error) {
 	}
 	return TLSInfo{State: clientConn.ConnectionState()}, nil
 }
+
+func TestNewTLS13ServerConfig(t *testing.T) {
+	config, err := NewTLS13ServerConfig(testdata.Path("server1.pem"), testdata.Path("server1.key"))
+	if err != nil {
+		t.Fatalf("NewTLS13ServerConfig failed: %v", err)
+	}
+	if !reflect.DeepEqual(config.NextProtos, alpnProtoStr) {
+		t.Errorf("config.NextProtos = %v, want %v", config.NextProtos, alpnProtoStr)
+	}
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("config.MinVersion = %v, want %v", config.MinVersion, tls.VersionTLS13)
+	}
+	if len(config.Certificates) == 0 {
+		t.Errorf("config.Certificates is empty, want the loaded certificate")
+	}
+}
+
+func TestNewTLS13ClientConfig(t *testing.T) {
+	config := NewTLS13ClientConfig(nil, "x.test.youtube.com")
+	if !reflect.DeepEqual(config.NextProtos, alpnProtoStr) {
+		t.Errorf("config.NextProtos = %v, want %v", config.NextProtos, alpnProtoStr)
+	}
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("config.MinVersion = %v, want %v", config.MinVersion, tls.VersionTLS13)
+	}
+	if config.ServerName != "x.test.youtube.com" {
+		t.Errorf("config.ServerName = %v, want %v", config.ServerName, "x.test.youtube.com")
+	}
+}
@@ -18,7 +18,8 @@
 
 // Package grpclog defines logging for grpc.
 //
-// All logs in transport package only go to verbose level 2.
+// All logs in transport package only go to verbose level 2; the most frequent
+// per-stream messages there only go to verbose level 3.
 // All logs in other packages in grpc are logged in spite of the verbosity level.
 //
 // In the default logger,
@@ -35,6 +36,22 @@ func V(l int) bool {
 	return logger.V(l)
 }
 
+// verbositySetter is implemented by loggers whose verbosity threshold can be
+// changed after construction.
+type verbositySetter interface {
+	setVerbosity(v int)
+}
+
+// SetVerbosity sets the verbosity threshold of the current logger so that
+// V(l) reports true only for l <= v. It has no effect if the logger installed
+// with SetLoggerV2 does not support adjustable verbosity.
+// Not mutex-protected, should be called before any gRPC functions.
+func SetVerbosity(v int) {
+	if l, ok := logger.(verbositySetter); ok {
+		l.setVerbosity(v)
+	}
+}
+
 // Info logs to the INFO log.
 func Info(args ...interface{}) {
 	logger.Info(args...)
@@ -193,3 +193,7 @@ func (g *loggerT) Fatalf(format string, args ...interface{}) {
 func (g *loggerT) V(l int) bool {
 	return l <= g.v
 }
+
+func (g *loggerT) setVerbosity(v int) {
+	g.v = v
+}
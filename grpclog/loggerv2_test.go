@@ -51,6 +51,24 @@ func TestLoggerV2Severity(t *testing.T) {
 	}
 }
 
+func TestSetVerbosity(t *testing.T) {
+	SetLoggerV2(NewLoggerV2WithVerbosity(new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer), 0))
+	if V(1) {
+		t.Errorf("V(1) = true with verbosity 0, want false")
+	}
+	SetVerbosity(2)
+	if !V(2) {
+		t.Errorf("V(2) = false after SetVerbosity(2), want true")
+	}
+	if V(3) {
+		t.Errorf("V(3) = true after SetVerbosity(2), want false")
+	}
+	SetVerbosity(0)
+	if V(1) {
+		t.Errorf("V(1) = true after SetVerbosity(0), want false")
+	}
+}
+
 // check if b is in the format of:
 //  WARNING: 2017/04/07 14:55:42 WARNING
 func checkLogForSeverity(s int, b []byte) error {
@@ -20,8 +20,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/publica-project/grpc"
 	"github.com/publica-project/grpc/credentials"
@@ -32,12 +35,32 @@ import (
 )
 
 var (
-	useTLS   = flag.Bool("use_tls", false, "Connection uses TLS if true, else plain TCP")
-	certFile = flag.String("tls_cert_file", "", "The TLS cert file")
-	keyFile  = flag.String("tls_key_file", "", "The TLS key file")
-	port     = flag.Int("port", 10000, "The server port")
+	useTLS        = flag.Bool("use_tls", false, "Connection uses TLS if true, else plain TCP")
+	certFile      = flag.String("tls_cert_file", "", "The TLS cert file")
+	keyFile       = flag.String("tls_key_file", "", "The TLS key file")
+	port          = flag.Int("port", 10000, "The server port")
+	injectLatency = flag.String("inject_latency", "", "Artificial delay added before each unary response and between streamed messages; either a single duration (e.g. 20ms) or a min-max range picked at random per message (e.g. 10ms-50ms). Empty means no delay")
 )
 
+// parseLatency parses the -inject_latency value: a single duration or a
+// min-max range of durations separated by a dash.
+func parseLatency(s string) (min, max time.Duration, err error) {
+	if i := strings.Index(s, "-"); i >= 0 {
+		if min, err = time.ParseDuration(s[:i]); err != nil {
+			return 0, 0, err
+		}
+		if max, err = time.ParseDuration(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		if max < min {
+			return 0, 0, fmt.Errorf("max %v smaller than min %v", max, min)
+		}
+		return min, max, nil
+	}
+	min, err = time.ParseDuration(s)
+	return min, min, err
+}
+
 func main() {
 	flag.Parse()
 	p := strconv.Itoa(*port)
@@ -60,6 +83,14 @@ func main() {
 		opts = []grpc.ServerOption{grpc.Creds(creds)}
 	}
 	server := grpc.NewServer(opts...)
-	testpb.RegisterTestServiceServer(server, interop.NewTestServer())
+	ts := interop.NewTestServer()
+	if *injectLatency != "" {
+		min, max, err := parseLatency(*injectLatency)
+		if err != nil {
+			grpclog.Fatalf("Invalid -inject_latency value %q: %v", *injectLatency, err)
+		}
+		ts = interop.NewTestServerWithLatency(min, max)
+	}
+	testpb.RegisterTestServiceServer(server, ts)
 	server.Serve(lis)
 }
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"strings"
 	"time"
 
@@ -580,6 +581,10 @@ func DoUnimplementedMethod(cc *grpc.ClientConn) {
 }
 
 type testServer struct {
+	// minLatency and maxLatency bound the artificial delay injected before
+	// each unary response and between streamed messages. Both zero, the
+	// default, disables injection.
+	minLatency, maxLatency time.Duration
 }
 
 // NewTestServer creates a test server for test service.
@@ -587,7 +592,28 @@ func NewTestServer() testpb.TestServiceServer {
 	return &testServer{}
 }
 
+// NewTestServerWithLatency creates a test server that sleeps for a duration
+// chosen uniformly at random from [min, max] before sending each unary
+// response and between streamed messages, to exercise client timeout and
+// retry behavior. Pass min == max for a fixed delay.
+func NewTestServerWithLatency(min, max time.Duration) testpb.TestServiceServer {
+	return &testServer{minLatency: min, maxLatency: max}
+}
+
+// injectLatency sleeps for the configured artificial delay, if any.
+func (s *testServer) injectLatency() {
+	if s.maxLatency <= 0 {
+		return
+	}
+	d := s.minLatency
+	if s.maxLatency > s.minLatency {
+		d += time.Duration(rand.Int63n(int64(s.maxLatency-s.minLatency) + 1))
+	}
+	time.Sleep(d)
+}
+
 func (s *testServer) EmptyCall(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) {
+	s.injectLatency()
 	return new(testpb.Empty), nil
 }
 
@@ -628,6 +654,7 @@ func (s *testServer) UnaryCall(ctx context.Context, in *testpb.SimpleRequest) (*
 	if err != nil {
 		return nil, err
 	}
+	s.injectLatency()
 	return &testpb.SimpleResponse{
 		Payload: pl,
 	}, nil
@@ -643,6 +670,7 @@ func (s *testServer) StreamingOutputCall(args *testpb.StreamingOutputCallRequest
 		if err != nil {
 			return err
 		}
+		s.injectLatency()
 		if err := stream.Send(&testpb.StreamingOutputCallResponse{
 			Payload: pl,
 		}); err != nil {
@@ -657,6 +685,7 @@ func (s *testServer) StreamingInputCall(stream testpb.TestService_StreamingInput
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
+			s.injectLatency()
 			return stream.SendAndClose(&testpb.StreamingInputCallResponse{
 				AggregatedPayloadSize: int32(sum),
 			})
@@ -702,6 +731,7 @@ func (s *testServer) FullDuplexCall(stream testpb.TestService_FullDuplexCallServ
 			if err != nil {
 				return err
 			}
+			s.injectLatency()
 			if err := stream.Send(&testpb.StreamingOutputCallResponse{
 				Payload: pl,
 			}); err != nil {
@@ -734,6 +764,7 @@ func (s *testServer) HalfDuplexCall(stream testpb.TestService_HalfDuplexCallServ
 			if err != nil {
 				return err
 			}
+			s.injectLatency()
 			if err := stream.Send(&testpb.StreamingOutputCallResponse{
 				Payload: pl,
 			}); err != nil {
@@ -36,6 +36,9 @@ type ClientParameters struct {
 	Timeout time.Duration // The current default value is 20 seconds.
 	// If true, client runs keepalive checks even with no active RPCs.
 	PermitWithoutStream bool // false by default.
+	// MaxUnackedPings is the number of consecutive keepalive pings that must go unacked within their Timeout
+	// before the connection is force-closed, for peers that stop acking pings while keeping the TCP connection open.
+	MaxUnackedPings int // The current default value is 1, i.e. the connection is closed after the first unacked ping.
 }
 
 // ServerParameters is used to set keepalive and max-age parameters on the server-side.
@@ -44,8 +47,11 @@ type ServerParameters struct {
 	// Idleness duration is defined since the most recent time the number of outstanding RPCs became zero or the connection establishment.
 	MaxConnectionIdle time.Duration // The current default value is infinity.
 	// MaxConnectionAge is a duration for the maximum amount of time a connection may exist before it will be closed by sending a GoAway.
-	// A random jitter of +/-10% will be added to MaxConnectionAge to spread out connection storms.
+	// A random jitter of +/-MaxConnectionAgeJitter will be added to MaxConnectionAge to spread out connection storms.
 	MaxConnectionAge time.Duration // The current default value is infinity.
+	// MaxConnectionAgeJitter is the magnitude of the random jitter applied to MaxConnectionAge, as a fraction of its value.
+	// A negative value disables the jitter entirely.
+	MaxConnectionAgeJitter float64 // The current default value is 0.1 (+/-10%).
 	// MaxConnectinoAgeGrace is an additive period after MaxConnectionAge after which the connection will be forcibly closed.
 	MaxConnectionAgeGrace time.Duration // The current default value is infinity.
 	// After a duration of this time if the server doesn't see any activity it pings the client to see if the transport is still alive.
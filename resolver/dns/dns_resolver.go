@@ -57,6 +57,14 @@ func NewBuilder() resolver.Builder {
 	return &dnsBuilder{freq: defaultFreq}
 }
 
+// NewBuilderWithFreq creates a dnsBuilder which is used to factory DNS
+// resolvers that poll the DNS server every freq, pushing the updated address
+// set to the ClientConn. This is in addition to the on-demand resolution
+// triggered via ResolveNow. Re-resolution stops when the resolver is closed.
+func NewBuilderWithFreq(freq time.Duration) resolver.Builder {
+	return &dnsBuilder{freq: freq}
+}
+
 type dnsBuilder struct {
 	// frequency of polling the DNS server.
 	freq time.Duration
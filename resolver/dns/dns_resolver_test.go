@@ -803,6 +803,47 @@ func testDNSResolveNow(t *testing.T) {
 	}
 }
 
+func TestDNSResolverRefresh(t *testing.T) {
+	defer leakcheck.Check(t)
+	const target = "foo.bar.com"
+	b := NewBuilderWithFreq(20 * time.Millisecond)
+	cc := &testClientConn{target: target}
+	r, err := b.Build(resolver.Target{Endpoint: target}, cc, resolver.BuildOption{})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer r.Close()
+	var addrs []resolver.Address
+	var cnt int
+	for {
+		addrs, cnt = cc.getAddress()
+		if cnt > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := []resolver.Address{{Addr: "1.2.3.4" + colonDefaultPort}, {Addr: "5.6.7.8" + colonDefaultPort}}
+	if !reflect.DeepEqual(want, addrs) {
+		t.Fatalf("Resolved addresses of target: %q = %+v, want %+v\n", target, addrs, want)
+	}
+	// Change the DNS answer and expect the periodic re-resolution to pick it
+	// up without an explicit ResolveNow.
+	revertTbl := mutateTbl(target)
+	defer revertTbl()
+	wantNext := []resolver.Address{{Addr: "1.2.3.4" + colonDefaultPort}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		addrs, _ = cc.getAddress()
+		if reflect.DeepEqual(wantNext, addrs) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Re-resolved addresses of target: %q = %+v, want %+v\n", target, addrs, wantNext)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 const colonDefaultPort = ":" + defaultPort
 
 func testIPResolver(t *testing.T) {
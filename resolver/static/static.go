@@ -0,0 +1,89 @@
+/*
+ *
+ * Copyright 2017 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package static implements a resolver for a fixed, comma-separated list of
+// host:port pairs given in the target, e.g.
+// "static:///10.0.0.1:443,10.0.0.2:443". The list is reported once when the
+// resolver is built and never changes.
+package static
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/publica-project/grpc/resolver"
+)
+
+const scheme = "static"
+
+type staticBuilder struct{}
+
+func (*staticBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	addrs, err := parseTarget(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	r := &staticResolver{
+		cc:    cc,
+		addrs: addrs,
+	}
+	r.start()
+	return r, nil
+}
+
+func (*staticBuilder) Scheme() string {
+	return scheme
+}
+
+// parseTarget splits endpoint into a list of resolver.Address. Each element
+// must be a host:port pair; IPv6 literals must use bracket syntax, e.g.
+// "[::1]:443". An empty list or a malformed element is an error.
+func parseTarget(endpoint string) ([]resolver.Address, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("static resolver: missing address list in target")
+	}
+	var addrs []resolver.Address
+	for _, a := range strings.Split(endpoint, ",") {
+		if a == "" {
+			return nil, fmt.Errorf("static resolver: empty address in target %q", endpoint)
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return nil, fmt.Errorf("static resolver: invalid address %q: %v", a, err)
+		}
+		addrs = append(addrs, resolver.Address{Addr: a})
+	}
+	return addrs, nil
+}
+
+type staticResolver struct {
+	cc    resolver.ClientConn
+	addrs []resolver.Address
+}
+
+func (r *staticResolver) start() {
+	r.cc.NewAddress(r.addrs)
+}
+
+func (*staticResolver) ResolveNow(o resolver.ResolveNowOption) {}
+
+func (*staticResolver) Close() {}
+
+func init() {
+	resolver.Register(&staticBuilder{})
+}
@@ -0,0 +1,82 @@
+/*
+ *
+ * Copyright 2017 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package static
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/publica-project/grpc/resolver"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, test := range []struct {
+		endpoint string
+		want     []resolver.Address
+		wantErr  bool
+	}{
+		{"localhost:1234", []resolver.Address{{Addr: "localhost:1234"}}, false},
+		{"127.0.0.1:80,127.0.0.2:81", []resolver.Address{{Addr: "127.0.0.1:80"}, {Addr: "127.0.0.2:81"}}, false},
+		{"[::1]:1234", []resolver.Address{{Addr: "[::1]:1234"}}, false},
+		{"[2001:db8::1]:80,[::1]:81", []resolver.Address{{Addr: "[2001:db8::1]:80"}, {Addr: "[::1]:81"}}, false},
+		{"", nil, true},
+		{",", nil, true},
+		{"localhost:1234,", nil, true},
+		{"localhost", nil, true},
+		{"::1:1234", nil, true},
+	} {
+		got, err := parseTarget(test.endpoint)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseTarget(%q) = _, %v, want error: %v", test.endpoint, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseTarget(%q) = %v, want %v", test.endpoint, got, test.want)
+		}
+	}
+}
+
+type testClientConn struct {
+	resolver.ClientConn // For unimplemented functions
+	addrs               []resolver.Address
+}
+
+func (cc *testClientConn) NewAddress(addresses []resolver.Address) {
+	cc.addrs = addresses
+}
+
+func TestBuild(t *testing.T) {
+	b := resolver.Get(scheme)
+	if b == nil {
+		t.Fatalf("resolver.Get(%q) = nil, want non-nil builder", scheme)
+	}
+	cc := &testClientConn{}
+	r, err := b.Build(resolver.Target{Scheme: scheme, Endpoint: "127.0.0.1:80,[::1]:81"}, cc, resolver.BuildOption{})
+	if err != nil {
+		t.Fatalf("Build() returned error: %v", err)
+	}
+	defer r.Close()
+	want := []resolver.Address{{Addr: "127.0.0.1:80"}, {Addr: "[::1]:81"}}
+	if !reflect.DeepEqual(cc.addrs, want) {
+		t.Fatalf("Build() reported addresses %v, want %v", cc.addrs, want)
+	}
+	if _, err := b.Build(resolver.Target{Scheme: scheme, Endpoint: ""}, cc, resolver.BuildOption{}); err == nil {
+		t.Fatalf("Build() with an empty address list succeeded, want error")
+	}
+}
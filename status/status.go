@@ -34,6 +34,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/publica-project/grpc/codes"
+	"golang.org/x/net/context"
 	spb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
@@ -175,8 +176,17 @@ func (s *Status) Details() []interface{} {
 	return details
 }
 
-// Code returns the Code of the error if it is a Status error, codes.OK if err
-// is nil, or codes.Unknown otherwise.
+// coder is implemented by errors outside this package that carry a gRPC code,
+// such as the transport package's stream and connection errors. It lets Code
+// recover their code without this package depending on theirs.
+type coder interface {
+	GRPCCode() codes.Code
+}
+
+// Code returns the gRPC code carried by err: codes.OK if err is nil, the
+// embedded code for errors from this package and for errors implementing
+// GRPCCode() (e.g. transport errors), the canonical mapping for context
+// expiration and cancelation errors, and codes.Unknown for everything else.
 func Code(err error) codes.Code {
 	// Don't use FromError to avoid allocation of OK status.
 	if err == nil {
@@ -185,5 +195,14 @@ func Code(err error) codes.Code {
 	if se, ok := err.(*statusError); ok {
 		return se.status().Code()
 	}
+	if c, ok := err.(coder); ok {
+		return c.GRPCCode()
+	}
+	switch err {
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	}
 	return codes.Unknown
 }
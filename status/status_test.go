@@ -29,6 +29,7 @@ import (
 	apb "github.com/golang/protobuf/ptypes/any"
 	dpb "github.com/golang/protobuf/ptypes/duration"
 	"github.com/publica-project/grpc/codes"
+	"golang.org/x/net/context"
 	cpb "google.golang.org/genproto/googleapis/rpc/code"
 	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
 	spb "google.golang.org/genproto/googleapis/rpc/status"
@@ -286,3 +287,36 @@ func mustMarshalAny(msg proto.Message) *apb.Any {
 	}
 	return any
 }
+
+// codeError carries a gRPC code through the GRPCCode method, standing in for
+// errors from the transport package.
+type codeError struct {
+	c codes.Code
+}
+
+func (e codeError) Error() string {
+	return fmt.Sprintf("code error: %v", e.c)
+}
+
+func (e codeError) GRPCCode() codes.Code {
+	return e.c
+}
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{nil, codes.OK},
+		{Error(codes.NotFound, "not found"), codes.NotFound},
+		{codeError{codes.ResourceExhausted}, codes.ResourceExhausted},
+		{context.Canceled, codes.Canceled},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{errors.New("unclassified"), codes.Unknown},
+	}
+	for _, tc := range tests {
+		if got := Code(tc.err); got != tc.want {
+			t.Errorf("Code(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -504,6 +504,7 @@ func (cs *clientStream) finish(err error) {
 			Err:           err,
 			BytesSent:     true,
 			BytesReceived: cs.s.BytesReceived(),
+			Trailer:       cs.s.Trailer(),
 		})
 		cs.done = nil
 	}
@@ -41,9 +41,19 @@ const (
 	defaultMaxConnectionIdle      = infinity
 	defaultMaxConnectionAge       = infinity
 	defaultMaxConnectionAgeGrace  = infinity
+	// defaultMaxConnectionAgeJitter is the fraction of MaxConnectionAge used
+	// as the random jitter window (+/-10%) to spread out GOAWAYs of
+	// connections created around the same time.
+	defaultMaxConnectionAgeJitter = 0.1
 	defaultServerKeepaliveTime    = time.Duration(2 * time.Hour)
 	defaultServerKeepaliveTimeout = time.Duration(20 * time.Second)
 	defaultKeepalivePolicyMinTime = time.Duration(5 * time.Minute)
+	// defaultDialRetryBackoff is the wait between dial attempts when
+	// ConnectOptions.DialRetries is set without an explicit backoff.
+	defaultDialRetryBackoff = 100 * time.Millisecond
+	// defaultMaxGoAways is the number of GOAWAY frames a client tolerates on
+	// one connection before force-closing it. Graceful shutdown uses two.
+	defaultMaxGoAways = 2
 	// max window limit set by HTTP2 Specs.
 	maxWindowSize = math.MaxInt32
 	// defaultLocalSendQuota sets is default value for number of data
@@ -99,6 +109,15 @@ type settingsAck struct {
 
 func (*settingsAck) item() {}
 
+// headerTableUpdate resizes the HPACK encoder's dynamic table once the peer
+// announced a new SETTINGS_HEADER_TABLE_SIZE. It is applied on the writing
+// goroutine since that is where the encoder is used.
+type headerTableUpdate struct {
+	v uint32
+}
+
+func (*headerTableUpdate) item() {}
+
 type resetStream struct {
 	streamID uint32
 	code     http2.ErrCode
@@ -168,6 +187,77 @@ func (qb *quotaPool) lockedAdd(v int) {
 	}
 }
 
+// currentQuota returns a snapshot of the quota currently available in the
+// pool. The value may be stale as soon as it is returned.
+func (qb *quotaPool) currentQuota() int {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	return qb.quota
+}
+
+// quotaLatencyBuckets is the number of histogram buckets kept by
+// QuotaLatencyStats. Bucket i counts waits of [2^(i-1), 2^i) microseconds,
+// with the first bucket absorbing sub-microsecond waits and the last one
+// everything beyond the range.
+const quotaLatencyBuckets = 24
+
+// QuotaLatencyStats is a coarse, concurrency-safe histogram of the time
+// spent waiting to acquire stream quota. It is only populated when
+// ConnectOptions.TrackStreamQuotaLatency is set.
+type QuotaLatencyStats struct {
+	mu      sync.Mutex
+	count   int64
+	total   time.Duration
+	max     time.Duration
+	buckets [quotaLatencyBuckets]int64
+}
+
+func (s *QuotaLatencyStats) add(d time.Duration) {
+	s.mu.Lock()
+	s.count++
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+	b := 0
+	for v := d / time.Microsecond; v > 0 && b < quotaLatencyBuckets-1; v >>= 1 {
+		b++
+	}
+	s.buckets[b]++
+	s.mu.Unlock()
+}
+
+// Count returns the number of quota acquisitions recorded.
+func (s *QuotaLatencyStats) Count() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Total returns the cumulative time spent waiting for quota.
+func (s *QuotaLatencyStats) Total() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Max returns the longest single wait observed.
+func (s *QuotaLatencyStats) Max() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+// Buckets returns a copy of the histogram buckets; see quotaLatencyBuckets
+// for the bucket boundaries.
+func (s *QuotaLatencyStats) Buckets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := make([]int64, quotaLatencyBuckets)
+	copy(b, s.buckets[:])
+	return b
+}
+
 func (qb *quotaPool) addAndUpdate(v int) {
 	qb.mu.Lock()
 	qb.lockedAdd(v)
@@ -197,6 +287,8 @@ func (qb *quotaPool) get(v int, wc waiters) (int, uint32, error) {
 			return 0, 0, io.EOF
 		case <-wc.goAway:
 			return 0, 0, errStreamDrain
+		case <-wc.writeDeadline:
+			return 0, 0, ErrWriteDeadlineExceeded
 		case <-qb.c:
 			qb.mu.Lock()
 			if qb.quota > 0 {
@@ -246,6 +338,18 @@ type inFlow struct {
 	// delta is the extra window update given by receiver when an application
 	// is reading data bigger in size than the inFlow limit.
 	delta uint32
+	// updateRatio is the fraction of the window that pendingUpdate must
+	// reach before a window update is flushed to the peer. Zero means the
+	// default of 1/4.
+	updateRatio float64
+}
+
+// snapshot returns the accounting values of f under its lock. The values may
+// be stale as soon as they are returned.
+func (f *inFlow) snapshot() (limit, pendingData, pendingUpdate, delta uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.limit, f.pendingData, f.pendingUpdate, f.delta
 }
 
 // newLimit updates the inflow window to a new value n.
@@ -317,7 +421,7 @@ func (f *inFlow) onRead(n uint32) uint32 {
 		n = 0
 	}
 	f.pendingUpdate += n
-	if f.pendingUpdate >= f.limit/4 {
+	if f.pendingUpdate >= f.updateThreshold() {
 		wu := f.pendingUpdate
 		f.pendingUpdate = 0
 		return wu
@@ -325,6 +429,19 @@ func (f *inFlow) onRead(n uint32) uint32 {
 	return 0
 }
 
+// updateThreshold returns the number of consumed bytes that must accumulate
+// before a window update is flushed. The caller must hold f.mu.
+func (f *inFlow) updateThreshold() uint32 {
+	if f.updateRatio == 0 {
+		return f.limit / 4
+	}
+	t := uint32(f.updateRatio * float64(f.limit))
+	if t == 0 {
+		t = 1
+	}
+	return t
+}
+
 func (f *inFlow) resetPendingUpdate() uint32 {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -332,3 +449,94 @@ func (f *inFlow) resetPendingUpdate() uint32 {
 	f.pendingUpdate = 0
 	return n
 }
+
+// connBufLimiter bounds the aggregate number of unread bytes buffered by the
+// receive buffers of all streams on a connection. While the bound is
+// exceeded, connection-level window updates are withheld so that the peer
+// stops sending once the connection window drains; the withheld updates are
+// released as the application catches up on its reads.
+type connBufLimiter struct {
+	mu sync.Mutex
+	// limit is the number of aggregate unread bytes tolerated on the
+	// connection.
+	limit int
+	// unread is the number of bytes handed to stream receive buffers that
+	// the application has not read yet.
+	unread int
+	// withheld accumulates connection-level window updates held back while
+	// unread exceeds limit.
+	withheld uint32
+}
+
+// onBuffer accounts n bytes handed to a stream's receive buffer.
+func (l *connBufLimiter) onBuffer(n int) {
+	l.mu.Lock()
+	l.unread += n
+	l.mu.Unlock()
+}
+
+// onWindowUpdate filters a pending connection-level window update of w
+// bytes. It returns the amount that may be sent now, zero while the limit is
+// exceeded.
+func (l *connBufLimiter) onWindowUpdate(w uint32) uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unread > l.limit {
+		l.withheld += w
+		return 0
+	}
+	w += l.withheld
+	l.withheld = 0
+	return w
+}
+
+// onRead accounts n bytes drained from a stream's receive buffer, by the
+// application reading them or by the stream going away, and returns any
+// withheld connection-level window update that may be sent now.
+func (l *connBufLimiter) onRead(n int) uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unread -= n
+	if l.unread > l.limit || l.withheld == 0 {
+		return 0
+	}
+	w := l.withheld
+	l.withheld = 0
+	return w
+}
+
+// streamRateLimiter is a token bucket refilled at rate tokens per second
+// with a burst allowance of the same size, used to bound how fast new
+// streams may be opened on one connection.
+type streamRateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newStreamRateLimiter(rate int) *streamRateLimiter {
+	return &streamRateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// allow consumes a token when one is available and reports whether the
+// stream may be opened.
+func (l *streamRateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -31,6 +31,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -67,9 +68,12 @@ func NewServerHandlerTransport(w http.ResponseWriter, r *http.Request, stats sta
 		return nil, errors.New("gRPC requires a ResponseWriter supporting http.CloseNotifier")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	st := &serverHandlerTransport{
 		rw:             w,
 		req:            r,
+		ctx:            ctx,
+		ctxCancel:      cancel,
 		closedCh:       make(chan struct{}),
 		writes:         make(chan func()),
 		contentType:    contentType,
@@ -125,6 +129,10 @@ type serverHandlerTransport struct {
 	closeOnce sync.Once
 	closedCh  chan struct{} // closed on Close
 
+	// ctx is returned by Context and canceled on Close.
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
 	// writes is a channel of code to run serialized in the
 	// ServeHTTP (HandleStreams) goroutine. The channel is closed
 	// when WriteStatus is called.
@@ -141,6 +149,12 @@ type serverHandlerTransport struct {
 	contentSubtype string
 
 	stats stats.Handler
+
+	// Lifetime stream counters returned by TransportStats; this transport
+	// carries at most one stream. Accessed atomically.
+	streamsCreated uint64
+	streamsOK      uint64
+	streamsFailed  uint64
 }
 
 func (ht *serverHandlerTransport) Close() error {
@@ -148,10 +162,20 @@ func (ht *serverHandlerTransport) Close() error {
 	return nil
 }
 
-func (ht *serverHandlerTransport) closeCloseChanOnce() { close(ht.closedCh) }
+func (ht *serverHandlerTransport) closeCloseChanOnce() {
+	close(ht.closedCh)
+	ht.ctxCancel()
+}
+
+// Context returns a context that is canceled when the transport closes.
+func (ht *serverHandlerTransport) Context() context.Context { return ht.ctx }
 
 func (ht *serverHandlerTransport) RemoteAddr() net.Addr { return strAddr(ht.req.RemoteAddr) }
 
+// LocalAddr returns the empty strAddr: net/http does not expose the
+// connection's local address to handlers in a way this transport can use.
+func (ht *serverHandlerTransport) LocalAddr() net.Addr { return strAddr("") }
+
 // strAddr is a net.Addr backed by either a TCP "ip:port" string, or
 // the empty string if unknown.
 type strAddr string
@@ -234,6 +258,11 @@ func (ht *serverHandlerTransport) WriteStatus(s *Stream, st *status.Status) erro
 	})
 
 	if err == nil { // transport has not been closed
+		if st.Code() == codes.OK {
+			atomic.AddUint64(&ht.streamsOK, 1)
+		} else {
+			atomic.AddUint64(&ht.streamsFailed, 1)
+		}
 		if ht.stats != nil {
 			ht.stats.HandleRPC(s.Context(), &stats.OutTrailer{})
 		}
@@ -346,6 +375,7 @@ func (ht *serverHandlerTransport) HandleStreams(startStream func(*Stream), trace
 		method:         req.URL.Path,
 		recvCompress:   req.Header.Get("grpc-encoding"),
 		contentSubtype: ht.contentSubtype,
+		hasDeadline:    ht.timeoutSet,
 	}
 	pr := &peer.Peer{
 		Addr: ht.RemoteAddr(),
@@ -380,11 +410,11 @@ func (ht *serverHandlerTransport) HandleStreams(startStream func(*Stream), trace
 		for buf := make([]byte, readSize); ; {
 			n, err := req.Body.Read(buf)
 			if n > 0 {
-				s.buf.put(recvMsg{data: buf[:n:n]})
+				s.write(recvMsg{data: buf[:n:n]})
 				buf = buf[n:]
 			}
 			if err != nil {
-				s.buf.put(recvMsg{err: mapRecvMsgError(err)})
+				s.write(recvMsg{err: mapRecvMsgError(err)})
 				return
 			}
 			if len(buf) == 0 {
@@ -393,6 +423,8 @@ func (ht *serverHandlerTransport) HandleStreams(startStream func(*Stream), trace
 		}
 	}()
 
+	atomic.AddUint64(&ht.streamsCreated, 1)
+
 	// startStream is provided by the *grpc.Server's serveStreams.
 	// It starts a goroutine serving s and exits immediately.
 	// The goroutine that is started is the one that then calls
@@ -425,13 +457,33 @@ func (ht *serverHandlerTransport) Drain() {
 	panic("Drain() is not implemented")
 }
 
+// TransportStats returns a snapshot of the transport's lifetime stream
+// counters.
+func (ht *serverHandlerTransport) TransportStats() TransportStats {
+	created := atomic.LoadUint64(&ht.streamsCreated)
+	ok := atomic.LoadUint64(&ht.streamsOK)
+	failed := atomic.LoadUint64(&ht.streamsFailed)
+	return TransportStats{
+		StreamsCreated:        created,
+		StreamsCompletedOK:    ok,
+		StreamsCompletedError: failed,
+		StreamsActive:         created - ok - failed,
+	}
+}
+
+// FlowControlSnapshot returns an empty snapshot: flow control is delegated
+// to the net/http server, so this transport keeps no accounting of its own.
+func (ht *serverHandlerTransport) FlowControlSnapshot() FlowControlSnapshot {
+	return FlowControlSnapshot{}
+}
+
 // mapRecvMsgError returns the non-nil err into the appropriate
 // error value as expected by callers of *grpc.parser.recvMsg.
 // In particular, in can only be:
-//   * io.EOF
-//   * io.ErrUnexpectedEOF
-//   * of type transport.ConnectionError
-//   * of type transport.StreamError
+//   - io.EOF
+//   - io.ErrUnexpectedEOF
+//   - of type transport.ConnectionError
+//   - of type transport.StreamError
 func mapRecvMsgError(err error) error {
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return err
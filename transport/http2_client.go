@@ -20,10 +20,12 @@ package transport
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -43,9 +45,28 @@ import (
 
 // http2Client implements the ClientTransport interface with HTTP2.
 type http2Client struct {
-	ctx        context.Context
-	cancel     context.CancelFunc
-	userAgent  string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	userAgent string
+	// acceptEncoding is the comma-joined grpc-accept-encoding value sent on
+	// every stream, advertising the decompressors this client supports.
+	acceptEncoding string
+	// hpackTableSize, when non-zero, caps the HPACK dynamic table size on
+	// both the decoder and the encoder; see ConnectOptions.HpackTableSize.
+	hpackTableSize uint32
+	// onWindowUpdate, when non-nil, observes received WINDOW_UPDATE frames;
+	// see ConnectOptions.OnWindowUpdate.
+	onWindowUpdate func(streamID, increment uint32)
+	// maxSendFrameSize is the largest DATA frame payload the peer accepts,
+	// learned from its SETTINGS_MAX_FRAME_SIZE. Accessed atomically.
+	maxSendFrameSize uint32
+	// prefaceReceived is closed once the server's initial SETTINGS frame has
+	// been processed, i.e. the handshake finished and the transport is
+	// usable.
+	prefaceReceived chan struct{}
+	// framing, when non-nil, substitutes the standard gRPC message framing;
+	// see ConnectOptions.FramingCodec.
+	framing    FramingCodec
 	md         interface{}
 	conn       net.Conn // underlying communication channel
 	remoteAddr net.Addr
@@ -67,6 +88,9 @@ type http2Client struct {
 	// updates, reset streams, and various settings) to the controller.
 	controlBuf *controlBuffer
 	fc         *inFlow
+	// connBuf, when non-nil, bounds the aggregate unread bytes buffered by
+	// all streams of the connection.
+	connBuf *connBufLimiter
 	// sendQuotaPool provides flow control to outbound message.
 	sendQuotaPool *quotaPool
 	// localSendQuota limits the amount of data that can be scheduled
@@ -74,6 +98,9 @@ type http2Client struct {
 	localSendQuota *quotaPool
 	// streamsQuota limits the max number of concurrent streams.
 	streamsQuota *quotaPool
+	// streamQuotaLatency records how long NewStream waits on streamsQuota.
+	// Nil unless ConnectOptions.TrackStreamQuotaLatency was set.
+	streamQuotaLatency *QuotaLatencyStats
 
 	// The scheme used: https if TLS is on, http otherwise.
 	scheme string
@@ -87,10 +114,62 @@ type http2Client struct {
 	activity uint32 // Accessed atomically.
 	kp       keepalive.ClientParameters
 
+	// Lifetime stream counters returned by TransportStats. Accessed
+	// atomically.
+	streamsCreated uint64
+	streamsOK      uint64
+	streamsFailed  uint64
+
 	statsHandler stats.Handler
 
 	initialWindowSize int32
 
+	// prefaceTimeout, when non-zero, bounds the wait for the server's first
+	// SETTINGS frame.
+	prefaceTimeout time.Duration
+
+	// maxRecvMsgBytes, when positive, caps the declared length of incoming
+	// gRPC messages.
+	maxRecvMsgBytes int
+
+	// maxGoAways bounds the number of GOAWAY frames tolerated on this
+	// connection before it is force-closed.
+	maxGoAways int
+
+	// controlBufQuota, when non-nil, bounds the number of data bytes queued
+	// in controlBuf awaiting a write to the wire. Quota is acquired in Write
+	// and returned once the corresponding frame has been written out.
+	controlBufQuota *quotaPool
+
+	// httpStatusConvTab, when non-nil, overrides entries of the default
+	// HTTP status to gRPC code mapping.
+	httpStatusConvTab map[int]codes.Code
+
+	// strictGRPC hard-fails responses without a valid gRPC content-type
+	// instead of mapping their HTTP status; see ConnectOptions.StrictGRPC.
+	strictGRPC bool
+
+	// maxHeaderFields, when positive, caps the number of non-pseudo header
+	// fields the server may send on one stream.
+	maxHeaderFields int
+
+	// compressHeaders enables the companion-header compression pass on
+	// large metadata values; see ConnectOptions.CompressLargeHeaders.
+	compressHeaders bool
+
+	// reuseStreamBufs recycles stream receive buffers through a pool; see
+	// ConnectOptions.ReuseStreamBuffers.
+	reuseStreamBufs bool
+
+	// onMaxStreamsChange, when non-nil, is told the advertised
+	// SETTINGS_MAX_CONCURRENT_STREAMS value on the initial SETTINGS frame
+	// and on every later update. Called from the reader goroutine.
+	onMaxStreamsChange func(newMax uint32)
+
+	// windowUpdateRatio is applied to the connection's and every stream's
+	// inFlow; see ConnectOptions.WindowUpdateRatio.
+	windowUpdateRatio float64
+
 	bdpEst          *bdpEstimator
 	outQuotaVersion uint32
 
@@ -99,6 +178,10 @@ type http2Client struct {
 	// connection was established.
 	onSuccess func()
 
+	// onDraining, when non-nil, is called once, in its own goroutine, when
+	// the transport enters the draining state upon the first GOAWAY.
+	onDraining func()
+
 	mu            sync.Mutex     // guard the following variables
 	state         transportState // the state of underlying connection
 	activeStreams map[uint32]*Stream
@@ -111,12 +194,29 @@ type http2Client struct {
 	// goAwayReason records the http2.ErrCode and debug data received with the
 	// GoAway frame.
 	goAwayReason GoAwayReason
+	// goAwayCount records how many GOAWAY frames have been received on this
+	// connection.
+	goAwayCount int
+	// pingAcks maps the opaque data of outstanding Ping calls to the channel
+	// closed when the matching ack arrives.
+	pingAcks map[[8]byte]chan struct{}
+
+	// pingID generates unique opaque data for Ping frames. Accessed
+	// atomically.
+	pingID uint64
 }
 
 func dial(ctx context.Context, fn func(context.Context, string) (net.Conn, error), addr string) (net.Conn, error) {
 	if fn != nil {
 		return fn(ctx, addr)
 	}
+	// Connect over a unix domain socket when the address carries the unix
+	// scheme, e.g. unix:///var/run/app.sock.
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		path = strings.TrimPrefix(path, "//")
+		return dialContext(ctx, "unix", path)
+	}
 	return dialContext(ctx, "tcp", addr)
 }
 
@@ -152,6 +252,12 @@ func isTemporary(err error) bool {
 // and starts to receive messages on it. Non-nil error returns if construction
 // fails.
 func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts ConnectOptions, onSuccess func()) (_ ClientTransport, err error) {
+	if opts.MaxFrameSize != 0 && (opts.MaxFrameSize < minMaxFrameSize || opts.MaxFrameSize > maxMaxFrameSize) {
+		return nil, connectionErrorf(false, nil, "transport: invalid MaxFrameSize %d; must be within [%d, %d]", opts.MaxFrameSize, minMaxFrameSize, maxMaxFrameSize)
+	}
+	if r := opts.WindowUpdateRatio; r < 0 || r > 1 {
+		return nil, connectionErrorf(false, nil, "transport: invalid WindowUpdateRatio %v; must be within (0, 1]", r)
+	}
 	scheme := "http"
 	ctx, cancel := context.WithCancel(ctx)
 	defer func() {
@@ -160,24 +266,59 @@ func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts Conne
 		}
 	}()
 
-	conn, err := dial(connectCtx, opts.Dialer, addr.Addr)
+	// With a proxy configured the transport dials the proxy and tunnels to
+	// the real target through an HTTP CONNECT.
+	dialAddr := addr.Addr
+	if opts.ProxyURL != nil {
+		dialAddr = opts.ProxyURL.Host
+	}
+	conn, err := dial(connectCtx, opts.Dialer, dialAddr)
+	// Retry transient dial failures up to opts.DialRetries more times,
+	// backing off between attempts, as long as the connect context lives.
+	for retries := opts.DialRetries; err != nil && retries > 0 && connectCtx.Err() == nil; retries-- {
+		if opts.FailOnNonTempDialError && !isTemporary(err) {
+			break
+		}
+		backoff := opts.DialRetryBackoff
+		if backoff <= 0 {
+			backoff = defaultDialRetryBackoff
+		}
+		select {
+		case <-connectCtx.Done():
+		case <-time.After(backoff):
+			conn, err = dial(connectCtx, opts.Dialer, dialAddr)
+		}
+	}
 	if err != nil {
 		if opts.FailOnNonTempDialError {
 			return nil, connectionErrorf(isTemporary(err), err, "transport: error while dialing: %v", err)
 		}
 		return nil, connectionErrorf(true, err, "transport: Error while dialing %v", err)
 	}
+	if opts.ProxyURL != nil {
+		conn, err = doHTTPConnectHandshake(connectCtx, conn, addr.Addr, opts.ProxyURL)
+		if err != nil {
+			return nil, connectionErrorf(true, err, "transport: proxy connect handshake failed: %v", err)
+		}
+	}
 	// Any further errors will close the underlying connection
 	defer func(conn net.Conn) {
 		if err != nil {
 			conn.Close()
 		}
 	}(conn)
+	setKernelBufferSizes(conn, opts.ReadBufferKernelSize, opts.WriteBufferKernelSize)
 	var (
 		isSecure bool
 		authInfo credentials.AuthInfo
 	)
-	if creds := opts.TransportCredentials; creds != nil {
+	creds := opts.TransportCredentials
+	if opts.CredsSelector != nil {
+		if c := opts.CredsSelector(addr); c != nil {
+			creds = c
+		}
+	}
+	if creds != nil {
 		scheme = "https"
 		conn, authInfo, err = creds.ClientHandshake(connectCtx, addr.Authority, conn)
 		if err != nil {
@@ -196,7 +337,11 @@ func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts Conne
 	if kp.Timeout == 0 {
 		kp.Timeout = defaultClientKeepaliveTimeout
 	}
-	dynamicWindow := true
+	dynamicWindow := !opts.DisableBDPEstimation
+	var quotaLatency *QuotaLatencyStats
+	if opts.TrackStreamQuotaLatency {
+		quotaLatency = &QuotaLatencyStats{}
+	}
 	icwz := int32(initialWindowSize)
 	if opts.InitialConnWindowSize >= defaultWindowSize {
 		icwz = opts.InitialConnWindowSize
@@ -211,6 +356,14 @@ func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts Conne
 	if opts.ReadBufferSize > 0 {
 		readBufSize = opts.ReadBufferSize
 	}
+	maxGoAways := defaultMaxGoAways
+	if opts.MaxGoAways > 0 {
+		maxGoAways = opts.MaxGoAways
+	}
+	acceptCompressors := opts.AcceptCompressors
+	if acceptCompressors == nil {
+		acceptCompressors = []string{"identity", "gzip"}
+	}
 	t := &http2Client{
 		ctx:        ctx,
 		cancel:     cancel,
@@ -221,33 +374,63 @@ func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts Conne
 		localAddr:  conn.LocalAddr(),
 		authInfo:   authInfo,
 		// The client initiated stream id is odd starting from 1.
-		nextID:            1,
-		goAway:            make(chan struct{}),
-		awakenKeepalive:   make(chan struct{}, 1),
-		hBuf:              &buf,
-		hEnc:              hpack.NewEncoder(&buf),
-		framer:            newFramer(conn, writeBufSize, readBufSize),
-		controlBuf:        newControlBuffer(),
-		fc:                &inFlow{limit: uint32(icwz)},
-		sendQuotaPool:     newQuotaPool(defaultWindowSize),
-		localSendQuota:    newQuotaPool(defaultLocalSendQuota),
-		scheme:            scheme,
-		state:             reachable,
-		activeStreams:     make(map[uint32]*Stream),
-		isSecure:          isSecure,
-		creds:             opts.PerRPCCredentials,
-		maxStreams:        defaultMaxStreamsClient,
-		streamsQuota:      newQuotaPool(defaultMaxStreamsClient),
-		streamSendQuota:   defaultWindowSize,
-		kp:                kp,
-		statsHandler:      opts.StatsHandler,
-		initialWindowSize: initialWindowSize,
-		onSuccess:         onSuccess,
+		nextID:             1,
+		goAway:             make(chan struct{}),
+		awakenKeepalive:    make(chan struct{}, 1),
+		hBuf:               &buf,
+		hEnc:               hpack.NewEncoder(&buf),
+		framer:             newFramer(conn, writeBufSize, readBufSize, 0, opts.HpackTableSize, opts.MaxFrameSize),
+		controlBuf:         newControlBuffer(),
+		fc:                 &inFlow{limit: uint32(icwz), updateRatio: opts.WindowUpdateRatio},
+		windowUpdateRatio:  opts.WindowUpdateRatio,
+		sendQuotaPool:      newQuotaPool(defaultWindowSize),
+		localSendQuota:     newQuotaPool(defaultLocalSendQuota),
+		scheme:             scheme,
+		state:              reachable,
+		activeStreams:      make(map[uint32]*Stream),
+		isSecure:           isSecure,
+		creds:              opts.PerRPCCredentials,
+		maxStreams:         defaultMaxStreamsClient,
+		streamsQuota:       newQuotaPool(defaultMaxStreamsClient),
+		streamQuotaLatency: quotaLatency,
+		streamSendQuota:    defaultWindowSize,
+		kp:                 kp,
+		statsHandler:       opts.StatsHandler,
+		initialWindowSize:  initialWindowSize,
+		prefaceTimeout:     opts.PrefaceTimeout,
+		maxRecvMsgBytes:    opts.MaxReceiveMessageBytes,
+		maxGoAways:         maxGoAways,
+		httpStatusConvTab:  opts.HTTPStatusConvTab,
+		strictGRPC:         opts.StrictGRPC,
+		maxHeaderFields:    opts.MaxHeaderFields,
+		compressHeaders:    opts.CompressLargeHeaders,
+		reuseStreamBufs:    opts.ReuseStreamBuffers,
+		onMaxStreamsChange: opts.OnMaxStreamsChange,
+		acceptEncoding:     strings.Join(acceptCompressors, ","),
+		onSuccess:          onSuccess,
+		onDraining:         opts.OnDraining,
+		hpackTableSize:     opts.HpackTableSize,
+		onWindowUpdate:     opts.OnWindowUpdate,
+		maxSendFrameSize:   http2MaxFrameLen,
+		prefaceReceived:    make(chan struct{}),
+		framing:            opts.FramingCodec,
+	}
+	if t.hpackTableSize > 0 && t.hpackTableSize < http2InitHeaderTableSize {
+		// The encoder may shrink its table below the peer's current limit
+		// right away; growing beyond it has to wait for the server's
+		// SETTINGS_HEADER_TABLE_SIZE.
+		t.hEnc.SetMaxDynamicTableSize(t.hpackTableSize)
 	}
 	if opts.InitialWindowSize >= defaultWindowSize {
 		t.initialWindowSize = opts.InitialWindowSize
 		dynamicWindow = false
 	}
+	if opts.MaxControlBufBytes > 0 {
+		t.controlBufQuota = newQuotaPool(opts.MaxControlBufBytes)
+	}
+	if opts.MaxConnReceiveBuffer > 0 {
+		t.connBuf = &connBufLimiter{limit: opts.MaxConnReceiveBuffer}
+	}
 	if dynamicWindow {
 		t.bdpEst = &bdpEstimator{
 			bdp:               initialWindowSize,
@@ -281,14 +464,31 @@ func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts Conne
 		t.Close()
 		return nil, connectionErrorf(true, err, "transport: preface mismatch, wrote %d bytes; want %d", n, len(clientPreface))
 	}
+	// gRPC never uses server push; advertise it as disabled so a conforming
+	// server won't even try.
+	isettings := []http2.Setting{{
+		ID:  http2.SettingEnablePush,
+		Val: 0,
+	}}
 	if t.initialWindowSize != defaultWindowSize {
-		err = t.framer.fr.WriteSettings(http2.Setting{
+		isettings = append(isettings, http2.Setting{
 			ID:  http2.SettingInitialWindowSize,
 			Val: uint32(t.initialWindowSize),
 		})
-	} else {
-		err = t.framer.fr.WriteSettings()
 	}
+	if t.hpackTableSize > 0 {
+		isettings = append(isettings, http2.Setting{
+			ID:  http2.SettingHeaderTableSize,
+			Val: t.hpackTableSize,
+		})
+	}
+	if opts.MaxFrameSize != 0 {
+		isettings = append(isettings, http2.Setting{
+			ID:  http2.SettingMaxFrameSize,
+			Val: opts.MaxFrameSize,
+		})
+	}
+	err = t.framer.fr.WriteSettings(isettings...)
 	if err != nil {
 		t.Close()
 		return nil, connectionErrorf(true, err, "transport: failed to write initial settings frame: %v", err)
@@ -312,18 +512,25 @@ func newHTTP2Client(connectCtx, ctx context.Context, addr TargetInfo, opts Conne
 }
 
 func (t *http2Client) newStream(ctx context.Context, callHdr *CallHdr) *Stream {
+	buf, bufGen := getRecvBuffer(t.reuseStreamBufs)
 	// TODO(zhaoq): Handle uint32 overflow of Stream.id.
 	s := &Stream{
-		id:             t.nextID,
-		done:           make(chan struct{}),
-		goAway:         make(chan struct{}),
-		method:         callHdr.Method,
-		sendCompress:   callHdr.SendCompress,
-		buf:            newRecvBuffer(),
-		fc:             &inFlow{limit: uint32(t.initialWindowSize)},
-		sendQuotaPool:  newQuotaPool(int(t.streamSendQuota)),
-		headerChan:     make(chan struct{}),
-		contentSubtype: callHdr.ContentSubtype,
+		id:                t.nextID,
+		done:              make(chan struct{}),
+		goAway:            make(chan struct{}),
+		method:            callHdr.Method,
+		sendCompress:      callHdr.SendCompress,
+		buf:               buf,
+		bufGen:            bufGen,
+		fc:                &inFlow{limit: uint32(t.initialWindowSize), updateRatio: t.windowUpdateRatio},
+		sendQuotaPool:     newQuotaPool(int(t.streamSendQuota)),
+		headerChan:        make(chan struct{}),
+		contentSubtype:    callHdr.ContentSubtype,
+		maxRecvMsgBytes:   t.maxRecvMsgBytes,
+		framing:           t.framing,
+		idleTimeout:       callHdr.IdleTimeout,
+		correlationID:     callHdr.CorrelationID,
+		writeBufThreshold: callHdr.WriteBufferThreshold,
 	}
 	t.nextID += 2
 	s.requestRead = func(n int) {
@@ -338,6 +545,7 @@ func (t *http2Client) newStream(ctx context.Context, callHdr *CallHdr) *Stream {
 			ctx:    s.ctx,
 			goAway: s.goAway,
 			recv:   s.buf,
+			gen:    s.bufGen,
 		},
 		windowHandler: func(n int) {
 			t.updateWindow(s, uint32(n))
@@ -355,6 +563,9 @@ func (t *http2Client) newStream(ctx context.Context, callHdr *CallHdr) *Stream {
 // NewStream creates a stream and registers it into the transport as "active"
 // streams.
 func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Stream, err error) {
+	if callHdr.PreviousRPCAttempts < 0 {
+		return nil, streamErrorf(codes.InvalidArgument, "transport: negative PreviousRPCAttempts: %d", callHdr.PreviousRPCAttempts)
+	}
 	pr := &peer.Peer{
 		Addr: t.remoteAddr,
 	}
@@ -426,9 +637,16 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 	}
 	t.mu.Unlock()
 	// Get a quota of 1 from streamsQuota.
+	var quotaWaitStart time.Time
+	if t.streamQuotaLatency != nil {
+		quotaWaitStart = time.Now()
+	}
 	if _, _, err := t.streamsQuota.get(1, waiters{ctx: ctx, tctx: t.ctx}); err != nil {
 		return nil, err
 	}
+	if t.streamQuotaLatency != nil {
+		t.streamQuotaLatency.add(time.Since(quotaWaitStart))
+	}
 	// TODO(mmukhi): Benchmark if the performance gets better if count the metadata and other header fields
 	// first and create a slice of that exact size.
 	// Make the slice of certain predictable size to reduce allocations made by append.
@@ -446,6 +664,12 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 	if callHdr.SendCompress != "" {
 		headerFields = append(headerFields, hpack.HeaderField{Name: "grpc-encoding", Value: callHdr.SendCompress})
 	}
+	if t.acceptEncoding != "" {
+		headerFields = append(headerFields, hpack.HeaderField{Name: "grpc-accept-encoding", Value: t.acceptEncoding})
+	}
+	if callHdr.PreviousRPCAttempts > 0 {
+		headerFields = append(headerFields, hpack.HeaderField{Name: "grpc-previous-rpc-attempts", Value: strconv.Itoa(callHdr.PreviousRPCAttempts)})
+	}
 	if dl, ok := ctx.Deadline(); ok {
 		// Send out timeout regardless its value. The server can detect timeout context by itself.
 		// TODO(mmukhi): Perhaps this field should be updated when actually writing out to the wire.
@@ -453,10 +677,10 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 		headerFields = append(headerFields, hpack.HeaderField{Name: "grpc-timeout", Value: encodeTimeout(timeout)})
 	}
 	for k, v := range authData {
-		headerFields = append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+		headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
 	}
 	for k, v := range callAuthData {
-		headerFields = append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+		headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
 	}
 	if b := stats.OutgoingTags(ctx); b != nil {
 		headerFields = append(headerFields, hpack.HeaderField{Name: "grpc-tags-bin", Value: encodeBinHeader(b)})
@@ -477,7 +701,7 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 				if isReservedHeader(k) {
 					continue
 				}
-				headerFields = append(headerFields, hpack.HeaderField{Name: strings.ToLower(k), Value: encodeMetadataHeader(k, v)})
+				headerFields = appendEncodedHeader(headerFields, strings.ToLower(k), v, t.compressHeaders)
 			}
 		}
 		for k, vv := range md {
@@ -486,17 +710,24 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 				continue
 			}
 			for _, v := range vv {
-				headerFields = append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+				headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
 			}
 		}
 	}
+	// Metadata staged by NewCallHdr has already been filtered and
+	// lowercased by the constructor.
+	for k, vv := range callHdr.md {
+		for _, v := range vv {
+			headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
+		}
+	}
 	if md, ok := t.md.(*metadata.MD); ok {
 		for k, vv := range *md {
 			if isReservedHeader(k) {
 				continue
 			}
 			for _, v := range vv {
-				headerFields = append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+				headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
 			}
 		}
 	}
@@ -512,6 +743,7 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 	}
 	s := t.newStream(ctx, callHdr)
 	t.activeStreams[s.id] = s
+	atomic.AddUint64(&t.streamsCreated, 1)
 	// If the number of active streams change from 0 to 1, then check if keepalive
 	// has gone dormant. If so, wake it up.
 	if len(t.activeStreams) == 1 {
@@ -531,6 +763,73 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 		endStream: false,
 	})
 	t.mu.Unlock()
+	// The HEADERS frame is already queued above; flushing the framer is all
+	// SendHeader needs to do to push it out to the wire.
+	s.flushHeader = func() {
+		t.controlBuf.put(&flushIO{})
+	}
+	s.closeSend = func() error {
+		select {
+		case <-s.ctx.Done():
+			return ContextErr(s.ctx.Err())
+		default:
+		}
+		s.mu.Lock()
+		if s.state == streamWriteDone || s.state == streamDone {
+			// END_STREAM was already sent, or the stream is finished; there
+			// is nothing left to half-close.
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		// Go through Write so any bytes held back for write coalescing are
+		// sent ahead of END_STREAM instead of being dropped; Write marks
+		// the stream write-done once the half-close is queued.
+		if err := t.Write(s, nil, nil, &Options{Last: true}); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	s.reserveQuota = func(ctx context.Context, n int) error {
+		wc := s.waiters
+		wc.ctx = ctx
+		// Wait for the stream-level window to reach n. The stream pool is
+		// private to this stream, so the quota can be put right back.
+		var sq int
+		for sq < n {
+			q, _, err := s.sendQuotaPool.get(n-sq, wc)
+			if err != nil {
+				s.sendQuotaPool.add(sq)
+				return err
+			}
+			sq += q
+		}
+		s.sendQuotaPool.add(sq)
+		// Hold the connection-level share so other streams cannot take it.
+		var tq int
+		for tq < n {
+			q, _, err := t.sendQuotaPool.get(n-tq, wc)
+			if err != nil {
+				t.sendQuotaPool.add(tq)
+				return err
+			}
+			tq += q
+		}
+		s.mu.Lock()
+		s.reservedSendQuota += tq
+		s.mu.Unlock()
+		return nil
+	}
+	s.flush = func() error {
+		t.mu.Lock()
+		if t.state == closing {
+			t.mu.Unlock()
+			return ErrConnClosing
+		}
+		t.mu.Unlock()
+		t.controlBuf.put(&flushIO{})
+		return nil
+	}
 
 	if t.statsHandler != nil {
 		outHeader := &stats.OutHeader{
@@ -542,9 +841,31 @@ func (t *http2Client) NewStream(ctx context.Context, callHdr *CallHdr) (_ *Strea
 		}
 		t.statsHandler.HandleRPC(s.ctx, outHeader)
 	}
+	if s.idleTimeout > 0 {
+		s.mu.Lock()
+		if s.state != streamDone {
+			s.idleTimer = time.AfterFunc(s.idleTimeout, func() { t.closeStreamIdle(s) })
+		}
+		s.mu.Unlock()
+	}
 	return s, nil
 }
 
+// closeStreamIdle resets stream s after its idle timeout expired without a
+// DATA frame arriving.
+func (t *http2Client) closeStreamIdle(s *Stream) {
+	s.mu.Lock()
+	if s.state == streamDone {
+		s.mu.Unlock()
+		return
+	}
+	s.rstStream = true
+	s.rstError = http2.ErrCodeCancel
+	s.finish(status.New(codes.DeadlineExceeded, fmt.Sprintf("transport: no message received on stream within the idle timeout of %v", s.idleTimeout)))
+	s.mu.Unlock()
+	s.write(recvMsg{err: io.EOF})
+}
+
 // CloseStream clears the footprint of a stream when the stream is not needed any more.
 // This must not be executed in reader's goroutine.
 func (t *http2Client) CloseStream(s *Stream, err error) {
@@ -558,6 +879,18 @@ func (t *http2Client) CloseStream(s *Stream, err error) {
 		s.write(recvMsg{err: err})
 	}
 	delete(t.activeStreams, s.id)
+	if t.connBuf != nil {
+		// Return the stream's never-read bytes to the aggregate budget.
+		if rem := atomic.SwapInt64(&s.unreadBuffered, 0); rem > 0 {
+			if cw := t.connBuf.onRead(int(rem)); cw > 0 {
+				t.controlBuf.put(&windowUpdate{0, cw})
+			}
+		}
+	}
+	// Merge any unused send quota reservation back into the connection pool.
+	if rq := s.takeReservedSendQuota(math.MaxInt32); rq > 0 {
+		t.sendQuotaPool.add(rq)
+	}
 	if t.state == draining && len(t.activeStreams) == 0 {
 		// The transport is draining and s is the last live stream on t.
 		t.mu.Unlock()
@@ -574,7 +907,13 @@ func (t *http2Client) CloseStream(s *Stream, err error) {
 	// the controller() routine).
 	var rstStream bool
 	var rstError http2.ErrCode
+	var resetDone bool
 	defer func() {
+		// The transport has already sent RST_STREAM and returned the
+		// streams quota for streams it cancelled itself.
+		if resetDone {
+			return
+		}
 		// In case, the client doesn't have to send RST_STREAM to server
 		// we can safely add back to streamsQuota pool now.
 		if !rstStream {
@@ -586,6 +925,15 @@ func (t *http2Client) CloseStream(s *Stream, err error) {
 	s.mu.Lock()
 	rstStream = s.rstStream
 	rstError = s.rstError
+	resetDone = s.resetDone
+	if !s.countedDone {
+		s.countedDone = true
+		if err != nil || (s.status != nil && s.status.Code() != codes.OK) {
+			atomic.AddUint64(&t.streamsFailed, 1)
+		} else {
+			atomic.AddUint64(&t.streamsOK, 1)
+		}
+	}
 	if s.state == streamDone {
 		s.mu.Unlock()
 		return
@@ -594,7 +942,20 @@ func (t *http2Client) CloseStream(s *Stream, err error) {
 		close(s.headerChan)
 		s.headerDone = true
 	}
-	s.state = streamDone
+	// The stream is reaching a terminal state without a status from the
+	// server; derive one from the close error so Done observers get a
+	// reason.
+	st := status.New(codes.Canceled, "transport: stream closed by the client")
+	if err != nil && err != io.EOF {
+		if se, ok := err.(StreamError); ok {
+			st = status.New(se.Code, se.Desc)
+		} else if s2, ok := status.FromError(err); ok {
+			st = s2
+		} else {
+			st = status.New(codes.Canceled, err.Error())
+		}
+	}
+	s.finish(st)
 	s.mu.Unlock()
 	if err != nil && !rstStream {
 		rstStream = true
@@ -602,6 +963,48 @@ func (t *http2Client) CloseStream(s *Stream, err error) {
 	}
 }
 
+// CancelAllStreams aborts every stream currently active on the transport
+// with err, sending a RST_STREAM frame to the server for each, while leaving
+// the connection open for future NewStream calls. Streams that completed
+// concurrently are left alone.
+func (t *http2Client) CancelAllStreams(err error) {
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.New(codes.Canceled, err.Error())
+	}
+	t.mu.Lock()
+	if t.activeStreams == nil {
+		t.mu.Unlock()
+		return
+	}
+	streams := make([]*Stream, 0, len(t.activeStreams))
+	for _, s := range t.activeStreams {
+		streams = append(streams, s)
+	}
+	t.activeStreams = make(map[uint32]*Stream)
+	t.mu.Unlock()
+	for _, s := range streams {
+		s.mu.Lock()
+		if s.state == streamDone {
+			s.mu.Unlock()
+			continue
+		}
+		s.resetDone = true
+		if !s.headerDone {
+			close(s.headerChan)
+			s.headerDone = true
+		}
+		if !s.countedDone {
+			s.countedDone = true
+			atomic.AddUint64(&t.streamsFailed, 1)
+		}
+		s.finish(st)
+		s.mu.Unlock()
+		s.write(recvMsg{err: err})
+		t.controlBuf.put(&resetStream{s.id, http2.ErrCodeCancel})
+	}
+}
+
 // Close kicks off the shutdown process of the transport. This should be called
 // only once on a transport. Once it is called, the transport should not be
 // accessed any more.
@@ -626,6 +1029,9 @@ func (t *http2Client) Close() error {
 			close(s.headerChan)
 			s.headerDone = true
 		}
+		if s.state != streamDone {
+			s.finish(status.New(codes.Unavailable, ErrConnClosing.Desc))
+		}
 		s.mu.Unlock()
 		s.write(recvMsg{err: ErrConnClosing})
 	}
@@ -659,6 +1065,34 @@ func (t *http2Client) GracefulClose() error {
 	return nil
 }
 
+// GracefulCloseWithDeadline drains the transport like GracefulClose, but
+// bounds the wait: new streams are refused immediately while existing
+// streams may finish their pending work until ctx fires, after which the
+// transport is force-closed. It returns nil when the drain completed
+// cleanly and the context's error when the deadline forced the close.
+func (t *http2Client) GracefulCloseWithDeadline(ctx context.Context) error {
+	t.mu.Lock()
+	if t.state == closing {
+		t.mu.Unlock()
+		return nil
+	}
+	t.state = draining
+	active := len(t.activeStreams)
+	t.mu.Unlock()
+	if active == 0 {
+		return t.Close()
+	}
+	// While draining, the transport closes itself once the last active
+	// stream finishes, which cancels t.ctx.
+	select {
+	case <-t.ctx.Done():
+		return nil
+	case <-ctx.Done():
+		t.Close()
+		return ctx.Err()
+	}
+}
+
 // Write formats the data into HTTP2 data frame(s) and sends it out. The caller
 // should proceed only if Write returns nil.
 func (t *http2Client) Write(s *Stream, hdr []byte, data []byte, opts *Options) error {
@@ -672,18 +1106,55 @@ func (t *http2Client) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 	default:
 	}
 
+	if t.framing != nil && hdr == nil && data != nil {
+		// With a custom framing codec the transport frames the payload
+		// itself when the caller did not supply a header.
+		hdr = t.framing.Encode(data)
+	}
+	if s.writeBufThreshold > 0 {
+		if !opts.Last && !opts.Flush && len(s.writeBuf)+len(hdr)+len(data) < s.writeBufThreshold {
+			// Hold this write back until enough bytes are pending, the
+			// stream's last write, or an explicit flush.
+			s.writeBuf = append(s.writeBuf, hdr...)
+			s.writeBuf = append(s.writeBuf, data...)
+			return nil
+		}
+		if len(s.writeBuf) > 0 {
+			// Emit everything held back along with this write.
+			hdr = append(s.writeBuf, hdr...)
+			s.writeBuf = nil
+		}
+	}
 	if hdr == nil && data == nil && opts.Last {
 		// stream.CloseSend uses this to send an empty frame with endStream=True
 		t.controlBuf.put(&dataFrame{streamID: s.id, endStream: true, f: func() {}})
+		s.mu.Lock()
+		if s.state != streamDone {
+			s.state = streamWriteDone
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if hdr == nil && data == nil {
+		// An explicit flush with nothing pending.
 		return nil
 	}
 	// Add data to header frame so that we can equally distribute data across frames.
-	emptyLen := http2MaxFrameLen - len(hdr)
+	maxFrameLen := int(atomic.LoadUint32(&t.maxSendFrameSize))
+	emptyLen := maxFrameLen - len(hdr)
 	if emptyLen > len(data) {
 		emptyLen = len(data)
 	}
 	hdr = append(hdr, data[:emptyLen]...)
 	data = data[emptyLen:]
+	wc := s.waiters
+	if !opts.WriteDeadline.IsZero() {
+		// A per-write soft deadline; when it fires the quota waits below
+		// give up without tearing down the stream.
+		timer := time.NewTimer(opts.WriteDeadline.Sub(time.Now()))
+		defer timer.Stop()
+		wc.writeDeadline = timer.C
+	}
 	var (
 		streamQuota    int
 		streamQuotaVer uint32
@@ -691,13 +1162,13 @@ func (t *http2Client) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 	)
 	for idx, r := range [][]byte{hdr, data} {
 		for len(r) > 0 {
-			size := http2MaxFrameLen
+			size := maxFrameLen
 			if size > len(r) {
 				size = len(r)
 			}
 			if streamQuota == 0 { // Used up all the locally cached stream quota.
 				// Get all the stream quota there is.
-				streamQuota, streamQuotaVer, err = s.sendQuotaPool.get(math.MaxInt32, s.waiters)
+				streamQuota, streamQuotaVer, err = s.sendQuotaPool.get(math.MaxInt32, wc)
 				if err != nil {
 					return err
 				}
@@ -706,18 +1177,45 @@ func (t *http2Client) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 				size = streamQuota
 			}
 
-			// Get size worth quota from transport.
-			tq, _, err := t.sendQuotaPool.get(size, s.waiters)
-			if err != nil {
-				return err
+			// Get size worth quota from transport, consuming any quota
+			// reserved via ReserveSendQuota first.
+			tq := s.takeReservedSendQuota(size)
+			if tq < size {
+				q, _, err := t.sendQuotaPool.get(size-tq, wc)
+				if err != nil {
+					if tq > 0 {
+						t.sendQuotaPool.add(tq)
+					}
+					s.sendQuotaPool.add(streamQuota)
+					return err
+				}
+				tq += q
 			}
 			if tq < size {
 				size = tq
 			}
-			ltq, _, err := t.localSendQuota.get(size, s.waiters)
+			// Bound the data bytes sitting in the control buffer awaiting a
+			// write to the wire.
+			if t.controlBufQuota != nil {
+				cbq, _, err := t.controlBufQuota.get(size, wc)
+				if err != nil {
+					s.sendQuotaPool.add(streamQuota)
+					t.sendQuotaPool.add(size)
+					return err
+				}
+				if cbq < size {
+					t.sendQuotaPool.add(size - cbq)
+					size = cbq
+				}
+			}
+			ltq, _, err := t.localSendQuota.get(size, wc)
 			if err != nil {
-				// Add the acquired quota back to transport.
-				t.sendQuotaPool.add(tq)
+				// Add the acquired quota back to stream and transport.
+				s.sendQuotaPool.add(streamQuota)
+				t.sendQuotaPool.add(size)
+				if t.controlBufQuota != nil {
+					t.controlBufQuota.add(size)
+				}
 				return err
 			}
 			// even if ltq is smaller than size we don't adjust size since
@@ -739,8 +1237,18 @@ func (t *http2Client) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 			}
 			success := func() {
 				ltq := ltq
-				t.controlBuf.put(&dataFrame{streamID: s.id, endStream: endStream, d: p, f: func() { t.localSendQuota.add(ltq) }})
+				t.controlBuf.put(&dataFrame{streamID: s.id, endStream: endStream, d: p, f: func() {
+					t.localSendQuota.add(ltq)
+					if t.controlBufQuota != nil {
+						t.controlBufQuota.add(len(p))
+					}
+				}})
 				r = r[size:]
+				// The first chunk of this write is committed now; returning
+				// ErrWriteDeadlineExceeded from here on would leave a partial
+				// message on the wire, so stop honoring the deadline and
+				// block until the rest is queued.
+				wc.writeDeadline = nil
 			}
 			failure := func() { // The stream quota version must have changed.
 				// Our streamQuota cache is invalidated now, so give it back.
@@ -750,6 +1258,9 @@ func (t *http2Client) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 				// Couldn't send this chunk out.
 				t.sendQuotaPool.add(size)
 				t.localSendQuota.add(ltq)
+				if t.controlBufQuota != nil {
+					t.controlBufQuota.add(size)
+				}
 				streamQuota = 0
 			}
 		}
@@ -796,15 +1307,33 @@ func (t *http2Client) adjustWindow(s *Stream, n uint32) {
 // updateWindow adjusts the inbound quota for the stream and the transport.
 // Window updates will deliver to the controller for sending when
 // the cumulative quota exceeds the corresponding threshold.
+// putConnWindowUpdate queues a connection-level window update of w bytes,
+// first letting connBuf withhold it while the aggregate receive buffer bound
+// is exceeded.
+func (t *http2Client) putConnWindowUpdate(w uint32) {
+	if t.connBuf != nil {
+		w = t.connBuf.onWindowUpdate(w)
+	}
+	if w > 0 {
+		t.controlBuf.put(&windowUpdate{0, w})
+	}
+}
+
 func (t *http2Client) updateWindow(s *Stream, n uint32) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.state == streamDone {
 		return
 	}
+	if t.connBuf != nil {
+		atomic.AddInt64(&s.unreadBuffered, -int64(n))
+		if cw := t.connBuf.onRead(int(n)); cw > 0 {
+			t.controlBuf.put(&windowUpdate{0, cw})
+		}
+	}
 	if w := s.fc.onRead(n); w > 0 {
 		if cw := t.fc.resetPendingUpdate(); cw > 0 {
-			t.controlBuf.put(&windowUpdate{0, cw})
+			t.putConnWindowUpdate(cw)
 		}
 		t.controlBuf.put(&windowUpdate{s.id, w})
 	}
@@ -850,7 +1379,7 @@ func (t *http2Client) handleData(f *http2.DataFrame) {
 	// connection's window update for the bytes we just received.
 	if sendBDPPing {
 		if size != 0 { // Could've been an empty data frame.
-			t.controlBuf.put(&windowUpdate{0, uint32(size)})
+			t.putConnWindowUpdate(uint32(size))
 		}
 		t.controlBuf.put(bdpPing)
 	} else {
@@ -859,7 +1388,7 @@ func (t *http2Client) handleData(f *http2.DataFrame) {
 			return
 		}
 		if w := t.fc.onRead(uint32(size)); w > 0 {
-			t.controlBuf.put(&windowUpdate{0, w})
+			t.putConnWindowUpdate(w)
 		}
 	}
 	// Select the right stream to dispatch.
@@ -867,6 +1396,14 @@ func (t *http2Client) handleData(f *http2.DataFrame) {
 	if !ok {
 		return
 	}
+	s.mu.Lock()
+	if size > 0 && s.firstByteTime.IsZero() {
+		s.firstByteTime = time.Now()
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+	s.mu.Unlock()
 	if size > 0 {
 		s.mu.Lock()
 		if s.state == streamDone {
@@ -886,13 +1423,26 @@ func (t *http2Client) handleData(f *http2.DataFrame) {
 				t.controlBuf.put(&windowUpdate{s.id, w})
 			}
 		}
+		if err := s.checkRecvMsgSize(f.Data()); err != nil {
+			se := err.(StreamError)
+			s.rstStream = true
+			s.rstError = http2.ErrCodeCancel
+			s.finish(status.New(se.Code, se.Desc))
+			s.mu.Unlock()
+			s.write(recvMsg{err: io.EOF})
+			return
+		}
 		s.mu.Unlock()
 		// TODO(bradfitz, zhaoq): A copy is required here because there is no
 		// guarantee f.Data() is consumed before the arrival of next frame.
 		// Can this copy be eliminated?
 		if len(f.Data()) > 0 {
-			data := make([]byte, len(f.Data()))
+			data := getRecvData(len(f.Data()))
 			copy(data, f.Data())
+			if t.connBuf != nil {
+				atomic.AddInt64(&s.unreadBuffered, int64(len(data)))
+				t.connBuf.onBuffer(len(data))
+			}
 			s.write(recvMsg{data: data})
 		}
 	}
@@ -932,7 +1482,7 @@ func (t *http2Client) handleRSTStream(f *http2.RSTStreamFrame) {
 	}
 	statusCode, ok := http2ErrConvTab[code]
 	if !ok {
-		warningf("transport: http2Client.handleRSTStream found no mapped gRPC status for the received http2 error %v", f.ErrCode)
+		debugf("transport: http2Client.handleRSTStream found no mapped gRPC status for the received http2 error %v", f.ErrCode)
 		statusCode = codes.Unknown
 	}
 	s.finish(status.Newf(statusCode, "stream terminated by RST_STREAM with error code: %v", f.ErrCode))
@@ -984,8 +1534,47 @@ func (t *http2Client) isRestrictive(s http2.Setting) bool {
 	return false
 }
 
+// Ping sends an HTTP/2 PING frame to the server and blocks until the
+// matching ack is received. It returns ErrConnClosing if the transport is
+// closed before the ack arrives, or the context error if ctx expires first.
+func (t *http2Client) Ping(ctx context.Context) error {
+	p := &ping{}
+	binary.BigEndian.PutUint64(p.data[:], atomic.AddUint64(&t.pingID, 1))
+	ack := make(chan struct{})
+	t.mu.Lock()
+	if t.state == closing {
+		t.mu.Unlock()
+		return ErrConnClosing
+	}
+	if t.pingAcks == nil {
+		t.pingAcks = make(map[[8]byte]chan struct{})
+	}
+	t.pingAcks[p.data] = ack
+	t.mu.Unlock()
+	t.controlBuf.put(p)
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		delete(t.pingAcks, p.data)
+		t.mu.Unlock()
+		return ContextErr(ctx.Err())
+	case <-t.ctx.Done():
+		return ErrConnClosing
+	}
+}
+
 func (t *http2Client) handlePing(f *http2.PingFrame) {
 	if f.IsAck() {
+		t.mu.Lock()
+		if ack, ok := t.pingAcks[f.Data]; ok {
+			delete(t.pingAcks, f.Data)
+			close(ack)
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
 		// Maybe it's a BDP ping.
 		if t.bdpEst != nil {
 			t.bdpEst.calculate(f.Data)
@@ -1006,6 +1595,13 @@ func (t *http2Client) handleGoAway(f *http2.GoAwayFrame) {
 	if f.ErrCode == http2.ErrCodeEnhanceYourCalm {
 		infof("Client received GoAway with http2.ErrCodeEnhanceYourCalm.")
 	}
+	t.goAwayCount++
+	if t.goAwayCount > t.maxGoAways {
+		t.mu.Unlock()
+		errorf("transport: received %d GOAWAY frames from the server, exceeding the limit of %d; closing the connection", t.goAwayCount, t.maxGoAways)
+		t.Close()
+		return
+	}
 	id := f.LastStreamID
 	if id > 0 && id%2 != 1 {
 		t.mu.Unlock()
@@ -1034,6 +1630,11 @@ func (t *http2Client) handleGoAway(f *http2.GoAwayFrame) {
 		t.setGoAwayReason(f)
 		close(t.goAway)
 		t.state = draining
+		if t.onDraining != nil {
+			// Run the callback in its own goroutine so a slow callback can't
+			// stall the transport's reader.
+			go t.onDraining()
+		}
 	}
 	// All streams with IDs greater than the GoAwayId
 	// and smaller than the previous GoAway ID should be killed.
@@ -1066,6 +1667,8 @@ func (t *http2Client) handleGoAway(f *http2.GoAwayFrame) {
 func (t *http2Client) setGoAwayReason(f *http2.GoAwayFrame) {
 	t.goAwayReason = GoAwayNoReason
 	switch f.ErrCode {
+	case http2.ErrCodeNo:
+		t.goAwayReason = GoAwayGraceful
 	case http2.ErrCodeEnhanceYourCalm:
 		if string(f.DebugData()) == "too_many_pings" {
 			t.goAwayReason = GoAwayTooManyPings
@@ -1073,15 +1676,113 @@ func (t *http2Client) setGoAwayReason(f *http2.GoAwayFrame) {
 	}
 }
 
+// AvailableStreamQuota returns the number of streams that can currently be
+// opened on t without blocking on MAX_CONCURRENT_STREAMS.
+func (t *http2Client) AvailableStreamQuota() int {
+	if q := t.streamsQuota.currentQuota(); q > 0 {
+		return q
+	}
+	return 0
+}
+
+// TransportStats returns a snapshot of the transport's lifetime stream
+// counters.
+func (t *http2Client) TransportStats() TransportStats {
+	t.mu.Lock()
+	active := uint64(len(t.activeStreams))
+	t.mu.Unlock()
+	return TransportStats{
+		StreamsCreated:        atomic.LoadUint64(&t.streamsCreated),
+		StreamsCompletedOK:    atomic.LoadUint64(&t.streamsOK),
+		StreamsCompletedError: atomic.LoadUint64(&t.streamsFailed),
+		StreamsActive:         active,
+	}
+}
+
+// FlowControlSnapshot returns a read-only view of the transport's
+// flow-control accounting; see FlowControlSnapshot.
+func (t *http2Client) FlowControlSnapshot() FlowControlSnapshot {
+	snap := FlowControlSnapshot{ConnSendQuota: t.sendQuotaPool.currentQuota()}
+	snap.ConnRecvLimit, snap.ConnPendingData, snap.ConnPendingUpdate, snap.ConnDelta = t.fc.snapshot()
+	t.mu.Lock()
+	streams := make([]*Stream, 0, len(t.activeStreams))
+	for _, s := range t.activeStreams {
+		streams = append(streams, s)
+	}
+	t.mu.Unlock()
+	for _, s := range streams {
+		ss := StreamFlowSnapshot{StreamID: s.id, SendQuota: s.sendQuotaPool.currentQuota()}
+		ss.RecvLimit, ss.PendingData, ss.PendingUpdate, ss.Delta = s.fc.snapshot()
+		snap.Streams = append(snap.Streams, ss)
+	}
+	return snap
+}
+
+// LocalAddr returns the local address the connection was dialed from. The
+// value is cached at connection time, so it remains valid after Close.
+func (t *http2Client) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+// RemoteAddr returns the address of the server the connection was dialed to,
+// with the same lifetime as LocalAddr.
+func (t *http2Client) RemoteAddr() net.Addr {
+	return t.remoteAddr
+}
+
+// Context returns a context that is canceled when the transport closes.
+func (t *http2Client) Context() context.Context {
+	return t.ctx
+}
+
+// StreamQuotaLatency returns the histogram of time NewStream spent waiting
+// for stream quota, or nil when ConnectOptions.TrackStreamQuotaLatency was
+// not set.
+func (t *http2Client) StreamQuotaLatency() *QuotaLatencyStats {
+	return t.streamQuotaLatency
+}
+
 func (t *http2Client) GetGoAwayReason() GoAwayReason {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	return t.goAwayReason
 }
 
+// WaitForReady blocks until the server's initial SETTINGS frame has been
+// processed and the transport is usable, ctx expires, or the transport dies,
+// whichever comes first.
+func (t *http2Client) WaitForReady(ctx context.Context) error {
+	select {
+	case <-t.prefaceReceived:
+	case <-ctx.Done():
+		return ContextErr(ctx.Err())
+	case <-t.ctx.Done():
+		return ErrConnClosing
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != reachable {
+		return ErrConnClosing
+	}
+	return nil
+}
+
+// GoAwayLastStreamID returns the Last-Stream-ID of the most recent GOAWAY
+// frame, or zero if none was received. handleGoAway records it under t.mu
+// before releasing the lock, so observers woken by the GoAway channel always
+// see the value of the GOAWAY that fired it.
+func (t *http2Client) GoAwayLastStreamID() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.prevGoAwayID
+}
+
 func (t *http2Client) handleWindowUpdate(f *http2.WindowUpdateFrame) {
 	id := f.Header().StreamID
 	incr := f.Increment
+	if t.onWindowUpdate != nil {
+		t.onWindowUpdate(id, incr)
+	}
 	if id == 0 {
 		t.sendQuotaPool.add(int(incr))
 		return
@@ -1100,7 +1801,7 @@ func (t *http2Client) operateHeaders(frame *http2.MetaHeadersFrame) {
 	s.mu.Lock()
 	s.bytesReceived = true
 	s.mu.Unlock()
-	var state decodeState
+	state := decodeState{httpStatusConvTab: t.httpStatusConvTab, strictGRPC: t.strictGRPC, maxHeaderFields: t.maxHeaderFields, decompressHeaders: t.compressHeaders}
 	if err := state.decodeResponseHeader(frame); err != nil {
 		s.mu.Lock()
 		if !s.headerDone {
@@ -1142,6 +1843,10 @@ func (t *http2Client) operateHeaders(frame *http2.MetaHeadersFrame) {
 			if len(state.mdata) > 0 {
 				s.header = state.mdata
 			}
+		} else {
+			// No initial headers were ever received; the server responded
+			// with a single trailers-only HEADERS frame.
+			s.trailersOnly = true
 		}
 		close(s.headerChan)
 		s.headerDone = true
@@ -1168,6 +1873,37 @@ func handleMalformedHTTP2(s *Stream, err error) {
 	s.write(recvMsg{err: err})
 }
 
+// checkStreamID validates the stream ID a frame arrived on and reports
+// whether the frame should be processed. The server must neither initiate
+// streams of its own (even IDs) nor touch client stream IDs that were never
+// opened; either is answered with a PROTOCOL_ERROR GOAWAY and the connection
+// is torn down. Frames for streams that were opened and have since closed
+// are still ignored silently, as RFC 7540 allows them to arrive while the
+// peer's view of the close is in flight.
+func (t *http2Client) checkStreamID(f http2.Frame) bool {
+	id := f.Header().StreamID
+	if id == 0 {
+		return true
+	}
+	t.mu.Lock()
+	nextID := t.nextID
+	t.mu.Unlock()
+	if id%2 == 0 || id >= nextID {
+		errorf("transport: http2Client received a frame on illegal stream id %d, closing the connection", id)
+		t.controlBuf.put(&goAway{code: http2.ErrCodeProtocol, debugData: []byte("illegal stream id"), closeConn: true})
+		return false
+	}
+	return true
+}
+
+// handlePushPromise tears the connection down with a PROTOCOL_ERROR GOAWAY:
+// the client advertises SETTINGS_ENABLE_PUSH=0, so a server sending
+// PUSH_PROMISE anyway is violating the protocol.
+func (t *http2Client) handlePushPromise(f *http2.PushPromiseFrame) {
+	errorf("transport: http2Client received a PUSH_PROMISE for stream %d with push disabled, closing the connection", f.PromiseID)
+	t.controlBuf.put(&goAway{code: http2.ErrCodeProtocol, debugData: []byte("push disabled"), closeConn: true})
+}
+
 // reader runs as a separate goroutine in charge of reading data from network
 // connection.
 //
@@ -1176,11 +1912,20 @@ func handleMalformedHTTP2(s *Stream, err error) {
 // TODO(zhaoq): Check the validity of the incoming frame sequence.
 func (t *http2Client) reader() {
 	// Check the validity of server preface.
+	if t.prefaceTimeout > 0 {
+		t.conn.SetReadDeadline(time.Now().Add(t.prefaceTimeout))
+	}
 	frame, err := t.framer.fr.ReadFrame()
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && t.prefaceTimeout > 0 {
+			errorf("transport: timed out waiting for server preface after %v", t.prefaceTimeout)
+		}
 		t.Close()
 		return
 	}
+	if t.prefaceTimeout > 0 {
+		t.conn.SetReadDeadline(time.Time{})
+	}
 	atomic.CompareAndSwapUint32(&t.activity, 0, 1)
 	sf, ok := frame.(*http2.SettingsFrame)
 	if !ok {
@@ -1189,6 +1934,7 @@ func (t *http2Client) reader() {
 	}
 	t.onSuccess()
 	t.handleSettings(sf, true)
+	close(t.prefaceReceived)
 
 	// loop to keep reading incoming messages on this transport.
 	for {
@@ -1213,6 +1959,9 @@ func (t *http2Client) reader() {
 				return
 			}
 		}
+		if !t.checkStreamID(frame) {
+			continue
+		}
 		switch frame := frame.(type) {
 		case *http2.MetaHeadersFrame:
 			t.operateHeaders(frame)
@@ -1228,6 +1977,8 @@ func (t *http2Client) reader() {
 			t.handleGoAway(frame)
 		case *http2.WindowUpdateFrame:
 			t.handleWindowUpdate(frame)
+		case *http2.PushPromiseFrame:
+			t.handlePushPromise(frame)
 		default:
 			errorf("transport: http2Client.reader got unhandled frame type %v.", frame)
 		}
@@ -1247,6 +1998,9 @@ func (t *http2Client) applySettings(ss []http2.Setting) {
 			ms := t.maxStreams
 			t.maxStreams = int(s.Val)
 			t.streamsQuota.add(int(s.Val) - ms)
+			if t.onMaxStreamsChange != nil {
+				t.onMaxStreamsChange(s.Val)
+			}
 		case http2.SettingInitialWindowSize:
 			t.mu.Lock()
 			for _, stream := range t.activeStreams {
@@ -1255,6 +2009,11 @@ func (t *http2Client) applySettings(ss []http2.Setting) {
 			}
 			t.streamSendQuota = s.Val
 			t.mu.Unlock()
+		case http2.SettingHeaderTableSize:
+			// The encoder lives on the writing goroutine; resize it there.
+			t.controlBuf.put(&headerTableUpdate{v: s.Val})
+		case http2.SettingMaxFrameSize:
+			atomic.StoreUint32(&t.maxSendFrameSize, s.Val)
 		}
 	}
 }
@@ -1315,6 +2074,18 @@ func (t *http2Client) itemHandler(i item) (err error) {
 		return t.framer.fr.WriteSettings(i.ss...)
 	case *settingsAck:
 		return t.framer.fr.WriteSettingsAck()
+	case *headerTableUpdate:
+		// Use up to the peer's announced table size, but no more than our
+		// own configured (or default) bound.
+		max := uint32(http2InitHeaderTableSize)
+		if t.hpackTableSize > 0 {
+			max = t.hpackTableSize
+		}
+		if i.v < max {
+			max = i.v
+		}
+		t.hEnc.SetMaxDynamicTableSize(max)
+		return nil
 	case *resetStream:
 		// If the server needs to be to intimated about stream closing,
 		// then we need to make sure the RST_STREAM frame is written to
@@ -1324,8 +2095,23 @@ func (t *http2Client) itemHandler(i item) (err error) {
 		err := t.framer.fr.WriteRSTStream(i.streamID, i.code)
 		t.streamsQuota.add(1)
 		return err
+	case *goAway:
+		if err := t.framer.fr.WriteGoAway(0, i.code, i.debugData); err != nil {
+			return err
+		}
+		if i.closeConn {
+			// Abort the connection once the GOAWAY has been flushed.
+			t.controlBuf.put(&flushIO{closeTr: true})
+		}
+		return nil
 	case *flushIO:
-		return t.framer.writer.Flush()
+		if err := t.framer.writer.Flush(); err != nil {
+			return err
+		}
+		if i.closeTr {
+			return ErrConnClosing
+		}
+		return nil
 	case *ping:
 		if !i.ack {
 			t.bdpEst.timesnap(i.data)
@@ -1340,11 +2126,15 @@ func (t *http2Client) itemHandler(i item) (err error) {
 // keepalive running in a separate goroutune makes sure the connection is alive by sending pings.
 func (t *http2Client) keepalive() {
 	p := &ping{data: [8]byte{}}
+	// unacked counts the consecutive pings that went unacked within their
+	// timeout; it is reset whenever the connection shows any activity.
+	unacked := 0
 	timer := time.NewTimer(t.kp.Time)
 	for {
 		select {
 		case <-timer.C:
 			if atomic.CompareAndSwapUint32(&t.activity, 1, 0) {
+				unacked = 0
 				timer.Reset(t.kp.Time)
 				continue
 			}
@@ -1372,9 +2162,18 @@ func (t *http2Client) keepalive() {
 			select {
 			case <-timer.C:
 				if atomic.CompareAndSwapUint32(&t.activity, 1, 0) {
+					unacked = 0
+					timer.Reset(t.kp.Time)
+					continue
+				}
+				unacked++
+				if unacked < t.kp.MaxUnackedPings {
+					// The ping went unacked, but the budget allows more
+					// attempts before giving up on the connection.
 					timer.Reset(t.kp.Time)
 					continue
 				}
+				warningf("transport: closing client transport after %d unacked keepalive ping(s)", unacked)
 				t.Close()
 				return
 			case <-t.ctx.Done():
@@ -26,6 +26,7 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -62,21 +63,39 @@ type http2Server struct {
 	framer      *framer
 	hBuf        *bytes.Buffer  // the buffer for HPACK encoding
 	hEnc        *hpack.Encoder // HPACK encoder
+	// hpackTableSize, when non-zero, caps the HPACK dynamic table size on
+	// both the decoder and the encoder; see ServerConfig.HpackTableSize.
+	hpackTableSize uint32
+	// onWindowUpdate, when non-nil, observes received WINDOW_UPDATE frames;
+	// see ServerConfig.OnWindowUpdate.
+	onWindowUpdate func(streamID, increment uint32)
 	// The max number of concurrent streams.
 	maxStreams uint32
 	// controlBuf delivers all the control related tasks (e.g., window
 	// updates, reset streams, and various settings) to the controller.
 	controlBuf *controlBuffer
 	fc         *inFlow
+	// connBuf, when non-nil, bounds the aggregate unread bytes buffered by
+	// all streams of the connection.
+	connBuf *connBufLimiter
 	// sendQuotaPool provides flow control to outbound message.
 	sendQuotaPool *quotaPool
 	// localSendQuota limits the amount of data that can be scheduled
 	// for writing before it is actually written out.
 	localSendQuota *quotaPool
 	stats          stats.Handler
+	// onProtoMismatch, when non-nil, is called with the bytes received in
+	// place of the HTTP/2 client preface. See
+	// ServerConfig.OnProtocolMismatch.
+	onProtoMismatch func(firstBytes []byte)
 	// Flag to keep track of reading activity on transport.
 	// 1 is true and 0 is false.
 	activity uint32 // Accessed atomically.
+	// Lifetime stream counters returned by TransportStats. Accessed
+	// atomically.
+	streamsCreated uint64
+	streamsOK      uint64
+	streamsFailed  uint64
 	// Keepalive and max-age parameters for the server.
 	kp keepalive.ServerParameters
 
@@ -92,6 +111,45 @@ type http2Server struct {
 	resetPingStrikes  uint32 // Accessed atomically.
 	initialWindowSize int32
 	bdpEst            *bdpEstimator
+	// maxRecvMsgBytes, when positive, caps the declared length of incoming
+	// gRPC messages.
+	maxRecvMsgBytes int
+	// maxHeaderFields, when positive, caps the number of non-pseudo header
+	// fields a client may send on one stream.
+	maxHeaderFields int
+	// streamRate, when non-nil, bounds how fast new streams may be opened
+	// on the connection; see ServerConfig.MaxStreamsPerSecond.
+	streamRate *streamRateLimiter
+	// methodFilter, when non-nil, decides which methods are dispatched to a
+	// handler; see ServerConfig.MethodFilter.
+	methodFilter func(method string) bool
+	// authorityValidator, when non-nil, decides which :authority values are
+	// accepted; see ServerConfig.AuthorityValidator.
+	authorityValidator func(authority string) bool
+	// onStreamComplete, when non-nil, receives an access-log record for
+	// every completed stream; see ServerConfig.OnStreamComplete.
+	onStreamComplete func(rec StreamRecord)
+	// maxHandlerDuration, when positive, caps how long a handler may run
+	// when the client supplied no deadline or a longer one.
+	maxHandlerDuration time.Duration
+	// streamIdleTimeout, when positive, resets streams that make no
+	// progress for the duration; see ServerConfig.StreamIdleTimeout.
+	streamIdleTimeout time.Duration
+	// compressHeaders enables the companion-header compression pass on
+	// large metadata values; see ServerConfig.CompressLargeHeaders.
+	compressHeaders bool
+	// reuseStreamBufs recycles stream receive buffers through a pool; see
+	// ServerConfig.ReuseStreamBuffers.
+	reuseStreamBufs bool
+	// maxSendFrameSize is the largest DATA frame payload the peer accepts,
+	// learned from its SETTINGS_MAX_FRAME_SIZE. Accessed atomically.
+	maxSendFrameSize uint32
+	// framing, when non-nil, substitutes the standard gRPC message framing;
+	// see ServerConfig.FramingCodec.
+	framing FramingCodec
+	// readSched, when non-nil, delivers buffered data to stream readers in
+	// priority order; see ServerConfig.PriorityReadScheduling.
+	readSched *readScheduler
 
 	mu sync.Mutex // guard the following
 
@@ -116,6 +174,35 @@ type http2Server struct {
 // newHTTP2Server constructs a ServerTransport based on HTTP2. ConnectionError is
 // returned if something goes wrong.
 func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err error) {
+	if config.MaxFrameSize != 0 && (config.MaxFrameSize < minMaxFrameSize || config.MaxFrameSize > maxMaxFrameSize) {
+		return nil, connectionErrorf(false, nil, "transport: invalid MaxFrameSize %d; must be within [%d, %d]", config.MaxFrameSize, minMaxFrameSize, maxMaxFrameSize)
+	}
+	if len(config.RequiredALPN) > 0 {
+		var proto string
+		if tlsInfo, ok := config.AuthInfo.(credentials.TLSInfo); ok {
+			proto = tlsInfo.State.NegotiatedProtocol
+		}
+		ok := false
+		for _, p := range config.RequiredALPN {
+			if p == proto {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, connectionErrorf(false, nil, "transport: client negotiated ALPN protocol %q, want one of %v", proto, config.RequiredALPN)
+		}
+	}
+	setKernelBufferSizes(conn, config.ReadBufferKernelSize, config.WriteBufferKernelSize)
+	if config.TCPKeepAlive > 0 {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if err := tc.SetKeepAlive(true); err != nil {
+				warningf("transport: failed to enable TCP keepalive: %v", err)
+			} else if err := tc.SetKeepAlivePeriod(config.TCPKeepAlive); err != nil {
+				warningf("transport: failed to set TCP keepalive period to %v: %v", config.TCPKeepAlive, err)
+			}
+		}
+	}
 	writeBufSize := defaultWriteBufSize
 	if config.WriteBufferSize > 0 {
 		writeBufSize = config.WriteBufferSize
@@ -124,7 +211,11 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 	if config.ReadBufferSize > 0 {
 		readBufSize = config.ReadBufferSize
 	}
-	framer := newFramer(conn, writeBufSize, readBufSize)
+	maxContinuationFrames := defaultMaxContinuationFrames
+	if config.MaxContinuationFrames > 0 {
+		maxContinuationFrames = config.MaxContinuationFrames
+	}
+	framer := newFramer(conn, writeBufSize, readBufSize, maxContinuationFrames, config.HpackTableSize, config.MaxFrameSize)
 	// Send initial settings as connection preface to client.
 	var isettings []http2.Setting
 	// TODO(zhaoq): Have a better way to signal "no limit" because 0 is
@@ -138,7 +229,7 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 			Val: maxStreams,
 		})
 	}
-	dynamicWindow := true
+	dynamicWindow := !config.DisableBDPEstimation
 	iwz := int32(initialWindowSize)
 	if config.InitialWindowSize >= defaultWindowSize {
 		iwz = config.InitialWindowSize
@@ -154,6 +245,16 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 			ID:  http2.SettingInitialWindowSize,
 			Val: uint32(iwz)})
 	}
+	if config.HpackTableSize > 0 {
+		isettings = append(isettings, http2.Setting{
+			ID:  http2.SettingHeaderTableSize,
+			Val: config.HpackTableSize})
+	}
+	if config.MaxFrameSize != 0 {
+		isettings = append(isettings, http2.Setting{
+			ID:  http2.SettingMaxFrameSize,
+			Val: config.MaxFrameSize})
+	}
 	if err := framer.fr.WriteSettings(isettings...); err != nil {
 		return nil, connectionErrorf(false, err, "transport: %v", err)
 	}
@@ -170,8 +271,11 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 	if kp.MaxConnectionAge == 0 {
 		kp.MaxConnectionAge = defaultMaxConnectionAge
 	}
+	if kp.MaxConnectionAgeJitter == 0 {
+		kp.MaxConnectionAgeJitter = defaultMaxConnectionAgeJitter
+	}
 	// Add a jitter to MaxConnectionAge.
-	kp.MaxConnectionAge += getJitter(kp.MaxConnectionAge)
+	kp.MaxConnectionAge += getJitter(kp.MaxConnectionAge, kp.MaxConnectionAgeJitter)
 	if kp.MaxConnectionAgeGrace == 0 {
 		kp.MaxConnectionAgeGrace = defaultMaxConnectionAgeGrace
 	}
@@ -188,29 +292,59 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 	var buf bytes.Buffer
 	ctx, cancel := context.WithCancel(context.Background())
 	t := &http2Server{
-		ctx:               ctx,
-		cancel:            cancel,
-		conn:              conn,
-		remoteAddr:        conn.RemoteAddr(),
-		localAddr:         conn.LocalAddr(),
-		authInfo:          config.AuthInfo,
-		framer:            framer,
-		hBuf:              &buf,
-		hEnc:              hpack.NewEncoder(&buf),
-		maxStreams:        maxStreams,
-		inTapHandle:       config.InTapHandle,
-		controlBuf:        newControlBuffer(),
-		fc:                &inFlow{limit: uint32(icwz)},
-		sendQuotaPool:     newQuotaPool(defaultWindowSize),
-		localSendQuota:    newQuotaPool(defaultLocalSendQuota),
-		state:             reachable,
-		activeStreams:     make(map[uint32]*Stream),
-		streamSendQuota:   defaultWindowSize,
-		stats:             config.StatsHandler,
-		kp:                kp,
-		idle:              time.Now(),
-		kep:               kep,
-		initialWindowSize: iwz,
+		ctx:                ctx,
+		cancel:             cancel,
+		conn:               conn,
+		remoteAddr:         conn.RemoteAddr(),
+		localAddr:          conn.LocalAddr(),
+		authInfo:           config.AuthInfo,
+		framer:             framer,
+		hBuf:               &buf,
+		hEnc:               hpack.NewEncoder(&buf),
+		maxStreams:         maxStreams,
+		inTapHandle:        config.InTapHandle,
+		controlBuf:         newControlBuffer(),
+		fc:                 &inFlow{limit: uint32(icwz)},
+		sendQuotaPool:      newQuotaPool(defaultWindowSize),
+		localSendQuota:     newQuotaPool(defaultLocalSendQuota),
+		state:              reachable,
+		activeStreams:      make(map[uint32]*Stream),
+		streamSendQuota:    defaultWindowSize,
+		stats:              config.StatsHandler,
+		kp:                 kp,
+		idle:               time.Now(),
+		kep:                kep,
+		initialWindowSize:  iwz,
+		maxRecvMsgBytes:    config.MaxReceiveMessageBytes,
+		maxHeaderFields:    config.MaxHeaderFields,
+		methodFilter:       config.MethodFilter,
+		authorityValidator: config.AuthorityValidator,
+		onStreamComplete:   config.OnStreamComplete,
+		maxHandlerDuration: config.MaxHandlerDuration,
+		streamIdleTimeout:  config.StreamIdleTimeout,
+		compressHeaders:    config.CompressLargeHeaders,
+		reuseStreamBufs:    config.ReuseStreamBuffers,
+		maxSendFrameSize:   http2MaxFrameLen,
+		framing:            config.FramingCodec,
+		onProtoMismatch:    config.OnProtocolMismatch,
+		hpackTableSize:     config.HpackTableSize,
+		onWindowUpdate:     config.OnWindowUpdate,
+	}
+	if t.hpackTableSize > 0 && t.hpackTableSize < http2InitHeaderTableSize {
+		// The encoder may shrink its table below the peer's current limit
+		// right away; growing beyond it has to wait for the client's
+		// SETTINGS_HEADER_TABLE_SIZE.
+		t.hEnc.SetMaxDynamicTableSize(t.hpackTableSize)
+	}
+	if config.MaxConnReceiveBuffer > 0 {
+		t.connBuf = &connBufLimiter{limit: config.MaxConnReceiveBuffer}
+	}
+	if config.MaxStreamsPerSecond > 0 {
+		t.streamRate = newStreamRateLimiter(config.MaxStreamsPerSecond)
+	}
+	if config.PriorityReadScheduling {
+		t.readSched = newReadScheduler()
+		go t.readSched.run()
 	}
 	if dynamicWindow {
 		t.bdpEst = &bdpEstimator{
@@ -234,12 +368,26 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 		}
 	}()
 
+	if config.PrefaceReadTimeout > 0 {
+		t.conn.SetReadDeadline(time.Now().Add(config.PrefaceReadTimeout))
+		defer t.conn.SetReadDeadline(time.Time{})
+	}
+
 	// Check the validity of client preface.
 	preface := make([]byte, len(clientPreface))
 	if _, err := io.ReadFull(t.conn, preface); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, connectionErrorf(false, err, "transport: http2Server.HandleStreams did not receive the client preface within %v", config.PrefaceReadTimeout)
+		}
 		return nil, connectionErrorf(false, err, "transport: http2Server.HandleStreams failed to receive the preface from client: %v", err)
 	}
 	if !bytes.Equal(preface, clientPreface) {
+		if t.onProtoMismatch != nil {
+			t.onProtoMismatch(preface)
+		}
+		if looksLikeHTTP1(preface) {
+			return nil, connectionErrorf(false, nil, "transport: http2Server.HandleStreams received an HTTP/1.x request line instead of the HTTP/2 client preface: %q; the peer likely does not speak h2c", preface)
+		}
 		return nil, connectionErrorf(false, nil, "transport: http2Server.HandleStreams received bogus greeting from client: %q", preface)
 	}
 
@@ -248,6 +396,9 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 		return nil, err
 	}
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, connectionErrorf(false, err, "transport: http2Server.HandleStreams did not receive the initial settings frame within %v", config.PrefaceReadTimeout)
+		}
 		return nil, connectionErrorf(false, err, "transport: http2Server.HandleStreams failed to read initial settings frame: %v", err)
 	}
 	atomic.StoreUint32(&t.activity, 1)
@@ -269,33 +420,110 @@ func newHTTP2Server(conn net.Conn, config *ServerConfig) (_ ServerTransport, err
 func (t *http2Server) operateHeaders(frame *http2.MetaHeadersFrame, handle func(*Stream), traceCtx func(context.Context, string) context.Context) (close bool) {
 	streamID := frame.Header().StreamID
 
-	var state decodeState
+	state := decodeState{maxHeaderFields: t.maxHeaderFields, decompressHeaders: t.compressHeaders}
 	for _, hf := range frame.Fields {
 		if err := state.processHeaderField(hf); err != nil {
-			if se, ok := err.(StreamError); ok {
+			se, isStreamErr := err.(StreamError)
+			if hf.Name == "content-type" && isStreamErr && se.Code == codes.FailedPrecondition {
+				// Content-type validation failed, so the request is not gRPC
+				// at all (any application/grpc+<subtype> is accepted). Other
+				// errors on this field, such as crossing the header-field
+				// limit, keep the reset path below. Answer through the HTTP
+				// mapping path with 415 so non-gRPC clients get a meaningful
+				// response instead of a stream reset.
+				t.controlBuf.put(&headerFrame{
+					streamID: streamID,
+					hf: []hpack.HeaderField{
+						{Name: ":status", Value: strconv.Itoa(http.StatusUnsupportedMediaType)},
+					},
+					endStream: true,
+				})
+				return
+			}
+			if isStreamErr {
 				t.controlBuf.put(&resetStream{streamID, statusCodeConvTab[se.Code]})
 			}
 			return
 		}
 	}
 
-	buf := newRecvBuffer()
+	if t.authorityValidator != nil && !t.authorityValidator(state.authority) {
+		// The tenant is not served here; answer with a trailers-only
+		// PermissionDenied response before any handler is dispatched.
+		t.controlBuf.put(&headerFrame{
+			streamID: streamID,
+			hf: []hpack.HeaderField{
+				{Name: ":status", Value: "200"},
+				{Name: "content-type", Value: contentType(state.contentSubtype)},
+				{Name: "grpc-status", Value: strconv.Itoa(int(codes.PermissionDenied))},
+				{Name: "grpc-message", Value: encodeGrpcMessage(fmt.Sprintf("authority %q is not served", state.authority))},
+			},
+			endStream: true,
+		})
+		return
+	}
+
+	if t.methodFilter != nil && !t.methodFilter(state.method) {
+		// Answer with a trailers-only Unimplemented response instead of
+		// spinning up a handler goroutine for the stream.
+		t.controlBuf.put(&headerFrame{
+			streamID: streamID,
+			hf: []hpack.HeaderField{
+				{Name: ":status", Value: "200"},
+				{Name: "content-type", Value: contentType(state.contentSubtype)},
+				{Name: "grpc-status", Value: strconv.Itoa(int(codes.Unimplemented))},
+				{Name: "grpc-message", Value: encodeGrpcMessage(fmt.Sprintf("unknown method %v", state.method))},
+			},
+			endStream: true,
+		})
+		return
+	}
+
+	buf, bufGen := getRecvBuffer(t.reuseStreamBufs)
 	s := &Stream{
-		id:             streamID,
-		st:             t,
-		buf:            buf,
-		fc:             &inFlow{limit: uint32(t.initialWindowSize)},
-		recvCompress:   state.encoding,
-		method:         state.method,
-		contentSubtype: state.contentSubtype,
+		id:                streamID,
+		st:                t,
+		buf:               buf,
+		bufGen:            bufGen,
+		fc:                &inFlow{limit: uint32(t.initialWindowSize)},
+		recvCompress:      state.encoding,
+		acceptCompressors: state.acceptEncoding,
+		method:            state.method,
+		contentSubtype:    state.contentSubtype,
+		remoteAddr:        t.remoteAddr,
+		authInfo:          t.authInfo,
+		maxRecvMsgBytes:   t.maxRecvMsgBytes,
+		framing:           t.framing,
+		clientHalfClosed:  make(chan struct{}),
+		hasDeadline:       state.timeoutSet,
+		startTime:         time.Now(),
 	}
 
 	if frame.StreamEnded() {
 		// s is just created by the caller. No lock needed.
 		s.state = streamReadDone
+		s.markClientHalfClosed()
 	}
-	if state.timeoutSet {
-		s.ctx, s.cancel = context.WithTimeout(t.ctx, state.timeout)
+	if v := state.mdata["grpc-priority"]; len(v) > 0 {
+		if p, err := strconv.Atoi(v[0]); err == nil {
+			s.priority = p
+		}
+	}
+	if v := state.mdata["grpc-previous-rpc-attempts"]; len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil && n >= 0 {
+			s.previousAttempts = n
+		}
+	}
+	timeout, timeoutSet := state.timeout, state.timeoutSet
+	capped := false
+	if t.maxHandlerDuration > 0 && (!timeoutSet || timeout > t.maxHandlerDuration) {
+		// The client supplied no deadline, or a farther one than the
+		// server's handler cap; the cap wins.
+		timeout, timeoutSet = t.maxHandlerDuration, true
+		capped = true
+	}
+	if timeoutSet {
+		s.ctx, s.cancel = context.WithTimeout(t.ctx, timeout)
 	} else {
 		s.ctx, s.cancel = context.WithCancel(t.ctx)
 	}
@@ -316,9 +544,11 @@ func (t *http2Server) operateHeaders(frame *http2.MetaHeadersFrame, handle func(
 		s.ctx = metadata.NewIncomingContext(s.ctx, state.mdata)
 	}
 	if state.statsTags != nil {
+		s.statsTags = state.statsTags
 		s.ctx = stats.SetIncomingTags(s.ctx, state.statsTags)
 	}
 	if state.statsTrace != nil {
+		s.statsTrace = state.statsTrace
 		s.ctx = stats.SetIncomingTrace(s.ctx, state.statsTrace)
 	}
 	if t.inTapHandle != nil {
@@ -328,11 +558,15 @@ func (t *http2Server) operateHeaders(frame *http2.MetaHeadersFrame, handle func(
 		}
 		s.ctx, err = t.inTapHandle(s.ctx, info)
 		if err != nil {
-			warningf("transport: http2Server.operateHeaders got an error from InTapHandle: %v", err)
+			debugf("transport: http2Server.operateHeaders got an error from InTapHandle: %v", err)
 			t.controlBuf.put(&resetStream{s.id, http2.ErrCodeRefusedStream})
 			return
 		}
 	}
+	if t.streamRate != nil && !t.streamRate.allow() {
+		t.controlBuf.put(&resetStream{streamID, statusCodeConvTab[codes.ResourceExhausted]})
+		return
+	}
 	t.mu.Lock()
 	if t.state != reachable {
 		t.mu.Unlock()
@@ -352,10 +586,18 @@ func (t *http2Server) operateHeaders(frame *http2.MetaHeadersFrame, handle func(
 	t.maxStreamID = streamID
 	s.sendQuotaPool = newQuotaPool(int(t.streamSendQuota))
 	t.activeStreams[streamID] = s
+	atomic.AddUint64(&t.streamsCreated, 1)
 	if len(t.activeStreams) == 1 {
 		t.idle = time.Time{}
 	}
 	t.mu.Unlock()
+	if capped {
+		s.handlerTimer = time.AfterFunc(timeout, func() { t.closeStreamDeadline(s) })
+	}
+	if t.streamIdleTimeout > 0 {
+		s.idleTimeout = t.streamIdleTimeout
+		s.idleTimer = time.AfterFunc(t.streamIdleTimeout, func() { t.closeStreamIdle(s) })
+	}
 	s.requestRead = func(n int) {
 		t.adjustWindow(s, uint32(n))
 	}
@@ -375,6 +617,7 @@ func (t *http2Server) operateHeaders(frame *http2.MetaHeadersFrame, handle func(
 		reader: &recvBufferReader{
 			ctx:  s.ctx,
 			recv: s.buf,
+			gen:  s.bufGen,
 		},
 		windowHandler: func(n int) {
 			t.updateWindow(s, uint32(n))
@@ -401,11 +644,17 @@ func (t *http2Server) HandleStreams(handle func(*Stream), traceCtx func(context.
 				s := t.activeStreams[se.StreamID]
 				t.mu.Unlock()
 				if s != nil {
-					t.closeStream(s)
+					t.closeStream(s, false)
 				}
 				t.controlBuf.put(&resetStream{se.StreamID, se.Code})
 				continue
 			}
+			if err == errTooManyContinuations {
+				// Misbehaving or malicious peer; tell it to calm down
+				// and close the connection once the GOAWAY is flushed.
+				t.controlBuf.put(&goAway{code: http2.ErrCodeEnhanceYourCalm, debugData: []byte("too_many_continuations"), closeConn: true})
+				return
+			}
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				t.Close()
 				return
@@ -473,15 +722,33 @@ func (t *http2Server) adjustWindow(s *Stream, n uint32) {
 // updateWindow adjusts the inbound quota for the stream and the transport.
 // Window updates will deliver to the controller for sending when
 // the cumulative quota exceeds the corresponding threshold.
+// putConnWindowUpdate queues a connection-level window update of w bytes,
+// first letting connBuf withhold it while the aggregate receive buffer bound
+// is exceeded.
+func (t *http2Server) putConnWindowUpdate(w uint32) {
+	if t.connBuf != nil {
+		w = t.connBuf.onWindowUpdate(w)
+	}
+	if w > 0 {
+		t.controlBuf.put(&windowUpdate{0, w})
+	}
+}
+
 func (t *http2Server) updateWindow(s *Stream, n uint32) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.state == streamDone {
 		return
 	}
+	if t.connBuf != nil {
+		atomic.AddInt64(&s.unreadBuffered, -int64(n))
+		if cw := t.connBuf.onRead(int(n)); cw > 0 {
+			t.controlBuf.put(&windowUpdate{0, cw})
+		}
+	}
 	if w := s.fc.onRead(n); w > 0 {
 		if cw := t.fc.resetPendingUpdate(); cw > 0 {
-			t.controlBuf.put(&windowUpdate{0, cw})
+			t.putConnWindowUpdate(cw)
 		}
 		t.controlBuf.put(&windowUpdate{s.id, w})
 	}
@@ -528,7 +795,7 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 	// connection's window update for the bytes we just received.
 	if sendBDPPing {
 		if size != 0 { // Could be an empty frame.
-			t.controlBuf.put(&windowUpdate{0, uint32(size)})
+			t.putConnWindowUpdate(uint32(size))
 		}
 		t.controlBuf.put(bdpPing)
 	} else {
@@ -538,7 +805,7 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 			return
 		}
 		if w := t.fc.onRead(uint32(size)); w > 0 {
-			t.controlBuf.put(&windowUpdate{0, w})
+			t.putConnWindowUpdate(w)
 		}
 	}
 	// Select the right stream to dispatch.
@@ -546,6 +813,7 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 	if !ok {
 		return
 	}
+	s.touchIdleTimer()
 	if size > 0 {
 		s.mu.Lock()
 		if s.state == streamDone {
@@ -554,7 +822,7 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 		}
 		if err := s.fc.onData(uint32(size)); err != nil {
 			s.mu.Unlock()
-			t.closeStream(s)
+			t.closeStream(s, false)
 			t.controlBuf.put(&resetStream{s.id, http2.ErrCodeFlowControl})
 			return
 		}
@@ -563,14 +831,29 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 				t.controlBuf.put(&windowUpdate{s.id, w})
 			}
 		}
+		if err := s.checkRecvMsgSize(f.Data()); err != nil {
+			s.mu.Unlock()
+			t.closeStream(s, false)
+			t.controlBuf.put(&resetStream{s.id, statusCodeConvTab[codes.ResourceExhausted]})
+			return
+		}
 		s.mu.Unlock()
 		// TODO(bradfitz, zhaoq): A copy is required here because there is no
 		// guarantee f.Data() is consumed before the arrival of next frame.
 		// Can this copy be eliminated?
 		if len(f.Data()) > 0 {
-			data := make([]byte, len(f.Data()))
+			atomic.AddInt64(&s.bytesIn, int64(len(f.Data())))
+			data := getRecvData(len(f.Data()))
 			copy(data, f.Data())
-			s.write(recvMsg{data: data})
+			if t.connBuf != nil {
+				atomic.AddInt64(&s.unreadBuffered, int64(len(data)))
+				t.connBuf.onBuffer(len(data))
+			}
+			if t.readSched != nil {
+				t.readSched.put(s, recvMsg{data: data})
+			} else {
+				s.write(recvMsg{data: data})
+			}
 		}
 	}
 	if f.Header().Flags.Has(http2.FlagDataEndStream) {
@@ -580,7 +863,13 @@ func (t *http2Server) handleData(f *http2.DataFrame) {
 			s.state = streamReadDone
 		}
 		s.mu.Unlock()
-		s.write(recvMsg{err: io.EOF})
+		s.markClientHalfClosed()
+		if t.readSched != nil {
+			// Keep the EOF ordered behind the stream's queued data.
+			t.readSched.put(s, recvMsg{err: io.EOF})
+		} else {
+			s.write(recvMsg{err: io.EOF})
+		}
 	}
 }
 
@@ -589,7 +878,18 @@ func (t *http2Server) handleRSTStream(f *http2.RSTStreamFrame) {
 	if !ok {
 		return
 	}
-	t.closeStream(s)
+	// Record why the client reset the stream, so the handler can tell a
+	// cancellation (CANCEL maps to codes.Canceled) from an internal error.
+	code, ok := http2ErrConvTab[f.ErrCode]
+	if !ok {
+		code = codes.Unknown
+	}
+	s.mu.Lock()
+	if s.status == nil {
+		s.status = status.Newf(code, "transport: stream reset by client with error code %v", f.ErrCode)
+	}
+	s.mu.Unlock()
+	t.closeStream(s, false)
 }
 
 func (t *http2Server) handleSettings(f *http2.SettingsFrame) {
@@ -631,7 +931,13 @@ func (t *http2Server) applySettings(ss []http2.Setting) {
 			t.streamSendQuota = s.Val
 			t.mu.Unlock()
 		}
-
+		if s.ID == http2.SettingHeaderTableSize {
+			// The encoder lives on the writing goroutine; resize it there.
+			t.controlBuf.put(&headerTableUpdate{v: s.Val})
+		}
+		if s.ID == http2.SettingMaxFrameSize {
+			atomic.StoreUint32(&t.maxSendFrameSize, s.Val)
+		}
 	}
 }
 
@@ -693,11 +999,15 @@ func (t *http2Server) handlePing(f *http2.PingFrame) {
 func (t *http2Server) handleWindowUpdate(f *http2.WindowUpdateFrame) {
 	id := f.Header().StreamID
 	incr := f.Increment
+	if t.onWindowUpdate != nil {
+		t.onWindowUpdate(id, incr)
+	}
 	if id == 0 {
 		t.sendQuotaPool.add(int(incr))
 		return
 	}
 	if s, ok := t.getStream(f); ok {
+		s.touchIdleTimer()
 		s.sendQuotaPool.add(int(incr))
 	}
 }
@@ -741,7 +1051,7 @@ func (t *http2Server) WriteHeader(s *Stream, md metadata.MD) error {
 			continue
 		}
 		for _, v := range vv {
-			headerFields = append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+			headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
 		}
 	}
 	t.controlBuf.put(&headerFrame{
@@ -815,7 +1125,7 @@ func (t *http2Server) WriteStatus(s *Stream, st *status.Status) error {
 			continue
 		}
 		for _, v := range vv {
-			headerFields = append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+			headerFields = appendEncodedHeader(headerFields, k, v, t.compressHeaders)
 		}
 	}
 	t.controlBuf.put(&headerFrame{
@@ -826,7 +1136,8 @@ func (t *http2Server) WriteStatus(s *Stream, st *status.Status) error {
 	if t.stats != nil {
 		t.stats.HandleRPC(s.Context(), &stats.OutTrailer{})
 	}
-	t.closeStream(s)
+	t.recordStreamComplete(s, st.Code())
+	t.closeStream(s, st.Code() == codes.OK)
 	return nil
 }
 
@@ -850,13 +1161,29 @@ func (t *http2Server) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 	if writeHeaderFrame {
 		t.WriteHeader(s, nil)
 	}
+	s.touchIdleTimer()
+	if t.framing != nil && hdr == nil && data != nil {
+		// With a custom framing codec the transport frames the payload
+		// itself when the caller did not supply a header.
+		hdr = t.framing.Encode(data)
+	}
+	written := len(hdr) + len(data)
 	// Add data to header frame so that we can equally distribute data across frames.
-	emptyLen := http2MaxFrameLen - len(hdr)
+	maxFrameLen := int(atomic.LoadUint32(&t.maxSendFrameSize))
+	emptyLen := maxFrameLen - len(hdr)
 	if emptyLen > len(data) {
 		emptyLen = len(data)
 	}
 	hdr = append(hdr, data[:emptyLen]...)
 	data = data[emptyLen:]
+	wc := s.waiters
+	if !opts.WriteDeadline.IsZero() {
+		// A per-write soft deadline; when it fires the quota waits below
+		// give up without tearing down the stream.
+		timer := time.NewTimer(opts.WriteDeadline.Sub(time.Now()))
+		defer timer.Stop()
+		wc.writeDeadline = timer.C
+	}
 	var (
 		streamQuota    int
 		streamQuotaVer uint32
@@ -864,13 +1191,13 @@ func (t *http2Server) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 	)
 	for _, r := range [][]byte{hdr, data} {
 		for len(r) > 0 {
-			size := http2MaxFrameLen
+			size := maxFrameLen
 			if size > len(r) {
 				size = len(r)
 			}
 			if streamQuota == 0 { // Used up all the locally cached stream quota.
 				// Get all the stream quota there is.
-				streamQuota, streamQuotaVer, err = s.sendQuotaPool.get(math.MaxInt32, s.waiters)
+				streamQuota, streamQuotaVer, err = s.sendQuotaPool.get(math.MaxInt32, wc)
 				if err != nil {
 					return err
 				}
@@ -879,16 +1206,18 @@ func (t *http2Server) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 				size = streamQuota
 			}
 			// Get size worth quota from transport.
-			tq, _, err := t.sendQuotaPool.get(size, s.waiters)
+			tq, _, err := t.sendQuotaPool.get(size, wc)
 			if err != nil {
+				s.sendQuotaPool.add(streamQuota)
 				return err
 			}
 			if tq < size {
 				size = tq
 			}
-			ltq, _, err := t.localSendQuota.get(size, s.waiters)
+			ltq, _, err := t.localSendQuota.get(size, wc)
 			if err != nil {
-				// Add the acquired quota back to transport.
+				// Add the acquired quota back to stream and transport.
+				s.sendQuotaPool.add(streamQuota)
 				t.sendQuotaPool.add(tq)
 				return err
 			}
@@ -905,6 +1234,11 @@ func (t *http2Server) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 					t.localSendQuota.add(ltq)
 				}})
 				r = r[size:]
+				// The first chunk of this write is committed now; returning
+				// ErrWriteDeadlineExceeded from here on would leave a partial
+				// message on the wire, so stop honoring the deadline and
+				// block until the rest is queued.
+				wc.writeDeadline = nil
 			}
 			failure := func() { // The stream quota version must have changed.
 				// Our streamQuota cache is invalidated now, so give it back.
@@ -922,6 +1256,7 @@ func (t *http2Server) Write(s *Stream, hdr []byte, data []byte, opts *Options) e
 		// ADd the left over quota back to stream.
 		s.sendQuotaPool.add(streamQuota)
 	}
+	atomic.AddInt64(&s.bytesOut, int64(written))
 	return nil
 }
 
@@ -1060,6 +1395,18 @@ func (t *http2Server) itemHandler(i item) error {
 		return t.framer.fr.WriteSettings(i.ss...)
 	case *settingsAck:
 		return t.framer.fr.WriteSettingsAck()
+	case *headerTableUpdate:
+		// Use up to the peer's announced table size, but no more than our
+		// own configured (or default) bound.
+		max := uint32(http2InitHeaderTableSize)
+		if t.hpackTableSize > 0 {
+			max = t.hpackTableSize
+		}
+		if i.v < max {
+			max = i.v
+		}
+		t.hEnc.SetMaxDynamicTableSize(max)
+		return nil
 	case *resetStream:
 		return t.framer.fr.WriteRSTStream(i.streamID, i.code)
 	case *goAway:
@@ -1146,10 +1493,14 @@ func (t *http2Server) Close() error {
 	t.activeStreams = nil
 	t.mu.Unlock()
 	t.cancel()
+	if t.readSched != nil {
+		t.readSched.close()
+	}
 	err := t.conn.Close()
 	// Cancel all active streams.
 	for _, s := range streams {
 		s.cancel()
+		t.recordStreamComplete(s, codes.Unavailable)
 	}
 	if t.stats != nil {
 		connEnd := &stats.ConnEnd{}
@@ -1159,8 +1510,65 @@ func (t *http2Server) Close() error {
 }
 
 // closeStream clears the footprint of a stream when the stream is not needed
-// any more.
-func (t *http2Server) closeStream(s *Stream) {
+// any more. ok indicates whether the stream completed with an OK status; it
+// only matters for the first call on a stream.
+// closeStreamDeadline finishes stream s with DeadlineExceeded after the
+// server-imposed handler cap expired before the handler finished.
+func (t *http2Server) closeStreamDeadline(s *Stream) {
+	s.mu.Lock()
+	if s.state == streamDone {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	t.WriteStatus(s, status.New(codes.DeadlineExceeded, fmt.Sprintf("transport: handler did not finish within the server's cap of %v", t.maxHandlerDuration)))
+}
+
+// closeStreamIdle resets stream s after it made no progress — no reads,
+// writes, or window updates — within the server's idle timeout.
+func (t *http2Server) closeStreamIdle(s *Stream) {
+	s.mu.Lock()
+	if s.state == streamDone {
+		s.mu.Unlock()
+		return
+	}
+	s.status = status.New(codes.DeadlineExceeded, fmt.Sprintf("transport: stream made no progress within the idle timeout of %v", t.streamIdleTimeout))
+	s.mu.Unlock()
+	t.closeStream(s, false)
+	t.controlBuf.put(&resetStream{s.id, http2.ErrCodeCancel})
+}
+
+// recordStreamComplete delivers the access-log record for s exactly once.
+// code is used when the stream carries no status of its own (the status set
+// by a client reset takes precedence).
+func (t *http2Server) recordStreamComplete(s *Stream, code codes.Code) {
+	if t.onStreamComplete == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.recorded {
+		s.mu.Unlock()
+		return
+	}
+	s.recorded = true
+	if s.status != nil {
+		code = s.status.Code()
+	}
+	s.mu.Unlock()
+	rec := StreamRecord{
+		Method:     s.method,
+		StatusCode: code,
+		Duration:   time.Since(s.startTime),
+		BytesIn:    atomic.LoadInt64(&s.bytesIn),
+		BytesOut:   atomic.LoadInt64(&s.bytesOut),
+		PeerAddr:   t.remoteAddr,
+	}
+	// Run the hook in its own goroutine so a slow consumer can't stall the
+	// transport.
+	go t.onStreamComplete(rec)
+}
+
+func (t *http2Server) closeStream(s *Stream, ok bool) {
 	t.mu.Lock()
 	delete(t.activeStreams, s.id)
 	if len(t.activeStreams) == 0 {
@@ -1174,19 +1582,87 @@ func (t *http2Server) closeStream(s *Stream) {
 	// goroutines (e.g., bi-directional streaming), cancel needs to be
 	// called to interrupt the potential blocking on other goroutines.
 	s.cancel()
+	if s.handlerTimer != nil {
+		s.handlerTimer.Stop()
+	}
+	s.mu.Lock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.mu.Unlock()
+	if t.connBuf != nil {
+		// Return the stream's never-read bytes to the aggregate budget.
+		if rem := atomic.SwapInt64(&s.unreadBuffered, 0); rem > 0 {
+			if cw := t.connBuf.onRead(int(rem)); cw > 0 {
+				t.controlBuf.put(&windowUpdate{0, cw})
+			}
+		}
+	}
 	s.mu.Lock()
 	if s.state == streamDone {
 		s.mu.Unlock()
 		return
 	}
 	s.state = streamDone
+	if ok {
+		atomic.AddUint64(&t.streamsOK, 1)
+	} else {
+		atomic.AddUint64(&t.streamsFailed, 1)
+	}
 	s.mu.Unlock()
+	code := codes.Canceled
+	if ok {
+		code = codes.OK
+	}
+	t.recordStreamComplete(s, code)
 }
 
 func (t *http2Server) RemoteAddr() net.Addr {
 	return t.remoteAddr
 }
 
+func (t *http2Server) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+// TransportStats returns a snapshot of the transport's lifetime stream
+// counters.
+func (t *http2Server) TransportStats() TransportStats {
+	t.mu.Lock()
+	active := uint64(len(t.activeStreams))
+	t.mu.Unlock()
+	return TransportStats{
+		StreamsCreated:        atomic.LoadUint64(&t.streamsCreated),
+		StreamsCompletedOK:    atomic.LoadUint64(&t.streamsOK),
+		StreamsCompletedError: atomic.LoadUint64(&t.streamsFailed),
+		StreamsActive:         active,
+	}
+}
+
+// FlowControlSnapshot returns a read-only view of the transport's
+// flow-control accounting; see FlowControlSnapshot.
+func (t *http2Server) FlowControlSnapshot() FlowControlSnapshot {
+	snap := FlowControlSnapshot{ConnSendQuota: t.sendQuotaPool.currentQuota()}
+	snap.ConnRecvLimit, snap.ConnPendingData, snap.ConnPendingUpdate, snap.ConnDelta = t.fc.snapshot()
+	t.mu.Lock()
+	streams := make([]*Stream, 0, len(t.activeStreams))
+	for _, s := range t.activeStreams {
+		streams = append(streams, s)
+	}
+	t.mu.Unlock()
+	for _, s := range streams {
+		ss := StreamFlowSnapshot{StreamID: s.id, SendQuota: s.sendQuotaPool.currentQuota()}
+		ss.RecvLimit, ss.PendingData, ss.PendingUpdate, ss.Delta = s.fc.snapshot()
+		snap.Streams = append(snap.Streams, ss)
+	}
+	return snap
+}
+
+// Context returns a context that is canceled when the transport closes.
+func (t *http2Server) Context() context.Context {
+	return t.ctx
+}
+
 func (t *http2Server) Drain() {
 	t.drain(http2.ErrCodeNo, []byte{})
 }
@@ -1203,12 +1679,15 @@ func (t *http2Server) drain(code http2.ErrCode, debugData []byte) {
 
 var rgen = rand.New(rand.NewSource(time.Now().UnixNano()))
 
-func getJitter(v time.Duration) time.Duration {
-	if v == infinity {
+func getJitter(v time.Duration, fraction float64) time.Duration {
+	if v == infinity || fraction <= 0 {
+		return 0
+	}
+	// Generate a jitter between +/- fraction of the value.
+	r := int64(float64(v) * fraction)
+	if r <= 0 {
 		return 0
 	}
-	// Generate a jitter between +/- 10% of the value.
-	r := int64(v / 10)
 	j := rgen.Int63n(2*r) - r
 	return time.Duration(j)
 }
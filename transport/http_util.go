@@ -21,9 +21,12 @@ package transport
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
@@ -41,11 +44,20 @@ import (
 const (
 	// http2MaxFrameLen specifies the max length of a HTTP2 frame.
 	http2MaxFrameLen = 16384 // 16KB frame
+	// minMaxFrameSize and maxMaxFrameSize delimit the legal values of
+	// SETTINGS_MAX_FRAME_SIZE (RFC 7540 section 6.5.2).
+	minMaxFrameSize = 16384
+	maxMaxFrameSize = 16777215
 	// http://http2.github.io/http2-spec/#SettingValues
 	http2InitHeaderTableSize = 4096
 	// http2IOBufSize specifies the buffer size for sending frames.
 	defaultWriteBufSize = 32 * 1024
 	defaultReadBufSize  = 32 * 1024
+	// defaultMaxContinuationFrames is the number of CONTINUATION frames one
+	// header block may span before the server treats the peer as flooding
+	// and closes the connection. Well-behaved peers pack header blocks into
+	// as few frames as possible, so a generous handful is plenty.
+	defaultMaxContinuationFrames = 32
 	// baseContentType is the base content-type for gRPC.  This is a valid
 	// content-type on it's own, but can also include a content-subtype such as
 	// "proto" as a suffix after "+" or ";".  See
@@ -88,6 +100,8 @@ var (
 		http.StatusForbidden: codes.PermissionDenied,
 		// 404 Not Found - UNIMPLEMENTED.
 		http.StatusNotFound: codes.Unimplemented,
+		// 415 Unsupported Media Type - INTERNAL.
+		http.StatusUnsupportedMediaType: codes.Internal,
 		// 429 Too Many Requests - UNAVAILABLE.
 		http.StatusTooManyRequests: codes.Unavailable,
 		// 502 Bad Gateway - UNAVAILABLE.
@@ -112,15 +126,38 @@ type decodeState struct {
 	rawStatusCode *int
 	rawStatusMsg  string
 	httpStatus    *int
+	// httpStatusConvTab, when non-nil, overrides entries of the default
+	// httpStatusConvTab when mapping an HTTP status to a gRPC code.
+	// Client side only.
+	httpStatusConvTab map[int]codes.Code
+	// strictGRPC, when set, makes any response lacking a valid gRPC
+	// content-type a hard codes.Internal error instead of attempting the
+	// HTTP-status fallback mapping. Client side only.
+	strictGRPC bool
+	// sawGRPCContentType records that a valid gRPC content-type header was
+	// processed. Client side only.
+	sawGRPCContentType bool
 	// Server side only fields.
 	timeoutSet bool
 	timeout    time.Duration
 	method     string
+	// authority is the :authority pseudo-header value the client sent.
+	authority string
+	// acceptEncoding is the list of compressor names the peer advertised via
+	// grpc-accept-encoding.
+	acceptEncoding []string
 	// key-value metadata map from the peer.
 	mdata          map[string][]string
 	statsTags      []byte
 	statsTrace     []byte
 	contentSubtype string
+	// maxHeaderFields, when positive, caps how many non-pseudo header
+	// fields the peer may send on one stream; headerFields counts them.
+	maxHeaderFields int
+	headerFields    int
+	// decompressHeaders, when set, transparently expands companion headers
+	// carrying the gzipHdrSuffix back into their original key and value.
+	decompressHeaders bool
 }
 
 // isReservedHeader checks whether hdr belongs to HTTP2 headers
@@ -134,6 +171,7 @@ func isReservedHeader(hdr string) bool {
 	case "content-type",
 		"grpc-message-type",
 		"grpc-encoding",
+		"grpc-accept-encoding",
 		"grpc-message",
 		"grpc-status",
 		"grpc-timeout",
@@ -225,14 +263,71 @@ func encodeMetadataHeader(k, v string) string {
 	return v
 }
 
+// gzipHdrSuffix marks a companion header carrying a gzip-compressed copy of
+// a large metadata value; the original key is the name with the suffix
+// stripped. Experimental and opt-in on both peers; see
+// ConnectOptions.CompressLargeHeaders and ServerConfig.CompressLargeHeaders.
+const gzipHdrSuffix = "-gzip-bin"
+
+// headerCompressionThreshold is the smallest metadata value, in bytes, worth
+// the extra compression pass; hpack handles smaller values well enough on
+// its own.
+const headerCompressionThreshold = 1024
+
+// appendEncodedHeader appends the header (k, v) to headerFields in wire
+// form. With compress set, a large compressible value is sent as its gzipped
+// companion header instead.
+func appendEncodedHeader(headerFields []hpack.HeaderField, k, v string, compress bool) []hpack.HeaderField {
+	if compress && !strings.HasSuffix(k, binHdrSuffix) && len(v) >= headerCompressionThreshold {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(v))
+		gz.Close()
+		if buf.Len() < len(v) {
+			return append(headerFields, hpack.HeaderField{Name: k + gzipHdrSuffix, Value: encodeBinHeader(buf.Bytes())})
+		}
+	}
+	return append(headerFields, hpack.HeaderField{Name: k, Value: encodeMetadataHeader(k, v)})
+}
+
+// decompressHeaderValue reverses the companion-header encoding: k is a key
+// carrying the gzipHdrSuffix and v its decoded binary value. It returns the
+// original key and value.
+func decompressHeaderValue(k, v string) (string, string, error) {
+	gz, err := gzip.NewReader(strings.NewReader(v))
+	if err != nil {
+		return "", "", err
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSuffix(k, gzipHdrSuffix), string(b), nil
+}
+
 func decodeMetadataHeader(k, v string) (string, error) {
 	if strings.HasSuffix(k, binHdrSuffix) {
 		b, err := decodeBinHeader(v)
 		return string(b), err
 	}
+	if !isASCII(v) {
+		return "", fmt.Errorf("header %q contains non-ASCII value", k)
+	}
 	return v, nil
 }
 
+// isASCII reports whether s consists entirely of ASCII characters. Values of
+// metadata keys without the "-bin" suffix must be ASCII per the gRPC wire
+// protocol; only "-bin" keys may carry arbitrary bytes (base64-encoded).
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *decodeState) decodeResponseHeader(frame *http2.MetaHeadersFrame) error {
 	for _, hf := range frame.Fields {
 		if err := d.processHeaderField(hf); err != nil {
@@ -245,6 +340,13 @@ func (d *decodeState) decodeResponseHeader(frame *http2.MetaHeadersFrame) error
 		return nil
 	}
 
+	// In strict mode a response without a gRPC status must at least carry a
+	// gRPC content-type; anything else is a hard error rather than a
+	// candidate for the HTTP-status mapping below.
+	if d.strictGRPC && !d.sawGRPCContentType {
+		return streamErrorf(codes.Internal, "transport: received a response without a gRPC content-type in strict gRPC mode")
+	}
+
 	// If grpc status doesn't exist and http status doesn't exist,
 	// then it's a malformed header.
 	if d.httpStatus == nil {
@@ -252,7 +354,12 @@ func (d *decodeState) decodeResponseHeader(frame *http2.MetaHeadersFrame) error
 	}
 
 	if *(d.httpStatus) != http.StatusOK {
-		code, ok := httpStatusConvTab[*(d.httpStatus)]
+		code, ok := d.httpStatusConvTab[*(d.httpStatus)]
+		if !ok {
+			// Fall back to the default table for statuses the override
+			// doesn't cover.
+			code, ok = httpStatusConvTab[*(d.httpStatus)]
+		}
 		if !ok {
 			code = codes.Unknown
 		}
@@ -279,12 +386,24 @@ func (d *decodeState) addMetadata(k, v string) {
 }
 
 func (d *decodeState) processHeaderField(f hpack.HeaderField) error {
+	if f.Name == "" || f.Name[0] != ':' {
+		// Pseudo-headers are excluded from the count; their number is
+		// already fixed by the protocol.
+		d.headerFields++
+		if d.maxHeaderFields > 0 && d.headerFields > d.maxHeaderFields {
+			return streamErrorf(codes.ResourceExhausted, "transport: peer sent more than %d header fields", d.maxHeaderFields)
+		}
+	}
 	switch f.Name {
 	case "content-type":
 		contentSubtype, validContentType := contentSubtype(f.Value)
 		if !validContentType {
+			if d.strictGRPC {
+				return streamErrorf(codes.Internal, "transport: received the non-gRPC content-type %q in strict gRPC mode", f.Value)
+			}
 			return streamErrorf(codes.FailedPrecondition, "transport: received the unexpected content-type %q", f.Value)
 		}
+		d.sawGRPCContentType = true
 		d.contentSubtype = contentSubtype
 		// TODO: do we want to propagate the whole content-type in the metadata,
 		// or come up with a way to just propagate the content-subtype if it was set?
@@ -293,6 +412,12 @@ func (d *decodeState) processHeaderField(f hpack.HeaderField) error {
 		d.addMetadata(f.Name, f.Value)
 	case "grpc-encoding":
 		d.encoding = f.Value
+	case "grpc-accept-encoding":
+		for _, e := range strings.Split(f.Value, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				d.acceptEncoding = append(d.acceptEncoding, e)
+			}
+		}
 	case "grpc-status":
 		code, err := strconv.Atoi(f.Value)
 		if err != nil {
@@ -319,6 +444,9 @@ func (d *decodeState) processHeaderField(f hpack.HeaderField) error {
 		}
 	case ":path":
 		d.method = f.Value
+	case ":authority":
+		d.authority = f.Value
+		d.addMetadata(f.Name, f.Value)
 	case ":status":
 		code, err := strconv.Atoi(f.Value)
 		if err != nil {
@@ -345,8 +473,15 @@ func (d *decodeState) processHeaderField(f hpack.HeaderField) error {
 		}
 		v, err := decodeMetadataHeader(f.Name, f.Value)
 		if err != nil {
-			errorf("Failed to decode metadata header (%q, %q): %v", f.Name, f.Value, err)
-			return nil
+			return streamErrorf(codes.Internal, "transport: malformed %s: %v", f.Name, err)
+		}
+		if d.decompressHeaders && strings.HasSuffix(f.Name, gzipHdrSuffix) {
+			k, dv, err := decompressHeaderValue(f.Name, v)
+			if err != nil {
+				return streamErrorf(codes.Internal, "transport: malformed %s: %v", f.Name, err)
+			}
+			d.addMetadata(k, dv)
+			break
 		}
 		d.addMetadata(f.Name, string(v))
 	}
@@ -509,6 +644,94 @@ func decodeGrpcMessageUnchecked(msg string) string {
 	return buf.String()
 }
 
+// setKernelBufferSizes sets SO_RCVBUF and SO_SNDBUF on conn when the
+// respective size is positive. Connections that do not expose kernel buffer
+// sizing (e.g. in-memory pipes) are left untouched, and failures are logged
+// rather than surfaced since the transport works either way.
+func setKernelBufferSizes(conn net.Conn, readSize, writeSize int) {
+	type socketBufferConn interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	}
+	sc, ok := conn.(socketBufferConn)
+	if !ok {
+		return
+	}
+	if readSize > 0 {
+		if err := sc.SetReadBuffer(readSize); err != nil {
+			warningf("transport: failed to set SO_RCVBUF to %d: %v", readSize, err)
+		}
+	}
+	if writeSize > 0 {
+		if err := sc.SetWriteBuffer(writeSize); err != nil {
+			warningf("transport: failed to set SO_SNDBUF to %d: %v", writeSize, err)
+		}
+	}
+}
+
+// looksLikeHTTP1 reports whether the received greeting resembles the start of
+// an HTTP/1.x request, i.e. a known method name followed by a space, which
+// indicates a peer (or an intermediary) that does not speak h2c.
+func looksLikeHTTP1(greeting []byte) bool {
+	for _, m := range []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH "} {
+		if bytes.HasPrefix(greeting, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// errTooManyContinuations is surfaced by continuationLimitReader when a peer
+// splits one header block across more CONTINUATION frames than allowed.
+var errTooManyContinuations = errors.New("transport: peer sent too many CONTINUATION frames for one header block")
+
+// continuationLimitReader sits between the connection and the framer,
+// tracking HTTP/2 frame boundaries and counting the CONTINUATION frames that
+// make up a single header block. Reads fail with errTooManyContinuations once
+// a block exceeds max frames, so a flood of tiny CONTINUATION frames is
+// rejected before the hpack decode runs.
+type continuationLimitReader struct {
+	r   io.Reader
+	max int
+
+	hdr     [9]byte
+	hdrRead int // bytes of the current frame header read so far
+	payload int // payload bytes of the current frame not yet read
+	run     int // CONTINUATION frames seen in the current header block
+}
+
+func (c *continuationLimitReader) Read(p []byte) (int, error) {
+	// Pass the remainder of the current frame's payload through untouched.
+	if c.payload > 0 {
+		if len(p) > c.payload {
+			p = p[:c.payload]
+		}
+		n, err := c.r.Read(p)
+		c.payload -= n
+		return n, err
+	}
+	// Accumulate the 9-byte frame header.
+	if len(p) > len(c.hdr)-c.hdrRead {
+		p = p[:len(c.hdr)-c.hdrRead]
+	}
+	n, err := c.r.Read(p)
+	copy(c.hdr[c.hdrRead:], p[:n])
+	c.hdrRead += n
+	if c.hdrRead == len(c.hdr) {
+		c.hdrRead = 0
+		c.payload = int(c.hdr[0])<<16 | int(c.hdr[1])<<8 | int(c.hdr[2])
+		if http2.FrameType(c.hdr[3]) == http2.FrameContinuation {
+			c.run++
+			if c.run > c.max {
+				return n, errTooManyContinuations
+			}
+		} else {
+			c.run = 0
+		}
+	}
+	return n, err
+}
+
 type framer struct {
 	numWriters int32
 	reader     io.Reader
@@ -516,15 +739,32 @@ type framer struct {
 	fr         *http2.Framer
 }
 
-func newFramer(conn net.Conn, writeBufferSize, readBufferSize int) *framer {
+// newFramer creates a framer reading from and writing to conn. A positive
+// maxContinuationFrames bounds the number of CONTINUATION frames accepted per
+// header block; zero disables the bound. A positive headerTableSize sets the
+// maximum dynamic table size of the HPACK decoder; zero keeps the HTTP/2
+// default.
+func newFramer(conn net.Conn, writeBufferSize, readBufferSize, maxContinuationFrames int, headerTableSize, maxFrameSize uint32) *framer {
+	var r io.Reader = conn
+	if maxContinuationFrames > 0 {
+		r = &continuationLimitReader{r: conn, max: maxContinuationFrames}
+	}
+	if headerTableSize == 0 {
+		headerTableSize = http2InitHeaderTableSize
+	}
 	f := &framer{
-		reader: bufio.NewReaderSize(conn, readBufferSize),
+		reader: bufio.NewReaderSize(r, readBufferSize),
 		writer: bufio.NewWriterSize(conn, writeBufferSize),
 	}
 	f.fr = http2.NewFramer(f.writer, f.reader)
 	// Opt-in to Frame reuse API on framer to reduce garbage.
 	// Frames aren't safe to read from after a subsequent call to ReadFrame.
 	f.fr.SetReuseFrames()
-	f.fr.ReadMetaHeaders = hpack.NewDecoder(http2InitHeaderTableSize, nil)
+	if maxFrameSize > http2MaxFrameLen {
+		// The peer may send frames as large as what we advertise in
+		// SETTINGS_MAX_FRAME_SIZE; raise the reader's bound accordingly.
+		f.fr.SetMaxReadFrameSize(maxFrameSize)
+	}
+	f.fr.ReadMetaHeaders = hpack.NewDecoder(headerTableSize, nil)
 	return f
 }
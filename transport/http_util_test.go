@@ -174,3 +174,21 @@ func TestDecodeMetadataHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeMetadataHeaderInvalid(t *testing.T) {
+	for _, test := range []struct {
+		kin string
+		vin string
+	}{
+		// Malformed base64 in a binary header.
+		{"key-bin", "woA*"},
+		{"key-bin", "Zm9vAGJhcg=*"},
+		// Non-ASCII value in a non-binary header.
+		{"key", "abc\x80def"},
+		{"key", "系统"},
+	} {
+		if v, err := decodeMetadataHeader(test.kin, test.vin); err == nil {
+			t.Fatalf("decodeMetadataHeader(%q, %q) = %q, nil, want _, non-nil error", test.kin, test.vin, v)
+		}
+	}
+}
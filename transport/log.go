@@ -25,6 +25,16 @@ import "github.com/publica-project/grpc/grpclog"
 
 const logLevel = 2
 
+// debugLevel gates the most frequent per-stream and per-frame messages, which
+// are only useful when debugging the transport itself.
+const debugLevel = 3
+
+func debugf(format string, args ...interface{}) {
+	if grpclog.V(debugLevel) {
+		grpclog.Infof(format, args...)
+	}
+}
+
 func infof(format string, args ...interface{}) {
 	if grpclog.V(logLevel) {
 		grpclog.Infof(format, args...)
@@ -0,0 +1,146 @@
+/*
+ *
+ * Copyright 2017 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package transport
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// TransportRegistry shares client transports between callers dialing an
+// identical target, so layers that inadvertently create several transports
+// to the same address end up on one connection. Transports are
+// reference-counted: a transport obtained through GetOrDial stays open until
+// every holder has called its release function. A registry must be
+// constructed explicitly with NewTransportRegistry; there is no global one.
+type TransportRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*registryEntry
+}
+
+// registryEntry pairs a cached transport with the number of holders that
+// have not released it yet.
+type registryEntry struct {
+	tr   ClientTransport
+	refs int
+}
+
+// NewTransportRegistry creates an empty TransportRegistry.
+func NewTransportRegistry() *TransportRegistry {
+	return &TransportRegistry{entries: make(map[string]*registryEntry)}
+}
+
+// registryKey fingerprints the parts of the target and options that must
+// match for two callers to safely share one connection: the address and
+// authority, the identity of the transport credentials, and the user agent.
+func registryKey(target TargetInfo, opts ConnectOptions) string {
+	creds := ""
+	if opts.TransportCredentials != nil {
+		info := opts.TransportCredentials.Info()
+		creds = info.SecurityProtocol + "/" + info.SecurityVersion + "/" + info.ServerName
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", target.Addr, target.Authority, creds, opts.UserAgent)
+}
+
+// GetOrDial returns a reachable cached transport for the given target and
+// options, dialing a new one through NewClientTransport otherwise. The
+// returned release function gives up the caller's reference; the transport
+// is closed when the last reference is released. Transports that error are
+// evicted from the registry, so a later GetOrDial dials afresh.
+func (r *TransportRegistry) GetOrDial(connectCtx, ctx context.Context, target TargetInfo, opts ConnectOptions, onSuccess func()) (ClientTransport, func(), error) {
+	key := registryKey(target, opts)
+	r.mu.Lock()
+	if e, ok := r.entries[key]; ok {
+		if healthy(e.tr) {
+			e.refs++
+			r.mu.Unlock()
+			return e.tr, r.releaseFunc(key, e.tr), nil
+		}
+		// The cached transport died without being evicted yet.
+		delete(r.entries, key)
+	}
+	r.mu.Unlock()
+	tr, err := NewClientTransport(connectCtx, ctx, target, opts, onSuccess)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	if e, ok := r.entries[key]; ok && healthy(e.tr) {
+		// A concurrent caller won the dial race; keep its transport.
+		e.refs++
+		r.mu.Unlock()
+		tr.Close()
+		return e.tr, r.releaseFunc(key, e.tr), nil
+	}
+	r.entries[key] = &registryEntry{tr: tr, refs: 1}
+	r.mu.Unlock()
+	go r.watch(key, tr)
+	return tr, r.releaseFunc(key, tr), nil
+}
+
+// releaseFunc returns the function handed to one holder of tr. It is safe
+// to call more than once; only the first call gives up the reference.
+func (r *TransportRegistry) releaseFunc(key string, tr ClientTransport) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			e, ok := r.entries[key]
+			if !ok || e.tr != tr {
+				// Already evicted; the holder still owns a share of the
+				// transport, but nobody can acquire new references, so the
+				// last known holder closes it.
+				r.mu.Unlock()
+				tr.Close()
+				return
+			}
+			e.refs--
+			if e.refs > 0 {
+				r.mu.Unlock()
+				return
+			}
+			delete(r.entries, key)
+			r.mu.Unlock()
+			tr.Close()
+		})
+	}
+}
+
+// watch evicts tr from the registry once it errors, so new callers dial a
+// fresh transport instead of piling onto a dead one.
+func (r *TransportRegistry) watch(key string, tr ClientTransport) {
+	<-tr.Error()
+	r.mu.Lock()
+	if e, ok := r.entries[key]; ok && e.tr == tr {
+		delete(r.entries, key)
+	}
+	r.mu.Unlock()
+}
+
+// healthy reports whether tr can still accept new streams.
+func healthy(tr ClientTransport) bool {
+	select {
+	case <-tr.Error():
+		return false
+	default:
+		return true
+	}
+}
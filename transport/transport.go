@@ -22,10 +22,19 @@
 package transport // import "github.com/publica-project/grpc/transport"
 
 import (
+	"container/heap"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
 
 	"github.com/publica-project/grpc/codes"
 	"github.com/publica-project/grpc/credentials"
@@ -54,8 +63,15 @@ type recvMsg struct {
 // recvBuffer is written to much more often than
 // controlBuffer and using strict recvMsg structs helps avoid allocation in "recvBuffer.put"
 type recvBuffer struct {
-	c       chan recvMsg
-	mu      sync.Mutex
+	c  chan recvMsg
+	mu sync.Mutex
+	// gen identifies the current checkout of the buffer; it is bumped when
+	// the buffer is recycled so that late puts tagged with a retired
+	// generation are dropped instead of leaking into the next stream.
+	gen uint32
+	// pooled records that the buffer was handed out for reuse and should
+	// return to recvBufferPool once its reader detaches.
+	pooled  bool
 	backlog []recvMsg
 }
 
@@ -66,8 +82,14 @@ func newRecvBuffer() *recvBuffer {
 	return b
 }
 
-func (b *recvBuffer) put(r recvMsg) {
+func (b *recvBuffer) put(gen uint32, r recvMsg) {
 	b.mu.Lock()
+	if b.gen != gen {
+		// The generation this message was meant for has been recycled; it
+		// can only be a late post for a dead stream.
+		b.mu.Unlock()
+		return
+	}
 	if len(b.backlog) == 0 {
 		select {
 		case b.c <- r:
@@ -101,16 +123,96 @@ func (b *recvBuffer) get() <-chan recvMsg {
 	return b.c
 }
 
+// recvDataPool recycles the buffers that carry message data from the
+// transport's reader goroutine to the application. Buffers flow back into
+// the pool through ReleaseBuffer; buffers that are never released are simply
+// collected by the GC.
+var recvDataPool sync.Pool
+
+// getRecvData returns a buffer of the given length, reusing one from
+// recvDataPool when a large enough buffer is available.
+func getRecvData(size int) []byte {
+	if b, ok := recvDataPool.Get().([]byte); ok && cap(b) >= size {
+		return b[:size]
+	}
+	return make([]byte, size)
+}
+
+// ReleaseBuffer returns a buffer obtained from Stream.ReadBuffer to the
+// transport's buffer pool so it can be reused for a subsequent message. The
+// caller must not touch the buffer after releasing it.
+func ReleaseBuffer(p []byte) {
+	if cap(p) == 0 {
+		return
+	}
+	recvDataPool.Put(p[:cap(p)])
+}
+
+// recvBufferPool recycles recvBuffer shells between streams when stream
+// buffer reuse is enabled; see ConnectOptions.ReuseStreamBuffers and
+// ServerConfig.ReuseStreamBuffers.
+var recvBufferPool = sync.Pool{New: func() interface{} { return newRecvBuffer() }}
+
+// getRecvBuffer returns the receive buffer for a new stream together with
+// the generation the stream must tag its puts with, recycling a pooled
+// buffer when reuse is set.
+func getRecvBuffer(reuse bool) (*recvBuffer, uint32) {
+	if !reuse {
+		return newRecvBuffer(), 0
+	}
+	b := recvBufferPool.Get().(*recvBuffer)
+	b.mu.Lock()
+	b.pooled = true
+	gen := b.gen
+	b.mu.Unlock()
+	return b, gen
+}
+
+// recycle retires the checkout of b handed out with gen and returns the
+// buffer to the pool. It must only be called by the buffer's reader, once
+// that reader is permanently detached: puts tagged with a retired generation
+// are dropped, so a late write for the dead stream can never surface on a
+// stream the buffer is recycled to, and with the only reader gone dropping
+// whatever is still queued cannot starve anyone.
+func (b *recvBuffer) recycle(gen uint32) {
+	b.mu.Lock()
+	if !b.pooled || b.gen != gen {
+		b.mu.Unlock()
+		return
+	}
+	b.gen++
+	select {
+	case <-b.c:
+	default:
+	}
+	for i := range b.backlog {
+		b.backlog[i] = recvMsg{}
+	}
+	b.backlog = b.backlog[:0]
+	b.mu.Unlock()
+	recvBufferPool.Put(b)
+}
+
 // recvBufferReader implements io.Reader interface to read the data from
 // recvBuffer.
 type recvBufferReader struct {
 	ctx    context.Context
 	goAway chan struct{}
 	recv   *recvBuffer
+	gen    uint32 // the recv checkout this reader belongs to
 	last   []byte // Stores the remaining data in the previous calls.
 	err    error
 }
 
+// fail records err as the reader's sticky error and retires its checkout of
+// recv: once the error sticks the reader never touches the buffer again, so
+// it is safe to hand back for recycling.
+func (r *recvBufferReader) fail(err error) error {
+	r.err = err
+	r.recv.recycle(r.gen)
+	return err
+}
+
 // Read reads the next len(p) bytes from last. If last is drained, it tries to
 // read additional data from recv. It blocks if there no additional data available
 // in recv. If Read returns any non-nil error, it will continue to return that error.
@@ -118,8 +220,11 @@ func (r *recvBufferReader) Read(p []byte) (n int, err error) {
 	if r.err != nil {
 		return 0, r.err
 	}
-	n, r.err = r.read(p)
-	return n, r.err
+	n, err = r.read(p)
+	if err != nil {
+		return n, r.fail(err)
+	}
+	return n, nil
 }
 
 func (r *recvBufferReader) read(p []byte) (n int, err error) {
@@ -145,6 +250,32 @@ func (r *recvBufferReader) read(p []byte) (n int, err error) {
 	}
 }
 
+// readBuffer returns the unread remainder of the current message, or blocks
+// for the next message and hands its buffer over without copying. The caller
+// takes ownership of the returned bytes.
+func (r *recvBufferReader) readBuffer() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.last) > 0 {
+		b := r.last
+		r.last = nil
+		return b, nil
+	}
+	select {
+	case <-r.ctx.Done():
+		return nil, r.fail(ContextErr(r.ctx.Err()))
+	case <-r.goAway:
+		return nil, r.fail(errStreamDrain)
+	case m := <-r.recv.get():
+		r.recv.load()
+		if m.err != nil {
+			return nil, r.fail(m.err)
+		}
+		return m.data, nil
+	}
+}
+
 // All items in an out of a controlBuffer should be the same type.
 type item interface {
 	item()
@@ -199,6 +330,92 @@ func (b *controlBuffer) get() <-chan item {
 	return b.c
 }
 
+// readItem is one recvMsg pending delivery to a stream's receive buffer,
+// ordered by the stream's priority and then by arrival.
+type readItem struct {
+	s    *Stream
+	m    recvMsg
+	prio int
+	seq  uint64
+}
+
+type readItemHeap []*readItem
+
+func (h readItemHeap) Len() int { return len(h) }
+func (h readItemHeap) Less(i, j int) bool {
+	if h[i].prio != h[j].prio {
+		return h[i].prio > h[j].prio
+	}
+	return h[i].seq < h[j].seq
+}
+func (h readItemHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *readItemHeap) Push(x interface{}) { *h = append(*h, x.(*readItem)) }
+func (h *readItemHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return it
+}
+
+// readScheduler surfaces buffered data to server streams in priority order
+// when ServerConfig.PriorityReadScheduling is enabled. Items for the same
+// stream keep their arrival order; across streams, data of the stream with
+// the higher priority is delivered to its reader first.
+type readScheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	q      readItemHeap
+	seq    uint64
+	closed bool
+}
+
+func newReadScheduler() *readScheduler {
+	rs := &readScheduler{}
+	rs.cond = sync.NewCond(&rs.mu)
+	return rs
+}
+
+func (rs *readScheduler) put(s *Stream, m recvMsg) {
+	rs.mu.Lock()
+	heap.Push(&rs.q, &readItem{s: s, m: m, prio: s.priority, seq: rs.seq})
+	rs.seq++
+	rs.mu.Unlock()
+	rs.cond.Signal()
+}
+
+// get blocks until an item is available or the scheduler is closed.
+func (rs *readScheduler) get() (*readItem, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for len(rs.q) == 0 && !rs.closed {
+		rs.cond.Wait()
+	}
+	if len(rs.q) == 0 {
+		return nil, false
+	}
+	return heap.Pop(&rs.q).(*readItem), true
+}
+
+func (rs *readScheduler) close() {
+	rs.mu.Lock()
+	rs.closed = true
+	rs.mu.Unlock()
+	rs.cond.Broadcast()
+}
+
+// run delivers items until the scheduler is closed.
+func (rs *readScheduler) run() {
+	for {
+		it, ok := rs.get()
+		if !ok {
+			return
+		}
+		it.s.write(it.m)
+	}
+}
+
 type streamState uint8
 
 const (
@@ -210,20 +427,33 @@ const (
 
 // Stream represents an RPC in the transport layer.
 type Stream struct {
-	id           uint32
-	st           ServerTransport    // nil for client side Stream
-	ctx          context.Context    // the associated context of the stream
-	cancel       context.CancelFunc // always nil for client side Stream
-	done         chan struct{}      // closed when the final status arrives
-	goAway       chan struct{}      // closed when a GOAWAY control message is received
-	method       string             // the associated RPC method of the stream
+	id     uint32
+	st     ServerTransport    // nil for client side Stream
+	ctx    context.Context    // the associated context of the stream
+	cancel context.CancelFunc // always nil for client side Stream
+	done   chan struct{}      // closed when the final status arrives
+	goAway chan struct{}      // closed when a GOAWAY control message is received
+	method string             // the associated RPC method of the stream
+	// service and methodName cache the components of method parsed by
+	// Service and MethodName; methodSplit records that the parse has run.
+	// Guarded by mu.
+	service      string
+	methodName   string
+	methodSplit  bool
 	recvCompress string
 	sendCompress string
-	buf          *recvBuffer
-	trReader     io.Reader
-	fc           *inFlow
-	recvQuota    uint32
-	waiters      waiters
+	// acceptCompressors is the list of compressor names the peer advertised
+	// via grpc-accept-encoding. Server side only; set before the stream is
+	// handed to the handler.
+	acceptCompressors []string
+	buf               *recvBuffer
+	// bufGen is the checkout generation of buf; writes into buf are tagged
+	// with it so they are dropped once the buffer has been recycled.
+	bufGen    uint32
+	trReader  io.Reader
+	fc        *inFlow
+	recvQuota uint32
+	waiters   waiters
 
 	// Callback to state application's intentions to read data. This
 	// is used to adjust flow control, if needed.
@@ -244,12 +474,259 @@ type Stream struct {
 	rstStream bool          // indicates whether a RST_STREAM frame needs to be sent
 	rstError  http2.ErrCode // the error that needs to be sent along with the RST_STREAM frame
 
+	// resetDone is set once the transport has itself sent RST_STREAM for
+	// the stream and returned its streams quota (see CancelAllStreams), so
+	// that a later CloseStream does neither again. Client side only.
+	resetDone bool
+
+	// countedDone is set once the stream's completion has been recorded in
+	// the transport's lifetime counters, so it is counted at most once.
+	// Client side only; the server side counts in closeStream.
+	countedDone bool
+
 	bytesReceived bool // indicates whether any bytes have been received on this stream
 	unprocessed   bool // set if the server sends a refused stream or GOAWAY including this stream
 
 	// contentSubtype is the content-subtype for requests.
 	// this must be lowercase or the behavior is undefined.
 	contentSubtype string
+
+	// remoteAddr and authInfo describe the connection the stream was accepted
+	// on. They are set once when the server stream is created and are
+	// read-only afterwards. Both are nil for client side streams.
+	remoteAddr net.Addr
+	authInfo   credentials.AuthInfo
+
+	// clientHalfClosed is closed when the client half-closes the stream by
+	// sending its last message with END_STREAM. It is not closed when the
+	// stream is reset. Server side only (nil for client side streams).
+	clientHalfClosed chan struct{}
+	halfClosed       bool // protects clientHalfClosed from being closed twice
+
+	// flushHeader, set by the client transport, flushes the transport's
+	// pending frames, including this stream's initial HEADERS frame, out to
+	// the wire. See SendHeader. Client side only.
+	flushHeader func()
+
+	// closeSend, set by the client transport, enqueues an empty DATA frame
+	// with END_STREAM set. See CloseSend. Client side only.
+	closeSend func() error
+
+	// flush, set by the client transport, forces the transport's buffered
+	// frames out to the wire. See Flush. Client side only.
+	flush func() error
+
+	// reserveQuota, set by the client transport, implements
+	// ReserveSendQuota. reservedSendQuota, guarded by mu, is the
+	// connection-level send quota currently held for this stream; Write
+	// consumes it before tapping the shared pool and the transport returns
+	// the remainder when the stream closes. Client side only.
+	reserveQuota      func(ctx context.Context, n int) error
+	reservedSendQuota int
+
+	// unreadBuffered counts the bytes sitting in buf that the application
+	// has not read yet. Maintained only when the transport bounds the
+	// aggregate receive buffer; see connBufLimiter. Accessed atomically.
+	unreadBuffered int64
+
+	// trailersOnly is set when the server's response consisted solely of a
+	// single END_STREAM HEADERS frame, with no separate initial headers.
+	// Client side only. Guarded by mu.
+	trailersOnly bool
+
+	// firstByteTime records when the first DATA frame of the response
+	// arrived. It stays zero if no data ever arrives. Client side only.
+	// Guarded by mu.
+	firstByteTime time.Time
+
+	// idleTimeout and idleTimer implement CallHdr.IdleTimeout on the client
+	// and ServerConfig.StreamIdleTimeout on the server. The timer is reset
+	// whenever the stream makes progress and stopped when the stream
+	// finishes. Both guarded by mu.
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	// handlerTimer enforces ServerConfig.MaxHandlerDuration. Server side
+	// only; stopped when the stream closes.
+	handlerTimer *time.Timer
+
+	// priority is the client-supplied "grpc-priority" metadata value, used
+	// by the server's read scheduler when priority-based read scheduling is
+	// enabled. Zero for streams that carried no priority. Server side only.
+	priority int
+
+	// previousAttempts is the client-supplied grpc-previous-rpc-attempts
+	// header value. Zero for streams that carried none. Server side only.
+	previousAttempts int
+
+	// correlationID is the application-supplied CallHdr.CorrelationID, for
+	// local log and metric correlation. Client side only.
+	correlationID string
+
+	// writeBufThreshold is the application-supplied
+	// CallHdr.WriteBufferThreshold. When positive, outgoing writes smaller
+	// than the threshold accumulate in writeBuf instead of going to the
+	// control buffer individually. Client side only.
+	writeBufThreshold int
+	// writeBuf holds bytes accumulated by write buffering. It is only
+	// touched from Write, which callers must not invoke concurrently on
+	// the same stream.
+	writeBuf []byte
+
+	// statsTags and statsTrace hold the decoded grpc-tags-bin and
+	// grpc-trace-bin header values the client sent, if any. Server side
+	// only.
+	statsTags  []byte
+	statsTrace []byte
+
+	// hasDeadline is true when the incoming headers carried a grpc-timeout,
+	// i.e. the client propagated an explicit deadline. Server side only.
+	hasDeadline bool
+
+	// startTime is when the server accepted the stream. bytesIn and
+	// bytesOut count message bytes received from and sent to the client
+	// (accessed atomically); recorded, guarded by mu, makes the access-log
+	// record one-shot. Server side only.
+	startTime time.Time
+	bytesIn   int64
+	bytesOut  int64
+	recorded  bool
+
+	// maxRecvMsgBytes, when positive, caps the declared length of incoming
+	// gRPC messages on this stream. The remaining fields track the parse of
+	// the current message's length prefix across DATA frames and are
+	// only accessed by the transport's reader goroutine.
+	maxRecvMsgBytes  int
+	framing          FramingCodec // nil means the standard 5-byte gRPC framing
+	recvMsgHdr       []byte
+	recvMsgHdrLen    int
+	recvMsgRemaining uint32
+
+	// The following mirror the parse above on the application's read path so
+	// LastMessageCompressed can report the flag byte of the message most
+	// recently returned by Read. Only accessed by the stream's reader.
+	readMsgHdr        [5]byte
+	readMsgHdrLen     int
+	readMsgRemaining  uint32
+	lastMsgCompressed bool
+	recvMsgCount      int
+}
+
+// FramingCodec customizes the length-prefix framing of messages on the wire,
+// for peers that speak a variant of the gRPC wire format. Encode produces the
+// header the transport writes in front of a payload when the caller supplies
+// none; Decode parses a received header of HeaderLen bytes and returns the
+// declared payload length, which keeps the transport's message-size limits
+// and flow control working on the variant format. When no codec is
+// configured the standard framing (compression flag + 4-byte big-endian
+// length) is used.
+//
+// This API is EXPERIMENTAL and may change or be removed in a later release.
+type FramingCodec interface {
+	Encode(payload []byte) (hdr []byte)
+	Decode(hdr []byte) (length uint32, err error)
+	HeaderLen() int
+}
+
+// checkRecvMsgSize scans the length prefixes of the gRPC messages in data and
+// returns a StreamError with codes.ResourceExhausted if a message declares a
+// length larger than the stream's limit. It must only be called from the
+// transport's reader goroutine.
+func (s *Stream) checkRecvMsgSize(data []byte) error {
+	if s.maxRecvMsgBytes <= 0 {
+		return nil
+	}
+	if s.recvMsgHdr == nil {
+		hdrLen := 5
+		if s.framing != nil {
+			hdrLen = s.framing.HeaderLen()
+		}
+		s.recvMsgHdr = make([]byte, hdrLen)
+	}
+	for len(data) > 0 {
+		if s.recvMsgRemaining > 0 {
+			n := uint32(len(data))
+			if n > s.recvMsgRemaining {
+				n = s.recvMsgRemaining
+			}
+			s.recvMsgRemaining -= n
+			data = data[n:]
+			continue
+		}
+		n := copy(s.recvMsgHdr[s.recvMsgHdrLen:], data)
+		s.recvMsgHdrLen += n
+		data = data[n:]
+		if s.recvMsgHdrLen < len(s.recvMsgHdr) {
+			return nil
+		}
+		s.recvMsgHdrLen = 0
+		var length uint32
+		if s.framing != nil {
+			l, err := s.framing.Decode(s.recvMsgHdr)
+			if err != nil {
+				return streamErrorf(codes.Internal, "transport: malformed message header: %v", err)
+			}
+			length = l
+		} else {
+			length = binary.BigEndian.Uint32(s.recvMsgHdr[1:])
+		}
+		if length > uint32(s.maxRecvMsgBytes) {
+			return streamErrorf(codes.ResourceExhausted, "transport: received message larger than max (%d vs. %d)", length, s.maxRecvMsgBytes)
+		}
+		s.recvMsgRemaining = length
+	}
+	return nil
+}
+
+// trackRecvFraming scans bytes handed to the application by Read and records
+// the compressed-flag byte of every standard framing header it completes.
+// Tracking is skipped when a custom FramingCodec is in use, since variant
+// framings define no flag byte. It must only be called from the stream's
+// reader.
+func (s *Stream) trackRecvFraming(data []byte) {
+	if s.framing != nil {
+		return
+	}
+	for len(data) > 0 {
+		if s.readMsgRemaining > 0 {
+			n := uint32(len(data))
+			if n > s.readMsgRemaining {
+				n = s.readMsgRemaining
+			}
+			s.readMsgRemaining -= n
+			data = data[n:]
+			continue
+		}
+		n := copy(s.readMsgHdr[s.readMsgHdrLen:], data)
+		s.readMsgHdrLen += n
+		data = data[n:]
+		if s.readMsgHdrLen < len(s.readMsgHdr) {
+			return
+		}
+		s.readMsgHdrLen = 0
+		s.lastMsgCompressed = s.readMsgHdr[0] != 0
+		s.readMsgRemaining = binary.BigEndian.Uint32(s.readMsgHdr[1:])
+		s.recvMsgCount++
+	}
+}
+
+// LastMessageCompressed reports whether the message most recently read off
+// the stream had its compressed flag set. It is only meaningful after a
+// successful Read has consumed the message's framing header, and always
+// reports false when a custom FramingCodec is in use. It must only be called
+// from the stream's reader.
+func (s *Stream) LastMessageCompressed() bool {
+	return s.lastMsgCompressed
+}
+
+// ReceivedMessageCount returns how many messages have had their framing
+// header consumed by Read so far, so the grpc layer can enforce the unary
+// "exactly one message" invariant without parsing the framing itself. Like
+// LastMessageCompressed it tracks the standard framing only and stays zero
+// when a custom FramingCodec is in use. It must only be called from the
+// stream's reader.
+func (s *Stream) ReceivedMessageCount() int {
+	return s.recvMsgCount
 }
 
 func (s *Stream) waitOnHeader() error {
@@ -278,17 +755,41 @@ func (s *Stream) RecvCompress() string {
 	return s.recvCompress
 }
 
+// AcceptCompressors returns the compressor names the client advertised via
+// grpc-accept-encoding, in the order they were sent, so the handler can pick
+// a response compressor the client supports. Server side only; it returns nil
+// on client side streams and when the client sent no such header.
+func (s *Stream) AcceptCompressors() []string {
+	return s.acceptCompressors
+}
+
 // SetSendCompress sets the compression algorithm to the stream.
 func (s *Stream) SetSendCompress(str string) {
 	s.sendCompress = str
 }
 
-// Done returns a chanel which is closed when it receives the final status
-// from the server.
+// Done returns a channel which is closed when the stream reaches any
+// terminal state: the final status arrived from the server, the RPC was
+// cancelled or timed out, the stream was reset, or the connection went away.
+// FinalStatus reports the reason. Client side only.
 func (s *Stream) Done() <-chan struct{} {
 	return s.done
 }
 
+// FinalStatus returns the status the stream terminated with, for any of the
+// terminal conditions that close Done. It returns nil while the stream is
+// still live. Client side only.
+func (s *Stream) FinalStatus() *status.Status {
+	select {
+	case <-s.done:
+	default:
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
 // GoAway returns a channel which is closed when the server sent GoAways signal
 // before this stream was initiated.
 func (s *Stream) GoAway() <-chan struct{} {
@@ -309,9 +810,9 @@ func (s *Stream) Header() (metadata.MD, error) {
 	return nil, err
 }
 
-// Trailer returns the cached trailer metedata. Note that if it is not called
-// after the entire stream is done, it could return an empty MD. Client
-// side only.
+// Trailer returns the cached trailer metadata received in the final HEADERS
+// frame. Note that if it is not called after the entire stream is done, it
+// could return an empty MD. It never returns a nil map. Client side only.
 func (s *Stream) Trailer() metadata.MD {
 	s.mu.RLock()
 	c := s.trailer.Copy()
@@ -319,12 +820,156 @@ func (s *Stream) Trailer() metadata.MD {
 	return c
 }
 
+// TrailersOnly returns whether the server's response consisted solely of a
+// single HEADERS frame with END_STREAM set, carrying the status and trailer
+// metadata but no initial headers or messages. Its value is only settled once
+// the stream has ended. Client side only.
+func (s *Stream) TrailersOnly() bool {
+	s.mu.RLock()
+	b := s.trailersOnly
+	s.mu.RUnlock()
+	return b
+}
+
+// SendHeader forces the stream's initial HEADERS frame, queued by NewStream,
+// out to the wire without waiting for the first Write. It lets the server
+// start processing headers (e.g. for authentication) while the caller is
+// still producing the request. Headers are written to the wire at most once
+// per stream; a subsequent Write carries only data. It is a no-op on the
+// server side.
+func (s *Stream) SendHeader() {
+	if s.flushHeader != nil {
+		s.flushHeader()
+	}
+}
+
+// WriteHeader flushes the stream's initial HEADERS frame with md immediately,
+// before the first message is written, so the client can read the header
+// metadata early. Headers can be sent at most once per stream; if they were
+// already written, by an earlier call or by the first Write, it returns
+// ErrIllegalHeaderWrite. Server side only; it returns ErrIllegalHeaderWrite
+// on client side streams.
+func (s *Stream) WriteHeader(md metadata.MD) error {
+	if s.st == nil {
+		return ErrIllegalHeaderWrite
+	}
+	return s.st.WriteHeader(s, md)
+}
+
+// ReserveSendQuota blocks until at least n bytes of stream- and
+// connection-level send quota are available, then holds the
+// connection-level share for this stream so that subsequent Writes of up to
+// n bytes proceed without stalling on flow control. The reservation is
+// consumed by Write; whatever is left when the stream finishes is returned
+// to the connection, so canceling the stream before use cannot leak quota.
+// It returns a ContextErr when ctx expires before the quota materializes.
+// Client side only; it is a no-op on server side streams.
+func (s *Stream) ReserveSendQuota(ctx context.Context, n int) error {
+	if s.reserveQuota == nil {
+		return nil
+	}
+	return s.reserveQuota(ctx, n)
+}
+
+// takeReservedSendQuota consumes up to max bytes from the stream's reserved
+// connection-level send quota and returns the amount taken.
+func (s *Stream) takeReservedSendQuota(max int) int {
+	s.mu.Lock()
+	v := s.reservedSendQuota
+	if v > max {
+		v = max
+	}
+	s.reservedSendQuota -= v
+	s.mu.Unlock()
+	return v
+}
+
+// SendWindow returns the stream-level send quota currently available,
+// without consuming any of it. The value is a snapshot taken under the
+// pool's lock and may be stale as soon as it is returned; it is meant for
+// observation and tuning, not for making send decisions. It returns 0 until
+// the peer's initial SETTINGS established the stream's window.
+func (s *Stream) SendWindow() int {
+	if s.sendQuotaPool == nil {
+		return 0
+	}
+	return s.sendQuotaPool.currentQuota()
+}
+
+// CloseSend signals the end of the request to the server by enqueuing an
+// empty DATA frame with END_STREAM set, without waiting for the frame to be
+// written out. It returns a StreamError derived from the stream context if
+// the stream is already canceled. Repeated calls after the first, and calls
+// on server side streams, are no-ops.
+func (s *Stream) CloseSend() error {
+	if s.closeSend == nil {
+		return nil
+	}
+	return s.closeSend()
+}
+
+// Flush forces any frames already handed to the stream's connection out to
+// the wire immediately. It does not push out bytes held back for write
+// coalescing (see CallHdr.WriteBufferThreshold) — only a Write with
+// Options.Flush or Options.Last set does that — which is what keeps Flush
+// safe to call concurrently with Write. It returns ErrConnClosing if the
+// transport is closing. It is a no-op on the server side.
+func (s *Stream) Flush() error {
+	if s.flush == nil {
+		return nil
+	}
+	return s.flush()
+}
+
+// FirstByteTime returns the arrival time of the first DATA frame of the
+// response, or the zero Time if no data has arrived on the stream. It is
+// useful for measuring time-to-first-byte separately from total RPC time.
+// Client side only.
+func (s *Stream) FirstByteTime() time.Time {
+	s.mu.RLock()
+	t := s.firstByteTime
+	s.mu.RUnlock()
+	return t
+}
+
 // ServerTransport returns the underlying ServerTransport for the stream.
 // The client side stream always returns nil.
 func (s *Stream) ServerTransport() ServerTransport {
 	return s.st
 }
 
+// ClientHalfClosed returns a channel that is closed when the client has
+// half-closed the stream, i.e. sent its last message with END_STREAM. It
+// does not fire when the stream is reset; use Context().Done() to observe
+// cancellation. Server side only; it returns nil for client side streams.
+func (s *Stream) ClientHalfClosed() <-chan struct{} {
+	return s.clientHalfClosed
+}
+
+// markClientHalfClosed closes the clientHalfClosed channel, if it hasn't
+// been closed already.
+func (s *Stream) markClientHalfClosed() {
+	s.mu.Lock()
+	if !s.halfClosed {
+		s.halfClosed = true
+		close(s.clientHalfClosed)
+	}
+	s.mu.Unlock()
+}
+
+// RemoteAddr returns the network address of the client the stream was
+// accepted from. Server side only; it returns nil for client side streams.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// AuthInfo returns the authentication information of the connection the
+// stream was accepted on. It returns nil for insecure connections and for
+// client side streams.
+func (s *Stream) AuthInfo() credentials.AuthInfo {
+	return s.authInfo
+}
+
 // ContentSubtype returns the content-subtype for a request. For example, a
 // content-subtype of "proto" will result in a content-type of
 // "application/grpc+proto". This will always be lowercase.  See
@@ -344,11 +989,123 @@ func (s *Stream) Method() string {
 	return s.method
 }
 
-// Status returns the status received from the server.
+// Priority returns the priority the client attached to the stream via the
+// "grpc-priority" metadata key, or zero if none was supplied. Server side
+// only.
+func (s *Stream) Priority() int {
+	return s.priority
+}
+
+// PreviousRPCAttempts returns the number of earlier attempts of this RPC
+// the client reported via the grpc-previous-rpc-attempts header, or zero if
+// none was supplied. Server side only.
+func (s *Stream) PreviousRPCAttempts() int {
+	return s.previousAttempts
+}
+
+// CorrelationID returns the application-supplied identifier attached to the
+// stream via CallHdr.CorrelationID, or the empty string if none was set. It
+// is never sent on the wire. Client side only.
+func (s *Stream) CorrelationID() string {
+	return s.correlationID
+}
+
+// HasDeadline reports whether the client propagated an explicit deadline
+// via the grpc-timeout header. It stays false when the stream context's
+// deadline was imposed by server configuration alone, letting handlers
+// apply their own default only for clients that did not set one. Server
+// side only.
+func (s *Stream) HasDeadline() bool {
+	return s.hasDeadline
+}
+
+// TagsBin returns the decoded value of the grpc-tags-bin header the client
+// sent, or nil if the header was absent. The bytes are the census tag
+// propagation payload, passed through opaquely by the transport. Server side
+// only.
+func (s *Stream) TagsBin() []byte {
+	return s.statsTags
+}
+
+// TraceBin returns the decoded value of the grpc-trace-bin header the client
+// sent, or nil if the header was absent. The bytes are the trace context
+// propagation payload, passed through opaquely by the transport. Server side
+// only.
+func (s *Stream) TraceBin() []byte {
+	return s.statsTrace
+}
+
+// splitMethod parses a method path of the form /service/method into its
+// components. It tolerates a missing leading slash; a path without a
+// service/method separator yields empty strings.
+func splitMethod(method string) (service, methodName string) {
+	method = strings.TrimPrefix(method, "/")
+	pos := strings.LastIndex(method, "/")
+	if pos < 0 {
+		return "", ""
+	}
+	return method[:pos], method[pos+1:]
+}
+
+// lazySplitMethod parses the stream's method path once and caches the
+// components.
+func (s *Stream) lazySplitMethod() {
+	s.mu.Lock()
+	if !s.methodSplit {
+		s.service, s.methodName = splitMethod(s.method)
+		s.methodSplit = true
+	}
+	s.mu.Unlock()
+}
+
+// Service returns the service component of the stream's method path, e.g.
+// "pkg.Service" for "/pkg.Service/Method". It returns an empty string when
+// the path cannot be parsed.
+func (s *Stream) Service() string {
+	s.lazySplitMethod()
+	return s.service
+}
+
+// MethodName returns the bare method component of the stream's method path,
+// e.g. "Method" for "/pkg.Service/Method". It returns an empty string when
+// the path cannot be parsed.
+func (s *Stream) MethodName() string {
+	s.lazySplitMethod()
+	return s.methodName
+}
+
+// Status returns the status received from the server on the client side. On
+// the server side it is only set when the client resets the stream, mapping
+// the RST_STREAM error code to a gRPC code (e.g. CANCEL to codes.Canceled),
+// and is nil otherwise.
 func (s *Stream) Status() *status.Status {
 	return s.status
 }
 
+// RetryAfter returns the retry delay the server attached to the stream's
+// final status, either as a conventional "retry-after" trailer holding a
+// number of seconds or as a RetryInfo detail in grpc-status-details-bin.
+// ok is false when the stream has not finished or the server supplied no
+// hint; the caller's retry layer decides what to do with the delay.
+func (s *Stream) RetryAfter() (d time.Duration, ok bool) {
+	s.mu.RLock()
+	vals := s.trailer["retry-after"]
+	s.mu.RUnlock()
+	if len(vals) > 0 {
+		if sec, err := strconv.Atoi(vals[0]); err == nil && sec >= 0 {
+			return time.Duration(sec) * time.Second, true
+		}
+	}
+	for _, detail := range s.status.Details() {
+		if ri, ok := detail.(*epb.RetryInfo); ok && ri.RetryDelay != nil {
+			if delay, err := ptypes.Duration(ri.RetryDelay); err == nil {
+				return delay, true
+			}
+		}
+	}
+	return 0, false
+}
+
 // SetHeader sets the header metadata. This can be called multiple times.
 // Server side only.
 func (s *Stream) SetHeader(md metadata.MD) error {
@@ -379,7 +1136,7 @@ func (s *Stream) SetTrailer(md metadata.MD) error {
 }
 
 func (s *Stream) write(m recvMsg) {
-	s.buf.put(m)
+	s.buf.put(s.bufGen, m)
 }
 
 // Read reads all p bytes from the wire for this stream.
@@ -389,7 +1146,34 @@ func (s *Stream) Read(p []byte) (n int, err error) {
 		return 0, er
 	}
 	s.requestRead(len(p))
-	return io.ReadFull(s.trReader, p)
+	n, err = io.ReadFull(s.trReader, p)
+	if n > 0 {
+		s.trackRecvFraming(p[:n])
+	}
+	return n, err
+}
+
+// ReadBuffer returns the next chunk of data received on the stream without
+// copying it, transferring ownership of the underlying buffer to the caller.
+// The buffer is only valid until it is handed back via ReleaseBuffer; callers
+// that need the data beyond the message's lifetime must copy it out first.
+// ReadBuffer and Read may be mixed; ReadBuffer then returns the unread
+// remainder of a partially Read message before moving on to the next one.
+func (s *Stream) ReadBuffer() ([]byte, error) {
+	tr := s.trReader.(*transportReader)
+	if er := tr.er; er != nil {
+		return nil, er
+	}
+	b, err := tr.reader.(*recvBufferReader).readBuffer()
+	if err != nil {
+		tr.er = err
+		return nil, err
+	}
+	if len(b) > 0 {
+		tr.windowHandler(len(b))
+		s.trackRecvFraming(b)
+	}
+	return b, nil
 }
 
 // tranportReader reads all the data available for this Stream from the transport and
@@ -414,9 +1198,22 @@ func (t *transportReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// touchIdleTimer pushes back the stream's idle deadline after the stream
+// makes progress. It is a no-op when no idle timeout is configured.
+func (s *Stream) touchIdleTimer() {
+	s.mu.Lock()
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+	s.mu.Unlock()
+}
+
 // finish sets the stream's state and status, and closes the done channel.
 // s.mu must be held by the caller.  st must always be non-nil.
 func (s *Stream) finish(st *status.Status) {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
 	s.status = st
 	s.state = streamDone
 	close(s.done)
@@ -479,8 +1276,142 @@ type ServerConfig struct {
 	KeepalivePolicy       keepalive.EnforcementPolicy
 	InitialWindowSize     int32
 	InitialConnWindowSize int32
-	WriteBufferSize       int
-	ReadBufferSize        int
+	// DisableBDPEstimation turns off dynamic flow-control window tuning, so
+	// the stream and connection windows stay fixed at their configured (or
+	// default) sizes regardless of the observed bandwidth-delay product.
+	DisableBDPEstimation   bool
+	WriteBufferSize        int
+	ReadBufferSize         int
+	MaxReceiveMessageBytes int
+	// MaxConnReceiveBuffer, when positive, bounds the aggregate number of
+	// unread bytes buffered by all streams of the connection. Once exceeded,
+	// connection-level window updates are withheld until the applications
+	// catch up on their reads, so the peer stops sending. Zero leaves the
+	// aggregate unbounded.
+	MaxConnReceiveBuffer int
+	// ReadBufferKernelSize, when positive, sets SO_RCVBUF on the accepted
+	// connection. Connections that do not support it are left untouched.
+	ReadBufferKernelSize int
+	// WriteBufferKernelSize, when positive, sets SO_SNDBUF on the accepted
+	// connection. Connections that do not support it are left untouched.
+	WriteBufferKernelSize int
+	// MaxContinuationFrames, when positive, overrides the default bound on
+	// the number of CONTINUATION frames one header block may span. A peer
+	// exceeding it is considered to be flooding and the connection is
+	// closed with a GOAWAY before the header block is decoded.
+	MaxContinuationFrames int
+	// OnProtocolMismatch, when non-nil, is called with the bytes a client
+	// sent in place of the HTTP/2 preface before the connection is
+	// rejected, e.g. an HTTP/1.1 request line from a peer that does not
+	// speak h2c. It lets servers log or count protocol mismatches.
+	OnProtocolMismatch func(firstBytes []byte)
+	// HpackTableSize, when positive, sets the maximum dynamic table size
+	// for HPACK header compression. It is advertised to the client via
+	// SETTINGS_HEADER_TABLE_SIZE and used by the encoder up to whatever the
+	// client advertises in turn. Zero keeps the HTTP/2 default of 4096
+	// bytes.
+	HpackTableSize uint32
+	// OnWindowUpdate, when non-nil, is called for every WINDOW_UPDATE frame
+	// received from the client, with stream ID 0 denoting the
+	// connection-level window. It is invoked synchronously from the
+	// transport's read loop and must not block.
+	OnWindowUpdate func(streamID, increment uint32)
+	// MaxHandlerDuration, when positive, caps how long a handler may run
+	// when the client supplied no deadline or a longer one. Once the cap
+	// expires the stream's context is canceled and the RPC is finished with
+	// codes.DeadlineExceeded. A shorter client deadline takes precedence.
+	MaxHandlerDuration time.Duration
+	// MaxFrameSize, when non-zero, is advertised to the client via
+	// SETTINGS_MAX_FRAME_SIZE. It must lie within the legal range of 16KB
+	// to 16MB-1; values outside it are rejected at setup. Zero keeps the
+	// HTTP/2 default of 16KB.
+	MaxFrameSize uint32
+	// FramingCodec, when non-nil, substitutes the standard gRPC message
+	// framing; see the FramingCodec type. This is EXPERIMENTAL.
+	FramingCodec FramingCodec
+	// PriorityReadScheduling, when set, delivers buffered data to stream
+	// readers in order of the client-supplied "grpc-priority" metadata
+	// value, higher values first, instead of strictly by arrival. Streams
+	// without a priority are treated as priority zero. Off by default,
+	// which keeps the fair arrival-order delivery.
+	PriorityReadScheduling bool
+	// RequiredALPN, when non-empty, lists the ALPN protocols a TLS client
+	// must have negotiated; connections whose negotiated protocol is not in
+	// the list are rejected right after the handshake, before any stream is
+	// served. Empty accepts any protocol.
+	RequiredALPN []string
+	// TCPKeepAlive, when non-zero, enables OS-level TCP keepalive with the
+	// given period on accepted TCP connections, so that clients that
+	// vanished behind a NAT are detected by the kernel even when HTTP/2
+	// keepalive is off. It is a no-op for non-TCP connections.
+	TCPKeepAlive time.Duration
+	// MaxHeaderFields, when positive, caps the number of non-pseudo header
+	// fields a client may send on one stream; streams exceeding it are
+	// reset with codes.ResourceExhausted before the handler runs.
+	MaxHeaderFields int
+	// AuthorityValidator, when non-nil, is consulted with the :authority
+	// pseudo-header of every new stream; when it returns false the stream
+	// is answered with a trailers-only codes.PermissionDenied response
+	// before any handler is dispatched. When nil any authority is
+	// accepted.
+	AuthorityValidator func(authority string) bool
+	// MethodFilter, when non-nil, is consulted with the full method name of
+	// every new stream before the handler is dispatched; when it returns
+	// false the stream is answered with a trailers-only
+	// codes.Unimplemented response and no handler goroutine is started.
+	// When nil all methods proceed.
+	MethodFilter func(method string) bool
+	// MaxStreamsPerSecond, when positive, caps the rate at which new
+	// streams may be opened on the connection, via a token bucket with a
+	// burst allowance of one second's worth. Streams arriving with the
+	// bucket empty are reset with codes.ResourceExhausted. Zero leaves the
+	// rate unlimited. This is distinct from MaxStreams, which bounds
+	// concurrency rather than churn.
+	MaxStreamsPerSecond int
+	// PrefaceReadTimeout, when non-zero, bounds how long the server waits
+	// for the full client preface and the initial SETTINGS frame on a new
+	// connection before giving up and closing it. Zero keeps the current
+	// behavior of waiting indefinitely.
+	PrefaceReadTimeout time.Duration
+	// StreamIdleTimeout, when non-zero, resets any stream on which neither
+	// side makes progress — no reads, writes, or window updates — for the
+	// duration. It complements the handler and read/write bounds by
+	// catching fully-idle streams, e.g. a client that never reads the
+	// response and never half-closes. Zero disables the timeout.
+	StreamIdleTimeout time.Duration
+	// CompressLargeHeaders, when set, sends large metadata values gzipped
+	// under a companion "-gzip-bin" key and transparently expands such keys
+	// on receipt; see the identically named ConnectOptions field.
+	// Experimental; both peers must enable it.
+	CompressLargeHeaders bool
+	// ReuseStreamBuffers, when set, recycles stream receive buffers through
+	// a pool instead of allocating per stream; see the identically named
+	// ConnectOptions field.
+	ReuseStreamBuffers bool
+	// OnStreamComplete, when non-nil, is invoked exactly once per stream
+	// after it completes — normally, by reset, or by cancellation — with a
+	// populated StreamRecord, e.g. to emit access-log records. The hook
+	// runs in its own goroutine so a slow consumer cannot stall the
+	// transport.
+	OnStreamComplete func(rec StreamRecord)
+}
+
+// StreamRecord summarizes one completed server stream for access logging;
+// see ServerConfig.OnStreamComplete.
+type StreamRecord struct {
+	// Method is the stream's full method name.
+	Method string
+	// StatusCode is the gRPC code the stream finished with.
+	StatusCode codes.Code
+	// Duration is the time between the stream's arrival and its
+	// completion.
+	Duration time.Duration
+	// BytesIn and BytesOut count message bytes received from and sent to
+	// the client, including the length-prefix framing.
+	BytesIn  int64
+	BytesOut int64
+	// PeerAddr is the client's network address.
+	PeerAddr net.Addr
 }
 
 // NewServerTransport creates a ServerTransport with conn or non-nil error
@@ -498,12 +1429,31 @@ type ConnectOptions struct {
 	Authority string
 	// Dialer specifies how to dial a network address.
 	Dialer func(context.Context, string) (net.Conn, error)
+	// ProxyURL, when non-nil, routes the connection through the given HTTP
+	// CONNECT proxy: the transport dials the proxy address, issues a
+	// CONNECT for the real target (sending basic Proxy-Authorization when
+	// the URL carries user info), and then runs the usual TLS and HTTP/2
+	// handshakes over the tunnel.
+	ProxyURL *url.URL
 	// FailOnNonTempDialError specifies if gRPC fails on non-temporary dial errors.
 	FailOnNonTempDialError bool
+	// DialRetries is the number of additional dial attempts made after a
+	// transient dial failure, waiting DialRetryBackoff between attempts and
+	// stopping early once the connect context expires. The last dial error
+	// is returned on exhaustion. Zero preserves the single-attempt behavior.
+	DialRetries int
+	// DialRetryBackoff is the wait between dial attempts. It defaults to
+	// 100ms when zero.
+	DialRetryBackoff time.Duration
 	// PerRPCCredentials stores the PerRPCCredentials required to issue RPCs.
 	PerRPCCredentials []credentials.PerRPCCredentials
 	// TransportCredentials stores the Authenticator required to setup a client connection.
 	TransportCredentials credentials.TransportCredentials
+	// CredsSelector, when non-nil, is consulted with the target of each new
+	// connection and may return the TransportCredentials to use for it,
+	// allowing per-destination identities behind e.g. a shared egress proxy.
+	// A nil return falls back to TransportCredentials.
+	CredsSelector func(target TargetInfo) credentials.TransportCredentials
 	// KeepaliveParams stores the keepalive parameters.
 	KeepaliveParams keepalive.ClientParameters
 	// StatsHandler stores the handler for stats.
@@ -512,10 +1462,123 @@ type ConnectOptions struct {
 	InitialWindowSize int32
 	// InitialConnWindowSize sets the initial window size for a connection.
 	InitialConnWindowSize int32
+	// DisableBDPEstimation turns off dynamic flow-control window tuning, so
+	// the stream and connection windows stay fixed at their configured (or
+	// default) sizes regardless of the observed bandwidth-delay product.
+	DisableBDPEstimation bool
+	// WindowUpdateRatio is the fraction of the receive window that consumed
+	// bytes must reach before a WINDOW_UPDATE is sent, for both the stream
+	// and connection windows. Larger values coalesce more updates into
+	// fewer frames at the cost of a smaller effective sender window. Must
+	// lie in (0, 1]; zero keeps the default of 1/4.
+	WindowUpdateRatio float64
 	// WriteBufferSize sets the size of write buffer which in turn determines how much data can be batched before it's written on the wire.
 	WriteBufferSize int
 	// ReadBufferSize sets the size of read buffer, which in turn determines how much data can be read at most for one read syscall.
 	ReadBufferSize int
+	// MaxReceiveMessageBytes, when positive, caps the declared length of
+	// incoming gRPC messages. Streams carrying a message whose length prefix
+	// exceeds the limit are reset immediately without buffering the payload.
+	MaxReceiveMessageBytes int
+	// PrefaceTimeout bounds the wait for the server's initial SETTINGS frame
+	// independently of the overall dial deadline. This is useful when an L7
+	// proxy delays the preface even though the connection was established in
+	// time. A zero value preserves the previous behavior of waiting
+	// indefinitely (until the connection dies).
+	PrefaceTimeout time.Duration
+	// MaxGoAways bounds the number of GOAWAY frames tolerated on a single
+	// connection. Buggy peers may repeatedly send GOAWAY with no error while
+	// keeping the connection open, leaving the transport draining forever;
+	// once the limit is exceeded the transport is closed instead. A zero
+	// value uses the default of 2 (the two-GOAWAY graceful shutdown
+	// sequence).
+	MaxGoAways int
+	// MaxControlBufBytes, when positive, bounds the number of data bytes
+	// queued in the transport's control buffer awaiting a write to the wire.
+	// Once the bound is reached Write blocks (respecting the stream context)
+	// instead of enqueuing without limit, turning memory pressure into
+	// backpressure. A zero value leaves the buffer unbounded.
+	MaxControlBufBytes int
+	// HTTPStatusConvTab, when non-nil, overrides or extends the default
+	// mapping from HTTP statuses to gRPC codes for non-gRPC responses, e.g.
+	// nonstandard statuses returned by a fronting proxy. Statuses not in the
+	// map fall back to the default table.
+	HTTPStatusConvTab map[int]codes.Code
+	// StrictGRPC, when set, treats any response lacking a valid gRPC
+	// content-type as an immediate codes.Internal error instead of
+	// attempting the HTTP-status fallback mapping, for clients that only
+	// ever talk to real gRPC servers. Off by default.
+	StrictGRPC bool
+	// MaxHeaderFields, when positive, caps the number of non-pseudo header
+	// fields the server may send on one stream; responses exceeding it fail
+	// the RPC with codes.ResourceExhausted instead of blowing up the
+	// metadata map.
+	MaxHeaderFields int
+	// CompressLargeHeaders, when set, sends large metadata values gzipped
+	// under a companion "-gzip-bin" key and transparently expands such keys
+	// on receipt, for values hpack alone compresses poorly (e.g. big unique
+	// tokens). Experimental; both peers must enable it, a peer without it
+	// sees the companion key as ordinary metadata.
+	CompressLargeHeaders bool
+	// ReuseStreamBuffers, when set, recycles stream receive buffers through
+	// a pool instead of allocating per stream, reducing GC pressure under
+	// high stream churn. A buffer is recycled once the stream's reader has
+	// observed its terminal error, so a stream that is never read to
+	// completion simply keeps its buffer out of the pool.
+	ReuseStreamBuffers bool
+	// OnMaxStreamsChange, when non-nil, is called with the value of
+	// SETTINGS_MAX_CONCURRENT_STREAMS the server advertises, both on the
+	// initial SETTINGS frame and on every later update, so the layer above
+	// can adjust its own concurrency gating. It is called from the
+	// transport's reader goroutine and must not block.
+	OnMaxStreamsChange func(newMax uint32)
+	// MaxConnReceiveBuffer, when positive, bounds the aggregate number of
+	// unread bytes buffered by all streams of the connection. Once exceeded,
+	// connection-level window updates are withheld until the applications
+	// catch up on their reads, so the server stops sending. Zero leaves the
+	// aggregate unbounded.
+	MaxConnReceiveBuffer int
+	// AcceptCompressors is the list of compressor names advertised to the
+	// server via grpc-accept-encoding on every stream, in preference order.
+	// When nil, identity and gzip are advertised.
+	AcceptCompressors []string
+	// OnDraining, when non-nil, is called when the transport enters the
+	// draining state upon receiving its first GOAWAY, so the layer above can
+	// pre-warm a replacement connection while in-flight streams finish. It
+	// is called at most once per transport, in its own goroutine.
+	OnDraining func()
+	// ReadBufferKernelSize, when positive, sets SO_RCVBUF on the dialed
+	// connection, sizing the kernel receive buffer for high
+	// bandwidth-delay-product links independently of the userspace
+	// ReadBufferSize. Connections that do not support it are left untouched.
+	ReadBufferKernelSize int
+	// WriteBufferKernelSize, when positive, sets SO_SNDBUF on the dialed
+	// connection. Connections that do not support it are left untouched.
+	WriteBufferKernelSize int
+	// HpackTableSize, when positive, sets the maximum dynamic table size
+	// for HPACK header compression. It is advertised to the server via
+	// SETTINGS_HEADER_TABLE_SIZE and used by the encoder up to whatever the
+	// server advertises in turn. Zero keeps the HTTP/2 default of 4096
+	// bytes.
+	HpackTableSize uint32
+	// OnWindowUpdate, when non-nil, is called for every WINDOW_UPDATE frame
+	// received from the server, with stream ID 0 denoting the
+	// connection-level window. It is invoked synchronously from the
+	// transport's read loop and must not block.
+	OnWindowUpdate func(streamID, increment uint32)
+	// MaxFrameSize, when non-zero, is advertised to the server via
+	// SETTINGS_MAX_FRAME_SIZE. It must lie within the legal range of 16KB
+	// to 16MB-1; values outside it are rejected at setup. Zero keeps the
+	// HTTP/2 default of 16KB.
+	MaxFrameSize uint32
+	// FramingCodec, when non-nil, substitutes the standard gRPC message
+	// framing; see the FramingCodec type. This is EXPERIMENTAL.
+	FramingCodec FramingCodec
+	// TrackStreamQuotaLatency enables recording a histogram of the time
+	// NewStream spends waiting for MAX_CONCURRENT_STREAMS quota,
+	// retrievable via the transport's StreamQuotaLatency method. Off by
+	// default to avoid the bookkeeping overhead.
+	TrackStreamQuotaLatency bool
 }
 
 // TargetInfo contains the information of the target such as network address and metadata.
@@ -542,6 +1605,22 @@ type Options struct {
 	// the data could be buffered for a batching write. The
 	// transport implementation may ignore the hint.
 	Delay bool
+
+	// WriteDeadline, when non-zero, bounds how long this write may block
+	// waiting for send quota. When it passes, Write returns
+	// ErrWriteDeadlineExceeded without affecting the stream, so the caller
+	// can retry or give up on its own schedule instead of canceling the
+	// whole RPC. The deadline is only honored until the first frame of the
+	// message is queued; after that the write blocks until the whole
+	// message is queued, so a deadline error never leaves a partial
+	// message on the wire. The zero value leaves the write bounded only by
+	// the stream context.
+	WriteDeadline time.Time
+
+	// Flush forces any bytes held back by the stream's write-buffering
+	// threshold (see CallHdr.WriteBufferThreshold) onto the wire together
+	// with this write. It has no effect on streams without buffering.
+	Flush bool
 }
 
 // CallHdr carries the information of a particular RPC.
@@ -574,6 +1653,100 @@ type CallHdr struct {
 	// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
 	// for more details.
 	ContentSubtype string
+
+	// IdleTimeout, when non-zero, bounds the time the client waits for the
+	// next DATA frame on this stream. If none arrives within the window the
+	// transport resets the stream with codes.DeadlineExceeded. The timer
+	// restarts every time a message is received.
+	IdleTimeout time.Duration
+
+	// PreviousRPCAttempts, when positive, is written out as the
+	// grpc-previous-rpc-attempts header so the server can tell that this
+	// stream is a retry of an earlier attempt. Negative values make
+	// NewStream fail with codes.InvalidArgument.
+	PreviousRPCAttempts int
+
+	// CorrelationID is an application-supplied identifier stored on the
+	// stream for correlating transport-level observations with the
+	// application's own request IDs. It is purely local: it never goes on
+	// the wire unless the caller also puts it in metadata.
+	CorrelationID string
+
+	// WriteBufferThreshold, when positive, makes the client transport
+	// accumulate outgoing writes for this stream in a per-stream buffer
+	// until at least this many bytes are pending, the write is marked
+	// Last, or the caller sets Options.Flush. The buffered bytes are then
+	// written out together, so a stream carrying many small messages costs
+	// far fewer control-buffer operations. Message boundaries are carried
+	// by the message framing and are unaffected by batching.
+	WriteBufferThreshold int
+
+	// md carries user metadata staged by NewCallHdr. NewStream writes it
+	// out as headers on the new stream.
+	md metadata.MD
+}
+
+// A CallHdrOption configures optional fields of a CallHdr built by
+// NewCallHdr.
+type CallHdrOption func(*CallHdr)
+
+// CallHdrSendCompress returns a CallHdrOption that sets the compression
+// algorithm applied on outbound messages.
+func CallHdrSendCompress(name string) CallHdrOption {
+	return func(c *CallHdr) { c.SendCompress = name }
+}
+
+// CallHdrContentSubtype returns a CallHdrOption that sets the
+// content-subtype for the request.
+func CallHdrContentSubtype(s string) CallHdrOption {
+	return func(c *CallHdr) { c.ContentSubtype = s }
+}
+
+// NewCallHdr constructs a CallHdr for an RPC on the given method and host
+// and stages md to be written out as headers by NewStream. Keys are
+// lowercased as required by HTTP/2; headers reserved by the gRPC protocol
+// and keys containing illegal characters are dropped so callers cannot
+// accidentally set grpc-* headers. The metadata is copied, so the caller
+// may reuse md after the call returns.
+func NewCallHdr(method, host string, md metadata.MD, opts ...CallHdrOption) *CallHdr {
+	c := &CallHdr{
+		Host:   host,
+		Method: method,
+	}
+	if len(md) > 0 {
+		c.md = make(metadata.MD, len(md))
+		for k, vv := range md {
+			k = strings.ToLower(k)
+			if isReservedHeader(k) || !isValidHeaderKey(k) {
+				continue
+			}
+			c.md[k] = append([]string(nil), vv...)
+		}
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// isValidHeaderKey reports whether k is a legal HTTP/2 header field name
+// once lowercased: non-empty and made up of lowercase letters, digits and
+// the special characters -, _ and ..
+func isValidHeaderKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 // ClientTransport is the common interface for all gRPC client-side transport
@@ -588,6 +1761,11 @@ type ClientTransport interface {
 	// new RPCs and wait the completion of the pending RPCs.
 	GracefulClose() error
 
+	// GracefulCloseWithDeadline drains the transport like GracefulClose
+	// but force-closes it once ctx fires, returning the context's error
+	// when the deadline cut the drain short and nil on a clean drain.
+	GracefulCloseWithDeadline(ctx context.Context) error
+
 	// Write sends the data for the given stream. A nil stream indicates
 	// the write is to be performed on the transport as a whole.
 	Write(s *Stream, hdr []byte, data []byte, opts *Options) error
@@ -601,6 +1779,18 @@ type ClientTransport interface {
 	// unless the associated transport is closing.
 	CloseStream(stream *Stream, err error)
 
+	// CancelAllStreams aborts every stream currently active on the
+	// transport with err, sending RST_STREAM to the server for each, while
+	// keeping the connection open for future NewStream calls. Streams that
+	// complete concurrently are left alone.
+	CancelAllStreams(err error)
+
+	// WaitForReady blocks until the connection handshake (the initial
+	// SETTINGS exchange) has completed and the transport is usable, ctx
+	// expires, or the transport dies, whichever comes first. A nil return
+	// means RPCs can be issued without NewStream having to wait.
+	WaitForReady(ctx context.Context) error
+
 	// Error returns a channel that is closed when some I/O error
 	// happens. Typically the caller should have a goroutine to monitor
 	// this in order to take action (e.g., close the current transport
@@ -615,6 +1805,46 @@ type ClientTransport interface {
 
 	// GetGoAwayReason returns the reason why GoAway frame was received.
 	GetGoAwayReason() GoAwayReason
+
+	// GoAwayLastStreamID returns the last-stream-id carried by the most
+	// recent GOAWAY frame, or zero if none was received. Streams with
+	// higher IDs were definitely not processed by the server and can be
+	// retried on another connection. It is populated before the GoAway
+	// channel fires.
+	GoAwayLastStreamID() uint32
+
+	// Ping sends an HTTP/2 PING frame to the server and blocks until the
+	// matching ack is received, ctx expires, or the transport closes. It can
+	// be used to probe the health of an otherwise quiet connection.
+	Ping(ctx context.Context) error
+
+	// AvailableStreamQuota returns the number of streams that can currently
+	// be opened without blocking on MAX_CONCURRENT_STREAMS. The returned
+	// value is a conservative snapshot and may be stale as soon as it is
+	// returned.
+	AvailableStreamQuota() int
+
+	// TransportStats returns a snapshot of the transport's lifetime stream
+	// counters.
+	TransportStats() TransportStats
+
+	// FlowControlSnapshot returns a read-only view of the transport's
+	// flow-control accounting, e.g. for diagnosing a stuck transfer.
+	FlowControlSnapshot() FlowControlSnapshot
+
+	// LocalAddr returns the local network address of the connection. It is
+	// safe to call at any time and keeps returning the last-known address
+	// after the transport is closed.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the remote network address of the connection,
+	// with the same lifetime guarantees as LocalAddr.
+	RemoteAddr() net.Addr
+
+	// Context returns a context that is canceled when the transport
+	// closes, so resources scoped to the whole connection rather than a
+	// single stream can be cleaned up with it.
+	Context() context.Context
 }
 
 // ServerTransport is the common interface for all gRPC server-side transport
@@ -646,8 +1876,83 @@ type ServerTransport interface {
 	// RemoteAddr returns the remote network address.
 	RemoteAddr() net.Addr
 
+	// LocalAddr returns the local network address the connection was
+	// accepted on, which identifies the serving interface on multi-homed
+	// hosts. It is safe to call at any time and keeps returning the
+	// last-known address after the transport is closed.
+	LocalAddr() net.Addr
+
 	// Drain notifies the client this ServerTransport stops accepting new RPCs.
 	Drain()
+
+	// TransportStats returns a snapshot of the transport's lifetime stream
+	// counters.
+	TransportStats() TransportStats
+
+	// FlowControlSnapshot returns a read-only view of the transport's
+	// flow-control accounting, e.g. for diagnosing a stuck transfer.
+	FlowControlSnapshot() FlowControlSnapshot
+
+	// Context returns a context that is canceled when the transport
+	// closes, so resources scoped to the whole connection rather than a
+	// single stream can be cleaned up with it.
+	Context() context.Context
+}
+
+// TransportStats is a snapshot of a transport's lifetime stream counters,
+// e.g. for capacity planning. The counters only ever grow, except for
+// StreamsActive; streams that are still live when the connection goes down
+// abruptly are not counted as completed.
+type TransportStats struct {
+	// StreamsCreated is the total number of streams ever opened on the
+	// transport.
+	StreamsCreated uint64
+	// StreamsCompletedOK is the number of streams that completed with an OK
+	// status.
+	StreamsCompletedOK uint64
+	// StreamsCompletedError is the number of streams that completed with a
+	// non-OK status or a transport error, including streams reset by the
+	// peer.
+	StreamsCompletedError uint64
+	// StreamsActive is the number of streams currently active on the
+	// transport.
+	StreamsActive uint64
+}
+
+// StreamFlowSnapshot is the flow-control accounting of one stream within a
+// FlowControlSnapshot.
+type StreamFlowSnapshot struct {
+	// StreamID identifies the stream on its connection.
+	StreamID uint32
+	// RecvLimit is the stream's inbound flow-control window limit.
+	RecvLimit uint32
+	// PendingData is the number of received bytes the application has not
+	// consumed yet.
+	PendingData uint32
+	// PendingUpdate is the number of consumed bytes for which no window
+	// update has been sent to the peer yet.
+	PendingUpdate uint32
+	// Delta is the extra window granted for messages larger than the limit.
+	Delta uint32
+	// SendQuota is the stream-level send window currently available.
+	SendQuota int
+}
+
+// FlowControlSnapshot is a point-in-time, read-only view of a transport's
+// flow-control accounting, e.g. for diagnosing a stuck transfer. Each value
+// is captured under its own lock; the snapshot is consistent per value, not
+// across the whole transport, and may be stale as soon as it is returned.
+type FlowControlSnapshot struct {
+	// ConnRecvLimit, ConnPendingData, ConnPendingUpdate and ConnDelta are
+	// the connection-level counterparts of the per-stream fields.
+	ConnRecvLimit     uint32
+	ConnPendingData   uint32
+	ConnPendingUpdate uint32
+	ConnDelta         uint32
+	// ConnSendQuota is the connection-level send window currently available.
+	ConnSendQuota int
+	// Streams holds one entry per stream active when the snapshot was taken.
+	Streams []StreamFlowSnapshot
 }
 
 // streamErrorf creates an StreamError with the specified error code and description.
@@ -684,6 +1989,12 @@ func (e ConnectionError) Temporary() bool {
 	return e.temp
 }
 
+// GRPCCode returns the gRPC code a broken connection surfaces as, so that
+// status.Code can classify connection errors without importing this package.
+func (e ConnectionError) GRPCCode() codes.Code {
+	return codes.Unavailable
+}
+
 // Origin returns the original error of this connection error.
 func (e ConnectionError) Origin() error {
 	// Never return nil error here.
@@ -704,6 +2015,11 @@ var (
 	// StatusGoAway indicates that the server sent a GOAWAY that included this
 	// stream's ID in unprocessed RPCs.
 	statusGoAway = status.New(codes.Unavailable, "the stream is rejected because server is draining the connection")
+	// ErrWriteDeadlineExceeded is returned by Write when Options.WriteDeadline
+	// passes while the write is blocked waiting for send quota. It is only
+	// returned before any part of the message has been committed to the
+	// wire, so the stream is left intact and the write may be retried.
+	ErrWriteDeadlineExceeded = streamErrorf(codes.DeadlineExceeded, "transport: per-write deadline exceeded while waiting for send quota")
 )
 
 // TODO: See if we can replace StreamError with status package errors.
@@ -718,6 +2034,12 @@ func (e StreamError) Error() string {
 	return fmt.Sprintf("stream error: code = %s desc = %q", e.Code, e.Desc)
 }
 
+// GRPCCode returns the stream error's code, so that status.Code can recover
+// it without importing this package.
+func (e StreamError) GRPCCode() codes.Code {
+	return e.Code
+}
+
 // waiters are passed to quotaPool get methods to
 // wait on in addition to waiting on quota.
 type waiters struct {
@@ -725,6 +2047,9 @@ type waiters struct {
 	tctx   context.Context
 	done   chan struct{}
 	goAway chan struct{}
+	// writeDeadline, when non-nil, fires when the current write's soft
+	// deadline passes. See Options.WriteDeadline.
+	writeDeadline <-chan time.Time
 }
 
 // GoAwayReason contains the reason for the GoAway frame received.
@@ -739,6 +2064,11 @@ const (
 	// ErrCodeEnhanceYourCalm was received and that the debug data said
 	// "too_many_pings".
 	GoAwayTooManyPings GoAwayReason = 2
+	// GoAwayGraceful indicates that a GoAway frame with ErrCodeNo was
+	// received, i.e. the server shut the connection down cleanly, for
+	// example for a graceful restart. Reconnecting does not need to be
+	// backed off in this case.
+	GoAwayGraceful GoAwayReason = 3
 )
 
 // loopyWriter is run in a separate go routine. It is the single code path that will
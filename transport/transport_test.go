@@ -21,26 +21,43 @@ package transport
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/ptypes/duration"
 	"github.com/publica-project/grpc/codes"
+	"github.com/publica-project/grpc/credentials"
 	"github.com/publica-project/grpc/keepalive"
+	"github.com/publica-project/grpc/metadata"
+	"github.com/publica-project/grpc/stats"
 	"github.com/publica-project/grpc/status"
 	"golang.org/x/net/context"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
 )
 
 type server struct {
@@ -58,6 +75,7 @@ var (
 	expectedRequestLarge       = make([]byte, initialWindowSize*2)
 	expectedResponseLarge      = make([]byte, initialWindowSize*2)
 	expectedInvalidHeaderField = "invalid/content-type"
+	testTrailerMetadata        = metadata.MD{"testkey": []string{"testval"}}
 )
 
 type testStreamHandler struct {
@@ -77,6 +95,9 @@ const (
 	delayRead
 	delayWrite
 	pingpong
+	trailerMD
+	statusDetails
+	echoMetadata
 )
 
 func (h *testStreamHandler) handleStreamAndNotify(s *Stream) {
@@ -136,6 +157,46 @@ func (h *testStreamHandler) handleStreamPingPong(t *testing.T, s *Stream) {
 	}
 }
 
+func (h *testStreamHandler) handleStreamTrailer(t *testing.T, s *Stream) {
+	if err := s.SetTrailer(testTrailerMetadata); err != nil {
+		t.Errorf("Error while setting trailer metadata: %v", err)
+	}
+	h.t.WriteStatus(s, status.New(codes.OK, ""))
+}
+
+// statusDetailsTestStatus builds the status, carrying a RetryInfo detail,
+// used by the grpc-status-details-bin round-trip test.
+func statusDetailsTestStatus(t *testing.T) *status.Status {
+	st, err := status.New(codes.ResourceExhausted, "try again later").WithDetails(&epb.RetryInfo{
+		RetryDelay: &dpb.Duration{Seconds: 7},
+	})
+	if err != nil {
+		t.Fatalf("Error while creating status with details: %v", err)
+	}
+	return st
+}
+
+func (h *testStreamHandler) handleStreamStatusDetails(t *testing.T, s *Stream) {
+	h.t.WriteStatus(s, statusDetailsTestStatus(t))
+}
+
+// handleStreamEchoMetadata sends the test keys of the incoming metadata back
+// to the client as trailer metadata.
+func (h *testStreamHandler) handleStreamEchoMetadata(t *testing.T, s *Stream) {
+	md, ok := metadata.FromIncomingContext(s.Context())
+	if !ok {
+		t.Errorf("Failed to read metadata from the stream's context")
+	}
+	echo := metadata.MD{}
+	for _, k := range []string{"small-key", "large-key"} {
+		echo[k] = md[k]
+	}
+	if err := s.SetTrailer(echo); err != nil {
+		t.Errorf("Error while setting trailer metadata: %v", err)
+	}
+	h.t.WriteStatus(s, status.New(codes.OK, ""))
+}
+
 func (h *testStreamHandler) handleStreamMisbehave(t *testing.T, s *Stream) {
 	conn, ok := s.ServerTransport().(*http2Server)
 	if !ok {
@@ -314,6 +375,24 @@ func (s *server) start(t *testing.T, port int, serverConfig *ServerConfig, ht hT
 			}, func(ctx context.Context, method string) context.Context {
 				return ctx
 			})
+		case trailerMD:
+			go transport.HandleStreams(func(s *Stream) {
+				go h.handleStreamTrailer(t, s)
+			}, func(ctx context.Context, method string) context.Context {
+				return ctx
+			})
+		case statusDetails:
+			go transport.HandleStreams(func(s *Stream) {
+				go h.handleStreamStatusDetails(t, s)
+			}, func(ctx context.Context, method string) context.Context {
+				return ctx
+			})
+		case echoMetadata:
+			go transport.HandleStreams(func(s *Stream) {
+				go h.handleStreamEchoMetadata(t, s)
+			}, func(ctx context.Context, method string) context.Context {
+				return ctx
+			})
 		default:
 			go transport.HandleStreams(func(s *Stream) {
 				go h.handleStream(t, s)
@@ -544,7 +623,7 @@ func TestKeepaliveServer(t *testing.T) {
 	if n, err := client.Write(clientPreface); err != nil || n != len(clientPreface) {
 		t.Fatalf("Error writing client preface; n=%v, err=%v", n, err)
 	}
-	framer := newFramer(client, defaultWriteBufSize, defaultReadBufSize)
+	framer := newFramer(client, defaultWriteBufSize, defaultReadBufSize, 0, 0, 0)
 	if err := framer.fr.WriteSettings(http2.Setting{}); err != nil {
 		t.Fatal("Error writing settings frame:", err)
 	}
@@ -610,6 +689,44 @@ func TestKeepaliveClientClosesIdleTransport(t *testing.T) {
 	}
 }
 
+// TestKeepaliveClientMaxUnackedPings verifies that with MaxUnackedPings set,
+// the client tolerates that many consecutive unacked pings before closing,
+// instead of closing on the first one.
+func TestKeepaliveClientMaxUnackedPings(t *testing.T) {
+	done := make(chan net.Conn, 1)
+	tr := setUpWithNoPingServer(t, ConnectOptions{KeepaliveParams: keepalive.ClientParameters{
+		Time:                500 * time.Millisecond,
+		Timeout:             500 * time.Millisecond,
+		PermitWithoutStream: true,
+		MaxUnackedPings:     3,
+	}}, done)
+	defer tr.Close()
+	conn, ok := <-done
+	if !ok {
+		t.Fatalf("Server didn't return connection object")
+	}
+	defer conn.Close()
+	ct := tr.(*http2Client)
+	// After one ping has gone unacked (~1s in) the transport must still be
+	// healthy; with the default budget it would have closed already.
+	time.Sleep(1200 * time.Millisecond)
+	ct.mu.Lock()
+	state := ct.state
+	ct.mu.Unlock()
+	if state != reachable {
+		t.Fatalf("Test failed: Expected client transport to survive the first unacked ping.")
+	}
+	// After three pings have gone unacked the transport must be closed.
+	waitWhileTrue(t, func() (bool, error) {
+		ct.mu.Lock()
+		defer ct.mu.Unlock()
+		if ct.state == reachable {
+			return true, fmt.Errorf("timed-out while waiting for the client transport to close")
+		}
+		return false, nil
+	})
+}
+
 func TestKeepaliveClientStaysHealthyOnIdleTransport(t *testing.T) {
 	done := make(chan net.Conn, 1)
 	tr := setUpWithNoPingServer(t, ConnectOptions{KeepaliveParams: keepalive.ClientParameters{
@@ -852,6 +969,63 @@ func TestClientSendAndReceive(t *testing.T) {
 	server.stop()
 }
 
+// TestReadBuffer exercises the zero-copy receive path: the stream hands the
+// message's backing buffer to the caller instead of copying it into a
+// caller-provided slice.
+func TestReadBuffer(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo.Small",
+	}
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	opts := Options{Last: true}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	// Read a prefix through the copying path, then drain the rest through
+	// ReadBuffer; the first buffer handed over is the unread remainder of
+	// the partially consumed message.
+	prefix := make([]byte, 2)
+	if _, err := s.Read(prefix); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	got := append([]byte(nil), prefix...)
+	for len(got) < len(expectedResponse) {
+		b, err := s.ReadBuffer()
+		if err != nil {
+			t.Fatalf("ReadBuffer() = _, %v", err)
+		}
+		got = append(got, b...)
+		ReleaseBuffer(b)
+	}
+	if !bytes.Equal(got, expectedResponse) {
+		t.Fatalf("Received %v, want %v", got, expectedResponse)
+	}
+	if _, err := s.ReadBuffer(); err != io.EOF {
+		t.Fatalf("ReadBuffer() = _, %v; want <EOF>", err)
+	}
+}
+
+// TestReleaseBufferReuse verifies that a released buffer goes back to the
+// pool and is handed out again for a subsequent message that fits in it.
+func TestReleaseBufferReuse(t *testing.T) {
+	b := getRecvData(64)
+	ReleaseBuffer(b)
+	nb := getRecvData(32)
+	if &nb[0] != &b[0] {
+		t.Fatalf("getRecvData did not reuse the released buffer")
+	}
+	if len(nb) != 32 {
+		t.Fatalf("Reused buffer has length %d, want 32", len(nb))
+	}
+}
+
 func TestClientErrorNotify(t *testing.T) {
 	server, ct := setUp(t, 0, math.MaxUint32, normal)
 	go server.stop()
@@ -1072,6 +1246,123 @@ func TestLargeMessageSuspension(t *testing.T) {
 	server.stop()
 }
 
+// TestWriteDeadline verifies that a per-write soft deadline bounds a Write
+// blocked on flow control and fires before the stream context deadline,
+// returning ErrWriteDeadlineExceeded without tearing the stream down.
+func TestWriteDeadline(t *testing.T) {
+	// Fix the server's windows so BDP estimation doesn't grow the client's
+	// send quota behind the test's back.
+	serverConfig := &ServerConfig{
+		InitialWindowSize:     defaultWindowSize,
+		InitialConnWindowSize: defaultWindowSize,
+	}
+	server, ct := setUpWithOptions(t, 0, serverConfig, suspended, ConnectOptions{})
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo.Large",
+	}
+	// The stream context outlives the per-write deadline by far.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	// Exhaust the stream's send window so the deadline write below blocks
+	// before committing any frame; the deadline is only honored until the
+	// first frame of a message is queued.
+	if err := ct.Write(s, nil, make([]byte, initialWindowSize), &Options{}); err != nil {
+		t.Fatalf("Failed to fill the send window: %v", err)
+	}
+	start := time.Now()
+	err = ct.Write(s, nil, expectedRequest, &Options{Last: true, WriteDeadline: start.Add(100 * time.Millisecond)})
+	if err != ErrWriteDeadlineExceeded {
+		t.Fatalf("Write got %v, want %v", err, ErrWriteDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Fatalf("Write took %v, want it bounded by the per-write deadline", elapsed)
+	}
+	// The stream survives the deadline: a retry blocks on the still-empty
+	// window and fails with the same retriable error instead of a stream
+	// teardown error.
+	if err := ct.Write(s, nil, expectedRequest, &Options{WriteDeadline: time.Now().Add(100 * time.Millisecond)}); err != ErrWriteDeadlineExceeded {
+		t.Fatalf("Retried Write got %v, want %v", err, ErrWriteDeadlineExceeded)
+	}
+	ct.Close()
+	server.stop()
+}
+
+// TestSettingsInitialWindowSizeMidConnection verifies that a
+// SETTINGS_INITIAL_WINDOW_SIZE change arriving mid-connection applies the
+// signed delta to the send quota of streams that are already open, per RFC
+// 7540 section 6.9.2, and that subsequent writes respect the new window.
+func TestSettingsInitialWindowSizeMidConnection(t *testing.T) {
+	const newWindow = 1000
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// probeQuota peeks at the stream's send quota without consuming it.
+	probeQuota := func() (int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		q, _, err := s.sendQuotaPool.get(math.MaxInt32, waiters{
+			ctx:  ctx,
+			tctx: context.Background(),
+		})
+		if err != nil {
+			return 0, err
+		}
+		s.sendQuotaPool.add(q)
+		return q, nil
+	}
+	initialQuota, err := probeQuota()
+	if err != nil {
+		t.Fatalf("Error while acquiring the initial stream send quota: %v", err)
+	}
+	if initialQuota != defaultWindowSize {
+		t.Fatalf("Initial stream send quota: %d, want %d", initialQuota, defaultWindowSize)
+	}
+	// Shrink the initial window size mid-connection; the client must apply
+	// the delta to the already-open stream.
+	st.controlBuf.put(&settings{ss: []http2.Setting{{ID: http2.SettingInitialWindowSize, Val: newWindow}}})
+	waitWhileTrue(t, func() (bool, error) {
+		q, err := probeQuota()
+		if err != nil {
+			return true, fmt.Errorf("error while acquiring stream send quota: %v", err)
+		}
+		if q != newWindow {
+			return true, fmt.Errorf("stream send quota after SETTINGS: %d, want %d", q, newWindow)
+		}
+		return false, nil
+	})
+	// A write that fits in the new window goes through; the next one blocks
+	// on the exhausted window until its soft deadline fires.
+	if err := ct.Write(s, nil, make([]byte, newWindow), &Options{WriteDeadline: time.Now().Add(2 * time.Second)}); err != nil {
+		t.Fatalf("Write within the new window got %v, want <nil>", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{WriteDeadline: time.Now().Add(100 * time.Millisecond)}); err != ErrWriteDeadlineExceeded {
+		t.Fatalf("Write beyond the new window got %v, want %v", err, ErrWriteDeadlineExceeded)
+	}
+}
+
 func TestMaxStreams(t *testing.T) {
 	server, ct := setUp(t, 0, 1, suspended)
 	callHdr := &CallHdr{
@@ -1197,464 +1488,863 @@ func TestServerContextCanceledOnClosedConnection(t *testing.T) {
 	server.stop()
 }
 
-func TestClientConnDecoupledFromApplicationRead(t *testing.T) {
-	connectOptions := ConnectOptions{
-		InitialWindowSize:     defaultWindowSize,
-		InitialConnWindowSize: defaultWindowSize,
-	}
-	server, client := setUpWithOptions(t, 0, &ServerConfig{}, notifyCall, connectOptions)
-	defer server.stop()
-	defer client.Close()
-
-	waitWhileTrue(t, func() (bool, error) {
-		server.mu.Lock()
-		defer server.mu.Unlock()
-
-		if len(server.conns) == 0 {
-			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
-		}
-		return false, nil
-	})
-
-	var st *http2Server
-	server.mu.Lock()
-	for k := range server.conns {
-		st = k.(*http2Server)
-	}
-	notifyChan := make(chan struct{})
-	server.h.notify = notifyChan
-	server.mu.Unlock()
-	cstream1, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+// TestDialUnixSocket verifies that the transport's dial path recognizes the
+// unix scheme and connects over a unix domain socket.
+func TestDialUnixSocket(t *testing.T) {
+	sock := fmt.Sprintf("%s/grpc-uds-test-%d.sock", os.TempDir(), os.Getpid())
+	lis, err := net.Listen("unix", sock)
 	if err != nil {
-		t.Fatalf("Client failed to create first stream. Err: %v", err)
+		t.Fatalf("Failed to listen on unix socket: %v", err)
 	}
-
-	<-notifyChan
-	var sstream1 *Stream
-	// Access stream on the server.
-	st.mu.Lock()
-	for _, v := range st.activeStreams {
-		if v.id == cstream1.id {
-			sstream1 = v
+	defer lis.Close()
+	defer os.Remove(sock)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
 		}
-	}
-	st.mu.Unlock()
-	if sstream1 == nil {
-		t.Fatalf("Didn't find stream corresponding to client cstream.id: %v on the server", cstream1.id)
-	}
-	// Exhaust client's connection window.
-	if err := st.Write(sstream1, []byte{}, make([]byte, defaultWindowSize), &Options{}); err != nil {
-		t.Fatalf("Server failed to write data. Err: %v", err)
-	}
-	notifyChan = make(chan struct{})
-	server.mu.Lock()
-	server.h.notify = notifyChan
-	server.mu.Unlock()
-	// Create another stream on client.
-	cstream2, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, nil, "unix://"+sock)
 	if err != nil {
-		t.Fatalf("Client failed to create second stream. Err: %v", err)
+		t.Fatalf("Failed to dial unix socket: %v", err)
 	}
-	<-notifyChan
-	var sstream2 *Stream
-	st.mu.Lock()
-	for _, v := range st.activeStreams {
-		if v.id == cstream2.id {
-			sstream2 = v
-		}
+	defer conn.Close()
+	msg := []byte("ping")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Failed to write to unix socket: %v", err)
 	}
-	st.mu.Unlock()
-	if sstream2 == nil {
-		t.Fatalf("Didn't find stream corresponding to client cstream.id: %v on the server", cstream2.id)
+	p := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, p); err != nil {
+		t.Fatalf("Failed to read echo from unix socket: %v", err)
 	}
-	// Server should be able to send data on the new stream, even though the client hasn't read anything on the first stream.
-	if err := st.Write(sstream2, []byte{}, make([]byte, defaultWindowSize), &Options{}); err != nil {
-		t.Fatalf("Server failed to write data. Err: %v", err)
+	if !bytes.Equal(p, msg) {
+		t.Fatalf("Read %q from echo server, want %q", p, msg)
 	}
+}
 
-	// Client should be able to read data on second stream.
-	if _, err := cstream2.Read(make([]byte, defaultWindowSize)); err != nil {
-		t.Fatalf("_.Read(_) = _, %v, want _, <nil>", err)
+func TestClientPrefaceTimeout(t *testing.T) {
+	done := make(chan net.Conn, 1)
+	// The server accepts the connection but never sends its preface, which
+	// should trip the client's preface timeout.
+	tr := setUpWithNoPingServer(t, ConnectOptions{PrefaceTimeout: 250 * time.Millisecond}, done)
+	defer tr.Close()
+	select {
+	case <-tr.Error():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out while waiting for the transport to close after a delayed server preface.")
 	}
+	if conn, ok := <-done; ok {
+		conn.Close()
+	}
+}
 
-	// Client should be able to read data on first stream.
-	if _, err := cstream1.Read(make([]byte, defaultWindowSize)); err != nil {
-		t.Fatalf("_.Read(_) = _, %v, want _, <nil>", err)
+// TestStreamMethodSplit exercises Service and MethodName on well-formed,
+// missing-slash and empty method paths.
+func TestStreamMethodSplit(t *testing.T) {
+	for _, test := range []struct {
+		method  string
+		service string
+		name    string
+	}{
+		{"/pkg.Service/Method", "pkg.Service", "Method"},
+		{"pkg.Service/Method", "pkg.Service", "Method"},
+		{"/foo.Service/sub/Method", "foo.Service/sub", "Method"},
+		{"/Method", "", ""},
+		{"Method", "", ""},
+		{"", "", ""},
+	} {
+		s := &Stream{method: test.method}
+		if got := s.Service(); got != test.service {
+			t.Errorf("Stream{method: %q}.Service() = %q, want %q", test.method, got, test.service)
+		}
+		if got := s.MethodName(); got != test.name {
+			t.Errorf("Stream{method: %q}.MethodName() = %q, want %q", test.method, got, test.name)
+		}
 	}
 }
 
-func TestServerConnDecoupledFromApplicationRead(t *testing.T) {
-	serverConfig := &ServerConfig{
+// TestMaxConnReceiveBuffer verifies that once the aggregate unread bytes
+// buffered by all streams exceed ServerConfig.MaxConnReceiveBuffer, the
+// server withholds connection-level window updates so the client's writes
+// block on connection flow control.
+func TestMaxConnReceiveBuffer(t *testing.T) {
+	copts := ConnectOptions{
 		InitialWindowSize:     defaultWindowSize,
 		InitialConnWindowSize: defaultWindowSize,
 	}
-	server, client := setUpWithOptions(t, 0, serverConfig, suspended, ConnectOptions{})
-	defer server.stop()
-	defer client.Close()
-	waitWhileTrue(t, func() (bool, error) {
-		server.mu.Lock()
-		defer server.mu.Unlock()
+	const numStreams = 12
+	msg := make([]byte, 16*1024)
+	writeAll := func(ct ClientTransport) chan error {
+		done := make(chan error, 1)
+		go func() {
+			for i := 0; i < numStreams; i++ {
+				s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+				if err != nil {
+					done <- err
+					return
+				}
+				if err := ct.Write(s, nil, msg, &Options{Last: false, Delay: false}); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+		return done
+	}
 
-		if len(server.conns) == 0 {
-			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+	// Without the bound, a server that never reads keeps replenishing the
+	// connection window and all writes complete.
+	serverConfig := &ServerConfig{
+		InitialWindowSize:     defaultWindowSize,
+		InitialConnWindowSize: defaultWindowSize,
+	}
+	server, ct := setUpWithOptions(t, 0, serverConfig, suspended, copts)
+	select {
+	case err := <-writeAll(ct):
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
 		}
-		return false, nil
-	})
-	var st *http2Server
-	server.mu.Lock()
-	for k := range server.conns {
-		st = k.(*http2Server)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Writes timed out with no aggregate receive buffer bound")
 	}
-	server.mu.Unlock()
-	cstream1, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
-	if err != nil {
-		t.Fatalf("Failed to create 1st stream. Err: %v", err)
-	}
-	// Exhaust server's connection window.
-	if err := client.Write(cstream1, nil, make([]byte, defaultWindowSize), &Options{Last: true}); err != nil {
-		t.Fatalf("Client failed to write data. Err: %v", err)
+	ct.Close()
+	server.stop()
+
+	// With the bound in place the connection window stops being replenished
+	// once the streams' buffers hold more than the configured bytes, and the
+	// writes block.
+	serverConfig.MaxConnReceiveBuffer = 16 * 1024
+	server, ct = setUpWithOptions(t, 0, serverConfig, suspended, copts)
+	defer server.stop()
+	defer ct.Close()
+	select {
+	case err := <-writeAll(ct):
+		t.Fatalf("Writes finished with error %v; want them to block on connection-level backpressure", err)
+	case <-time.After(1 * time.Second):
 	}
-	//Client should be able to create another stream and send data on it.
-	cstream2, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+}
+
+// TestDialRetries verifies that transport creation retries transient dial
+// failures within the connect deadline instead of failing on the first one.
+func TestDialRetries(t *testing.T) {
+	// Reserve a port with no listener behind it so the first dial attempt is
+	// refused, then start listening shortly before the retries run out.
+	lis, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
-		t.Fatalf("Failed to create 2nd stream. Err: %v", err)
+		t.Fatalf("Failed to listen: %v", err)
 	}
-	if err := client.Write(cstream2, nil, make([]byte, defaultWindowSize), &Options{}); err != nil {
-		t.Fatalf("Client failed to write data. Err: %v", err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	target := TargetInfo{Addr: addr}
+	connectCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(2*time.Second))
+	defer cancel()
+	// Without retries the refused connection surfaces immediately.
+	if _, err := NewClientTransport(connectCtx, context.Background(), target, ConnectOptions{}, func() {}); err == nil {
+		t.Fatalf("NewClientTransport() = _, <nil>, want an error with no listener and no retries")
 	}
-	// Get the streams on server.
-	waitWhileTrue(t, func() (bool, error) {
-		st.mu.Lock()
-		defer st.mu.Unlock()
 
-		if len(st.activeStreams) != 2 {
-			return true, fmt.Errorf("timed-out while waiting for server to have created the streams")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("Failed to listen: %v", err)
+			return
 		}
-		return false, nil
-	})
-	var sstream1 *Stream
-	st.mu.Lock()
-	for _, v := range st.activeStreams {
-		if v.id == 1 {
-			sstream1 = v
+		defer lis.Close()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Errorf("Error at server-side while accepting: %v", err)
+			return
 		}
-	}
-	st.mu.Unlock()
-	// Trying to write more on a max-ed out stream should result in a RST_STREAM from the server.
-	ct := client.(*http2Client)
-	ct.controlBuf.put(&dataFrame{cstream2.id, true, make([]byte, 1), func() {}})
-	code := http2ErrConvTab[http2.ErrCodeFlowControl]
-	waitWhileTrue(t, func() (bool, error) {
-		cstream2.mu.Lock()
-		defer cstream2.mu.Unlock()
-		if cstream2.status.Code() != code {
-			return true, fmt.Errorf("want code = %v, got %v", code, cstream2.status.Code())
+		defer conn.Close()
+		framer := http2.NewFramer(conn, conn)
+		if err := framer.WriteSettings(); err != nil {
+			t.Errorf("Error writing settings: %v", err)
+			return
 		}
-		return false, nil
-	})
-	// Reading from the stream on server should succeed.
-	if _, err := sstream1.Read(make([]byte, defaultWindowSize)); err != nil {
-		t.Fatalf("_.Read(_) = %v, want <nil>", err)
+		<-done
+	}()
+	copts := ConnectOptions{
+		DialRetries:      5,
+		DialRetryBackoff: 100 * time.Millisecond,
+	}
+	ct, err := NewClientTransport(connectCtx, context.Background(), target, copts, func() {})
+	if err != nil {
+		t.Fatalf("NewClientTransport() = _, %v, want it to succeed after retrying the dial", err)
 	}
+	ct.Close()
+}
 
-	if _, err := sstream1.Read(make([]byte, 1)); err != io.EOF {
-		t.Fatalf("_.Read(_) = %v, want io.EOF", err)
+// TestTrailersOnly contrasts a normal unary response, which carries initial
+// headers and data, with a trailers-only rejection consisting of a single
+// END_STREAM HEADERS frame.
+func TestTrailersOnly(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	opts := Options{Last: true, Delay: false}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil {
+		t.Fatalf("s.Read() = _, %v, want _, <nil>", err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if s.TrailersOnly() {
+		t.Fatalf("s.TrailersOnly() = true for a normal response, want false")
 	}
 
+	// A handler that only calls WriteStatus responds with a single HEADERS
+	// frame carrying END_STREAM.
+	server2, ct2 := setUp(t, 0, math.MaxUint32, trailerMD)
+	defer server2.stop()
+	defer ct2.Close()
+	s2, err := ct2.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if _, err := s2.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if !s2.TrailersOnly() {
+		t.Fatalf("s.TrailersOnly() = false for a trailers-only response, want true")
+	}
 }
 
-func TestServerWithMisbehavedClient(t *testing.T) {
+// TestMaxConnectionAgeJitter verifies that connections created around the
+// same time receive their max-age GOAWAYs at spread-out moments rather than
+// all at once.
+func TestMaxConnectionAgeJitter(t *testing.T) {
 	serverConfig := &ServerConfig{
-		InitialWindowSize:     defaultWindowSize,
-		InitialConnWindowSize: defaultWindowSize,
+		KeepaliveParams: keepalive.ServerParameters{
+			MaxConnectionAge:       1 * time.Second,
+			MaxConnectionAgeGrace:  10 * time.Second,
+			MaxConnectionAgeJitter: 0.5,
+		},
 	}
-	connectOptions := ConnectOptions{
-		InitialWindowSize:     defaultWindowSize,
-		InitialConnWindowSize: defaultWindowSize,
+	server, client := setUpWithOptions(t, 0, serverConfig, suspended, ConnectOptions{})
+	defer server.stop()
+	clients := []ClientTransport{client}
+	for i := 0; i < 9; i++ {
+		connectCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(2*time.Second))
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: "localhost:" + server.port}, ConnectOptions{}, func() {})
+		if err != nil {
+			cancel() // Do not cancel in success path.
+			t.Fatalf("failed to create transport: %v", err)
+		}
+		clients = append(clients, ct)
 	}
-	server, ct := setUpWithOptions(t, 0, serverConfig, suspended, connectOptions)
-	callHdr := &CallHdr{
-		Host:   "localhost",
-		Method: "foo",
+	for _, c := range clients {
+		defer c.Close()
 	}
-	var sc *http2Server
-	// Wait until the server transport is setup.
-	for {
-		server.mu.Lock()
-		if len(server.conns) == 0 {
-			server.mu.Unlock()
-			time.Sleep(time.Millisecond)
-			continue
-		}
-		for k := range server.conns {
-			var ok bool
-			sc, ok = k.(*http2Server)
-			if !ok {
-				t.Fatalf("Failed to convert %v to *http2Server", k)
+	start := time.Now()
+	var (
+		mu   sync.Mutex
+		ages []time.Duration
+		wg   sync.WaitGroup
+	)
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c ClientTransport) {
+			defer wg.Done()
+			select {
+			case <-c.GoAway():
+				mu.Lock()
+				ages = append(ages, time.Since(start))
+				mu.Unlock()
+			case <-time.After(5 * time.Second):
+				t.Errorf("Timed out waiting for GoAway")
 			}
-		}
-		server.mu.Unlock()
-		break
-	}
-	cc, ok := ct.(*http2Client)
-	if !ok {
-		t.Fatalf("Failed to convert %v to *http2Client", ct)
+		}(c)
 	}
-	// Test server behavior for violation of stream flow control window size restriction.
-	s, err := ct.NewStream(context.Background(), callHdr)
-	if err != nil {
-		t.Fatalf("Failed to open stream: %v", err)
+	wg.Wait()
+	if t.Failed() {
+		return
 	}
-	var sent int
-	// Drain the stream flow control window
-	cc.controlBuf.put(&dataFrame{s.id, false, make([]byte, http2MaxFrameLen), func() {}})
-	sent += http2MaxFrameLen
-	// Wait until the server creates the corresponding stream and receive some data.
-	var ss *Stream
-	for {
-		time.Sleep(time.Millisecond)
-		sc.mu.Lock()
-		if len(sc.activeStreams) == 0 {
-			sc.mu.Unlock()
-			continue
+	min, max := ages[0], ages[0]
+	for _, d := range ages[1:] {
+		if d < min {
+			min = d
 		}
-		ss = sc.activeStreams[s.id]
-		sc.mu.Unlock()
-		ss.fc.mu.Lock()
-		if ss.fc.pendingData > 0 {
-			ss.fc.mu.Unlock()
-			break
+		if d > max {
+			max = d
 		}
-		ss.fc.mu.Unlock()
-	}
-	if ss.fc.pendingData != http2MaxFrameLen || ss.fc.pendingUpdate != 0 || sc.fc.pendingData != 0 || sc.fc.pendingUpdate != 0 {
-		t.Fatalf("Server mistakenly updates inbound flow control params: got %d, %d, %d, %d; want %d, %d, %d, %d", ss.fc.pendingData, ss.fc.pendingUpdate, sc.fc.pendingData, sc.fc.pendingUpdate, http2MaxFrameLen, 0, 0, 0)
 	}
-	// Keep sending until the server inbound window is drained for that stream.
-	for sent <= initialWindowSize {
-		cc.controlBuf.put(&dataFrame{s.id, false, make([]byte, 1), func() {}})
-		sent++
+	if max-min < 20*time.Millisecond {
+		t.Fatalf("GOAWAY times spread over only %v; want them spread out by the max-age jitter", max-min)
 	}
-	// Server sent a resetStream for s already.
-	code := http2ErrConvTab[http2.ErrCodeFlowControl]
-	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
-		t.Fatalf("%v got err %v want <EOF>", s, err)
+}
+
+// TestSendHeader verifies that SendHeader pushes the stream's initial HEADERS
+// frame out to the server before the client has written any DATA frame.
+func TestSendHeader(t *testing.T) {
+	server, client := setUpWithOptions(t, 0, &ServerConfig{}, notifyCall, ConnectOptions{})
+	defer server.stop()
+	defer client.Close()
+
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+
+	notifyChan := make(chan struct{})
+	server.mu.Lock()
+	server.h.notify = notifyChan
+	server.mu.Unlock()
+	cstream, err := client.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Client failed to create stream. Err: %v", err)
 	}
-	if s.status.Code() != code {
-		t.Fatalf("%v got status %v; want Code=%v", s, s.status, code)
+	cstream.SendHeader()
+	// The server's stream handler must run on the strength of the flushed
+	// headers alone; no DATA frame has been written on the stream.
+	select {
+	case <-notifyChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the server to see the stream headers")
 	}
+}
 
-	ct.CloseStream(s, nil)
+// TestTransportPing verifies that ClientTransport.Ping returns once the
+// server acknowledges the ping, and times out against a server that never
+// responds.
+func TestTransportPing(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ct.Ping(ctx); err != nil {
+		t.Fatalf("ct.Ping() = %v, want <nil>", err)
+	}
 	ct.Close()
 	server.stop()
-}
 
-func TestClientWithMisbehavedServer(t *testing.T) {
-	// Turn off BDP estimation so that the server can
-	// violate stream window.
-	connectOptions := ConnectOptions{
-		InitialWindowSize: initialWindowSize,
+	// A server that never responds must make Ping fail with the context
+	// error once the deadline expires.
+	done := make(chan net.Conn, 1)
+	client := setUpWithNoPingServer(t, ConnectOptions{}, done)
+	defer client.Close()
+	conn, ok := <-done
+	if !ok {
+		t.Fatalf("Server didn't return connection object")
 	}
-	server, ct := setUpWithOptions(t, 0, &ServerConfig{}, misbehaved, connectOptions)
-	callHdr := &CallHdr{
-		Host:   "localhost",
-		Method: "foo.Stream",
+	defer conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := client.Ping(ctx); err != ContextErr(context.DeadlineExceeded) {
+		t.Fatalf("client.Ping() = %v, want %v", err, ContextErr(context.DeadlineExceeded))
 	}
-	conn, ok := ct.(*http2Client)
+}
+
+// TestMaxGoAways verifies that the client force-closes the transport once the
+// server has sent more GOAWAY frames than MaxGoAways allows, instead of
+// staying in the draining state forever.
+func TestMaxGoAways(t *testing.T) {
+	done := make(chan net.Conn, 1)
+	tr := setUpWithNoPingServer(t, ConnectOptions{MaxGoAways: 2}, done)
+	defer tr.Close()
+	conn, ok := <-done
 	if !ok {
-		t.Fatalf("Failed to convert %v to *http2Client", ct)
+		t.Fatalf("Server didn't return connection object")
 	}
-	// Test the logic for the violation of stream flow control window size restriction.
-	s, err := ct.NewStream(context.Background(), callHdr)
-	if err != nil {
-		t.Fatalf("Failed to open stream: %v", err)
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+		t.Fatalf("Error while reading client preface: %v", err)
 	}
-	d := make([]byte, 1)
-	if err := ct.Write(s, nil, d, &Options{Last: true, Delay: false}); err != nil && err != io.EOF {
-		t.Fatalf("Failed to write: %v", err)
+	sfr := http2.NewFramer(conn, conn)
+	if err := sfr.WriteSettings(); err != nil {
+		t.Fatalf("Error while writing settings: %v", err)
 	}
-	// Read without window update.
+	// Open a stream so the transport stays in draining state instead of
+	// closing as soon as the first GOAWAY arrives.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := tr.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// Wait for the stream's headers so the GOAWAY frames are guaranteed to be
+	// handled with an active stream present.
 	for {
-		p := make([]byte, http2MaxFrameLen)
-		if _, err = s.trReader.(*transportReader).reader.Read(p); err != nil {
+		frame, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error while reading frame: %v", err)
+		}
+		if _, ok := frame.(*http2.HeadersFrame); ok {
 			break
 		}
 	}
-	if s.fc.pendingData <= initialWindowSize || s.fc.pendingUpdate != 0 || conn.fc.pendingData != 0 || conn.fc.pendingUpdate != 0 {
-		t.Fatalf("Client mistakenly updates inbound flow control params: got %d, %d, %d, %d; want >%d, %d, %d, >%d", s.fc.pendingData, s.fc.pendingUpdate, conn.fc.pendingData, conn.fc.pendingUpdate, initialWindowSize, 0, 0, 0)
-	}
-
-	if err != io.EOF {
-		t.Fatalf("Got err %v, want <EOF>", err)
+	// None of these GOAWAYs kills the active stream, but the third one
+	// exceeds the limit.
+	for i := 0; i < 3; i++ {
+		if err := sfr.WriteGoAway(math.MaxUint32, http2.ErrCodeNo, nil); err != nil {
+			t.Fatalf("Error while writing GOAWAY: %v", err)
+		}
 	}
-	if s.status.Code() != codes.Internal {
-		t.Fatalf("Got s.status %v, want s.status.Code()=Internal", s.status)
+	select {
+	case <-tr.Error():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Transport didn't close after receiving more GOAWAY frames than MaxGoAways.")
 	}
-
-	conn.CloseStream(s, err)
-	ct.Close()
-	server.stop()
 }
 
-var encodingTestStatus = status.New(codes.Internal, "\n")
-
-func TestEncodingRequiredStatus(t *testing.T) {
-	server, ct := setUp(t, 0, math.MaxUint32, encodingRequiredStatus)
-	callHdr := &CallHdr{
-		Host:   "localhost",
-		Method: "foo",
+// TestOnDraining verifies that the OnDraining callback fires promptly when
+// the transport enters the draining state on its first GOAWAY, and only once
+// even when more GOAWAY frames follow.
+func TestOnDraining(t *testing.T) {
+	var fired int32
+	drainingCh := make(chan struct{}, 1)
+	done := make(chan net.Conn, 1)
+	tr := setUpWithNoPingServer(t, ConnectOptions{OnDraining: func() {
+		if atomic.AddInt32(&fired, 1) == 1 {
+			drainingCh <- struct{}{}
+		}
+	}}, done)
+	defer tr.Close()
+	conn, ok := <-done
+	if !ok {
+		t.Fatalf("Server didn't return connection object")
 	}
-	s, err := ct.NewStream(context.Background(), callHdr)
-	if err != nil {
-		return
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+		t.Fatalf("Error while reading client preface: %v", err)
 	}
-	opts := Options{
-		Last:  true,
-		Delay: false,
+	sfr := http2.NewFramer(conn, conn)
+	if err := sfr.WriteSettings(); err != nil {
+		t.Fatalf("Error while writing settings: %v", err)
 	}
-	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
-		t.Fatalf("Failed to write the request: %v", err)
+	// Open a stream so the transport stays in draining state instead of
+	// closing as soon as the first GOAWAY arrives.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := tr.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
 	}
-	p := make([]byte, http2MaxFrameLen)
-	if _, err := s.trReader.(*transportReader).Read(p); err != io.EOF {
-		t.Fatalf("Read got error %v, want %v", err, io.EOF)
+	for {
+		frame, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error while reading frame: %v", err)
+		}
+		if _, ok := frame.(*http2.HeadersFrame); ok {
+			break
+		}
 	}
-	if !reflect.DeepEqual(s.Status(), encodingTestStatus) {
-		t.Fatalf("stream with status %v, want %v", s.Status(), encodingTestStatus)
+	for i := 0; i < 2; i++ {
+		if err := sfr.WriteGoAway(math.MaxUint32, http2.ErrCodeNo, nil); err != nil {
+			t.Fatalf("Error while writing GOAWAY: %v", err)
+		}
+	}
+	select {
+	case <-drainingCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnDraining didn't fire after the first GOAWAY")
+	}
+	// Give the second GOAWAY time to be processed; the callback must not run
+	// again for it.
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Fatalf("OnDraining fired %d times, want 1", n)
 	}
-	ct.Close()
-	server.stop()
 }
 
-func TestInvalidHeaderField(t *testing.T) {
-	server, ct := setUp(t, 0, math.MaxUint32, invalidHeaderField)
-	callHdr := &CallHdr{
-		Host:   "localhost",
-		Method: "foo",
+// TestMaxControlBufBytes verifies that once the peer stalls, Write blocks
+// after MaxControlBufBytes of data have been queued in the control buffer
+// instead of enqueuing without limit, and that the blocked Write honors the
+// stream context.
+func TestMaxControlBufBytes(t *testing.T) {
+	done := make(chan net.Conn, 1)
+	tr := setUpWithNoPingServer(t, ConnectOptions{MaxControlBufBytes: 16 * 1024}, done)
+	defer tr.Close()
+	conn, ok := <-done
+	if !ok {
+		t.Fatalf("Server didn't return connection object")
 	}
-	s, err := ct.NewStream(context.Background(), callHdr)
-	if err != nil {
-		return
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+		t.Fatalf("Error while reading client preface: %v", err)
 	}
-	opts := Options{
-		Last:  true,
-		Delay: false,
+	// Grant the client ample flow-control quota so that the control buffer
+	// bound, not flow control, is what blocks the write. After these frames
+	// the server stalls and never reads off the connection again.
+	const grant = 10 * 1024 * 1024
+	sfr := http2.NewFramer(conn, conn)
+	if err := sfr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: grant}); err != nil {
+		t.Fatalf("Error while writing settings: %v", err)
 	}
-	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
-		t.Fatalf("Failed to write the request: %v", err)
+	if err := sfr.WriteWindowUpdate(0, grant); err != nil {
+		t.Fatalf("Error while writing window update: %v", err)
 	}
-	p := make([]byte, http2MaxFrameLen)
-	_, err = s.trReader.(*transportReader).Read(p)
-	if se, ok := err.(StreamError); !ok || se.Code != codes.FailedPrecondition || !strings.Contains(err.Error(), expectedInvalidHeaderField) {
-		t.Fatalf("Read got error %v, want error with code %s and contains %q", err, codes.FailedPrecondition, expectedInvalidHeaderField)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := tr.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	writeDone := make(chan error, 1)
+	go func() {
+		writeDone <- tr.Write(s, nil, make([]byte, 8*1024*1024), &Options{})
+	}()
+	select {
+	case err := <-writeDone:
+		t.Fatalf("Write returned %v; want it to block on the control buffer bound", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	// The blocked Write must still respect the stream context.
+	cancel()
+	select {
+	case err := <-writeDone:
+		if err != ContextErr(context.Canceled) {
+			t.Fatalf("Write returned %v, want %v", err, ContextErr(context.Canceled))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Write didn't return after the stream context was canceled.")
 	}
-	ct.Close()
-	server.stop()
 }
 
-func TestStreamContext(t *testing.T) {
-	expectedStream := &Stream{}
-	ctx := newContextWithStream(context.Background(), expectedStream)
-	s, ok := StreamFromContext(ctx)
-	if !ok || expectedStream != s {
-		t.Fatalf("GetStreamFromContext(%v) = %v, %t, want: %v, true", ctx, s, ok, expectedStream)
+// TestStreamIdleTimeout verifies that a stream carrying an idle timeout is
+// reset with codes.DeadlineExceeded when the server sends nothing within the
+// window.
+func TestStreamIdleTimeout(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo", IdleTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if _, err := s.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if got := s.Status().Code(); got != codes.DeadlineExceeded {
+		t.Fatalf("stream status code: %v, want %v", got, codes.DeadlineExceeded)
 	}
 }
 
-func TestIsReservedHeader(t *testing.T) {
-	tests := []struct {
-		h    string
-		want bool
-	}{
-		{"", false}, // but should be rejected earlier
-		{"foo", false},
-		{"content-type", true},
-		{"grpc-message-type", true},
-		{"grpc-encoding", true},
-		{"grpc-message", true},
-		{"grpc-status", true},
-		{"grpc-timeout", true},
-		{"te", true},
+// TestStreamIdleTimeoutReset verifies that the idle timer restarts on every
+// received message, so a stream that keeps receiving messages outlives its
+// idle timeout.
+func TestStreamIdleTimeoutReset(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{}, pingpong, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo", IdleTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
 	}
-	for _, tt := range tests {
-		got := isReservedHeader(tt.h)
-		if got != tt.want {
-			t.Errorf("isReservedHeader(%q) = %v; want %v", tt.h, got, tt.want)
+	const msgSize = 10
+	// Three round trips spaced out so that the total elapsed time exceeds the
+	// idle timeout while each individual gap stays within it.
+	for i := 0; i < 3; i++ {
+		time.Sleep(300 * time.Millisecond)
+		buf := make([]byte, msgSize+5)
+		binary.BigEndian.PutUint32(buf[1:], msgSize)
+		opts := Options{}
+		if i == 2 {
+			opts.Last = true
 		}
+		if err := ct.Write(s, nil, buf, &opts); err != nil {
+			t.Fatalf("Failed to write message: %v", err)
+		}
+		echo := make([]byte, msgSize+5)
+		if _, err := s.Read(echo[:5]); err != nil {
+			t.Fatalf("Failed to read echoed header: %v", err)
+		}
+		if _, err := s.Read(echo[5:]); err != nil {
+			t.Fatalf("Failed to read echoed message: %v", err)
+		}
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if got := s.Status().Code(); got != codes.OK {
+		t.Fatalf("stream status code: %v, want %v", got, codes.OK)
 	}
 }
 
-func TestContextErr(t *testing.T) {
-	for _, test := range []struct {
-		// input
-		errIn error
-		// outputs
-		errOut StreamError
-	}{
-		{context.DeadlineExceeded, StreamError{codes.DeadlineExceeded, context.DeadlineExceeded.Error()}},
-		{context.Canceled, StreamError{codes.Canceled, context.Canceled.Error()}},
-	} {
-		err := ContextErr(test.errIn)
-		if err != test.errOut {
-			t.Fatalf("ContextErr{%v} = %v \nwant %v", test.errIn, err, test.errOut)
+// TestTrailersOnlyResponse verifies that a handler calling WriteStatus
+// without having written headers or messages produces a single trailers-only
+// HEADERS frame on the wire, carrying :status and grpc-status together with
+// END_STREAM set.
+func TestTrailersOnlyResponse(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, trailerMD)
+	defer server.stop()
+	ct.Close()
+	conn, err := net.Dial("tcp", "localhost:"+server.port)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("Failed to write client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	henc.WriteField(hpack.HeaderField{Name: ":path", Value: "/foo"})
+	henc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+		EndStream:     true,
+	}); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error while waiting for the trailers-only response: %v", err)
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			if !f.StreamEnded() {
+				t.Fatalf("The first HEADERS frame from the server doesn't have END_STREAM set; want a single trailers-only frame")
+			}
+			var hasStatus, hasGRPCStatus bool
+			for _, hf := range f.Fields {
+				switch hf.Name {
+				case ":status":
+					hasStatus = true
+				case "grpc-status":
+					hasGRPCStatus = true
+				}
+			}
+			if !hasStatus || !hasGRPCStatus {
+				t.Fatalf("Trailers-only frame missing fields; got :status: %v, grpc-status: %v", hasStatus, hasGRPCStatus)
+			}
+			return
+		case *http2.DataFrame:
+			t.Fatalf("Received an unexpected DATA frame before the trailers-only response")
 		}
 	}
 }
 
-func max(a, b int32) int32 {
-	if a > b {
-		return a
+// TestStatusDetailsRoundTrip verifies that a status carrying details written
+// by the server through WriteStatus arrives at the client intact via the
+// grpc-status-details-bin trailer.
+func TestStatusDetailsRoundTrip(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, statusDetails)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if _, err := s.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	want := statusDetailsTestStatus(t)
+	got := s.Status()
+	if !proto.Equal(got.Proto(), want.Proto()) {
+		t.Fatalf("stream status: %v, want %v", got.Proto(), want.Proto())
 	}
-	return b
 }
 
-type windowSizeConfig struct {
-	serverStream int32
-	serverConn   int32
-	clientStream int32
-	clientConn   int32
+// TestRetryAfter verifies that the delay carried in a RetryInfo status
+// detail is surfaced through Stream.RetryAfter, and that streams without a
+// hint report none.
+func TestRetryAfter(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, statusDetails)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if d, ok := s.RetryAfter(); ok {
+		t.Fatalf("RetryAfter() before the stream finished = (%v, true), want ok=false", d)
+	}
+	if _, err := s.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if d, ok := s.RetryAfter(); !ok || d != 7*time.Second {
+		t.Fatalf("RetryAfter() = (%v, %v), want (7s, true)", d, ok)
+	}
 }
 
-func TestAccountCheckWindowSizeWithLargeWindow(t *testing.T) {
-	wc := windowSizeConfig{
-		serverStream: 10 * 1024 * 1024,
-		serverConn:   12 * 1024 * 1024,
-		clientStream: 6 * 1024 * 1024,
-		clientConn:   8 * 1024 * 1024,
+// TestClientTrailerMetadata verifies that trailers the server sets via
+// SetTrailer and WriteStatus are available through Stream.Trailer once the
+// stream has reached EOF.
+func TestClientTrailerMetadata(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, trailerMD)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if _, err := s.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	// The decoded metadata may carry extra entries such as content-type; only
+	// the trailers set by the handler are of interest here.
+	trailer := s.Trailer()
+	for k, want := range testTrailerMetadata {
+		if got := trailer[k]; !reflect.DeepEqual(got, want) {
+			t.Fatalf("s.Trailer()[%q] = %v, want %v", k, got, want)
+		}
 	}
-	testAccountCheckWindowSize(t, wc)
 }
 
-func TestAccountCheckWindowSizeWithSmallWindow(t *testing.T) {
-	wc := windowSizeConfig{
-		serverStream: defaultWindowSize,
-		// Note this is smaller than initialConnWindowSize which is the current default.
-		serverConn:   defaultWindowSize,
-		clientStream: defaultWindowSize,
-		clientConn:   defaultWindowSize,
+// TestClientTrailerMetadataEmpty verifies that Stream.Trailer returns an
+// empty, non-nil map when the server set no trailers.
+func TestClientTrailerMetadataEmpty(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	opts := Options{Last: true, Delay: false}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil {
+		t.Fatalf("s.Read() = _, %v, want _, <nil>", err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if trailer := s.Trailer(); trailer == nil || len(trailer) != 0 {
+		t.Fatalf("s.Trailer() = %v, want an empty non-nil MD", trailer)
 	}
-	testAccountCheckWindowSize(t, wc)
 }
 
-func testAccountCheckWindowSize(t *testing.T, wc windowSizeConfig) {
-	serverConfig := &ServerConfig{
-		InitialWindowSize:     wc.serverStream,
-		InitialConnWindowSize: wc.serverConn,
+// TestStreamFirstByteTime verifies that Stream.FirstByteTime records the
+// arrival of the first response DATA frame, exactly once, and stays zero on
+// a stream that never receives data.
+func TestStreamFirstByteTime(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
 	}
-	connectOptions := ConnectOptions{
-		InitialWindowSize:     wc.clientStream,
-		InitialConnWindowSize: wc.clientConn,
+	if got := s.FirstByteTime(); !got.IsZero() {
+		t.Fatalf("s.FirstByteTime() = %v before any data, want the zero Time", got)
 	}
-	server, client := setUpWithOptions(t, 0, serverConfig, suspended, connectOptions)
+	before := time.Now()
+	opts := Options{Last: true, Delay: false}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil {
+		t.Fatalf("s.Read() = _, %v, want _, <nil>", err)
+	}
+	ttfb := s.FirstByteTime()
+	if ttfb.IsZero() {
+		t.Fatalf("s.FirstByteTime() = zero Time after reading the response, want non-zero")
+	}
+	if ttfb.Before(before) || ttfb.After(time.Now()) {
+		t.Fatalf("s.FirstByteTime() = %v, want a time between %v and now", ttfb, before)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if got := s.FirstByteTime(); got != ttfb {
+		t.Fatalf("s.FirstByteTime() = %v after the stream finished, want it unchanged from %v", got, ttfb)
+	}
+
+	// A stream on which the server never sends data keeps a zero time.
+	server2, ct2 := setUp(t, 0, math.MaxUint32, suspended)
+	defer server2.stop()
+	defer ct2.Close()
+	s2, err := ct2.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct2.Write(s2, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := s2.FirstByteTime(); !got.IsZero() {
+		t.Fatalf("s.FirstByteTime() = %v on a stream with no response data, want the zero Time", got)
+	}
+}
+
+func TestMaxReceiveMessageBytesClient(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{}, pingpong, ConnectOptions{MaxReceiveMessageBytes: 100})
 	defer server.stop()
-	defer client.Close()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// Send a framed message larger than the client's receive limit; the
+	// pingpong handler echoes it back.
+	const msgSize = 200
+	buf := make([]byte, msgSize+5)
+	binary.BigEndian.PutUint32(buf[1:], msgSize)
+	if err := ct.Write(s, nil, buf, &Options{Last: true}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	p := make([]byte, 5)
+	if _, err := s.Read(p); err == nil {
+		t.Fatalf("s.Read(_) = _, <nil>, want _, non-nil error")
+	}
+	if got, want := s.Status().Code(), codes.ResourceExhausted; got != want {
+		t.Fatalf("s.Status().Code() = %v, want %v", got, want)
+	}
+}
 
-	// Wait for server conns to be populated with new server transport.
+// TestContentSubtypeRoundTrip verifies that the content-subtype set on the
+// client's CallHdr is sent as application/grpc+<subtype> and surfaces on the
+// server side stream, and that the plain application/grpc content-type still
+// round-trips as an empty subtype.
+func TestContentSubtypeRoundTrip(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
 	waitWhileTrue(t, func() (bool, error) {
 		server.mu.Lock()
 		defer server.mu.Unlock()
 		if len(server.conns) == 0 {
-			return true, fmt.Errorf("timed out waiting for server transport to be created")
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
 		}
 		return false, nil
 	})
@@ -1664,111 +2354,165 @@ func testAccountCheckWindowSize(t *testing.T, wc windowSizeConfig) {
 		st = k.(*http2Server)
 	}
 	server.mu.Unlock()
-	ct := client.(*http2Client)
-	cstream, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
-	if err != nil {
-		t.Fatalf("Failed to create stream. Err: %v", err)
-	}
-	// Wait for server to receive headers.
-	waitWhileTrue(t, func() (bool, error) {
-		st.mu.Lock()
-		defer st.mu.Unlock()
-		if len(st.activeStreams) == 0 {
-			return true, fmt.Errorf("timed out waiting for server to receive headers")
+	for _, subtype := range []string{"", "proto", "json", "mycodec"} {
+		s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo", ContentSubtype: subtype})
+		if err != nil {
+			t.Fatalf("Failed to open stream with content-subtype %q: %v", subtype, err)
 		}
-		return false, nil
-	})
-	// Sleeping to make sure the settings are applied in case of negative test.
-	time.Sleep(time.Second)
-
-	waitWhileTrue(t, func() (bool, error) {
-		st.fc.mu.Lock()
-		lim := st.fc.limit
-		st.fc.mu.Unlock()
-		if lim != uint32(serverConfig.InitialConnWindowSize) {
-			return true, fmt.Errorf("Server transport flow control window size: got %v, want %v", lim, serverConfig.InitialConnWindowSize)
+		var ss *Stream
+		waitWhileTrue(t, func() (bool, error) {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			var ok bool
+			ss, ok = st.activeStreams[s.id]
+			if !ok {
+				return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+			}
+			return false, nil
+		})
+		if got := ss.ContentSubtype(); got != subtype {
+			t.Fatalf("server stream ContentSubtype() = %q, want %q", got, subtype)
 		}
-		return false, nil
-	})
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	serverSendQuota, _, err := st.sendQuotaPool.get(math.MaxInt32, waiters{
-		ctx:    ctx,
-		tctx:   st.ctx,
-		done:   nil,
-		goAway: nil,
-	})
-	if err != nil {
-		t.Fatalf("Error while acquiring sendQuota on server. Err: %v", err)
-	}
-	cancel()
-	st.sendQuotaPool.add(serverSendQuota)
-	if serverSendQuota != int(connectOptions.InitialConnWindowSize) {
-		t.Fatalf("Server send quota(%v) not equal to client's window size(%v) on conn.", serverSendQuota, connectOptions.InitialConnWindowSize)
+		ct.CloseStream(s, nil)
 	}
-	st.mu.Lock()
-	ssq := st.streamSendQuota
-	st.mu.Unlock()
-	if ssq != uint32(connectOptions.InitialWindowSize) {
-		t.Fatalf("Server stream send quota(%v) not equal to client's window size(%v) on stream.", ssq, connectOptions.InitialWindowSize)
+}
+
+// TestAcceptCompressorsRoundTrip verifies that the client advertises its
+// supported decompressors via grpc-accept-encoding, defaulting to identity
+// and gzip, and that the server side stream surfaces the received list.
+func TestAcceptCompressorsRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		copts ConnectOptions
+		want  []string
+	}{
+		{ConnectOptions{}, []string{"identity", "gzip"}},
+		{ConnectOptions{AcceptCompressors: []string{"gzip", "snappy", "identity"}}, []string{"gzip", "snappy", "identity"}},
+	} {
+		server, ct := setUpWithOptions(t, 0, &ServerConfig{}, suspended, test.copts)
+		waitWhileTrue(t, func() (bool, error) {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if len(server.conns) == 0 {
+				return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+			}
+			return false, nil
+		})
+		var st *http2Server
+		server.mu.Lock()
+		for k := range server.conns {
+			st = k.(*http2Server)
+		}
+		server.mu.Unlock()
+		s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		var ss *Stream
+		waitWhileTrue(t, func() (bool, error) {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			var ok bool
+			ss, ok = st.activeStreams[s.id]
+			if !ok {
+				return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+			}
+			return false, nil
+		})
+		if got := ss.AcceptCompressors(); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("server stream AcceptCompressors() = %v, want %v", got, test.want)
+		}
+		ct.CloseStream(s, nil)
+		ct.Close()
+		server.stop()
 	}
-	ct.fc.mu.Lock()
-	limit := ct.fc.limit
-	ct.fc.mu.Unlock()
-	if limit != uint32(connectOptions.InitialConnWindowSize) {
-		t.Fatalf("Client transport flow control window size is %v, want %v", limit, connectOptions.InitialConnWindowSize)
+}
+
+// getKernelBufferSizes reads SO_RCVBUF and SO_SNDBUF off a TCP connection.
+func getKernelBufferSizes(t *testing.T, conn net.Conn) (rcv, snd int) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("connection type %T, want *net.TCPConn", conn)
 	}
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-	clientSendQuota, _, err := ct.sendQuotaPool.get(math.MaxInt32, waiters{
-		ctx:    ctx,
-		tctx:   ct.ctx,
-		done:   nil,
-		goAway: nil,
-	})
+	raw, err := tc.SyscallConn()
 	if err != nil {
-		t.Fatalf("Error while acquiring sendQuota on client. Err: %v", err)
+		t.Fatalf("SyscallConn() failed: %v", err)
 	}
-	cancel()
-	ct.sendQuotaPool.add(clientSendQuota)
-	if clientSendQuota != int(serverConfig.InitialConnWindowSize) {
-		t.Fatalf("Client send quota(%v) not equal to server's window size(%v) on conn.", clientSendQuota, serverConfig.InitialConnWindowSize)
+	cerr := raw.Control(func(fd uintptr) {
+		rcv, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if err != nil {
+			t.Errorf("getsockopt(SO_RCVBUF) failed: %v", err)
+		}
+		snd, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if err != nil {
+			t.Errorf("getsockopt(SO_SNDBUF) failed: %v", err)
+		}
+	})
+	if cerr != nil {
+		t.Fatalf("Control() failed: %v", cerr)
 	}
-	ct.mu.Lock()
-	ssq = ct.streamSendQuota
-	ct.mu.Unlock()
-	if ssq != uint32(serverConfig.InitialWindowSize) {
-		t.Fatalf("Client stream send quota(%v) not equal to server's window size(%v) on stream.", ssq, serverConfig.InitialWindowSize)
+	return rcv, snd
+}
+
+// TestKernelSocketBufferSizes verifies that the kernel buffer size options
+// apply SO_RCVBUF/SO_SNDBUF on both the dialed and the accepted connection.
+// The kernel may round the requested sizes up, so only a lower bound is
+// checked.
+func TestKernelSocketBufferSizes(t *testing.T) {
+	const bufSize = 64 * 1024
+	serverConfig := &ServerConfig{
+		ReadBufferKernelSize:  bufSize,
+		WriteBufferKernelSize: bufSize,
 	}
-	cstream.fc.mu.Lock()
-	limit = cstream.fc.limit
-	cstream.fc.mu.Unlock()
-	if limit != uint32(connectOptions.InitialWindowSize) {
-		t.Fatalf("Client stream flow control window size is %v, want %v", limit, connectOptions.InitialWindowSize)
+	copts := ConnectOptions{
+		ReadBufferKernelSize:  bufSize,
+		WriteBufferKernelSize: bufSize,
 	}
-	var sstream *Stream
-	st.mu.Lock()
-	for _, v := range st.activeStreams {
-		sstream = v
+	server, ct := setUpWithOptions(t, 0, serverConfig, suspended, copts)
+	defer server.stop()
+	defer ct.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
 	}
-	st.mu.Unlock()
-	sstream.fc.mu.Lock()
-	limit = sstream.fc.limit
-	sstream.fc.mu.Unlock()
-	if limit != uint32(serverConfig.InitialWindowSize) {
-		t.Fatalf("Server stream flow control window size is %v, want %v", limit, serverConfig.InitialWindowSize)
+	server.mu.Unlock()
+	for _, side := range []struct {
+		name string
+		conn net.Conn
+	}{
+		{"client", ct.(*http2Client).conn},
+		{"server", st.conn},
+	} {
+		rcv, snd := getKernelBufferSizes(t, side.conn)
+		if rcv < bufSize {
+			t.Errorf("%s SO_RCVBUF = %d, want >= %d", side.name, rcv, bufSize)
+		}
+		if snd < bufSize {
+			t.Errorf("%s SO_SNDBUF = %d, want >= %d", side.name, snd, bufSize)
+		}
 	}
 }
 
-// Check accounting on both sides after sending and receiving large messages.
-func TestAccountCheckExpandingWindow(t *testing.T) {
-	server, client := setUp(t, 0, 0, pingpong)
+// TestServerTCPKeepAlive verifies that ServerConfig.TCPKeepAlive enables
+// SO_KEEPALIVE with the configured period on the accepted connection.
+func TestServerTCPKeepAlive(t *testing.T) {
+	const period = 2 * time.Minute
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{TCPKeepAlive: period}, suspended, ConnectOptions{})
 	defer server.stop()
-	defer client.Close()
+	defer ct.Close()
 	waitWhileTrue(t, func() (bool, error) {
 		server.mu.Lock()
 		defer server.mu.Unlock()
 		if len(server.conns) == 0 {
-			return true, fmt.Errorf("timed out while waiting for server transport to be created")
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
 		}
 		return false, nil
 	})
@@ -1778,452 +2522,4371 @@ func TestAccountCheckExpandingWindow(t *testing.T) {
 		st = k.(*http2Server)
 	}
 	server.mu.Unlock()
-	ct := client.(*http2Client)
-	cstream, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	tc, ok := st.conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("server connection type %T, want *net.TCPConn", st.conn)
+	}
+	raw, err := tc.SyscallConn()
 	if err != nil {
-		t.Fatalf("Failed to create stream. Err: %v", err)
+		t.Fatalf("SyscallConn() failed: %v", err)
 	}
-
-	msgSize := 65535 * 16 * 2
-	msg := make([]byte, msgSize)
-	buf := make([]byte, msgSize+5)
-	buf[0] = byte(0)
-	binary.BigEndian.PutUint32(buf[1:], uint32(msgSize))
-	copy(buf[5:], msg)
-	opts := Options{}
-	header := make([]byte, 5)
-	for i := 1; i <= 10; i++ {
-		if err := ct.Write(cstream, nil, buf, &opts); err != nil {
-			t.Fatalf("Error on client while writing message: %v", err)
-		}
-		if _, err := cstream.Read(header); err != nil {
-			t.Fatalf("Error on client while reading data frame header: %v", err)
-		}
-		sz := binary.BigEndian.Uint32(header[1:])
-		recvMsg := make([]byte, int(sz))
-		if _, err := cstream.Read(recvMsg); err != nil {
-			t.Fatalf("Error on client while reading data: %v", err)
+	var enabled, idle int
+	cerr := raw.Control(func(fd uintptr) {
+		enabled, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if err != nil {
+			t.Errorf("getsockopt(SO_KEEPALIVE) failed: %v", err)
 		}
-		if len(recvMsg) != len(msg) {
-			t.Fatalf("Length of message received by client: %v, want: %v", len(recvMsg), len(msg))
+		idle, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		if err != nil {
+			t.Errorf("getsockopt(TCP_KEEPIDLE) failed: %v", err)
 		}
+	})
+	if cerr != nil {
+		t.Fatalf("Control() failed: %v", cerr)
 	}
-	defer func() {
-		ct.Write(cstream, nil, nil, &Options{Last: true}) // Close the stream.
-		if _, err := cstream.Read(header); err != io.EOF {
-			t.Fatalf("Client expected an EOF from the server. Got: %v", err)
-		}
-	}()
-	var sstream *Stream
-	st.mu.Lock()
-	for _, v := range st.activeStreams {
-		sstream = v
+	if enabled == 0 {
+		t.Errorf("SO_KEEPALIVE is off on the accepted connection, want it enabled")
 	}
-	st.mu.Unlock()
+	if want := int(period / time.Second); idle != want {
+		t.Errorf("TCP_KEEPIDLE = %d, want %d", idle, want)
+	}
+}
 
-	waitWhileTrue(t, func() (bool, error) {
-		// Check that pendingData and delta on flow control windows on both sides are 0.
-		cstream.fc.mu.Lock()
-		if cstream.fc.delta != 0 {
-			cstream.fc.mu.Unlock()
-			return true, fmt.Errorf("delta on flow control window of client stream is non-zero")
-		}
-		if cstream.fc.pendingData != 0 {
-			cstream.fc.mu.Unlock()
-			return true, fmt.Errorf("pendingData on flow control window of client stream is non-zero")
+// TestServerPrefaceReadTimeout verifies that a connection whose client never
+// finishes sending the HTTP/2 preface is closed once
+// ServerConfig.PrefaceReadTimeout elapses.
+func TestServerPrefaceReadTimeout(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{PrefaceReadTimeout: 100 * time.Millisecond}, suspended, ConnectOptions{})
+	defer server.stop()
+	ct.Close()
+	conn, err := net.Dial("tcp", "localhost:"+server.port)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// Send a partial preface and then stall.
+	if _, err := conn.Write(clientPreface[:4]); err != nil {
+		t.Fatalf("Failed to write partial preface: %v", err)
+	}
+	// The server writes its SETTINGS frame right away; keep reading past it
+	// until the server gives up on the preface and closes the connection.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := conn.Read(make([]byte, 256)); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Read() = _, %v, want _, io.EOF from the server closing the connection", err)
+			}
+			break
 		}
-		cstream.fc.mu.Unlock()
-		sstream.fc.mu.Lock()
-		if sstream.fc.delta != 0 {
-			sstream.fc.mu.Unlock()
-			return true, fmt.Errorf("delta on flow control window of server stream is non-zero")
+	}
+}
+
+// TestHTTPConnectProxy runs a minimal CONNECT proxy in front of the
+// in-package server and verifies that a transport configured with
+// ConnectOptions.ProxyURL tunnels an RPC through it, sending basic proxy
+// auth along the way.
+func TestHTTPConnectProxy(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	ct.Close()
+	plis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for the proxy: %v", err)
+	}
+	defer plis.Close()
+	const wantAuth = "Basic " + "dGVzdHVzZXI6dGVzdHBhc3M=" // testuser:testpass
+	proxyDone := make(chan struct{})
+	go func() {
+		defer close(proxyDone)
+		in, err := plis.Accept()
+		if err != nil {
+			t.Errorf("Proxy failed to accept: %v", err)
+			return
 		}
-		if sstream.fc.pendingData != 0 {
-			sstream.fc.mu.Unlock()
-			return true, fmt.Errorf("pendingData on flow control window of sercer stream is non-zero")
+		defer in.Close()
+		br := bufio.NewReader(in)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Errorf("Proxy failed to read request: %v", err)
+			return
 		}
-		sstream.fc.mu.Unlock()
-		ct.fc.mu.Lock()
-		if ct.fc.delta != 0 {
-			ct.fc.mu.Unlock()
-			return true, fmt.Errorf("delta on flow control window of client transport is non-zero")
+		if req.Method != http.MethodConnect {
+			t.Errorf("Proxy received method %q, want CONNECT", req.Method)
+			return
 		}
-		if ct.fc.pendingData != 0 {
-			ct.fc.mu.Unlock()
-			return true, fmt.Errorf("pendingData on flow control window of client transport is non-zero")
+		if got := req.Header.Get("Proxy-Authorization"); got != wantAuth {
+			t.Errorf("Proxy-Authorization = %q, want %q", got, wantAuth)
+			return
 		}
-		ct.fc.mu.Unlock()
-		st.fc.mu.Lock()
-		if st.fc.delta != 0 {
-			st.fc.mu.Unlock()
-			return true, fmt.Errorf("delta on flow control window of server transport is non-zero")
+		out, err := net.Dial("tcp", req.URL.Host)
+		if err != nil {
+			t.Errorf("Proxy failed to dial %q: %v", req.URL.Host, err)
+			return
 		}
-		if st.fc.pendingData != 0 {
-			st.fc.mu.Unlock()
-			return true, fmt.Errorf("pendingData on flow control window of server transport is non-zero")
+		defer out.Close()
+		if _, err := in.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+			t.Errorf("Proxy failed to write response: %v", err)
+			return
 		}
-		st.fc.mu.Unlock()
-
-		// Check flow conrtrol window on client stream is equal to out flow on server stream.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		serverStreamSendQuota, _, err := sstream.sendQuotaPool.get(math.MaxInt32, waiters{
-			ctx:    ctx,
-			tctx:   context.Background(),
-			done:   nil,
-			goAway: nil,
-		})
-		cancel()
+		go func() {
+			io.Copy(out, br)
+			out.Close()
+		}()
+		io.Copy(in, out)
+	}()
+	proxyURL := &url.URL{
+		Host: plis.Addr().String(),
+		User: url.UserPassword("testuser", "testpass"),
+	}
+	connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ct, err = NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: "localhost:" + server.port}, ConnectOptions{ProxyURL: proxyURL}, func() {})
+	if err != nil {
+		cancel()
+		t.Fatalf("Failed to create transport through the proxy: %v", err)
+	}
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("s.Read() = %v, %v, want %v, <nil>", p, err, expectedResponse)
+	}
+	if _, err := s.Read(p); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	ct.Close()
+	<-proxyDone
+}
+
+// TestMaxHeaderFields verifies that a stream carrying more header fields than
+// ServerConfig.MaxHeaderFields allows is reset with codes.ResourceExhausted
+// before reaching the handler, while a stream within the limit is served.
+func TestMaxHeaderFields(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{MaxHeaderFields: 10}, normal, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{Host: "localhost", Method: "foo.Small"}
+	// A stream within the limit completes normally.
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("key", "val"))
+	s, err := ct.NewStream(ctx, callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("s.Read() = %v, %v, want %v, <nil>", p, err, expectedResponse)
+	}
+	// Twenty custom fields push the count past the limit of ten.
+	md := metadata.MD{}
+	for i := 0; i < 20; i++ {
+		md[fmt.Sprintf("key-%d", i)] = []string{"v"}
+	}
+	ctx = metadata.NewOutgoingContext(context.Background(), md)
+	s, err = ct.NewStream(ctx, callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	if _, err := s.Read(p); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if got := s.Status().Code(); got != codes.ResourceExhausted {
+		t.Fatalf("stream status code: %v, want %v", got, codes.ResourceExhausted)
+	}
+}
+
+// waitStreamDone blocks until the stream's Done channel closes and checks
+// the final status code.
+func waitStreamDone(t *testing.T, s *Stream, want codes.Code) {
+	t.Helper()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for the stream's Done channel to close")
+	}
+	st := s.FinalStatus()
+	if st == nil || st.Code() != want {
+		t.Fatalf("FinalStatus() = %v, want code %v", st, want)
+	}
+}
+
+// TestStreamDoneTerminalConditions checks that Done fires and FinalStatus
+// carries the reason for each way a stream can end: the server's final
+// status, a client-side close, a server reset, and the connection going
+// away.
+func TestStreamDoneTerminalConditions(t *testing.T) {
+	// Normal completion with the server's OK status.
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if st := s.FinalStatus(); st != nil {
+		t.Fatalf("FinalStatus() on a live stream = %v, want <nil>", st)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil {
+		t.Fatalf("s.Read() = _, %v, want _, <nil>", err)
+	}
+	if _, err := s.Read(p); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	waitStreamDone(t, s, codes.OK)
+	ct.Close()
+	server.stop()
+
+	// Client-side close, e.g. on context cancellation.
+	server, ct = setUp(t, 0, math.MaxUint32, suspended)
+	s, err = ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ct.CloseStream(s, ContextErr(context.Canceled))
+	waitStreamDone(t, s, codes.Canceled)
+	ct.Close()
+	server.stop()
+
+	// Server reset of the stream.
+	server, ct = setUpWithOptions(t, 0, &ServerConfig{MaxHeaderFields: 5}, suspended, ConnectOptions{})
+	md := metadata.MD{}
+	for i := 0; i < 20; i++ {
+		md[fmt.Sprintf("key-%d", i)] = []string{"v"}
+	}
+	s, err = ct.NewStream(metadata.NewOutgoingContext(context.Background(), md), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	waitStreamDone(t, s, codes.ResourceExhausted)
+	ct.Close()
+	server.stop()
+
+	// The connection goes away under the stream.
+	server, ct = setUp(t, 0, math.MaxUint32, suspended)
+	defer ct.Close()
+	s, err = ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	server.stop()
+	waitStreamDone(t, s, codes.Unavailable)
+}
+
+// TestStreamSendWindowSampling samples a stream's available send quota
+// during a ping-pong transfer and checks that the observed values stay
+// within the fixed window bounds, and that sampling consumes nothing.
+func TestStreamSendWindowSampling(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{DisableBDPEstimation: true}, pingpong, ConnectOptions{DisableBDPEstimation: true})
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	const msgSize = 1024
+	for i := 0; i < 10; i++ {
+		buf := make([]byte, msgSize+5)
+		binary.BigEndian.PutUint32(buf[1:], msgSize)
+		opts := Options{}
+		if i == 9 {
+			opts.Last = true
+		}
+		if err := ct.Write(s, nil, buf, &opts); err != nil {
+			t.Fatalf("Failed to write message %d: %v", i, err)
+		}
+		echo := make([]byte, msgSize+5)
+		if _, err := io.ReadFull(s, echo); err != nil {
+			t.Fatalf("Failed to read echoed message %d: %v", i, err)
+		}
+		if w := s.SendWindow(); w < 0 || w > defaultWindowSize {
+			t.Fatalf("SendWindow() after message %d = %d, want within [0, %d]", i, w, defaultWindowSize)
+		}
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+}
+
+// TestMethodFilter verifies that a stream for a method the filter rejects
+// gets a trailers-only Unimplemented response without reaching a handler,
+// while a stream for an allowed method is served normally.
+func TestMethodFilter(t *testing.T) {
+	filter := func(method string) bool { return method == "foo.Small" }
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{MethodFilter: filter}, normal, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	// The allowed method is served normally.
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("s.Read() = %v, %v, want %v, <nil>", p, err, expectedResponse)
+	}
+	// The filtered method is answered with trailers-only Unimplemented.
+	s, err = ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Unknown"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if _, err := s.Read(p); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if got := s.Status().Code(); got != codes.Unimplemented {
+		t.Fatalf("stream status code: %v, want %v", got, codes.Unimplemented)
+	}
+	if !s.TrailersOnly() {
+		t.Fatalf("TrailersOnly() = false, want true for the filtered method")
+	}
+}
+
+// TestAuthorityValidator verifies that a stream with a disallowed
+// :authority is answered with a trailers-only PermissionDenied response
+// while an allowed authority is served.
+func TestAuthorityValidator(t *testing.T) {
+	validator := func(authority string) bool { return authority == "localhost" }
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{AuthorityValidator: validator}, normal, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	// The allowed authority is served normally.
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("s.Read() = %v, %v, want %v, <nil>", p, err, expectedResponse)
+	}
+	// A disallowed authority is rejected before any handler runs.
+	s, err = ct.NewStream(context.Background(), &CallHdr{Host: "evil.example.com", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if _, err := s.Read(p); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	if got := s.Status().Code(); got != codes.PermissionDenied {
+		t.Fatalf("stream status code: %v, want %v", got, codes.PermissionDenied)
+	}
+	if !s.TrailersOnly() {
+		t.Fatalf("TrailersOnly() = false, want true for the rejected authority")
+	}
+}
+
+// TestOnStreamComplete checks that the access-log hook fires exactly once
+// per stream with a populated record, for both a normal and a cancelled
+// RPC.
+func TestOnStreamComplete(t *testing.T) {
+	recCh := make(chan StreamRecord, 4)
+	cfg := &ServerConfig{OnStreamComplete: func(rec StreamRecord) { recCh <- rec }}
+	server, ct := setUpWithOptions(t, 0, cfg, normal, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil {
+		t.Fatalf("s.Read() = _, %v, want _, <nil>", err)
+	}
+	if _, err := s.Read(p); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+	var rec StreamRecord
+	select {
+	case rec = <-recCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for the stream record")
+	}
+	if rec.Method != "foo.Small" {
+		t.Errorf("rec.Method = %q, want %q", rec.Method, "foo.Small")
+	}
+	if rec.StatusCode != codes.OK {
+		t.Errorf("rec.StatusCode = %v, want %v", rec.StatusCode, codes.OK)
+	}
+	if rec.BytesIn != int64(len(expectedRequest)) {
+		t.Errorf("rec.BytesIn = %d, want %d", rec.BytesIn, len(expectedRequest))
+	}
+	if rec.BytesOut != int64(len(expectedResponse)) {
+		t.Errorf("rec.BytesOut = %d, want %d", rec.BytesOut, len(expectedResponse))
+	}
+	if rec.Duration <= 0 {
+		t.Errorf("rec.Duration = %v, want > 0", rec.Duration)
+	}
+	if rec.PeerAddr == nil {
+		t.Errorf("rec.PeerAddr = <nil>, want the client's address")
+	}
+	// A cancelled RPC is recorded with the reset's status.
+	s, err = ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ct.CloseStream(s, ContextErr(context.Canceled))
+	select {
+	case rec = <-recCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for the cancelled stream's record")
+	}
+	if rec.StatusCode != codes.Canceled {
+		t.Errorf("rec.StatusCode = %v, want %v", rec.StatusCode, codes.Canceled)
+	}
+	// No stream may be recorded more than once.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case rec = <-recCh:
+		t.Fatalf("Received an extra stream record: %+v", rec)
+	default:
+	}
+}
+
+// TestMaxStreamsPerSecond opens streams in a tight loop against a server
+// with a low stream rate limit and checks that streams beyond the burst
+// allowance are reset with codes.ResourceExhausted while the ones within it
+// stay live.
+func TestMaxStreamsPerSecond(t *testing.T) {
+	const rate = 5
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{MaxStreamsPerSecond: rate}, suspended, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{Host: "localhost", Method: "foo"}
+	var streams []*Stream
+	for i := 0; i < 3*rate; i++ {
+		s, err := ct.NewStream(context.Background(), callHdr)
+		if err != nil {
+			t.Fatalf("Failed to open stream %d: %v", i, err)
+		}
+		streams = append(streams, s)
+	}
+	// The burst allowance admits the first streams; the tight loop is fast
+	// enough that the ones past it must have been rejected.
+	waitStreamDone(t, streams[len(streams)-1], codes.ResourceExhausted)
+	select {
+	case <-streams[0].Done():
+		t.Fatalf("stream within the rate limit was terminated: %v", streams[0].FinalStatus())
+	default:
+	}
+}
+
+// TestServerContentSubtypeMismatch verifies that the server answers a stream
+// whose content-type is not a valid gRPC content-type through the HTTP
+// mapping path, with a 415 trailers-only response instead of a stream reset.
+func TestServerContentSubtypeMismatch(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	ct.Close()
+	conn, err := net.Dial("tcp", "localhost:"+server.port)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("Failed to write client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	henc.WriteField(hpack.HeaderField{Name: ":path", Value: "/foo"})
+	henc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	// A '-' instead of '+' makes this an invalid gRPC content-type.
+	henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc-proto"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	timer := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error while expecting a 415 response: %v", err)
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			if f.Header().StreamID != 1 {
+				t.Fatalf("Got response for stream %d, want stream 1", f.Header().StreamID)
+			}
+			if got := f.PseudoValue("status"); got != "415" {
+				t.Fatalf("Got :status %q, want %q", got, "415")
+			}
+			if !f.StreamEnded() {
+				t.Fatalf("Got a 415 response without END_STREAM")
+			}
+			return
+		case *http2.RSTStreamFrame:
+			t.Fatalf("Got an RST frame, want a 415 response")
+		}
+	}
+}
+
+// TestTransportAddresses verifies that both transports expose the underlying
+// connection's addresses: the client's remote address is the server
+// listener's address, and the two ends of the connection agree with each
+// other.
+func TestTransportAddresses(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st ServerTransport
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k
+	}
+	server.mu.Unlock()
+	if got, want := ct.RemoteAddr().String(), server.lis.Addr().String(); got != want {
+		t.Errorf("client RemoteAddr() = %q, want %q", got, want)
+	}
+	if got, want := st.LocalAddr().String(), server.lis.Addr().String(); got != want {
+		t.Errorf("server LocalAddr() = %q, want %q", got, want)
+	}
+	if got, want := ct.LocalAddr().String(), st.RemoteAddr().String(); got != want {
+		t.Errorf("client LocalAddr() = %q, server RemoteAddr() = %q, want them equal", got, want)
+	}
+}
+
+// selfSignedCert creates a throwaway certificate with the given common name
+// for TLS tests.
+func selfSignedCert(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key for %q: %v", cn, err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate for %q: %v", cn, err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCredsSelector(t *testing.T) {
+	serverCert := selfSignedCert(t, "test-server")
+	// startServer accepts a single mutual-TLS connection, reports the common
+	// name of the client certificate it presented and then serves HTTP/2 on it.
+	startServer := func() (net.Listener, chan string) {
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		seenCN := make(chan string, 1)
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := tls.Server(conn, &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tls.RequireAnyClientCert,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return
+			}
+			seenCN <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			st, err := NewServerTransport("http2", tlsConn, &ServerConfig{})
+			if err != nil {
+				return
+			}
+			st.HandleStreams(func(*Stream) {}, func(ctx context.Context, method string) context.Context {
+				return ctx
+			})
+		}()
+		return lis, seenCN
+	}
+	lis1, seenCN1 := startServer()
+	defer lis1.Close()
+	lis2, seenCN2 := startServer()
+	defer lis2.Close()
+	credsFor := map[string]credentials.TransportCredentials{
+		lis1.Addr().String(): credentials.NewTLS(&tls.Config{
+			Certificates:       []tls.Certificate{selfSignedCert(t, "client-one")},
+			InsecureSkipVerify: true,
+		}),
+		lis2.Addr().String(): credentials.NewTLS(&tls.Config{
+			Certificates:       []tls.Certificate{selfSignedCert(t, "client-two")},
+			InsecureSkipVerify: true,
+		}),
+	}
+	copts := ConnectOptions{
+		CredsSelector: func(target TargetInfo) credentials.TransportCredentials {
+			return credsFor[target.Addr]
+		},
+	}
+	connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		addr   string
+		seenCN chan string
+		want   string
+	}{
+		{lis1.Addr().String(), seenCN1, "client-one"},
+		{lis2.Addr().String(), seenCN2, "client-two"},
+	} {
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: tc.addr}, copts, func() {})
+		if err != nil {
+			t.Fatalf("Failed to connect to %v: %v", tc.addr, err)
+		}
+		defer ct.Close()
+		select {
+		case got := <-tc.seenCN:
+			if got != tc.want {
+				t.Errorf("Server at %v saw client identity %q, want %q", tc.addr, got, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the server at %v to observe a client certificate", tc.addr)
+		}
+	}
+}
+
+// TestRequiredALPN verifies that a TLS client which did not negotiate one of
+// the required ALPN protocols is rejected at transport setup.
+func TestRequiredALPN(t *testing.T) {
+	serverCert := selfSignedCert(t, "test-server")
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	for _, tt := range []struct {
+		name       string
+		nextProtos []string
+		wantErr    bool
+	}{
+		{"no ALPN", nil, true},
+		{"wrong protocol", []string{"http/1.1"}, true},
+		{"h2", []string{"h2"}, false},
+	} {
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: failed to dial: %v", tt.name, err)
+		}
+		server, err := lis.Accept()
+		if err != nil {
+			t.Fatalf("%s: failed to accept: %v", tt.name, err)
+		}
+		tlsClient := tls.Client(client, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         tt.nextProtos,
+		})
+		handshakeErr := make(chan error, 1)
+		go func() {
+			handshakeErr <- tlsClient.Handshake()
+		}()
+		tlsServer := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		})
+		if err := tlsServer.Handshake(); err != nil {
+			t.Fatalf("%s: server handshake failed: %v", tt.name, err)
+		}
+		if err := <-handshakeErr; err != nil {
+			t.Fatalf("%s: client handshake failed: %v", tt.name, err)
+		}
+		config := &ServerConfig{
+			AuthInfo:     credentials.TLSInfo{State: tlsServer.ConnectionState()},
+			RequiredALPN: []string{"h2"},
+		}
+		if tt.wantErr {
+			if _, err := NewServerTransport("http2", tlsServer, config); err == nil {
+				t.Errorf("%s: NewServerTransport succeeded, want an ALPN rejection", tt.name)
+			}
+		} else {
+			// Complete the HTTP/2 setup so NewServerTransport can return.
+			go func() {
+				if _, err := tlsClient.Write(clientPreface); err != nil {
+					return
+				}
+				fr := http2.NewFramer(tlsClient, tlsClient)
+				fr.WriteSettings()
+				for {
+					if _, err := fr.ReadFrame(); err != nil {
+						return
+					}
+				}
+			}()
+			st, err := NewServerTransport("http2", tlsServer, config)
+			if err != nil {
+				t.Errorf("%s: NewServerTransport failed: %v", tt.name, err)
+			} else {
+				st.Close()
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// TestOnProtocolMismatch verifies that a connection opened with an HTTP/1.1
+// request line instead of the HTTP/2 client preface fires the
+// OnProtocolMismatch callback with the received bytes and is then closed.
+func TestOnProtocolMismatch(t *testing.T) {
+	mismatchCh := make(chan []byte, 1)
+	serverConfig := &ServerConfig{
+		OnProtocolMismatch: func(firstBytes []byte) {
+			mismatchCh <- firstBytes
+		},
+	}
+	server, ct := setUpWithOptions(t, 0, serverConfig, suspended, ConnectOptions{})
+	defer server.stop()
+	ct.Close()
+	conn, err := net.Dial("tcp", "localhost:"+server.port)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Failed to write the HTTP/1.1 request: %v", err)
+	}
+	select {
+	case got := <-mismatchCh:
+		if want := request[:len(clientPreface)]; string(got) != want {
+			t.Fatalf("OnProtocolMismatch got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out while waiting for OnProtocolMismatch to fire")
+	}
+	// The server must reject the connection; drain its initial SETTINGS
+	// frame until the close shows up. Depending on timing the close
+	// surfaces as EOF or as a reset, either of which ends the read loop.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				t.Fatalf("Timed out while waiting for the server to close the connection")
+			}
+			break
+		}
+	}
+}
+
+// TestHpackTableSizeAdvertised verifies that a configured HPACK header table
+// size is advertised to the peer in the server's initial SETTINGS frame.
+func TestHpackTableSizeAdvertised(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{HpackTableSize: 1024}, suspended, ConnectOptions{})
+	defer server.stop()
+	ct.Close()
+	conn, err := net.Dial("tcp", "localhost:"+server.port)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("Failed to write client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("Error reading server preface: %v", err)
+	}
+	sf, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("Received frame %T, want the initial settings frame", frame)
+	}
+	if v, ok := sf.Value(http2.SettingHeaderTableSize); !ok || v != 1024 {
+		t.Fatalf("Server advertised SETTINGS_HEADER_TABLE_SIZE (%v, %v), want (1024, true)", v, ok)
+	}
+}
+
+func TestHpackTableSizeEncoder(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{HpackTableSize: 512}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	sf, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("Received frame %T, want the initial settings frame", frame)
+	}
+	if v, ok := sf.Value(http2.SettingHeaderTableSize); !ok || v != 512 {
+		t.Fatalf("Client advertised SETTINGS_HEADER_TABLE_SIZE (%v, %v), want (512, true)", v, ok)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	if _, err := res.ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error reading frame: %v", err)
+		}
+		hf, ok := frame.(*http2.HeadersFrame)
+		if !ok {
+			continue
+		}
+		// A shrunken encoder table must announce itself with a dynamic table
+		// size update (RFC 7541 section 6.3) at the start of the first header
+		// block; an update to 512 encodes as 0x3f 0xe1 0x03.
+		if frag := hf.HeaderBlockFragment(); len(frag) < 3 || !bytes.Equal(frag[:3], []byte{0x3f, 0xe1, 0x03}) {
+			t.Fatalf("Header block does not start with a dynamic table size update to 512: %x", frag)
+		}
+		return
+	}
+}
+
+// TestWaitForReady connects to a server that delays its SETTINGS frame and
+// verifies that WaitForReady blocks until the frame arrives, honoring the
+// caller's context meanwhile.
+func TestWaitForReady(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	// No SETTINGS yet: WaitForReady must block until its context fires.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if err := res.ct.WaitForReady(ctx); err == nil {
+		t.Fatalf("WaitForReady returned nil before the server sent its settings")
+	}
+	cancel()
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := res.ct.WaitForReady(ctx); err != nil {
+		t.Fatalf("WaitForReady() = %v after the server sent its settings, want <nil>", err)
+	}
+}
+
+// TestGoAwayLastStreamID verifies that the Last-Stream-ID of a GOAWAY
+// received mid-session is exposed to the layer above by the time the GoAway
+// channel fires.
+func TestGoAwayLastStreamID(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	if id := res.ct.GoAwayLastStreamID(); id != 0 {
+		t.Fatalf("GoAwayLastStreamID() = %d before any GOAWAY, want 0", id)
+	}
+	if _, err := res.ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := framer.WriteGoAway(1, http2.ErrCodeNo, nil); err != nil {
+		t.Fatalf("Failed to write GOAWAY: %v", err)
+	}
+	select {
+	case <-res.ct.GoAway():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the GoAway channel to fire")
+	}
+	if id := res.ct.GoAwayLastStreamID(); id != 1 {
+		t.Fatalf("GoAwayLastStreamID() = %d, want 1", id)
+	}
+}
+
+// TestIllegalStreamID injects a frame on a stream id the client never
+// opened and verifies that the client tears down the connection with a
+// PROTOCOL_ERROR GOAWAY.
+func TestIllegalStreamID(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	// Stream 2 is illegal: clients only open odd-numbered streams.
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      2,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	timer := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	sawGoAway := false
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			if !sawGoAway {
+				t.Fatalf("Connection died without a GOAWAY: %v", err)
+			}
+			// The client closed the connection after the GOAWAY.
+			return
+		}
+		if f, ok := frame.(*http2.GoAwayFrame); ok {
+			if f.ErrCode != http2.ErrCodeProtocol {
+				t.Fatalf("GOAWAY error code %v, want %v", f.ErrCode, http2.ErrCodeProtocol)
+			}
+			sawGoAway = true
+		}
+	}
+}
+
+// TestPushPromiseRejected verifies that the client advertises
+// SETTINGS_ENABLE_PUSH=0 and answers a PUSH_PROMISE sent anyway with a
+// PROTOCOL_ERROR GOAWAY before closing the connection.
+func TestPushPromiseRejected(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	sf, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("Client's first frame is a %T, want a SETTINGS frame", frame)
+	}
+	if v, ok := sf.Value(http2.SettingEnablePush); !ok || v != 0 {
+		t.Fatalf("Client advertised SETTINGS_ENABLE_PUSH = %d (present: %v), want 0", v, ok)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	if _, err := res.ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	if err := framer.WritePushPromise(http2.PushPromiseParam{
+		StreamID:      1,
+		PromiseID:     2,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatalf("Failed to write PUSH_PROMISE: %v", err)
+	}
+	timer := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	sawGoAway := false
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			if !sawGoAway {
+				t.Fatalf("Connection died without a GOAWAY: %v", err)
+			}
+			// The client closed the connection after the GOAWAY.
+			return
+		}
+		if f, ok := frame.(*http2.GoAwayFrame); ok {
+			if f.ErrCode != http2.ErrCodeProtocol {
+				t.Fatalf("GOAWAY error code %v, want %v", f.ErrCode, http2.ErrCodeProtocol)
+			}
+			sawGoAway = true
+		}
+	}
+}
+
+// TestOnMaxStreamsChange verifies that the OnMaxStreamsChange callback is
+// invoked with the server's advertised SETTINGS_MAX_CONCURRENT_STREAMS, both
+// for the initial SETTINGS frame and when the server lowers the limit
+// mid-connection.
+func TestOnMaxStreamsChange(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	maxStreamsCh := make(chan uint32, 2)
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		copts := ConnectOptions{
+			OnMaxStreamsChange: func(newMax uint32) { maxStreamsCh <- newMax },
+		}
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, copts, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100}); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	select {
+	case got := <-maxStreamsCh:
+		if got != 100 {
+			t.Fatalf("OnMaxStreamsChange called with %d, want 100", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for OnMaxStreamsChange after the initial SETTINGS")
+	}
+	// Lower the limit mid-connection.
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 3}); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	select {
+	case got := <-maxStreamsCh:
+		if got != 3 {
+			t.Fatalf("OnMaxStreamsChange called with %d, want 3", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for OnMaxStreamsChange after the update")
+	}
+}
+
+// TestMaxFrameSize verifies that a configured SETTINGS_MAX_FRAME_SIZE is
+// advertised to the peer and that the writer splits data at the size the
+// peer advertised rather than the 16KB default.
+func TestMaxFrameSize(t *testing.T) {
+	const frameSize = 32768
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{MaxFrameSize: frameSize}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.SetMaxReadFrameSize(maxMaxFrameSize)
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	}
+	sf, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("Received frame %T, want the initial settings frame", frame)
+	}
+	if v, ok := sf.Value(http2.SettingMaxFrameSize); !ok || v != frameSize {
+		t.Fatalf("Client advertised SETTINGS_MAX_FRAME_SIZE (%v, %v), want (%v, true)", v, ok, frameSize)
+	}
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: frameSize}); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	ct := res.ct.(*http2Client)
+	// The reader applies the server's SETTINGS asynchronously; wait for it.
+	waitWhileTrue(t, func() (bool, error) {
+		if atomic.LoadUint32(&ct.maxSendFrameSize) != frameSize {
+			return true, fmt.Errorf("timed out waiting for the client to apply SETTINGS_MAX_FRAME_SIZE")
+		}
+		return false, nil
+	})
+	s, err := res.ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	const msgSize = 40000
+	if err := res.ct.Write(s, nil, make([]byte, msgSize), &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	var total, largest uint32
+	for total < msgSize {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error reading frame: %v", err)
+		}
+		df, ok := frame.(*http2.DataFrame)
+		if !ok {
+			continue
+		}
+		if l := df.Header().Length; l > largest {
+			largest = l
+		}
+		total += df.Header().Length
+	}
+	if largest <= http2MaxFrameLen || largest > frameSize {
+		t.Fatalf("Largest DATA frame was %d bytes, want more than %d and at most %d", largest, http2MaxFrameLen, frameSize)
+	}
+}
+
+// TestMaxFrameSizeValidation verifies that values outside the legal
+// SETTINGS_MAX_FRAME_SIZE range are rejected at transport setup.
+func TestMaxFrameSizeValidation(t *testing.T) {
+	for _, v := range []uint32{1, 16383, 16777216} {
+		connectCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if _, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: "localhost:0"}, ConnectOptions{MaxFrameSize: v}, func() {}); err == nil {
+			t.Errorf("NewClientTransport with MaxFrameSize %d succeeded, want an error", v)
+		}
+		cancel()
+		client, server := net.Pipe()
+		if _, err := NewServerTransport("http2", server, &ServerConfig{MaxFrameSize: v}); err == nil {
+			t.Errorf("NewServerTransport with MaxFrameSize %d succeeded, want an error", v)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// testFraming is a FramingCodec with an 8-byte header: a 4-byte magic
+// followed by the payload length in big-endian.
+type testFraming struct{}
+
+var testFramingMagic = []byte{0xca, 0xfe, 0xba, 0xbe}
+
+func (testFraming) Encode(payload []byte) []byte {
+	hdr := make([]byte, 8)
+	copy(hdr, testFramingMagic)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(payload)))
+	return hdr
+}
+
+func (testFraming) Decode(hdr []byte) (uint32, error) {
+	if !bytes.Equal(hdr[:4], testFramingMagic) {
+		return 0, fmt.Errorf("bad magic %x", hdr[:4])
+	}
+	return binary.BigEndian.Uint32(hdr[4:]), nil
+}
+
+func (testFraming) HeaderLen() int { return 8 }
+
+func TestFramingCodec(t *testing.T) {
+	tf := testFraming{}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{FramingCodec: tf, MaxReceiveMessageBytes: 1024}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	} else if _, ok := frame.(*http2.SettingsFrame); !ok {
+		t.Fatalf("Received frame %T, want the initial settings frame", frame)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	s, err := res.ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	request := []byte("ping")
+	if err := res.ct.Write(s, nil, request, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	// The transport should have framed the payload with the codec.
+	want := append(tf.Encode(request), request...)
+	var got []byte
+	for len(got) < len(want) {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error reading frame: %v", err)
+		}
+		if df, ok := frame.(*http2.DataFrame); ok {
+			got = append(got, df.Data()...)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Server received message %x, want %x", got, want)
+	}
+	// Reply with a codec-framed message and check the client can read it
+	// through the size-enforcement path.
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: buf.Bytes(), EndHeaders: true}); err != nil {
+		t.Fatalf("Failed to write response headers: %v", err)
+	}
+	response := []byte("pong")
+	if err := framer.WriteData(1, false, append(tf.Encode(response), response...)); err != nil {
+		t.Fatalf("Failed to write response data: %v", err)
+	}
+	buf.Reset()
+	henc.WriteField(hpack.HeaderField{Name: "grpc-status", Value: "0"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: buf.Bytes(), EndHeaders: true, EndStream: true}); err != nil {
+		t.Fatalf("Failed to write trailers: %v", err)
+	}
+	recv := make([]byte, 8+len(response))
+	if _, err := io.ReadFull(s, recv); err != nil {
+		t.Fatalf("Error reading the response: %v", err)
+	}
+	if l, err := tf.Decode(recv[:8]); err != nil || l != uint32(len(response)) {
+		t.Fatalf("Decoded response header (%v, %v), want (%v, nil)", l, err, len(response))
+	}
+	if !bytes.Equal(recv[8:], response) {
+		t.Fatalf("Received response %q, want %q", recv[8:], response)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after the response returned %v, want io.EOF", err)
+	}
+}
+
+// TestLastMessageCompressed sends one compressed-flagged and one plain
+// message and checks the flag reported after each read.
+func TestLastMessageCompressed(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	} else if _, ok := frame.(*http2.SettingsFrame); !ok {
+		t.Fatalf("Received frame %T, want the initial settings frame", frame)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	defer res.ct.Close()
+	s, err := res.ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	frameMsg := func(compressed byte, payload []byte) []byte {
+		hdr := make([]byte, 5)
+		hdr[0] = compressed
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+		return append(hdr, payload...)
+	}
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: buf.Bytes(), EndHeaders: true}); err != nil {
+		t.Fatalf("Failed to write response headers: %v", err)
+	}
+	msgs := [][]byte{frameMsg(1, []byte("squeezed")), frameMsg(0, []byte("plain"))}
+	if err := framer.WriteData(1, false, append(msgs[0], msgs[1]...)); err != nil {
+		t.Fatalf("Failed to write response data: %v", err)
+	}
+	for i, want := range []bool{true, false} {
+		hdr := make([]byte, 5)
+		if _, err := io.ReadFull(s, hdr); err != nil {
+			t.Fatalf("Error reading header of message %d: %v", i, err)
+		}
+		if got := s.LastMessageCompressed(); got != want {
+			t.Fatalf("LastMessageCompressed() after header of message %d = %v, want %v", i, got, want)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(s, payload); err != nil {
+			t.Fatalf("Error reading payload of message %d: %v", i, err)
+		}
+		if got := s.LastMessageCompressed(); got != want {
+			t.Fatalf("LastMessageCompressed() after payload of message %d = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// TestReceivedMessageCount runs several round trips over one stream and
+// checks that the per-stream message counter increments once per message
+// read.
+func TestReceivedMessageCount(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{}, pingpong, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if got := s.ReceivedMessageCount(); got != 0 {
+		t.Fatalf("ReceivedMessageCount() before any read = %d, want 0", got)
+	}
+	const msgSize = 10
+	for i := 0; i < 3; i++ {
+		buf := make([]byte, msgSize+5)
+		binary.BigEndian.PutUint32(buf[1:], msgSize)
+		opts := Options{}
+		if i == 2 {
+			opts.Last = true
+		}
+		if err := ct.Write(s, nil, buf, &opts); err != nil {
+			t.Fatalf("Failed to write message %d: %v", i, err)
+		}
+		echo := make([]byte, msgSize+5)
+		if _, err := io.ReadFull(s, echo); err != nil {
+			t.Fatalf("Failed to read echoed message %d: %v", i, err)
+		}
+		if got := s.ReceivedMessageCount(); got != i+1 {
+			t.Fatalf("ReceivedMessageCount() after message %d = %d, want %d", i, got, i+1)
+		}
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s.Read() = _, %v, want _, io.EOF", err)
+	}
+}
+
+// TestContinuationFlood verifies that a header block split across more
+// CONTINUATION frames than the configured limit closes the connection with an
+// ENHANCE_YOUR_CALM GOAWAY instead of accumulating frames indefinitely.
+func TestContinuationFlood(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{MaxContinuationFrames: 10}, suspended, ConnectOptions{})
+	defer server.stop()
+	ct.Close()
+	conn, err := net.Dial("tcp", "localhost:"+server.port)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("Failed to write client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	henc.WriteField(hpack.HeaderField{Name: ":path", Value: "/foo"})
+	henc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    false,
+	}); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	// Flood the server with CONTINUATION frames, well past the limit. The
+	// fragments are never hpack-decoded, so their content does not matter.
+	// Writes may fail once the server hangs up, which is the expected
+	// outcome.
+	for i := 0; i < 64; i++ {
+		if err := framer.WriteContinuation(1, false, []byte{0}); err != nil {
+			break
+		}
+	}
+	timer := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	sawGoAway := false
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			if !sawGoAway {
+				t.Fatalf("Connection died without a GOAWAY: %v", err)
+			}
+			// The server closed the connection after the GOAWAY.
+			return
+		}
+		if f, ok := frame.(*http2.GoAwayFrame); ok {
+			if f.ErrCode != http2.ErrCodeEnhanceYourCalm {
+				t.Fatalf("GOAWAY error code %v, want %v", f.ErrCode, http2.ErrCodeEnhanceYourCalm)
+			}
+			sawGoAway = true
+		}
+	}
+}
+
+func TestClientHalfClosed(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	serverStream := func(s *Stream) *Stream {
+		var ss *Stream
+		waitWhileTrue(t, func() (bool, error) {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			var ok bool
+			ss, ok = st.activeStreams[s.id]
+			if !ok {
+				return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+			}
+			return false, nil
+		})
+		return ss
+	}
+	// A half-close from the client should fire the channel.
+	s1, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ss1 := serverStream(s1)
+	select {
+	case <-ss1.ClientHalfClosed():
+		t.Fatalf("ClientHalfClosed() fired before the client half-closed the stream")
+	default:
+	}
+	if err := ct.Write(s1, nil, nil, &Options{Last: true}); err != nil {
+		t.Fatalf("Failed to half-close stream: %v", err)
+	}
+	select {
+	case <-ss1.ClientHalfClosed():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out while waiting for ClientHalfClosed() to fire")
+	}
+	// A reset from the client should not fire the channel.
+	s2, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ss2 := serverStream(s2)
+	ct.CloseStream(s2, errors.New("client cancelled the RPC"))
+	// Wait for the server to process the RST_STREAM.
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if _, ok := st.activeStreams[s2.id]; ok {
+			return true, fmt.Errorf("timed-out while waiting for server to process RST_STREAM")
+		}
+		return false, nil
+	})
+	select {
+	case <-ss2.ClientHalfClosed():
+		t.Fatalf("ClientHalfClosed() fired on a stream reset")
+	default:
+	}
+}
+
+// TestStreamFlush verifies that Flush pushes a delayed small write out to the
+// wire immediately: the echo handler only responds once it has read the whole
+// request, so receiving the response proves the message was flushed. It also
+// verifies that Flush fails once the transport is closing.
+func TestStreamFlush(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo.Small"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Delay: true}); err != nil {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush() = %v, want <nil>", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s.Read(p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("s.Read(_) = _, %v, read %v, want <nil>, %v", err, p, expectedResponse)
+	}
+	ct.Close()
+	if err := s.Flush(); err != ErrConnClosing {
+		t.Fatalf("Flush() after Close = %v, want %v", err, ErrConnClosing)
+	}
+}
+
+func TestCancelAllStreams(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo.Small",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var streams []*Stream
+	for i := 0; i < 3; i++ {
+		s, err := ct.NewStream(ctx, callHdr)
+		if err != nil {
+			t.Fatalf("failed to open stream %d: %v", i, err)
+		}
+		streams = append(streams, s)
+	}
+	cancelErr := streamErrorf(codes.Unavailable, "transport: backend draining")
+	ct.CancelAllStreams(cancelErr)
+	for i, s := range streams {
+		if _, err := s.Read(make([]byte, 1)); err != cancelErr {
+			t.Fatalf("stream %d: Read got error %v, want %v", i, err, cancelErr)
+		}
+	}
+	// The connection must stay usable for new streams.
+	s, err := ct.NewStream(ctx, callHdr)
+	if err != nil {
+		t.Fatalf("failed to open stream after CancelAllStreams: %v", err)
+	}
+	opts := Options{
+		Last:  true,
+		Delay: false,
+	}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, recvErr := s.Read(p); recvErr != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("Error: %v, want <nil>; Result: %v, want %v", recvErr, p, expectedResponse)
+	}
+}
+
+// TestCloseSend verifies that Stream.CloseSend half-closes the stream so the
+// server observes END_STREAM, that repeated calls are no-ops, and that it
+// fails with a StreamError once the stream context is canceled.
+func TestCloseSend(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		var ok bool
+		ss, ok = st.activeStreams[s.id]
+		if !ok {
+			return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+		}
+		return false, nil
+	})
+	if err := s.CloseSend(); err != nil {
+		t.Fatalf("CloseSend() = %v, want <nil>", err)
+	}
+	select {
+	case <-ss.ClientHalfClosed():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out while waiting for the server to observe END_STREAM")
+	}
+	// A second call must be a harmless no-op.
+	if err := s.CloseSend(); err != nil {
+		t.Fatalf("Second CloseSend() = %v, want <nil>", err)
+	}
+	// A canceled stream must surface a StreamError derived from the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	s2, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	cancel()
+	err = s2.CloseSend()
+	if se, ok := err.(StreamError); !ok || se.Code != codes.Canceled {
+		t.Fatalf("CloseSend() on a canceled stream = %v, want StreamError with code %v", err, codes.Canceled)
+	}
+}
+
+// TestClientCancelObservedByServer verifies that a client-side cancellation
+// arrives at the server as a CANCEL RST_STREAM and surfaces on the server
+// side stream status as codes.Canceled, distinguishable from internal
+// errors.
+func TestClientCancelObservedByServer(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		var ok bool
+		ss, ok = st.activeStreams[s.id]
+		if !ok {
+			return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+		}
+		return false, nil
+	})
+	// Cancel the RPC on the client; CloseStream sends RST_STREAM with the
+	// CANCEL error code.
+	ct.CloseStream(s, ContextErr(context.Canceled))
+	// Wait for the server to process the RST_STREAM.
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if _, ok := st.activeStreams[s.id]; ok {
+			return true, fmt.Errorf("timed-out while waiting for server to process RST_STREAM")
+		}
+		return false, nil
+	})
+	if got := ss.Status(); got == nil || got.Code() != codes.Canceled {
+		t.Fatalf("server stream Status() = %v, want code %v", got, codes.Canceled)
+	}
+}
+
+// TestTransportStats verifies the lifetime stream counters exposed by
+// TransportStats on both ends, after a successful RPC, a canceled RPC, and
+// with a stream still running.
+func TestTransportStats(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo.Small",
+	}
+	// A successful RPC.
+	s1, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s1, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s1.Read(p); err != nil {
+		t.Fatalf("s1.Read(_) = _, %v, want _, <nil>", err)
+	}
+	if _, err := s1.Read(p); err != io.EOF {
+		t.Fatalf("s1.Read(_) = _, %v, want _, io.EOF", err)
+	}
+	ct.CloseStream(s1, nil)
+	// An RPC canceled by the client.
+	s2, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ct.CloseStream(s2, errors.New("client cancelled the RPC"))
+	// A stream that stays running.
+	if _, err := ct.NewStream(context.Background(), callHdr); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	want := TransportStats{
+		StreamsCreated:        3,
+		StreamsCompletedOK:    1,
+		StreamsCompletedError: 1,
+		StreamsActive:         1,
+	}
+	if got := ct.TransportStats(); got != want {
+		t.Fatalf("client TransportStats() = %+v, want %+v", got, want)
+	}
+	var st *http2Server
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		for k := range server.conns {
+			st = k.(*http2Server)
+		}
+		return false, nil
+	})
+	// The server observes the third stream's HEADERS and the second stream's
+	// RST_STREAM asynchronously.
+	waitWhileTrue(t, func() (bool, error) {
+		if got := st.TransportStats(); got != want {
+			return true, fmt.Errorf("server TransportStats() = %+v, want %+v", got, want)
+		}
+		return false, nil
+	})
+}
+
+func TestAvailableStreamQuota(t *testing.T) {
+	server, ct := setUp(t, 0, 3, suspended)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	// Wait until the server's MAX_CONCURRENT_STREAMS setting has been applied.
+	waitWhileTrue(t, func() (bool, error) {
+		if q := ct.AvailableStreamQuota(); q != 3 {
+			return true, fmt.Errorf("AvailableStreamQuota() = %d, want 3", q)
+		}
+		return false, nil
+	})
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if q := ct.AvailableStreamQuota(); q != 2 {
+		t.Fatalf("AvailableStreamQuota() after NewStream = %d, want 2", q)
+	}
+	ct.CloseStream(s, nil)
+	waitWhileTrue(t, func() (bool, error) {
+		if q := ct.AvailableStreamQuota(); q != 3 {
+			return true, fmt.Errorf("AvailableStreamQuota() after CloseStream = %d, want 3", q)
+		}
+		return false, nil
+	})
+}
+
+func TestStreamQuotaLatency(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{MaxStreams: 1}, suspended, ConnectOptions{TrackStreamQuotaLatency: true})
+	defer server.stop()
+	defer ct.Close()
+	tr := ct.(*http2Client)
+	stats := tr.StreamQuotaLatency()
+	if stats == nil {
+		t.Fatalf("StreamQuotaLatency() = nil, want a histogram when tracking is enabled")
+	}
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	// Wait until the server's MAX_CONCURRENT_STREAMS setting has been applied.
+	waitWhileTrue(t, func() (bool, error) {
+		if q := ct.AvailableStreamQuota(); q != 1 {
+			return true, fmt.Errorf("AvailableStreamQuota() = %d, want 1", q)
+		}
+		return false, nil
+	})
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// The second stream has to wait for the first one's quota.
+	opened := make(chan struct{})
+	go func() {
+		if _, err := ct.NewStream(context.Background(), callHdr); err != nil {
+			t.Errorf("Failed to open the second stream: %v", err)
+		}
+		close(opened)
+	}()
+	const wait = 100 * time.Millisecond
+	time.Sleep(wait)
+	ct.CloseStream(s, nil)
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the second stream to open")
+	}
+	if c := stats.Count(); c != 2 {
+		t.Fatalf("stats.Count() = %d, want 2", c)
+	}
+	if m := stats.Max(); m < wait {
+		t.Fatalf("stats.Max() = %v, want at least %v", m, wait)
+	}
+	if total, max := stats.Total(), stats.Max(); total < max {
+		t.Fatalf("stats.Total() = %v, want at least the max wait %v", total, max)
+	}
+	var n int64
+	for _, b := range stats.Buckets() {
+		n += b
+	}
+	if n != 2 {
+		t.Fatalf("Histogram buckets sum to %d, want 2", n)
+	}
+}
+
+func TestStreamQuotaLatencyDisabled(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	if stats := ct.(*http2Client).StreamQuotaLatency(); stats != nil {
+		t.Fatalf("StreamQuotaLatency() = %v, want nil when tracking is disabled", stats)
+	}
+}
+
+// TestTransportContext verifies that the connection-scoped contexts of both
+// transports are canceled when the transports close.
+func TestTransportContext(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	if _, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st ServerTransport
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k
+	}
+	server.mu.Unlock()
+	cctx, sctx := ct.Context(), st.Context()
+	select {
+	case <-cctx.Done():
+		t.Fatalf("Client transport context done before Close")
+	case <-sctx.Done():
+		t.Fatalf("Server transport context done before Close")
+	default:
+	}
+	ct.Close()
+	select {
+	case <-cctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the client transport context to be canceled")
+	}
+	// The server notices the closed connection and tears down its transport.
+	select {
+	case <-sctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the server transport context to be canceled")
+	}
+}
+
+func TestServerStreamRemoteAddr(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		var ok bool
+		ss, ok = st.activeStreams[s.id]
+		if !ok {
+			return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+		}
+		return false, nil
+	})
+	cc, ok := ct.(*http2Client)
+	if !ok {
+		t.Fatalf("Failed to convert %v to *http2Client", ct)
+	}
+	if got, want := ss.RemoteAddr().String(), cc.conn.LocalAddr().String(); got != want {
+		t.Fatalf("ss.RemoteAddr() = %q, want %q", got, want)
+	}
+	if authInfo := ss.AuthInfo(); authInfo != nil {
+		t.Fatalf("ss.AuthInfo() = %v, want <nil> on an insecure connection", authInfo)
+	}
+}
+
+func TestClientConnDecoupledFromApplicationRead(t *testing.T) {
+	connectOptions := ConnectOptions{
+		InitialWindowSize:     defaultWindowSize,
+		InitialConnWindowSize: defaultWindowSize,
+	}
+	server, client := setUpWithOptions(t, 0, &ServerConfig{}, notifyCall, connectOptions)
+	defer server.stop()
+	defer client.Close()
+
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	notifyChan := make(chan struct{})
+	server.h.notify = notifyChan
+	server.mu.Unlock()
+	cstream1, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	if err != nil {
+		t.Fatalf("Client failed to create first stream. Err: %v", err)
+	}
+
+	<-notifyChan
+	var sstream1 *Stream
+	// Access stream on the server.
+	st.mu.Lock()
+	for _, v := range st.activeStreams {
+		if v.id == cstream1.id {
+			sstream1 = v
+		}
+	}
+	st.mu.Unlock()
+	if sstream1 == nil {
+		t.Fatalf("Didn't find stream corresponding to client cstream.id: %v on the server", cstream1.id)
+	}
+	// Exhaust client's connection window.
+	if err := st.Write(sstream1, []byte{}, make([]byte, defaultWindowSize), &Options{}); err != nil {
+		t.Fatalf("Server failed to write data. Err: %v", err)
+	}
+	notifyChan = make(chan struct{})
+	server.mu.Lock()
+	server.h.notify = notifyChan
+	server.mu.Unlock()
+	// Create another stream on client.
+	cstream2, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	if err != nil {
+		t.Fatalf("Client failed to create second stream. Err: %v", err)
+	}
+	<-notifyChan
+	var sstream2 *Stream
+	st.mu.Lock()
+	for _, v := range st.activeStreams {
+		if v.id == cstream2.id {
+			sstream2 = v
+		}
+	}
+	st.mu.Unlock()
+	if sstream2 == nil {
+		t.Fatalf("Didn't find stream corresponding to client cstream.id: %v on the server", cstream2.id)
+	}
+	// Server should be able to send data on the new stream, even though the client hasn't read anything on the first stream.
+	if err := st.Write(sstream2, []byte{}, make([]byte, defaultWindowSize), &Options{}); err != nil {
+		t.Fatalf("Server failed to write data. Err: %v", err)
+	}
+
+	// Client should be able to read data on second stream.
+	if _, err := cstream2.Read(make([]byte, defaultWindowSize)); err != nil {
+		t.Fatalf("_.Read(_) = _, %v, want _, <nil>", err)
+	}
+
+	// Client should be able to read data on first stream.
+	if _, err := cstream1.Read(make([]byte, defaultWindowSize)); err != nil {
+		t.Fatalf("_.Read(_) = _, %v, want _, <nil>", err)
+	}
+}
+
+func TestServerConnDecoupledFromApplicationRead(t *testing.T) {
+	serverConfig := &ServerConfig{
+		InitialWindowSize:     defaultWindowSize,
+		InitialConnWindowSize: defaultWindowSize,
+	}
+	server, client := setUpWithOptions(t, 0, serverConfig, suspended, ConnectOptions{})
+	defer server.stop()
+	defer client.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	cstream1, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	if err != nil {
+		t.Fatalf("Failed to create 1st stream. Err: %v", err)
+	}
+	// Exhaust server's connection window.
+	if err := client.Write(cstream1, nil, make([]byte, defaultWindowSize), &Options{Last: true}); err != nil {
+		t.Fatalf("Client failed to write data. Err: %v", err)
+	}
+	//Client should be able to create another stream and send data on it.
+	cstream2, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	if err != nil {
+		t.Fatalf("Failed to create 2nd stream. Err: %v", err)
+	}
+	if err := client.Write(cstream2, nil, make([]byte, defaultWindowSize), &Options{}); err != nil {
+		t.Fatalf("Client failed to write data. Err: %v", err)
+	}
+	// Get the streams on server.
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		if len(st.activeStreams) != 2 {
+			return true, fmt.Errorf("timed-out while waiting for server to have created the streams")
+		}
+		return false, nil
+	})
+	var sstream1 *Stream
+	st.mu.Lock()
+	for _, v := range st.activeStreams {
+		if v.id == 1 {
+			sstream1 = v
+		}
+	}
+	st.mu.Unlock()
+	// Trying to write more on a max-ed out stream should result in a RST_STREAM from the server.
+	ct := client.(*http2Client)
+	ct.controlBuf.put(&dataFrame{cstream2.id, true, make([]byte, 1), func() {}})
+	code := http2ErrConvTab[http2.ErrCodeFlowControl]
+	waitWhileTrue(t, func() (bool, error) {
+		cstream2.mu.Lock()
+		defer cstream2.mu.Unlock()
+		if cstream2.status.Code() != code {
+			return true, fmt.Errorf("want code = %v, got %v", code, cstream2.status.Code())
+		}
+		return false, nil
+	})
+	// Reading from the stream on server should succeed.
+	if _, err := sstream1.Read(make([]byte, defaultWindowSize)); err != nil {
+		t.Fatalf("_.Read(_) = %v, want <nil>", err)
+	}
+
+	if _, err := sstream1.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("_.Read(_) = %v, want io.EOF", err)
+	}
+
+}
+
+func TestServerWithMisbehavedClient(t *testing.T) {
+	serverConfig := &ServerConfig{
+		InitialWindowSize:     defaultWindowSize,
+		InitialConnWindowSize: defaultWindowSize,
+	}
+	connectOptions := ConnectOptions{
+		InitialWindowSize:     defaultWindowSize,
+		InitialConnWindowSize: defaultWindowSize,
+	}
+	server, ct := setUpWithOptions(t, 0, serverConfig, suspended, connectOptions)
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	var sc *http2Server
+	// Wait until the server transport is setup.
+	for {
+		server.mu.Lock()
+		if len(server.conns) == 0 {
+			server.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		for k := range server.conns {
+			var ok bool
+			sc, ok = k.(*http2Server)
+			if !ok {
+				t.Fatalf("Failed to convert %v to *http2Server", k)
+			}
+		}
+		server.mu.Unlock()
+		break
+	}
+	cc, ok := ct.(*http2Client)
+	if !ok {
+		t.Fatalf("Failed to convert %v to *http2Client", ct)
+	}
+	// Test server behavior for violation of stream flow control window size restriction.
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	var sent int
+	// Drain the stream flow control window
+	cc.controlBuf.put(&dataFrame{s.id, false, make([]byte, http2MaxFrameLen), func() {}})
+	sent += http2MaxFrameLen
+	// Wait until the server creates the corresponding stream and receive some data.
+	var ss *Stream
+	for {
+		time.Sleep(time.Millisecond)
+		sc.mu.Lock()
+		if len(sc.activeStreams) == 0 {
+			sc.mu.Unlock()
+			continue
+		}
+		ss = sc.activeStreams[s.id]
+		sc.mu.Unlock()
+		ss.fc.mu.Lock()
+		if ss.fc.pendingData > 0 {
+			ss.fc.mu.Unlock()
+			break
+		}
+		ss.fc.mu.Unlock()
+	}
+	if ss.fc.pendingData != http2MaxFrameLen || ss.fc.pendingUpdate != 0 || sc.fc.pendingData != 0 || sc.fc.pendingUpdate != 0 {
+		t.Fatalf("Server mistakenly updates inbound flow control params: got %d, %d, %d, %d; want %d, %d, %d, %d", ss.fc.pendingData, ss.fc.pendingUpdate, sc.fc.pendingData, sc.fc.pendingUpdate, http2MaxFrameLen, 0, 0, 0)
+	}
+	// Keep sending until the server inbound window is drained for that stream.
+	for sent <= initialWindowSize {
+		cc.controlBuf.put(&dataFrame{s.id, false, make([]byte, 1), func() {}})
+		sent++
+	}
+	// Server sent a resetStream for s already.
+	code := http2ErrConvTab[http2.ErrCodeFlowControl]
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("%v got err %v want <EOF>", s, err)
+	}
+	if s.status.Code() != code {
+		t.Fatalf("%v got status %v; want Code=%v", s, s.status, code)
+	}
+
+	ct.CloseStream(s, nil)
+	ct.Close()
+	server.stop()
+}
+
+func TestClientWithMisbehavedServer(t *testing.T) {
+	// Turn off BDP estimation so that the server can
+	// violate stream window.
+	connectOptions := ConnectOptions{
+		InitialWindowSize: initialWindowSize,
+	}
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{}, misbehaved, connectOptions)
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo.Stream",
+	}
+	conn, ok := ct.(*http2Client)
+	if !ok {
+		t.Fatalf("Failed to convert %v to *http2Client", ct)
+	}
+	// Test the logic for the violation of stream flow control window size restriction.
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	d := make([]byte, 1)
+	if err := ct.Write(s, nil, d, &Options{Last: true, Delay: false}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	// Read without window update.
+	for {
+		p := make([]byte, http2MaxFrameLen)
+		if _, err = s.trReader.(*transportReader).reader.Read(p); err != nil {
+			break
+		}
+	}
+	if s.fc.pendingData <= initialWindowSize || s.fc.pendingUpdate != 0 || conn.fc.pendingData != 0 || conn.fc.pendingUpdate != 0 {
+		t.Fatalf("Client mistakenly updates inbound flow control params: got %d, %d, %d, %d; want >%d, %d, %d, >%d", s.fc.pendingData, s.fc.pendingUpdate, conn.fc.pendingData, conn.fc.pendingUpdate, initialWindowSize, 0, 0, 0)
+	}
+
+	if err != io.EOF {
+		t.Fatalf("Got err %v, want <EOF>", err)
+	}
+	if s.status.Code() != codes.Internal {
+		t.Fatalf("Got s.status %v, want s.status.Code()=Internal", s.status)
+	}
+
+	conn.CloseStream(s, err)
+	ct.Close()
+	server.stop()
+}
+
+var encodingTestStatus = status.New(codes.Internal, "\n")
+
+func TestEncodingRequiredStatus(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, encodingRequiredStatus)
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		return
+	}
+	opts := Options{
+		Last:  true,
+		Delay: false,
+	}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, http2MaxFrameLen)
+	if _, err := s.trReader.(*transportReader).Read(p); err != io.EOF {
+		t.Fatalf("Read got error %v, want %v", err, io.EOF)
+	}
+	if !reflect.DeepEqual(s.Status(), encodingTestStatus) {
+		t.Fatalf("stream with status %v, want %v", s.Status(), encodingTestStatus)
+	}
+	ct.Close()
+	server.stop()
+}
+
+func TestInvalidHeaderField(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, invalidHeaderField)
+	callHdr := &CallHdr{
+		Host:   "localhost",
+		Method: "foo",
+	}
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		return
+	}
+	opts := Options{
+		Last:  true,
+		Delay: false,
+	}
+	if err := ct.Write(s, nil, expectedRequest, &opts); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, http2MaxFrameLen)
+	_, err = s.trReader.(*transportReader).Read(p)
+	if se, ok := err.(StreamError); !ok || se.Code != codes.FailedPrecondition || !strings.Contains(err.Error(), expectedInvalidHeaderField) {
+		t.Fatalf("Read got error %v, want error with code %s and contains %q", err, codes.FailedPrecondition, expectedInvalidHeaderField)
+	}
+	ct.Close()
+	server.stop()
+}
+
+func TestStreamContext(t *testing.T) {
+	expectedStream := &Stream{}
+	ctx := newContextWithStream(context.Background(), expectedStream)
+	s, ok := StreamFromContext(ctx)
+	if !ok || expectedStream != s {
+		t.Fatalf("GetStreamFromContext(%v) = %v, %t, want: %v, true", ctx, s, ok, expectedStream)
+	}
+}
+
+func TestIsReservedHeader(t *testing.T) {
+	tests := []struct {
+		h    string
+		want bool
+	}{
+		{"", false}, // but should be rejected earlier
+		{"foo", false},
+		{"content-type", true},
+		{"grpc-message-type", true},
+		{"grpc-encoding", true},
+		{"grpc-message", true},
+		{"grpc-status", true},
+		{"grpc-timeout", true},
+		{"te", true},
+	}
+	for _, tt := range tests {
+		got := isReservedHeader(tt.h)
+		if got != tt.want {
+			t.Errorf("isReservedHeader(%q) = %v; want %v", tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestContextErr(t *testing.T) {
+	for _, test := range []struct {
+		// input
+		errIn error
+		// outputs
+		errOut StreamError
+	}{
+		{context.DeadlineExceeded, StreamError{codes.DeadlineExceeded, context.DeadlineExceeded.Error()}},
+		{context.Canceled, StreamError{codes.Canceled, context.Canceled.Error()}},
+	} {
+		err := ContextErr(test.errIn)
+		if err != test.errOut {
+			t.Fatalf("ContextErr{%v} = %v \nwant %v", test.errIn, err, test.errOut)
+		}
+	}
+}
+
+func max(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type windowSizeConfig struct {
+	serverStream int32
+	serverConn   int32
+	clientStream int32
+	clientConn   int32
+}
+
+func TestAccountCheckWindowSizeWithLargeWindow(t *testing.T) {
+	wc := windowSizeConfig{
+		serverStream: 10 * 1024 * 1024,
+		serverConn:   12 * 1024 * 1024,
+		clientStream: 6 * 1024 * 1024,
+		clientConn:   8 * 1024 * 1024,
+	}
+	testAccountCheckWindowSize(t, wc)
+}
+
+func TestAccountCheckWindowSizeWithSmallWindow(t *testing.T) {
+	wc := windowSizeConfig{
+		serverStream: defaultWindowSize,
+		// Note this is smaller than initialConnWindowSize which is the current default.
+		serverConn:   defaultWindowSize,
+		clientStream: defaultWindowSize,
+		clientConn:   defaultWindowSize,
+	}
+	testAccountCheckWindowSize(t, wc)
+}
+
+func testAccountCheckWindowSize(t *testing.T, wc windowSizeConfig) {
+	serverConfig := &ServerConfig{
+		InitialWindowSize:     wc.serverStream,
+		InitialConnWindowSize: wc.serverConn,
+	}
+	connectOptions := ConnectOptions{
+		InitialWindowSize:     wc.clientStream,
+		InitialConnWindowSize: wc.clientConn,
+	}
+	server, client := setUpWithOptions(t, 0, serverConfig, suspended, connectOptions)
+	defer server.stop()
+	defer client.Close()
+
+	// Wait for server conns to be populated with new server transport.
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed out waiting for server transport to be created")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	ct := client.(*http2Client)
+	cstream, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	if err != nil {
+		t.Fatalf("Failed to create stream. Err: %v", err)
+	}
+	// Wait for server to receive headers.
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if len(st.activeStreams) == 0 {
+			return true, fmt.Errorf("timed out waiting for server to receive headers")
+		}
+		return false, nil
+	})
+	// Sleeping to make sure the settings are applied in case of negative test.
+	time.Sleep(time.Second)
+
+	waitWhileTrue(t, func() (bool, error) {
+		st.fc.mu.Lock()
+		lim := st.fc.limit
+		st.fc.mu.Unlock()
+		if lim != uint32(serverConfig.InitialConnWindowSize) {
+			return true, fmt.Errorf("Server transport flow control window size: got %v, want %v", lim, serverConfig.InitialConnWindowSize)
+		}
+		return false, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	serverSendQuota, _, err := st.sendQuotaPool.get(math.MaxInt32, waiters{
+		ctx:    ctx,
+		tctx:   st.ctx,
+		done:   nil,
+		goAway: nil,
+	})
+	if err != nil {
+		t.Fatalf("Error while acquiring sendQuota on server. Err: %v", err)
+	}
+	cancel()
+	st.sendQuotaPool.add(serverSendQuota)
+	if serverSendQuota != int(connectOptions.InitialConnWindowSize) {
+		t.Fatalf("Server send quota(%v) not equal to client's window size(%v) on conn.", serverSendQuota, connectOptions.InitialConnWindowSize)
+	}
+	st.mu.Lock()
+	ssq := st.streamSendQuota
+	st.mu.Unlock()
+	if ssq != uint32(connectOptions.InitialWindowSize) {
+		t.Fatalf("Server stream send quota(%v) not equal to client's window size(%v) on stream.", ssq, connectOptions.InitialWindowSize)
+	}
+	ct.fc.mu.Lock()
+	limit := ct.fc.limit
+	ct.fc.mu.Unlock()
+	if limit != uint32(connectOptions.InitialConnWindowSize) {
+		t.Fatalf("Client transport flow control window size is %v, want %v", limit, connectOptions.InitialConnWindowSize)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	clientSendQuota, _, err := ct.sendQuotaPool.get(math.MaxInt32, waiters{
+		ctx:    ctx,
+		tctx:   ct.ctx,
+		done:   nil,
+		goAway: nil,
+	})
+	if err != nil {
+		t.Fatalf("Error while acquiring sendQuota on client. Err: %v", err)
+	}
+	cancel()
+	ct.sendQuotaPool.add(clientSendQuota)
+	if clientSendQuota != int(serverConfig.InitialConnWindowSize) {
+		t.Fatalf("Client send quota(%v) not equal to server's window size(%v) on conn.", clientSendQuota, serverConfig.InitialConnWindowSize)
+	}
+	ct.mu.Lock()
+	ssq = ct.streamSendQuota
+	ct.mu.Unlock()
+	if ssq != uint32(serverConfig.InitialWindowSize) {
+		t.Fatalf("Client stream send quota(%v) not equal to server's window size(%v) on stream.", ssq, serverConfig.InitialWindowSize)
+	}
+	cstream.fc.mu.Lock()
+	limit = cstream.fc.limit
+	cstream.fc.mu.Unlock()
+	if limit != uint32(connectOptions.InitialWindowSize) {
+		t.Fatalf("Client stream flow control window size is %v, want %v", limit, connectOptions.InitialWindowSize)
+	}
+	var sstream *Stream
+	st.mu.Lock()
+	for _, v := range st.activeStreams {
+		sstream = v
+	}
+	st.mu.Unlock()
+	sstream.fc.mu.Lock()
+	limit = sstream.fc.limit
+	sstream.fc.mu.Unlock()
+	if limit != uint32(serverConfig.InitialWindowSize) {
+		t.Fatalf("Server stream flow control window size is %v, want %v", limit, serverConfig.InitialWindowSize)
+	}
+}
+
+// Check accounting on both sides after sending and receiving large messages.
+func TestAccountCheckExpandingWindow(t *testing.T) {
+	server, client := setUp(t, 0, 0, pingpong)
+	defer server.stop()
+	defer client.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed out while waiting for server transport to be created")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	ct := client.(*http2Client)
+	cstream, err := client.NewStream(context.Background(), &CallHdr{Flush: true})
+	if err != nil {
+		t.Fatalf("Failed to create stream. Err: %v", err)
+	}
+
+	msgSize := 65535 * 16 * 2
+	msg := make([]byte, msgSize)
+	buf := make([]byte, msgSize+5)
+	buf[0] = byte(0)
+	binary.BigEndian.PutUint32(buf[1:], uint32(msgSize))
+	copy(buf[5:], msg)
+	opts := Options{}
+	header := make([]byte, 5)
+	for i := 1; i <= 10; i++ {
+		if err := ct.Write(cstream, nil, buf, &opts); err != nil {
+			t.Fatalf("Error on client while writing message: %v", err)
+		}
+		if _, err := cstream.Read(header); err != nil {
+			t.Fatalf("Error on client while reading data frame header: %v", err)
+		}
+		sz := binary.BigEndian.Uint32(header[1:])
+		recvMsg := make([]byte, int(sz))
+		if _, err := cstream.Read(recvMsg); err != nil {
+			t.Fatalf("Error on client while reading data: %v", err)
+		}
+		if len(recvMsg) != len(msg) {
+			t.Fatalf("Length of message received by client: %v, want: %v", len(recvMsg), len(msg))
+		}
+	}
+	defer func() {
+		ct.Write(cstream, nil, nil, &Options{Last: true}) // Close the stream.
+		if _, err := cstream.Read(header); err != io.EOF {
+			t.Fatalf("Client expected an EOF from the server. Got: %v", err)
+		}
+	}()
+	var sstream *Stream
+	st.mu.Lock()
+	for _, v := range st.activeStreams {
+		sstream = v
+	}
+	st.mu.Unlock()
+
+	waitWhileTrue(t, func() (bool, error) {
+		// Check that pendingData and delta on flow control windows on both sides are 0.
+		cstream.fc.mu.Lock()
+		if cstream.fc.delta != 0 {
+			cstream.fc.mu.Unlock()
+			return true, fmt.Errorf("delta on flow control window of client stream is non-zero")
+		}
+		if cstream.fc.pendingData != 0 {
+			cstream.fc.mu.Unlock()
+			return true, fmt.Errorf("pendingData on flow control window of client stream is non-zero")
+		}
+		cstream.fc.mu.Unlock()
+		sstream.fc.mu.Lock()
+		if sstream.fc.delta != 0 {
+			sstream.fc.mu.Unlock()
+			return true, fmt.Errorf("delta on flow control window of server stream is non-zero")
+		}
+		if sstream.fc.pendingData != 0 {
+			sstream.fc.mu.Unlock()
+			return true, fmt.Errorf("pendingData on flow control window of sercer stream is non-zero")
+		}
+		sstream.fc.mu.Unlock()
+		ct.fc.mu.Lock()
+		if ct.fc.delta != 0 {
+			ct.fc.mu.Unlock()
+			return true, fmt.Errorf("delta on flow control window of client transport is non-zero")
+		}
+		if ct.fc.pendingData != 0 {
+			ct.fc.mu.Unlock()
+			return true, fmt.Errorf("pendingData on flow control window of client transport is non-zero")
+		}
+		ct.fc.mu.Unlock()
+		st.fc.mu.Lock()
+		if st.fc.delta != 0 {
+			st.fc.mu.Unlock()
+			return true, fmt.Errorf("delta on flow control window of server transport is non-zero")
+		}
+		if st.fc.pendingData != 0 {
+			st.fc.mu.Unlock()
+			return true, fmt.Errorf("pendingData on flow control window of server transport is non-zero")
+		}
+		st.fc.mu.Unlock()
+
+		// Check flow conrtrol window on client stream is equal to out flow on server stream.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		serverStreamSendQuota, _, err := sstream.sendQuotaPool.get(math.MaxInt32, waiters{
+			ctx:    ctx,
+			tctx:   context.Background(),
+			done:   nil,
+			goAway: nil,
+		})
+		cancel()
+		if err != nil {
+			return true, fmt.Errorf("error while acquiring server stream send quota. Err: %v", err)
+		}
+		sstream.sendQuotaPool.add(serverStreamSendQuota)
+		cstream.fc.mu.Lock()
+		clientEst := cstream.fc.limit - cstream.fc.pendingUpdate
+		cstream.fc.mu.Unlock()
+		if uint32(serverStreamSendQuota) != clientEst {
+			return true, fmt.Errorf("server stream outflow: %v, estimated by client: %v", serverStreamSendQuota, clientEst)
+		}
+
+		// Check flow control window on server stream is equal to out flow on client stream.
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		clientStreamSendQuota, _, err := cstream.sendQuotaPool.get(math.MaxInt32, waiters{
+			ctx:    ctx,
+			tctx:   context.Background(),
+			done:   nil,
+			goAway: nil,
+		})
+		cancel()
+		if err != nil {
+			return true, fmt.Errorf("error while acquiring client stream send quota. Err: %v", err)
+		}
+		cstream.sendQuotaPool.add(clientStreamSendQuota)
+		sstream.fc.mu.Lock()
+		serverEst := sstream.fc.limit - sstream.fc.pendingUpdate
+		sstream.fc.mu.Unlock()
+		if uint32(clientStreamSendQuota) != serverEst {
+			return true, fmt.Errorf("client stream outflow: %v. estimated by server: %v", clientStreamSendQuota, serverEst)
+		}
+
+		// Check flow control window on client transport is equal to out flow of server transport.
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		serverTrSendQuota, _, err := st.sendQuotaPool.get(math.MaxInt32, waiters{
+			ctx:    ctx,
+			tctx:   st.ctx,
+			done:   nil,
+			goAway: nil,
+		})
+		cancel()
+		if err != nil {
+			return true, fmt.Errorf("error while acquring server transport send quota. Err: %v", err)
+		}
+		st.sendQuotaPool.add(serverTrSendQuota)
+		ct.fc.mu.Lock()
+		clientEst = ct.fc.limit - ct.fc.pendingUpdate
+		ct.fc.mu.Unlock()
+		if uint32(serverTrSendQuota) != clientEst {
+			return true, fmt.Errorf("server transport outflow: %v, estimated by client: %v", serverTrSendQuota, clientEst)
+		}
+
+		// Check flow control window on server transport is equal to out flow of client transport.
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		clientTrSendQuota, _, err := ct.sendQuotaPool.get(math.MaxInt32, waiters{
+			ctx:    ctx,
+			tctx:   ct.ctx,
+			done:   nil,
+			goAway: nil,
+		})
+		cancel()
+		if err != nil {
+			return true, fmt.Errorf("error while acquiring client transport send quota. Err: %v", err)
+		}
+		ct.sendQuotaPool.add(clientTrSendQuota)
+		st.fc.mu.Lock()
+		serverEst = st.fc.limit - st.fc.pendingUpdate
+		st.fc.mu.Unlock()
+		if uint32(clientTrSendQuota) != serverEst {
+			return true, fmt.Errorf("client transport outflow: %v, estimated by client: %v", clientTrSendQuota, serverEst)
+		}
+
+		return false, nil
+	})
+
+}
+
+func waitWhileTrue(t *testing.T, condition func() (bool, error)) {
+	var (
+		wait bool
+		err  error
+	)
+	timer := time.NewTimer(time.Second * 5)
+	for {
+		wait, err = condition()
+		if wait {
+			select {
+			case <-timer.C:
+				t.Fatalf(err.Error())
+			default:
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+		}
+		if !timer.Stop() {
+			<-timer.C
+		}
+		break
+	}
+}
+
+// A function of type writeHeaders writes out
+// http status with the given stream ID using the given framer.
+type writeHeaders func(*http2.Framer, uint32, int) error
+
+func writeOneHeader(framer *http2.Framer, sid uint32, httpStatus int) error {
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":status", Value: fmt.Sprint(httpStatus)})
+	return framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      sid,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+}
+
+func writeTwoHeaders(framer *http2.Framer, sid uint32, httpStatus int) error {
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{
+		Name:  ":status",
+		Value: fmt.Sprint(http.StatusOK),
+	})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      sid,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		return err
+	}
+	buf.Reset()
+	henc.WriteField(hpack.HeaderField{
+		Name:  ":status",
+		Value: fmt.Sprint(httpStatus),
+	})
+	return framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      sid,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+}
+
+type httpServer struct {
+	conn       net.Conn
+	httpStatus int
+	wh         writeHeaders
+}
+
+func (s *httpServer) start(t *testing.T, lis net.Listener) {
+	// Launch an HTTP server to send back header with httpStatus.
+	go func() {
+		var err error
+		s.conn, err = lis.Accept()
 		if err != nil {
-			return true, fmt.Errorf("error while acquiring server stream send quota. Err: %v", err)
+			t.Errorf("Error accepting connection: %v", err)
+			return
+		}
+		defer s.conn.Close()
+		// Read preface sent by client.
+		if _, err = io.ReadFull(s.conn, make([]byte, len(http2.ClientPreface))); err != nil {
+			t.Errorf("Error at server-side while reading preface from cleint. Err: %v", err)
+			return
+		}
+		reader := bufio.NewReaderSize(s.conn, defaultWriteBufSize)
+		writer := bufio.NewWriterSize(s.conn, defaultReadBufSize)
+		framer := http2.NewFramer(writer, reader)
+		if err = framer.WriteSettingsAck(); err != nil {
+			t.Errorf("Error at server-side while sending Settings ack. Err: %v", err)
+			return
+		}
+		var sid uint32
+		// Read frames until a header is received.
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Errorf("Error at server-side while reading frame. Err: %v", err)
+				return
+			}
+			if hframe, ok := frame.(*http2.HeadersFrame); ok {
+				sid = hframe.Header().StreamID
+				break
+			}
+		}
+		if err = s.wh(framer, sid, s.httpStatus); err != nil {
+			t.Errorf("Error at server-side while writing headers. Err: %v", err)
+			return
+		}
+		writer.Flush()
+	}()
+}
+
+func (s *httpServer) cleanUp() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func setUpHTTPStatusTest(t *testing.T, httpStatus int, wh writeHeaders) (stream *Stream, cleanUp func()) {
+	return setUpHTTPStatusTestWithOptions(t, httpStatus, wh, ConnectOptions{})
+}
+
+func setUpHTTPStatusTestWithOptions(t *testing.T, httpStatus int, wh writeHeaders, copts ConnectOptions) (stream *Stream, cleanUp func()) {
+	var (
+		err    error
+		lis    net.Listener
+		server *httpServer
+		client ClientTransport
+	)
+	cleanUp = func() {
+		if lis != nil {
+			lis.Close()
+		}
+		if server != nil {
+			server.cleanUp()
+		}
+		if client != nil {
+			client.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			cleanUp()
+		}
+	}()
+	lis, err = net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen. Err: %v", err)
+	}
+	server = &httpServer{
+		httpStatus: httpStatus,
+		wh:         wh,
+	}
+	server.start(t, lis)
+	connectCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(2*time.Second))
+	client, err = newHTTP2Client(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, copts, func() {})
+	if err != nil {
+		cancel() // Do not cancel in success path.
+		t.Fatalf("Error creating client. Err: %v", err)
+	}
+	stream, err = client.NewStream(context.Background(), &CallHdr{Method: "bogus/method", Flush: true})
+	if err != nil {
+		t.Fatalf("Error creating stream at client-side. Err: %v", err)
+	}
+	return
+}
+
+func TestHTTPToGRPCStatusMapping(t *testing.T) {
+	for k := range httpStatusConvTab {
+		testHTTPToGRPCStatusMapping(t, k, writeOneHeader)
+	}
+}
+
+func testHTTPToGRPCStatusMapping(t *testing.T, httpStatus int, wh writeHeaders) {
+	stream, cleanUp := setUpHTTPStatusTest(t, httpStatus, wh)
+	defer cleanUp()
+	want := httpStatusConvTab[httpStatus]
+	buf := make([]byte, 8)
+	_, err := stream.Read(buf)
+	if err == nil {
+		t.Fatalf("Stream.Read(_) unexpectedly returned no error. Expected stream error with code %v", want)
+	}
+	serr, ok := err.(StreamError)
+	if !ok {
+		t.Fatalf("err.(Type) = %T, want StreamError", err)
+	}
+	if want != serr.Code {
+		t.Fatalf("Want error code: %v, got: %v", want, serr.Code)
+	}
+}
+
+// TestHTTPToGRPCStatusMappingOverride verifies that a custom conversion table
+// supplied through ConnectOptions takes precedence over the default one, and
+// that statuses absent from the override still fall back to the default.
+func TestHTTPToGRPCStatusMappingOverride(t *testing.T) {
+	convTab := map[int]codes.Code{
+		// Not in the default table at all.
+		http.StatusTooManyRequests: codes.ResourceExhausted,
+		// Overrides the default mapping of 404 (codes.Unimplemented).
+		http.StatusNotFound: codes.NotFound,
+	}
+	for httpStatus, want := range convTab {
+		testHTTPToGRPCStatusMappingOverride(t, httpStatus, want, convTab)
+	}
+	// A status missing from the override falls back to the default table.
+	testHTTPToGRPCStatusMappingOverride(t, http.StatusUnauthorized, codes.Unauthenticated, convTab)
+}
+
+func testHTTPToGRPCStatusMappingOverride(t *testing.T, httpStatus int, want codes.Code, convTab map[int]codes.Code) {
+	stream, cleanUp := setUpHTTPStatusTestWithOptions(t, httpStatus, writeOneHeader, ConnectOptions{HTTPStatusConvTab: convTab})
+	defer cleanUp()
+	buf := make([]byte, 8)
+	_, err := stream.Read(buf)
+	if err == nil {
+		t.Fatalf("Stream.Read(_) unexpectedly returned no error. Expected stream error with code %v", want)
+	}
+	serr, ok := err.(StreamError)
+	if !ok {
+		t.Fatalf("err.(Type) = %T, want StreamError", err)
+	}
+	if want != serr.Code {
+		t.Fatalf("Want error code: %v, got: %v", want, serr.Code)
+	}
+}
+
+// writeHTMLErrorPage responds the way a misconfigured proxy might: an HTTP
+// error status with an HTML body instead of anything gRPC.
+func writeHTMLErrorPage(framer *http2.Framer, sid uint32, httpStatus int) error {
+	var buf bytes.Buffer
+	henc := hpack.NewEncoder(&buf)
+	henc.WriteField(hpack.HeaderField{Name: ":status", Value: fmt.Sprint(httpStatus)})
+	henc.WriteField(hpack.HeaderField{Name: "content-type", Value: "text/html"})
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      sid,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		return err
+	}
+	return framer.WriteData(sid, true, []byte("<html><body>service unavailable</body></html>"))
+}
+
+// TestStrictGRPC verifies that in strict mode responses without a valid gRPC
+// content-type fail hard with codes.Internal instead of going through the
+// HTTP-status mapping.
+func TestStrictGRPC(t *testing.T) {
+	for _, wh := range []writeHeaders{writeHTMLErrorPage, writeOneHeader} {
+		stream, cleanUp := setUpHTTPStatusTestWithOptions(t, http.StatusServiceUnavailable, wh, ConnectOptions{StrictGRPC: true})
+		_, err := stream.Read(make([]byte, 8))
+		if err == nil {
+			t.Fatalf("Stream.Read(_) unexpectedly returned no error. Expected stream error with code %v", codes.Internal)
+		}
+		serr, ok := err.(StreamError)
+		if !ok {
+			t.Fatalf("err.(Type) = %T, want StreamError", err)
+		}
+		if serr.Code != codes.Internal {
+			t.Fatalf("Want error code: %v, got: %v", codes.Internal, serr.Code)
+		}
+		cleanUp()
+	}
+}
+
+func TestHTTPStatusOKAndMissingGRPCStatus(t *testing.T) {
+	stream, cleanUp := setUpHTTPStatusTest(t, http.StatusOK, writeOneHeader)
+	defer cleanUp()
+	buf := make([]byte, 8)
+	_, err := stream.Read(buf)
+	if err != io.EOF {
+		t.Fatalf("stream.Read(_) = _, %v, want _, io.EOF", err)
+	}
+	want := codes.Unknown
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.status.Code() != want {
+		t.Fatalf("Status code of stream: %v, want: %v", stream.status.Code(), want)
+	}
+}
+
+func TestHTTPStatusNottOKAndMissingGRPCStatusInSecondHeader(t *testing.T) {
+	testHTTPToGRPCStatusMapping(t, http.StatusUnauthorized, writeTwoHeaders)
+}
+
+// If any error occurs on a call to Stream.Read, future calls
+// should continue to return that same error.
+func TestReadGivesSameErrorAfterAnyErrorOccurs(t *testing.T) {
+	testRecvBuffer := newRecvBuffer()
+	s := &Stream{
+		ctx:         context.Background(),
+		goAway:      make(chan struct{}),
+		buf:         testRecvBuffer,
+		requestRead: func(int) {},
+	}
+	s.trReader = &transportReader{
+		reader: &recvBufferReader{
+			ctx:    s.ctx,
+			goAway: s.goAway,
+			recv:   s.buf,
+		},
+		windowHandler: func(int) {},
+	}
+	testData := make([]byte, 1)
+	testData[0] = 5
+	testErr := errors.New("test error")
+	s.write(recvMsg{data: testData, err: testErr})
+
+	inBuf := make([]byte, 1)
+	actualCount, actualErr := s.Read(inBuf)
+	if actualCount != 0 {
+		t.Errorf("actualCount, _ := s.Read(_) differs; want 0; got %v", actualCount)
+	}
+	if actualErr.Error() != testErr.Error() {
+		t.Errorf("_ , actualErr := s.Read(_) differs; want actualErr.Error() to be %v; got %v", testErr.Error(), actualErr.Error())
+	}
+
+	s.write(recvMsg{data: testData, err: nil})
+	s.write(recvMsg{data: testData, err: errors.New("different error from first")})
+
+	for i := 0; i < 2; i++ {
+		inBuf := make([]byte, 1)
+		actualCount, actualErr := s.Read(inBuf)
+		if actualCount != 0 {
+			t.Errorf("actualCount, _ := s.Read(_) differs; want %v; got %v", 0, actualCount)
 		}
-		sstream.sendQuotaPool.add(serverStreamSendQuota)
-		cstream.fc.mu.Lock()
-		clientEst := cstream.fc.limit - cstream.fc.pendingUpdate
-		cstream.fc.mu.Unlock()
-		if uint32(serverStreamSendQuota) != clientEst {
-			return true, fmt.Errorf("server stream outflow: %v, estimated by client: %v", serverStreamSendQuota, clientEst)
+		if actualErr.Error() != testErr.Error() {
+			t.Errorf("_ , actualErr := s.Read(_) differs; want actualErr.Error() to be %v; got %v", testErr.Error(), actualErr.Error())
 		}
+	}
+}
 
-		// Check flow control window on server stream is equal to out flow on client stream.
-		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-		clientStreamSendQuota, _, err := cstream.sendQuotaPool.get(math.MaxInt32, waiters{
-			ctx:    ctx,
-			tctx:   context.Background(),
-			done:   nil,
-			goAway: nil,
-		})
-		cancel()
-		if err != nil {
-			return true, fmt.Errorf("error while acquiring client stream send quota. Err: %v", err)
+// TestReadSchedulerOrder verifies that the read scheduler surfaces items of
+// the higher-priority stream first while keeping per-stream arrival order.
+func TestReadSchedulerOrder(t *testing.T) {
+	low := &Stream{priority: 0}
+	high := &Stream{priority: 5}
+	rs := newReadScheduler()
+	rs.put(low, recvMsg{data: []byte("l1")})
+	rs.put(high, recvMsg{data: []byte("h1")})
+	rs.put(low, recvMsg{data: []byte("l2")})
+	rs.put(high, recvMsg{data: []byte("h2")})
+	want := []struct {
+		s    *Stream
+		data string
+	}{
+		{high, "h1"},
+		{high, "h2"},
+		{low, "l1"},
+		{low, "l2"},
+	}
+	for i, w := range want {
+		it, ok := rs.get()
+		if !ok {
+			t.Fatalf("get() #%d returned ok=false, want an item", i)
 		}
-		cstream.sendQuotaPool.add(clientStreamSendQuota)
-		sstream.fc.mu.Lock()
-		serverEst := sstream.fc.limit - sstream.fc.pendingUpdate
-		sstream.fc.mu.Unlock()
-		if uint32(clientStreamSendQuota) != serverEst {
-			return true, fmt.Errorf("client stream outflow: %v. estimated by server: %v", clientStreamSendQuota, serverEst)
+		if it.s != w.s || string(it.m.data) != w.data {
+			t.Fatalf("get() #%d = (stream %p, %q), want (stream %p, %q)", i, it.s, it.m.data, w.s, w.data)
 		}
+	}
+	rs.close()
+	if it, ok := rs.get(); ok {
+		t.Fatalf("get() after close returned item %v, want ok=false", it)
+	}
+}
 
-		// Check flow control window on client transport is equal to out flow of server transport.
-		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-		serverTrSendQuota, _, err := st.sendQuotaPool.get(math.MaxInt32, waiters{
-			ctx:    ctx,
-			tctx:   st.ctx,
-			done:   nil,
-			goAway: nil,
-		})
-		cancel()
-		if err != nil {
-			return true, fmt.Errorf("error while acquring server transport send quota. Err: %v", err)
+// TestPriorityReadScheduling checks that the "grpc-priority" metadata value
+// reaches the server stream and that data still round-trips through the
+// scheduler.
+func TestPriorityReadScheduling(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{PriorityReadScheduling: true}, suspended, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("grpc-priority", "7"))
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	msg := []byte("hello")
+	if err := ct.Write(s, nil, msg, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
 		}
-		st.sendQuotaPool.add(serverTrSendQuota)
-		ct.fc.mu.Lock()
-		clientEst = ct.fc.limit - ct.fc.pendingUpdate
-		ct.fc.mu.Unlock()
-		if uint32(serverTrSendQuota) != clientEst {
-			return true, fmt.Errorf("server transport outflow: %v, estimated by client: %v", serverTrSendQuota, clientEst)
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if len(st.activeStreams) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for the stream to reach the server")
 		}
+		for _, v := range st.activeStreams {
+			ss = v
+		}
+		return false, nil
+	})
+	if p := ss.Priority(); p != 7 {
+		t.Fatalf("Server stream priority = %d, want 7", p)
+	}
+	p := make([]byte, len(msg))
+	if _, err := ss.Read(p); err != nil {
+		t.Fatalf("Error reading the request on the server: %v", err)
+	}
+	if !bytes.Equal(p, msg) {
+		t.Fatalf("Server read %q, want %q", p, msg)
+	}
+	if _, err := ss.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read past the request returned %v, want io.EOF", err)
+	}
+}
 
-		// Check flow control window on server transport is equal to out flow of client transport.
-		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-		clientTrSendQuota, _, err := ct.sendQuotaPool.get(math.MaxInt32, waiters{
-			ctx:    ctx,
-			tctx:   ct.ctx,
-			done:   nil,
-			goAway: nil,
-		})
-		cancel()
+func TestNewCallHdrFiltering(t *testing.T) {
+	md := metadata.MD{
+		"Key1":          []string{"value1"},
+		"grpc-status":   []string{"0"},
+		"grpc-timeout":  []string{"1S"},
+		"content-type":  []string{"application/json"},
+		":authority":    []string{"evil"},
+		"te":            []string{"gzip"},
+		"bad key":       []string{"rejected"},
+		"":              []string{"rejected"},
+		"accept-custom": []string{"v1", "v2"},
+	}
+	callHdr := NewCallHdr("foo", "localhost", md)
+	if callHdr.Method != "foo" || callHdr.Host != "localhost" {
+		t.Fatalf("NewCallHdr populated method %q, host %q, want foo, localhost", callHdr.Method, callHdr.Host)
+	}
+	want := metadata.MD{
+		"key1":          []string{"value1"},
+		"accept-custom": []string{"v1", "v2"},
+	}
+	if !reflect.DeepEqual(callHdr.md, want) {
+		t.Fatalf("NewCallHdr staged metadata %v, want %v", callHdr.md, want)
+	}
+	// The metadata must be copied so later mutation of md does not leak
+	// into the staged headers.
+	md["Key1"][0] = "mutated"
+	if got := callHdr.md["key1"][0]; got != "value1" {
+		t.Fatalf("Staged metadata value = %q after mutating the source, want value1", got)
+	}
+	callHdr = NewCallHdr("foo", "localhost", nil, CallHdrSendCompress("gzip"), CallHdrContentSubtype("proto"))
+	if callHdr.SendCompress != "gzip" || callHdr.ContentSubtype != "proto" {
+		t.Fatalf("NewCallHdr options set SendCompress %q, ContentSubtype %q, want gzip, proto", callHdr.SendCompress, callHdr.ContentSubtype)
+	}
+}
+
+func TestNewCallHdrMetadataEmission(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	callHdr := NewCallHdr("foo", "localhost", metadata.Pairs("key1", "value1", "key2", "value2"))
+	if _, err := ct.NewStream(context.Background(), callHdr); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if len(st.activeStreams) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for the stream to reach the server")
+		}
+		for _, v := range st.activeStreams {
+			ss = v
+		}
+		return false, nil
+	})
+	md, ok := metadata.FromIncomingContext(ss.Context())
+	if !ok {
+		t.Fatalf("Failed to retrieve metadata from the server stream")
+	}
+	for _, kv := range []struct{ k, v string }{{"key1", "value1"}, {"key2", "value2"}} {
+		if vv := md[kv.k]; len(vv) != 1 || vv[0] != kv.v {
+			t.Fatalf("Server received metadata %q = %v, want [%s]", kv.k, vv, kv.v)
+		}
+	}
+}
+
+func TestServerWriteHeaderBeforeData(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := s.WriteHeader(metadata.Pairs("request-id", "42")); err != ErrIllegalHeaderWrite {
+		t.Fatalf("WriteHeader on a client side stream returned %v, want %v", err, ErrIllegalHeaderWrite)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if len(st.activeStreams) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for the stream to reach the server")
+		}
+		for _, v := range st.activeStreams {
+			ss = v
+		}
+		return false, nil
+	})
+	// The suspended handler never writes a message, so the client can only
+	// see the headers if WriteHeader pushed them out on its own.
+	if err := ss.WriteHeader(metadata.Pairs("request-id", "42")); err != nil {
+		t.Fatalf("WriteHeader on the server stream failed: %v", err)
+	}
+	md, err := s.Header()
+	if err != nil {
+		t.Fatalf("Failed to read the headers on the client: %v", err)
+	}
+	if vv := md["request-id"]; len(vv) != 1 || vv[0] != "42" {
+		t.Fatalf("Client received header metadata request-id = %v, want [42]", vv)
+	}
+	if err := ss.WriteHeader(metadata.Pairs("request-id", "43")); err != ErrIllegalHeaderWrite {
+		t.Fatalf("Second WriteHeader returned %v, want %v", err, ErrIllegalHeaderWrite)
+	}
+}
+
+func TestBinPropagationHeaders(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	tags := []byte{0x00, 0x01, 0xff, 0x42}
+	trace := []byte{0xde, 0xad, 0xbe, 0xef, 0x00}
+	ctx := stats.SetTags(context.Background(), tags)
+	ctx = stats.SetTrace(ctx, trace)
+	if _, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if len(st.activeStreams) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for the stream to reach the server")
+		}
+		for _, v := range st.activeStreams {
+			ss = v
+		}
+		return false, nil
+	})
+	if got := ss.TagsBin(); !bytes.Equal(got, tags) {
+		t.Fatalf("Server stream TagsBin() = %v, want %v", got, tags)
+	}
+	if got := ss.TraceBin(); !bytes.Equal(got, trace) {
+		t.Fatalf("Server stream TraceBin() = %v, want %v", got, trace)
+	}
+	// The decoded values must also show up in the stream's incoming
+	// metadata so the grpc layer does not have to re-parse raw headers.
+	md, ok := metadata.FromIncomingContext(ss.Context())
+	if !ok {
+		t.Fatalf("Failed to retrieve metadata from the server stream")
+	}
+	if vv := md["grpc-tags-bin"]; len(vv) != 1 || vv[0] != string(tags) {
+		t.Fatalf("Server received metadata grpc-tags-bin = %v, want [%v]", vv, tags)
+	}
+	if vv := md["grpc-trace-bin"]; len(vv) != 1 || vv[0] != string(trace) {
+		t.Fatalf("Server received metadata grpc-trace-bin = %v, want [%v]", vv, trace)
+	}
+}
+
+func TestHasDeadline(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	dctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	for _, test := range []struct {
+		name string
+		ctx  context.Context
+		want bool
+	}{
+		{"with deadline", dctx, true},
+		{"without deadline", context.Background(), false},
+	} {
+		s, err := ct.NewStream(test.ctx, &CallHdr{Host: "localhost", Method: "foo"})
 		if err != nil {
-			return true, fmt.Errorf("error while acquiring client transport send quota. Err: %v", err)
+			t.Fatalf("%s: failed to open stream: %v", test.name, err)
 		}
-		ct.sendQuotaPool.add(clientTrSendQuota)
-		st.fc.mu.Lock()
-		serverEst = st.fc.limit - st.fc.pendingUpdate
-		st.fc.mu.Unlock()
-		if uint32(clientTrSendQuota) != serverEst {
-			return true, fmt.Errorf("client transport outflow: %v, estimated by client: %v", clientTrSendQuota, serverEst)
+		waitWhileTrue(t, func() (bool, error) {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if len(server.conns) == 0 {
+				return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
+			}
+			return false, nil
+		})
+		var st *http2Server
+		server.mu.Lock()
+		for k := range server.conns {
+			st = k.(*http2Server)
+		}
+		server.mu.Unlock()
+		var ss *Stream
+		waitWhileTrue(t, func() (bool, error) {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			var ok bool
+			ss, ok = st.activeStreams[s.id]
+			if !ok {
+				return true, fmt.Errorf("timed-out while waiting for server side stream to be created")
+			}
+			return false, nil
+		})
+		if got := ss.HasDeadline(); got != test.want {
+			t.Errorf("%s: server stream HasDeadline() = %v, want %v", test.name, got, test.want)
+		}
+		ct.CloseStream(s, nil)
+	}
+}
+
+func TestReserveSendQuota(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	type connectResult struct {
+		ct  ClientTransport
+		err error
+	}
+	connectCh := make(chan connectResult, 1)
+	go func() {
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
+		connectCh <- connectResult{ct, err}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		t.Fatalf("Error reading client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatalf("Error reading client settings: %v", err)
+	} else if _, ok := frame.(*http2.SettingsFrame); !ok {
+		t.Fatalf("Received frame %T, want the initial settings frame", frame)
+	}
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+	res := <-connectCh
+	if res.err != nil {
+		t.Fatalf("Failed to create client transport: %v", res.err)
+	}
+	ct := res.ct.(*http2Client)
+	defer ct.Close()
+	// Drain everything the client writes; the server never sends
+	// WINDOW_UPDATE, so flow control quota is the only limit on writes.
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
 		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s1, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	const n = 60000
+	if err := s1.ReserveSendQuota(ctx, n); err != nil {
+		t.Fatalf("ReserveSendQuota(%d) failed: %v", n, err)
+	}
+	if q := ct.sendQuotaPool.currentQuota(); q != defaultWindowSize-n {
+		t.Fatalf("Connection send quota after reservation = %d, want %d", q, defaultWindowSize-n)
+	}
+	// The reserved write must complete without waiting even though the
+	// shared pool can no longer cover it.
+	if err := ct.Write(s1, nil, make([]byte, n), &Options{}); err != nil {
+		t.Fatalf("Failed to write the reserved burst: %v", err)
+	}
+	if q := ct.sendQuotaPool.currentQuota(); q != defaultWindowSize-n {
+		t.Fatalf("Connection send quota after the reserved write = %d, want %d; the write dipped into the shared pool", q, defaultWindowSize-n)
+	}
+	// An unused reservation must flow back to the connection when the
+	// stream is closed.
+	s2, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := s2.ReserveSendQuota(ctx, 5000); err != nil {
+		t.Fatalf("ReserveSendQuota(5000) failed: %v", err)
+	}
+	if q := ct.sendQuotaPool.currentQuota(); q != defaultWindowSize-n-5000 {
+		t.Fatalf("Connection send quota after the second reservation = %d, want %d", q, defaultWindowSize-n-5000)
+	}
+	ct.CloseStream(s2, nil)
+	if q := ct.sendQuotaPool.currentQuota(); q != defaultWindowSize-n {
+		t.Fatalf("Connection send quota after closing the reserved stream = %d, want %d", q, defaultWindowSize-n)
+	}
+	// A reservation that cannot be satisfied fails once the context fires,
+	// returning whatever it had acquired.
+	s3, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	if err := s3.ReserveSendQuota(sctx, defaultWindowSize); err == nil {
+		t.Fatalf("ReserveSendQuota beyond the available quota succeeded, want a context error")
+	}
+	if q := ct.sendQuotaPool.currentQuota(); q != defaultWindowSize-n {
+		t.Fatalf("Connection send quota after the failed reservation = %d, want %d", q, defaultWindowSize-n)
+	}
+}
 
-		return false, nil
-	})
+func TestPingPong1B(t *testing.T) {
+	runPingPongTest(t, 1)
+}
 
+func TestPingPong1KB(t *testing.T) {
+	runPingPongTest(t, 1024)
 }
 
-func waitWhileTrue(t *testing.T, condition func() (bool, error)) {
-	var (
-		wait bool
-		err  error
-	)
-	timer := time.NewTimer(time.Second * 5)
-	for {
-		wait, err = condition()
-		if wait {
-			select {
-			case <-timer.C:
-				t.Fatalf(err.Error())
-			default:
-				time.Sleep(50 * time.Millisecond)
-				continue
+func TestPingPong64KB(t *testing.T) {
+	runPingPongTest(t, 65536)
+}
+
+func TestPingPong1MB(t *testing.T) {
+	runPingPongTest(t, 1048576)
+}
+
+// This is a stress-test of flow control logic.
+func TestOnWindowUpdate(t *testing.T) {
+	var mu sync.Mutex
+	var sawConn, sawStream bool
+	copts := ConnectOptions{
+		OnWindowUpdate: func(streamID, increment uint32) {
+			mu.Lock()
+			if streamID == 0 {
+				sawConn = true
+			} else {
+				sawStream = true
 			}
+			mu.Unlock()
+		},
+	}
+	server, client := setUpWithOptions(t, 0, &ServerConfig{}, pingpong, copts)
+	defer server.stop()
+	defer client.Close()
+	stream, err := client.NewStream(context.Background(), &CallHdr{})
+	if err != nil {
+		t.Fatalf("Failed to create stream. Err: %v", err)
+	}
+	// Ping-pong messages comparable to the default window size so the
+	// server has to replenish both the stream and the connection windows.
+	msgSize := initialWindowSize
+	msg := make([]byte, msgSize)
+	outgoingHeader := make([]byte, 5)
+	binary.BigEndian.PutUint32(outgoingHeader[1:], uint32(msgSize))
+	incomingHeader := make([]byte, 5)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := sawConn && sawStream
+		mu.Unlock()
+		if done {
+			break
 		}
-		if !timer.Stop() {
-			<-timer.C
+		if time.Now().After(deadline) {
+			t.Fatalf("OnWindowUpdate observed connection-level: %v, stream-level: %v, want both", sawConn, sawStream)
+		}
+		if err := client.Write(stream, outgoingHeader, msg, &Options{}); err != nil {
+			t.Fatalf("Error on client while writing message. Err: %v", err)
+		}
+		if _, err := stream.Read(incomingHeader); err != nil {
+			t.Fatalf("Error on client while reading data header. Err: %v", err)
+		}
+		sz := binary.BigEndian.Uint32(incomingHeader[1:])
+		recvMsg := make([]byte, int(sz))
+		if _, err := stream.Read(recvMsg); err != nil {
+			t.Fatalf("Error on client while reading data. Err: %v", err)
 		}
-		break
+	}
+	// End the stream cleanly so the server handler finishes before teardown.
+	client.Write(stream, nil, nil, &Options{Last: true})
+	if _, err := stream.Read(incomingHeader); err != io.EOF {
+		t.Fatalf("Client expected EOF from the server. Got: %v", err)
 	}
 }
 
-// A function of type writeHeaders writes out
-// http status with the given stream ID using the given framer.
-type writeHeaders func(*http2.Framer, uint32, int) error
+// TestMaxHandlerDuration verifies that a stream whose handler never finishes
+// is ended by the server with DeadlineExceeded once the configured cap
+// expires, when the client supplied no deadline of its own.
+func TestMaxHandlerDuration(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{MaxHandlerDuration: 100 * time.Millisecond}, suspended, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	// The suspended handler never responds; the server's cap has to end the
+	// stream.
+	p := make([]byte, 1)
+	if _, err := s.trReader.(*transportReader).Read(p); err != io.EOF {
+		t.Fatalf("Read got error %v, want %v", err, io.EOF)
+	}
+	if got := s.Status().Code(); got != codes.DeadlineExceeded {
+		t.Fatalf("stream ended with status code %v, want %v", got, codes.DeadlineExceeded)
+	}
+}
 
-func writeOneHeader(framer *http2.Framer, sid uint32, httpStatus int) error {
-	var buf bytes.Buffer
-	henc := hpack.NewEncoder(&buf)
-	henc.WriteField(hpack.HeaderField{Name: ":status", Value: fmt.Sprint(httpStatus)})
-	return framer.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      sid,
-		BlockFragment: buf.Bytes(),
-		EndStream:     true,
-		EndHeaders:    true,
-	})
+// TestServerStreamIdleTimeout verifies that a stream on which neither side
+// makes progress is reset by the server once StreamIdleTimeout expires.
+func TestServerStreamIdleTimeout(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{StreamIdleTimeout: 100 * time.Millisecond}, suspended, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	// The suspended handler never responds and the client sends nothing
+	// more; the idle timeout has to reset the stream.
+	p := make([]byte, 1)
+	if _, err := s.trReader.(*transportReader).Read(p); err != io.EOF {
+		t.Fatalf("Read got error %v, want %v", err, io.EOF)
+	}
+	if got := s.Status().Code(); got != codes.Canceled {
+		t.Fatalf("stream ended with status code %v, want %v", got, codes.Canceled)
+	}
 }
 
-func writeTwoHeaders(framer *http2.Framer, sid uint32, httpStatus int) error {
-	var buf bytes.Buffer
-	henc := hpack.NewEncoder(&buf)
-	henc.WriteField(hpack.HeaderField{
-		Name:  ":status",
-		Value: fmt.Sprint(http.StatusOK),
-	})
-	if err := framer.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      sid,
-		BlockFragment: buf.Bytes(),
-		EndHeaders:    true,
-	}); err != nil {
-		return err
+// TestCorrelationID verifies that an application-supplied correlation ID is
+// retrievable from the stream it was attached to and defaults to empty.
+func TestCorrelationID(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo", CorrelationID: "req-42"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if got := s.CorrelationID(); got != "req-42" {
+		t.Fatalf("CorrelationID() = %q, want %q", got, "req-42")
+	}
+	s2, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if got := s2.CorrelationID(); got != "" {
+		t.Fatalf("CorrelationID() = %q for a stream without one, want the empty string", got)
 	}
-	buf.Reset()
-	henc.WriteField(hpack.HeaderField{
-		Name:  ":status",
-		Value: fmt.Sprint(httpStatus),
-	})
-	return framer.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      sid,
-		BlockFragment: buf.Bytes(),
-		EndStream:     true,
-		EndHeaders:    true,
-	})
 }
 
-type httpServer struct {
-	conn       net.Conn
-	httpStatus int
-	wh         writeHeaders
+// TestGracefulCloseWithDeadline verifies that a slow in-flight stream keeps
+// the drain from finishing, so the deadline forces the transport closed and
+// the context's error is reported.
+func TestGracefulCloseWithDeadline(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, suspended)
+	defer server.stop()
+	defer ct.Close()
+	if _, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// The suspended handler never finishes the stream, so the drain cannot
+	// complete and the deadline has to force the close.
+	if err := ct.GracefulCloseWithDeadline(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("GracefulCloseWithDeadline() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-ct.Error():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Transport still open after the deadline forced the close")
+	}
 }
 
-func (s *httpServer) start(t *testing.T, lis net.Listener) {
-	// Launch an HTTP server to send back header with httpStatus.
-	go func() {
-		var err error
-		s.conn, err = lis.Accept()
+// TestGracefulCloseWithDeadlineCleanDrain verifies the clean path: with no
+// active streams the transport closes immediately and no error is returned.
+func TestGracefulCloseWithDeadlineCleanDrain(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ct.GracefulCloseWithDeadline(ctx); err != nil {
+		t.Fatalf("GracefulCloseWithDeadline() = %v, want <nil>", err)
+	}
+	select {
+	case <-ct.Error():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Transport still open after a clean drain")
+	}
+}
+
+// benchmarkRPCAllocs runs sequential small RPCs and reports allocations per
+// RPC; reuse toggles the stream receive-buffer pool on both peers.
+func benchmarkRPCAllocs(b *testing.B, reuse bool) {
+	server := &server{startedErr: make(chan error, 1)}
+	go server.start(nil, 0, &ServerConfig{ReuseStreamBuffers: reuse}, normal)
+	select {
+	case err := <-server.startedErr:
 		if err != nil {
-			t.Errorf("Error accepting connection: %v", err)
-			return
+			b.Fatal(err)
 		}
-		defer s.conn.Close()
-		// Read preface sent by client.
-		if _, err = io.ReadFull(s.conn, make([]byte, len(http2.ClientPreface))); err != nil {
-			t.Errorf("Error at server-side while reading preface from cleint. Err: %v", err)
-			return
+	case <-time.After(2 * time.Second):
+		b.Fatalf("Timed out waiting for server to be ready")
+	}
+	defer server.stop()
+	connectCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ct, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: "localhost:" + server.port}, ConnectOptions{ReuseStreamBuffers: reuse}, func() {})
+	if err != nil {
+		b.Fatalf("Failed to create client transport: %v", err)
+	}
+	defer ct.Close()
+	callHdr := &CallHdr{Host: "localhost", Method: "foo.Small"}
+	p := make([]byte, len(expectedResponse))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := ct.NewStream(context.Background(), callHdr)
+		if err != nil {
+			b.Fatalf("Failed to open stream: %v", err)
 		}
-		reader := bufio.NewReaderSize(s.conn, defaultWriteBufSize)
-		writer := bufio.NewWriterSize(s.conn, defaultReadBufSize)
-		framer := http2.NewFramer(writer, reader)
-		if err = framer.WriteSettingsAck(); err != nil {
-			t.Errorf("Error at server-side while sending Settings ack. Err: %v", err)
-			return
+		if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+			b.Fatalf("Failed to write the request: %v", err)
 		}
-		var sid uint32
-		// Read frames until a header is received.
-		for {
-			frame, err := framer.ReadFrame()
-			if err != nil {
-				t.Errorf("Error at server-side while reading frame. Err: %v", err)
-				return
-			}
-			if hframe, ok := frame.(*http2.HeadersFrame); ok {
-				sid = hframe.Header().StreamID
-				break
-			}
+		if _, err := s.Read(p); err != nil {
+			b.Fatalf("Failed to read the response: %v", err)
 		}
-		if err = s.wh(framer, sid, s.httpStatus); err != nil {
-			t.Errorf("Error at server-side while writing headers. Err: %v", err)
-			return
+		if _, err := s.Read(p); err != io.EOF {
+			b.Fatalf("Read got error %v, want %v", err, io.EOF)
 		}
-		writer.Flush()
+		ct.CloseStream(s, nil)
+	}
+}
+
+func BenchmarkRPCAllocs(b *testing.B) { benchmarkRPCAllocs(b, false) }
+
+func BenchmarkRPCAllocsReusedBufs(b *testing.B) { benchmarkRPCAllocs(b, true) }
+
+// TestReuseStreamBuffersBlockedReader verifies that with receive-buffer reuse
+// enabled a reader blocked in Read is still woken by the error posted when
+// the transport closes the stream, and that a stream opened afterwards — on
+// a possibly recycled buffer — carries its own messages with nothing leaked
+// across from the closed stream.
+func TestReuseStreamBuffersBlockedReader(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{ReuseStreamBuffers: true}, normal, ConnectOptions{ReuseStreamBuffers: true})
+	defer server.stop()
+	defer ct.Close()
+	callHdr := &CallHdr{Host: "localhost", Method: "foo.Small"}
+	s, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// The server only responds after reading a full request, so this reader
+	// parks on the stream's receive buffer.
+	readErr := make(chan error, 1)
+	go func() {
+		p := make([]byte, 1)
+		_, err := s.Read(p)
+		readErr <- err
 	}()
+	time.Sleep(100 * time.Millisecond)
+	ct.CloseStream(s, errors.New("client closes the stream"))
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatalf("Read returned <nil> after the stream was closed, want an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Reader still blocked after CloseStream; its wakeup message was lost")
+	}
+	// A fresh stream must see exactly its own response on the recycled
+	// buffer.
+	s2, err := ct.NewStream(context.Background(), callHdr)
+	if err != nil {
+		t.Fatalf("Failed to open second stream: %v", err)
+	}
+	if err := ct.Write(s2, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, len(expectedResponse))
+	if _, err := s2.Read(p); err != nil || !bytes.Equal(p, expectedResponse) {
+		t.Fatalf("s2.Read() = %v, %v, want %v, <nil>", p, err, expectedResponse)
+	}
+	if _, err := s2.Read(p); err != io.EOF {
+		t.Fatalf("s2.Read() = _, %v, want _, io.EOF", err)
+	}
+	ct.CloseStream(s2, nil)
 }
 
-func (s *httpServer) cleanUp() {
-	if s.conn != nil {
-		s.conn.Close()
+// TestTransportRegistryReuse verifies that GetOrDial hands out the cached
+// transport for an identical target and only closes it after the last
+// reference is released.
+func TestTransportRegistryReuse(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	ct.Close()
+	r := NewTransportRegistry()
+	target := TargetInfo{Addr: "localhost:" + server.port}
+	connectCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tr1, release1, err := r.GetOrDial(connectCtx, context.Background(), target, ConnectOptions{}, func() {})
+	if err != nil {
+		t.Fatalf("GetOrDial() = _, _, %v, want it to dial", err)
+	}
+	tr2, release2, err := r.GetOrDial(connectCtx, context.Background(), target, ConnectOptions{}, func() {})
+	if err != nil {
+		t.Fatalf("Second GetOrDial() = _, _, %v, want the cached transport", err)
+	}
+	if tr1 != tr2 {
+		t.Fatalf("GetOrDial dialed a second transport for an identical target, want the cached one")
+	}
+	// Releasing one reference must keep the shared transport usable for the
+	// other holder.
+	release1()
+	if _, err := tr2.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("NewStream on the shared transport after one release failed: %v", err)
+	}
+	release2()
+	select {
+	case <-tr2.Error():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Transport still open after the last reference was released")
+	}
+}
+
+// TestTransportRegistryDistinctTargets verifies that transports obtained for
+// different keys close independently of each other.
+func TestTransportRegistryDistinctTargets(t *testing.T) {
+	server1, ct1 := setUp(t, 0, math.MaxUint32, normal)
+	defer server1.stop()
+	ct1.Close()
+	server2, ct2 := setUp(t, 0, math.MaxUint32, normal)
+	defer server2.stop()
+	ct2.Close()
+	r := NewTransportRegistry()
+	connectCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tr1, release1, err := r.GetOrDial(connectCtx, context.Background(), TargetInfo{Addr: "localhost:" + server1.port}, ConnectOptions{}, func() {})
+	if err != nil {
+		t.Fatalf("GetOrDial() for the first target failed: %v", err)
+	}
+	tr2, release2, err := r.GetOrDial(connectCtx, context.Background(), TargetInfo{Addr: "localhost:" + server2.port}, ConnectOptions{}, func() {})
+	if err != nil {
+		t.Fatalf("GetOrDial() for the second target failed: %v", err)
+	}
+	if tr1 == tr2 {
+		t.Fatalf("GetOrDial returned one transport for two distinct targets")
+	}
+	release1()
+	select {
+	case <-tr1.Error():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("First transport still open after its last reference was released")
+	}
+	// The second transport is unaffected by the first one closing.
+	if _, err := tr2.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"}); err != nil {
+		t.Fatalf("NewStream on the surviving transport failed: %v", err)
+	}
+	release2()
+}
+
+// TestTransportRegistryEviction verifies that a transport that errors is
+// evicted, so the next GetOrDial dials afresh instead of returning the dead
+// transport.
+func TestTransportRegistryEviction(t *testing.T) {
+	server, ct := setUp(t, 0, math.MaxUint32, normal)
+	defer server.stop()
+	ct.Close()
+	r := NewTransportRegistry()
+	target := TargetInfo{Addr: "localhost:" + server.port}
+	connectCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tr1, release1, err := r.GetOrDial(connectCtx, context.Background(), target, ConnectOptions{}, func() {})
+	if err != nil {
+		t.Fatalf("GetOrDial() = _, _, %v, want it to dial", err)
+	}
+	// Kill the server ends; the client transport errors out shortly after.
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) < 2 {
+			return true, fmt.Errorf("timed-out while waiting for the registry's connection to reach the server")
+		}
+		return false, nil
+	})
+	server.mu.Lock()
+	for c := range server.conns {
+		c.Close()
+	}
+	server.mu.Unlock()
+	select {
+	case <-tr1.Error():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Transport did not error after its connection was closed")
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(r.entries) != 0 {
+			return true, fmt.Errorf("timed-out while waiting for the errored transport to be evicted")
+		}
+		return false, nil
+	})
+	tr2, release2, err := r.GetOrDial(connectCtx, context.Background(), target, ConnectOptions{}, func() {})
+	if err != nil {
+		t.Fatalf("GetOrDial() after eviction = _, _, %v, want a fresh dial", err)
+	}
+	if tr1 == tr2 {
+		t.Fatalf("GetOrDial returned the errored transport, want a fresh one")
 	}
+	release1()
+	release2()
 }
 
-func setUpHTTPStatusTest(t *testing.T, httpStatus int, wh writeHeaders) (stream *Stream, cleanUp func()) {
-	var (
-		err    error
-		lis    net.Listener
-		server *httpServer
-		client ClientTransport
-	)
-	cleanUp = func() {
-		if lis != nil {
-			lis.Close()
+// TestPreviousRPCAttempts checks that an attempt count stamped on the
+// CallHdr travels as the grpc-previous-rpc-attempts header and is readable
+// on the server stream, and that a negative count is rejected.
+func TestPreviousRPCAttempts(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{}, suspended, ConnectOptions{})
+	defer server.stop()
+	defer ct.Close()
+	if _, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo", PreviousRPCAttempts: -1}); err == nil {
+		t.Fatalf("NewStream with a negative PreviousRPCAttempts succeeded, want an error")
+	}
+	s, err := ct.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo", PreviousRPCAttempts: 3})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for connection to be created on the server")
 		}
-		if server != nil {
-			server.cleanUp()
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
+	}
+	server.mu.Unlock()
+	var ss *Stream
+	waitWhileTrue(t, func() (bool, error) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if len(st.activeStreams) == 0 {
+			return true, fmt.Errorf("timed-out while waiting for the stream to reach the server")
 		}
-		if client != nil {
-			client.Close()
+		for _, v := range st.activeStreams {
+			ss = v
 		}
+		return false, nil
+	})
+	if got := ss.PreviousRPCAttempts(); got != 3 {
+		t.Fatalf("Server stream PreviousRPCAttempts() = %d, want 3", got)
 	}
-	defer func() {
-		if err != nil {
-			cleanUp()
-		}
-	}()
-	lis, err = net.Listen("tcp", "localhost:0")
+}
+
+// TestFlowControlSnapshot verifies that the snapshot reflects both
+// transports' accounting while a known amount of data sits unread on the
+// server.
+func TestFlowControlSnapshot(t *testing.T) {
+	server, client := setUpWithOptions(t, 0, &ServerConfig{DisableBDPEstimation: true}, suspended, ConnectOptions{DisableBDPEstimation: true})
+	defer server.stop()
+	defer client.Close()
+	s, err := client.NewStream(context.Background(), &CallHdr{Host: "localhost", Method: "foo"})
 	if err != nil {
-		t.Fatalf("Failed to listen. Err: %v", err)
+		t.Fatalf("Failed to open stream: %v", err)
 	}
-	server = &httpServer{
-		httpStatus: httpStatus,
-		wh:         wh,
+	msg := make([]byte, 1024)
+	if err := client.Write(s, nil, msg, &Options{}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
 	}
-	server.start(t, lis)
-	connectCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(2*time.Second))
-	client, err = newHTTP2Client(connectCtx, context.Background(), TargetInfo{Addr: lis.Addr().String()}, ConnectOptions{}, func() {})
-	if err != nil {
-		cancel() // Do not cancel in success path.
-		t.Fatalf("Error creating client. Err: %v", err)
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed out while waiting for server transport to be created")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
 	}
-	stream, err = client.NewStream(context.Background(), &CallHdr{Method: "bogus/method", Flush: true})
-	if err != nil {
-		t.Fatalf("Error creating stream at client-side. Err: %v", err)
+	server.mu.Unlock()
+	// The suspended handler never reads, so the sent bytes accumulate as
+	// the server stream's pending data and stay deducted from the client
+	// stream's send quota.
+	waitWhileTrue(t, func() (bool, error) {
+		snap := st.FlowControlSnapshot()
+		if len(snap.Streams) != 1 {
+			return true, fmt.Errorf("server snapshot has %d streams, want 1", len(snap.Streams))
+		}
+		if snap.Streams[0].PendingData != uint32(len(msg)) {
+			return true, fmt.Errorf("server stream pending data = %d, want %d", snap.Streams[0].PendingData, len(msg))
+		}
+		return false, nil
+	})
+	snap := st.FlowControlSnapshot()
+	if snap.ConnRecvLimit != defaultWindowSize {
+		t.Fatalf("Server connection recv limit = %d, want %d", snap.ConnRecvLimit, defaultWindowSize)
 	}
-	return
-}
-
-func TestHTTPToGRPCStatusMapping(t *testing.T) {
-	for k := range httpStatusConvTab {
-		testHTTPToGRPCStatusMapping(t, k, writeOneHeader)
+	if snap.Streams[0].RecvLimit != initialWindowSize {
+		t.Fatalf("Server stream recv limit = %d, want %d", snap.Streams[0].RecvLimit, initialWindowSize)
 	}
-}
-
-func testHTTPToGRPCStatusMapping(t *testing.T, httpStatus int, wh writeHeaders) {
-	stream, cleanUp := setUpHTTPStatusTest(t, httpStatus, wh)
-	defer cleanUp()
-	want := httpStatusConvTab[httpStatus]
-	buf := make([]byte, 8)
-	_, err := stream.Read(buf)
-	if err == nil {
-		t.Fatalf("Stream.Read(_) unexpectedly returned no error. Expected stream error with code %v", want)
+	if snap.Streams[0].StreamID != s.id {
+		t.Fatalf("Server stream ID = %d, want %d", snap.Streams[0].StreamID, s.id)
 	}
-	serr, ok := err.(StreamError)
-	if !ok {
-		t.Fatalf("err.(Type) = %T, want StreamError", err)
+	csnap := client.FlowControlSnapshot()
+	if len(csnap.Streams) != 1 {
+		t.Fatalf("Client snapshot has %d streams, want 1", len(csnap.Streams))
 	}
-	if want != serr.Code {
-		t.Fatalf("Want error code: %v, got: %v", want, serr.Code)
+	if got, want := csnap.Streams[0].SendQuota, initialWindowSize-len(msg); got != want {
+		t.Fatalf("Client stream send quota = %d, want %d", got, want)
 	}
 }
 
-func TestHTTPStatusOKAndMissingGRPCStatus(t *testing.T) {
-	stream, cleanUp := setUpHTTPStatusTest(t, http.StatusOK, writeOneHeader)
-	defer cleanUp()
-	buf := make([]byte, 8)
-	_, err := stream.Read(buf)
-	if err != io.EOF {
-		t.Fatalf("stream.Read(_) = _, %v, want _, io.EOF", err)
+// TestCompressLargeHeadersRoundTrip verifies that with the companion-header
+// compression pass enabled on both peers, a large compressible metadata
+// value survives the round trip to the server and back intact.
+func TestCompressLargeHeadersRoundTrip(t *testing.T) {
+	server, ct := setUpWithOptions(t, 0, &ServerConfig{CompressLargeHeaders: true}, echoMetadata, ConnectOptions{CompressLargeHeaders: true})
+	defer server.stop()
+	defer ct.Close()
+	largeValue := strings.Repeat("0123456789abcdef", 256) // 4KiB, compressible.
+	md := metadata.Pairs("small-key", "small", "large-key", largeValue)
+	ctx := metadata.NewOutgoingContext(context.Background(), md)
+	s, err := ct.NewStream(ctx, &CallHdr{Host: "localhost", Method: "foo"})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
 	}
-	want := codes.Unknown
-	stream.mu.Lock()
-	defer stream.mu.Unlock()
-	if stream.status.Code() != want {
-		t.Fatalf("Status code of stream: %v, want: %v", stream.status.Code(), want)
+	if err := ct.Write(s, nil, expectedRequest, &Options{Last: true}); err != nil && err != io.EOF {
+		t.Fatalf("Failed to write the request: %v", err)
+	}
+	p := make([]byte, 1)
+	if _, err := s.trReader.(*transportReader).Read(p); err != io.EOF {
+		t.Fatalf("Read got error %v, want %v", err, io.EOF)
+	}
+	trailer := s.Trailer()
+	if got := trailer["large-key"]; len(got) != 1 || got[0] != largeValue {
+		t.Fatalf("Echoed large-key = %d values, want the original %d-byte value back", len(got), len(largeValue))
+	}
+	if got := trailer["small-key"]; len(got) != 1 || got[0] != "small" {
+		t.Fatalf("Echoed small-key = %v, want %v", got, []string{"small"})
 	}
 }
 
-func TestHTTPStatusNottOKAndMissingGRPCStatusInSecondHeader(t *testing.T) {
-	testHTTPToGRPCStatusMapping(t, http.StatusUnauthorized, writeTwoHeaders)
-}
-
-// If any error occurs on a call to Stream.Read, future calls
-// should continue to return that same error.
-func TestReadGivesSameErrorAfterAnyErrorOccurs(t *testing.T) {
-	testRecvBuffer := newRecvBuffer()
-	s := &Stream{
-		ctx:         context.Background(),
-		goAway:      make(chan struct{}),
-		buf:         testRecvBuffer,
-		requestRead: func(int) {},
+// TestDisableBDPEstimation verifies that with BDP estimation turned off the
+// flow-control windows stay at their initial sizes no matter how much data
+// flows, instead of being grown by the estimator.
+func TestDisableBDPEstimation(t *testing.T) {
+	server, client := setUpWithOptions(t, 0, &ServerConfig{DisableBDPEstimation: true}, pingpong, ConnectOptions{DisableBDPEstimation: true})
+	defer server.stop()
+	defer client.Close()
+	waitWhileTrue(t, func() (bool, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.conns) == 0 {
+			return true, fmt.Errorf("timed out while waiting for server transport to be created")
+		}
+		return false, nil
+	})
+	var st *http2Server
+	server.mu.Lock()
+	for k := range server.conns {
+		st = k.(*http2Server)
 	}
-	s.trReader = &transportReader{
-		reader: &recvBufferReader{
-			ctx:    s.ctx,
-			goAway: s.goAway,
-			recv:   s.buf,
-		},
-		windowHandler: func(int) {},
+	server.mu.Unlock()
+	ct := client.(*http2Client)
+	if ct.bdpEst != nil {
+		t.Fatalf("Client transport created a BDP estimator with estimation disabled")
 	}
-	testData := make([]byte, 1)
-	testData[0] = 5
-	testErr := errors.New("test error")
-	s.write(recvMsg{data: testData, err: testErr})
-
-	inBuf := make([]byte, 1)
-	actualCount, actualErr := s.Read(inBuf)
-	if actualCount != 0 {
-		t.Errorf("actualCount, _ := s.Read(_) differs; want 0; got %v", actualCount)
+	if st.bdpEst != nil {
+		t.Fatalf("Server transport created a BDP estimator with estimation disabled")
 	}
-	if actualErr.Error() != testErr.Error() {
-		t.Errorf("_ , actualErr := s.Read(_) differs; want actualErr.Error() to be %v; got %v", testErr.Error(), actualErr.Error())
+	stream, err := client.NewStream(context.Background(), &CallHdr{})
+	if err != nil {
+		t.Fatalf("Failed to create stream. Err: %v", err)
 	}
-
-	s.write(recvMsg{data: testData, err: nil})
-	s.write(recvMsg{data: testData, err: errors.New("different error from first")})
-
-	for i := 0; i < 2; i++ {
-		inBuf := make([]byte, 1)
-		actualCount, actualErr := s.Read(inBuf)
-		if actualCount != 0 {
-			t.Errorf("actualCount, _ := s.Read(_) differs; want %v; got %v", 0, actualCount)
+	// Move several windows' worth of data; an active estimator would have
+	// grown the connection window by now.
+	msgSize := initialWindowSize
+	msg := make([]byte, msgSize)
+	outgoingHeader := make([]byte, 5)
+	binary.BigEndian.PutUint32(outgoingHeader[1:], uint32(msgSize))
+	incomingHeader := make([]byte, 5)
+	for i := 0; i < 4; i++ {
+		if err := client.Write(stream, outgoingHeader, msg, &Options{}); err != nil {
+			t.Fatalf("Error on client while writing message. Err: %v", err)
 		}
-		if actualErr.Error() != testErr.Error() {
-			t.Errorf("_ , actualErr := s.Read(_) differs; want actualErr.Error() to be %v; got %v", testErr.Error(), actualErr.Error())
+		if _, err := stream.Read(incomingHeader); err != nil {
+			t.Fatalf("Error on client while reading data header. Err: %v", err)
+		}
+		sz := binary.BigEndian.Uint32(incomingHeader[1:])
+		recvMsg := make([]byte, int(sz))
+		if _, err := stream.Read(recvMsg); err != nil {
+			t.Fatalf("Error on client while reading data. Err: %v", err)
 		}
 	}
+	if limit := ct.fc.limit; limit != uint32(defaultWindowSize) {
+		t.Fatalf("Client connection window limit %d, want %d", limit, defaultWindowSize)
+	}
+	if limit := st.fc.limit; limit != uint32(defaultWindowSize) {
+		t.Fatalf("Server connection window limit %d, want %d", limit, defaultWindowSize)
+	}
+	// End the stream cleanly so the server handler finishes before teardown.
+	client.Write(stream, nil, nil, &Options{Last: true})
+	if _, err := stream.Read(incomingHeader); err != io.EOF {
+		t.Fatalf("Client expected EOF from the server. Got: %v", err)
+	}
 }
 
-func TestPingPong1B(t *testing.T) {
-	runPingPongTest(t, 1)
-}
-
-func TestPingPong1KB(t *testing.T) {
-	runPingPongTest(t, 1024)
+// countWindowUpdates runs a fixed ping-pong exchange and reports how many
+// WINDOW_UPDATE frames the server received from the client.
+func countWindowUpdates(t *testing.T, copts ConnectOptions) int {
+	var count int64
+	serverConfig := &ServerConfig{
+		OnWindowUpdate: func(streamID, increment uint32) {
+			atomic.AddInt64(&count, 1)
+		},
+	}
+	server, client := setUpWithOptions(t, 0, serverConfig, pingpong, copts)
+	defer server.stop()
+	defer client.Close()
+	ct := client.(*http2Client)
+	stream, err := client.NewStream(context.Background(), &CallHdr{})
+	if err != nil {
+		t.Fatalf("Failed to create stream. Err: %v", err)
+	}
+	const msgSize, iters = 8192, 64
+	msg := make([]byte, msgSize)
+	outgoingHeader := make([]byte, 5)
+	binary.BigEndian.PutUint32(outgoingHeader[1:], uint32(msgSize))
+	incomingHeader := make([]byte, 5)
+	for i := 0; i < iters; i++ {
+		if err := ct.Write(stream, outgoingHeader, msg, &Options{}); err != nil {
+			t.Fatalf("Error on client while writing message. Err: %v", err)
+		}
+		if _, err := stream.Read(incomingHeader); err != nil {
+			t.Fatalf("Error on client while reading data header. Err: %v", err)
+		}
+		recvMsg := make([]byte, binary.BigEndian.Uint32(incomingHeader[1:]))
+		if _, err := stream.Read(recvMsg); err != nil {
+			t.Fatalf("Error on client while reading data. Err: %v", err)
+		}
+	}
+	ct.Write(stream, nil, nil, &Options{Last: true})
+	if _, err := stream.Read(incomingHeader); err != io.EOF {
+		t.Fatalf("Client expected EOF from the server. Got: %v", err)
+	}
+	return int(atomic.LoadInt64(&count))
 }
 
-func TestPingPong64KB(t *testing.T) {
-	runPingPongTest(t, 65536)
+// TestWindowUpdateCoalescing verifies that raising WindowUpdateRatio reduces
+// the number of WINDOW_UPDATE frames the client emits while the same amount
+// of data still round-trips.
+func TestWindowUpdateCoalescing(t *testing.T) {
+	base := countWindowUpdates(t, ConnectOptions{DisableBDPEstimation: true})
+	coalesced := countWindowUpdates(t, ConnectOptions{DisableBDPEstimation: true, WindowUpdateRatio: 0.5})
+	if coalesced >= base {
+		t.Fatalf("WINDOW_UPDATE count with ratio 0.5 = %d, want fewer than the default's %d", coalesced, base)
+	}
 }
 
-func TestPingPong1MB(t *testing.T) {
-	runPingPongTest(t, 1048576)
+// TestWindowUpdateRatioValidation verifies that ratios outside (0, 1] are
+// rejected at transport setup.
+func TestWindowUpdateRatioValidation(t *testing.T) {
+	for _, r := range []float64{-0.1, 1.5} {
+		connectCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if _, err := NewClientTransport(connectCtx, context.Background(), TargetInfo{Addr: "localhost:0"}, ConnectOptions{WindowUpdateRatio: r}, func() {}); err == nil {
+			t.Errorf("NewClientTransport with WindowUpdateRatio %v succeeded, want an error", r)
+		}
+		cancel()
+	}
 }
 
-//This is a stress-test of flow control logic.
 func runPingPongTest(t *testing.T, msgSize int) {
 	server, client := setUp(t, 0, 0, pingpong)
 	defer server.stop()
@@ -2276,3 +6939,69 @@ func runPingPongTest(t *testing.T, msgSize int) {
 		}
 	}
 }
+
+// TestWriteBufferThreshold sends many small messages on a stream with a
+// write-buffering threshold, flushes them explicitly and via the last write,
+// and verifies the server receives every message with its boundaries intact.
+func TestWriteBufferThreshold(t *testing.T) {
+	server, client := setUp(t, 0, math.MaxUint32, pingpong)
+	defer server.stop()
+	defer client.Close()
+	ct := client.(*http2Client)
+	stream, err := client.NewStream(context.Background(), &CallHdr{WriteBufferThreshold: 4096})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	const numMsgs = 50
+	const msgSize = 8
+	mkMsg := func(i int) []byte {
+		msg := make([]byte, msgSize)
+		for j := range msg {
+			msg[j] = byte(i)
+		}
+		return msg
+	}
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr[1:], uint32(msgSize))
+	for i := 0; i < numMsgs; i++ {
+		if err := ct.Write(stream, append([]byte(nil), hdr...), mkMsg(i), &Options{}); err != nil {
+			t.Fatalf("Error on client while writing message %d: %v", i, err)
+		}
+	}
+	// All the messages are below the threshold; push them out together.
+	if err := ct.Write(stream, nil, nil, &Options{Flush: true}); err != nil {
+		t.Fatalf("Error on client while flushing: %v", err)
+	}
+	incomingHeader := make([]byte, 5)
+	readEcho := func(i int) {
+		if _, err := stream.Read(incomingHeader); err != nil {
+			t.Fatalf("Error on client while reading header of message %d: %v", i, err)
+		}
+		sz := binary.BigEndian.Uint32(incomingHeader[1:])
+		if sz != msgSize {
+			t.Fatalf("Message %d has size %d, want %d", i, sz, msgSize)
+		}
+		recvMsg := make([]byte, int(sz))
+		if _, err := stream.Read(recvMsg); err != nil {
+			t.Fatalf("Error on client while reading message %d: %v", i, err)
+		}
+		if !bytes.Equal(recvMsg, mkMsg(i)) {
+			t.Fatalf("Message %d is %v, want %v", i, recvMsg, mkMsg(i))
+		}
+	}
+	for i := 0; i < numMsgs; i++ {
+		readEcho(i)
+	}
+	// Half-closing must carry any buffered bytes as well instead of
+	// dropping them.
+	if err := ct.Write(stream, append([]byte(nil), hdr...), mkMsg(numMsgs), &Options{}); err != nil {
+		t.Fatalf("Error on client while writing final message: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Error on client while closing the send side: %v", err)
+	}
+	readEcho(numMsgs)
+	if _, err := stream.Read(incomingHeader); err != io.EOF {
+		t.Fatalf("Client expected EOF from the server, got: %v", err)
+	}
+}